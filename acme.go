@@ -0,0 +1,656 @@
+package main
+
+import (
+  "bytes"
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/tls"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/base64"
+  "encoding/json"
+  "encoding/pem"
+  "errors"
+  "fmt"
+  "github.com/brianhempel/sneakynote.com/logs"
+  "io/ioutil"
+  "log/slog"
+  "math/big"
+  "net/http"
+  "os"
+  "path"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// Gets and renews the certificate from an ACME CA such as Let's Encrypt
+// (RFC 8555), answering http-01 challenges on the port 80 handler, instead
+// of running certbot beside the server. Renewed certificates are written
+// over the old files and picked up by the CertificateReloader.
+//
+// Set SNEAKYNOTE_ACME_DIRECTORY to the CA's directory URL to turn it on.
+// SNEAKYNOTE_ACME_DOMAINS is a comma separated list (default
+// sneakynote.com), SNEAKYNOTE_ACME_EMAIL an optional contact, and
+// SNEAKYNOTE_ACME_DIR where the account key and certificate live (default
+// acme/ in the project). Certificates are renewed SNEAKYNOTE_ACME_RENEW_BEFORE
+// (default 30 days) ahead of expiry.
+
+const (
+  defaultACMEDomains = "sneakynote.com"
+  defaultACMERenewBefore = 30 * 24 * time.Hour
+  acmeRenewalCheckInterval = 12 * time.Hour
+  acmeChallengePathPrefix = "/.well-known/acme-challenge/"
+  // A new key and certificate wait beside the old ones under this suffix
+  // until both are written.
+  acmeNewPairSuffix = ".new"
+)
+
+var (
+  // Nil unless configured.
+  acmeClient *ACMEClient
+)
+
+type ACMEClient struct {
+  DirectoryURL string
+  Domains []string
+  Email string
+  StorageDir string
+  RenewBefore time.Duration
+  // Between checks on pending authorizations and orders.
+  PollInterval time.Duration
+  PollTimeout time.Duration
+  HTTPClient *http.Client
+
+  // One issuance at a time.
+  issueMutex sync.Mutex
+  accountKey *ecdsa.PrivateKey
+  accountURL string
+  directory acmeDirectory
+  nonce string
+
+  challengesMutex sync.RWMutex
+  // Token to key authorization.
+  challenges map[string]string
+}
+
+type acmeDirectory struct {
+  NewNonce string `json:"newNonce"`
+  NewAccount string `json:"newAccount"`
+  NewOrder string `json:"newOrder"`
+}
+
+type acmeProblem struct {
+  Type string `json:"type"`
+  Detail string `json:"detail"`
+}
+
+func (p *acmeProblem) Error() string {
+  return "ACME " + p.Type + ": " + p.Detail
+}
+
+type acmeOrder struct {
+  Status string `json:"status"`
+  Authorizations []string `json:"authorizations"`
+  Finalize string `json:"finalize"`
+  Certificate string `json:"certificate"`
+  Error *acmeProblem `json:"error"`
+}
+
+type acmeAuthorization struct {
+  Status string `json:"status"`
+  Identifier struct {
+    Value string `json:"value"`
+  } `json:"identifier"`
+  Challenges []acmeChallenge `json:"challenges"`
+}
+
+type acmeChallenge struct {
+  Type string `json:"type"`
+  URL string `json:"url"`
+  Token string `json:"token"`
+  Status string `json:"status"`
+  Error *acmeProblem `json:"error"`
+}
+
+// Reads the SNEAKYNOTE_ACME_* settings. Returns nil when ACME is off.
+func ConfigureACME() *ACMEClient {
+  directoryURL := os.Getenv("SNEAKYNOTE_ACME_DIRECTORY")
+  if directoryURL == "" {
+    acmeClient = nil
+    return nil
+  }
+
+  domains := os.Getenv("SNEAKYNOTE_ACME_DOMAINS")
+  if domains == "" {
+    domains = defaultACMEDomains
+  }
+
+  storageDir := os.Getenv("SNEAKYNOTE_ACME_DIR")
+  if storageDir == "" {
+    storageDir = path.Join(projectPath(), "acme")
+  }
+
+  acmeClient = NewACMEClient(directoryURL, strings.Split(domains, ","), storageDir)
+  acmeClient.Email = os.Getenv("SNEAKYNOTE_ACME_EMAIL")
+  acmeClient.RenewBefore = envDuration("SNEAKYNOTE_ACME_RENEW_BEFORE", defaultACMERenewBefore)
+
+  slog.Info("Using ACME", "directory", directoryURL, "domains", domains)
+  return acmeClient
+}
+
+func NewACMEClient(directoryURL string, domains []string, storageDir string) *ACMEClient {
+  return &ACMEClient{
+    DirectoryURL: directoryURL,
+    Domains: domains,
+    StorageDir: storageDir,
+    RenewBefore: defaultACMERenewBefore,
+    PollInterval: time.Second,
+    PollTimeout: 2 * time.Minute,
+    HTTPClient: &http.Client{Timeout: 30 * time.Second},
+    challenges: map[string]string{},
+  }
+}
+
+func (c *ACMEClient) CertificatePath() string {
+  return path.Join(c.StorageDir, "fullchain.pem")
+}
+
+func (c *ACMEClient) KeyPath() string {
+  return path.Join(c.StorageDir, "privkey.pem")
+}
+
+func (c *ACMEClient) accountKeyPath() string {
+  return path.Join(c.StorageDir, "account.key")
+}
+
+// Answers http-01 challenges and passes everything else to fallback.
+func (c *ACMEClient) HTTPHandler(fallback http.Handler) http.Handler {
+  return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+    if !strings.HasPrefix(request.URL.Path, acmeChallengePathPrefix) {
+      fallback.ServeHTTP(response, request)
+      return
+    }
+
+    token := strings.TrimPrefix(request.URL.Path, acmeChallengePathPrefix)
+    c.challengesMutex.RLock()
+    keyAuthorization, ok := c.challenges[token]
+    c.challengesMutex.RUnlock()
+
+    if !ok {
+      http.NotFound(response, request)
+      return
+    }
+
+    response.Header().Set("Content-Type", "text/plain")
+    response.Write([]byte(keyAuthorization))
+  })
+}
+
+// True when there's no certificate, it doesn't cover every domain, or it
+// expires within RenewBefore.
+func (c *ACMEClient) NeedsRenewal() bool {
+  certificatePEM, err := ioutil.ReadFile(c.CertificatePath())
+  if err != nil {
+    return true
+  }
+
+  block, _ := pem.Decode(certificatePEM)
+  if block == nil {
+    return true
+  }
+  leaf, err := x509.ParseCertificate(block.Bytes)
+  if err != nil {
+    return true
+  }
+
+  for _, domain := range c.Domains {
+    if leaf.VerifyHostname(domain) != nil {
+      return true
+    }
+  }
+
+  return time.Now().Add(c.RenewBefore).After(leaf.NotAfter)
+}
+
+// Finishes any swap to a new pair cut short, gets a certificate now if one
+// is needed, exiting if that fails with no certificate to serve, then checks
+// twice a day.
+func (c *ACMEClient) StartRenewing() {
+  if err := c.FinishCertificateSwap(); err != nil {
+    slog.Warn("Error finishing certificate swap", logs.Err(err))
+  }
+
+  if c.NeedsRenewal() {
+    err := c.ObtainCertificate()
+    if err != nil {
+      if _, statErr := os.Stat(c.CertificatePath()); os.IsNotExist(statErr) {
+        logs.Fatal("Obtaining certificate", logs.Err(err))
+      }
+      slog.Warn("Error renewing certificate, will retry", logs.Err(err))
+    }
+  }
+
+  go func() {
+    for range time.Tick(acmeRenewalCheckInterval) {
+      if !c.NeedsRenewal() {
+        continue
+      }
+      err := c.ObtainCertificate()
+      if err != nil {
+        slog.Warn("Error renewing certificate, will retry", logs.Err(err))
+      }
+    }
+  }()
+}
+
+// Runs a whole order: account, authorizations, finalization, download. The
+// new pair replaces the files only once it is complete.
+func (c *ACMEClient) ObtainCertificate() error {
+  c.issueMutex.Lock()
+  defer c.issueMutex.Unlock()
+
+  err := os.MkdirAll(c.StorageDir, 0700)
+  if err != nil {
+    return err
+  }
+
+  err = c.setupAccount()
+  if err != nil {
+    return err
+  }
+
+  identifiers := []map[string]string{}
+  for _, domain := range c.Domains {
+    identifiers = append(identifiers, map[string]string{"type": "dns", "value": domain})
+  }
+
+  order := &acmeOrder{}
+  response, err := c.postJSON(c.directory.NewOrder, map[string]interface{}{"identifiers": identifiers}, order)
+  if err != nil {
+    return err
+  }
+  orderURL := response.Header.Get("Location")
+
+  for _, authorizationURL := range order.Authorizations {
+    err = c.authorize(authorizationURL)
+    if err != nil {
+      return err
+    }
+  }
+
+  certificateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    return err
+  }
+  csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+    Subject: pkix.Name{CommonName: c.Domains[0]},
+    DNSNames: c.Domains,
+  }, certificateKey)
+  if err != nil {
+    return err
+  }
+
+  _, err = c.postJSON(order.Finalize, map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr)}, order)
+  if err != nil {
+    return err
+  }
+
+  deadline := time.Now().Add(c.PollTimeout)
+  for order.Status != "valid" {
+    if order.Status == "invalid" {
+      return fmt.Errorf("ACME order failed: %v", order.Error)
+    } else if time.Now().After(deadline) {
+      return errors.New("ACME order timed out in status " + order.Status)
+    }
+    time.Sleep(c.PollInterval)
+    _, err = c.postJSON(orderURL, nil, order)
+    if err != nil {
+      return err
+    }
+  }
+
+  response, err = c.post(order.Certificate, nil)
+  if err != nil {
+    return err
+  }
+  chainPEM, err := ioutil.ReadAll(response.Body)
+  response.Body.Close()
+  if err != nil {
+    return err
+  }
+  if block, _ := pem.Decode(chainPEM); block == nil || block.Type != "CERTIFICATE" {
+    return errors.New("ACME certificate download isn't a PEM chain")
+  }
+
+  keyDER, err := x509.MarshalECPrivateKey(certificateKey)
+  if err != nil {
+    return err
+  }
+
+  // Both written in full before either goes in, so running out of room
+  // leaves the old pair alone.
+  err = ioutil.WriteFile(c.KeyPath() + acmeNewPairSuffix, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+  if err == nil {
+    err = ioutil.WriteFile(c.CertificatePath() + acmeNewPairSuffix, chainPEM, 0644)
+  }
+  if err != nil {
+    os.Remove(c.KeyPath() + acmeNewPairSuffix)
+    os.Remove(c.CertificatePath() + acmeNewPairSuffix)
+    return err
+  }
+  err = c.FinishCertificateSwap()
+  if err != nil {
+    return err
+  }
+
+  slog.Info("Obtained certificate", "domains", c.Domains)
+  return nil
+}
+
+// Puts a new pair written beside the old one in its place. The new key goes
+// in first, then the certificate; the reloader rejects the new key with the
+// old certificate and takes the pair once both are in. If a crash comes
+// between the two, the new certificate is still waiting, and this finishes
+// the swap at the next start. Waiting files that don't make a pair with
+// what's there, as when a crash came while writing them, are removed,
+// keeping the old pair.
+func (c *ACMEClient) FinishCertificateSwap() error {
+  newKeyPath := c.KeyPath() + acmeNewPairSuffix
+  newCertificatePath := c.CertificatePath() + acmeNewPairSuffix
+
+  keyPath, certificatePath := c.KeyPath(), c.CertificatePath()
+  if _, err := os.Stat(newKeyPath); err == nil {
+    keyPath = newKeyPath
+  }
+  if _, err := os.Stat(newCertificatePath); err == nil {
+    certificatePath = newCertificatePath
+  }
+  if keyPath == c.KeyPath() && certificatePath == c.CertificatePath() {
+    return nil
+  }
+
+  if _, err := tls.LoadX509KeyPair(certificatePath, keyPath); err != nil {
+    os.Remove(newKeyPath)
+    os.Remove(newCertificatePath)
+    return errors.New("Discarded a new certificate that doesn't match its key: " + err.Error())
+  }
+
+  if keyPath == newKeyPath {
+    if err := os.Rename(newKeyPath, c.KeyPath()); err != nil {
+      return err
+    }
+  }
+  if certificatePath == newCertificatePath {
+    return os.Rename(newCertificatePath, c.CertificatePath())
+  }
+  return nil
+}
+
+func (c *ACMEClient) authorize(authorizationURL string) error {
+  authorization := &acmeAuthorization{}
+  _, err := c.postJSON(authorizationURL, nil, authorization)
+  if err != nil {
+    return err
+  }
+  if authorization.Status == "valid" {
+    return nil
+  }
+
+  var challenge *acmeChallenge
+  for i := range authorization.Challenges {
+    if authorization.Challenges[i].Type == "http-01" {
+      challenge = &authorization.Challenges[i]
+    }
+  }
+  if challenge == nil {
+    return errors.New("ACME offered no http-01 challenge for " + authorization.Identifier.Value)
+  }
+
+  thumbprint, err := jwkThumbprint(&c.accountKey.PublicKey)
+  if err != nil {
+    return err
+  }
+
+  c.challengesMutex.Lock()
+  c.challenges[challenge.Token] = challenge.Token + "." + thumbprint
+  c.challengesMutex.Unlock()
+  defer func() {
+    c.challengesMutex.Lock()
+    delete(c.challenges, challenge.Token)
+    c.challengesMutex.Unlock()
+  }()
+
+  _, err = c.postJSON(challenge.URL, struct{}{}, challenge)
+  if err != nil {
+    return err
+  }
+
+  deadline := time.Now().Add(c.PollTimeout)
+  for authorization.Status != "valid" {
+    if authorization.Status == "invalid" {
+      for _, attempted := range authorization.Challenges {
+        if attempted.Error != nil {
+          return attempted.Error
+        }
+      }
+      return errors.New("ACME authorization failed for " + authorization.Identifier.Value)
+    } else if time.Now().After(deadline) {
+      return errors.New("ACME authorization timed out for " + authorization.Identifier.Value)
+    }
+    time.Sleep(c.PollInterval)
+    _, err = c.postJSON(authorizationURL, nil, authorization)
+    if err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+// Loads or makes the account key and registers it, which finds the
+// existing account if there is one.
+func (c *ACMEClient) setupAccount() error {
+  if c.directory.NewOrder == "" {
+    response, err := c.HTTPClient.Get(c.DirectoryURL)
+    if err != nil {
+      return err
+    }
+    err = json.NewDecoder(response.Body).Decode(&c.directory)
+    response.Body.Close()
+    if err != nil {
+      return err
+    }
+  }
+
+  if c.accountKey == nil {
+    accountKey, err := loadOrCreateECKey(c.accountKeyPath())
+    if err != nil {
+      return err
+    }
+    c.accountKey = accountKey
+  }
+
+  if c.accountURL != "" {
+    return nil
+  }
+
+  account := map[string]interface{}{"termsOfServiceAgreed": true}
+  if c.Email != "" {
+    account["contact"] = []string{"mailto:" + c.Email}
+  }
+
+  response, err := c.postJSON(c.directory.NewAccount, account, nil)
+  if err != nil {
+    return err
+  }
+  c.accountURL = response.Header.Get("Location")
+  if c.accountURL == "" {
+    return errors.New("ACME account has no URL")
+  }
+  return nil
+}
+
+func loadOrCreateECKey(keyPath string) (*ecdsa.PrivateKey, error) {
+  keyPEM, err := ioutil.ReadFile(keyPath)
+  if err == nil {
+    block, _ := pem.Decode(keyPEM)
+    if block == nil {
+      return nil, errors.New("No PEM key in " + keyPath)
+    }
+    return x509.ParseECPrivateKey(block.Bytes)
+  } else if !os.IsNotExist(err) {
+    return nil, err
+  }
+
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    return nil, err
+  }
+  keyDER, err := x509.MarshalECPrivateKey(key)
+  if err != nil {
+    return nil, err
+  }
+  err = writeFileAtomically(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+  if err != nil {
+    return nil, err
+  }
+  return key, nil
+}
+
+func writeFileAtomically(filePath string, data []byte, mode os.FileMode) error {
+  tempPath := filePath + ".tmp"
+  err := ioutil.WriteFile(tempPath, data, mode)
+  if err != nil {
+    return err
+  }
+  return os.Rename(tempPath, filePath)
+}
+
+// Posts payload and decodes the JSON response into result, if given.
+func (c *ACMEClient) postJSON(url string, payload interface{}, result interface{}) (*http.Response, error) {
+  response, err := c.post(url, payload)
+  if err != nil {
+    return nil, err
+  }
+  defer response.Body.Close()
+
+  if result != nil {
+    err = json.NewDecoder(response.Body).Decode(result)
+    if err != nil {
+      return nil, err
+    }
+  }
+  return response, nil
+}
+
+// A JWS signed POST. A nil payload is a POST-as-GET. Retries once on a
+// stale nonce.
+func (c *ACMEClient) post(url string, payload interface{}) (*http.Response, error) {
+  payloadJSON := []byte{}
+  if payload != nil {
+    var err error
+    payloadJSON, err = json.Marshal(payload)
+    if err != nil {
+      return nil, err
+    }
+  }
+
+  for attempt := 0; ; attempt++ {
+    body, err := c.signedBody(url, payloadJSON)
+    if err != nil {
+      return nil, err
+    }
+
+    response, err := c.HTTPClient.Post(url, "application/jose+json", bytes.NewReader(body))
+    if err != nil {
+      return nil, err
+    }
+    c.nonce = response.Header.Get("Replay-Nonce")
+
+    if response.StatusCode < 400 {
+      return response, nil
+    }
+
+    problem := &acmeProblem{}
+    json.NewDecoder(response.Body).Decode(problem)
+    response.Body.Close()
+    if problem.Type == "" {
+      problem.Type = "status " + strconv.Itoa(response.StatusCode)
+    }
+
+    if problem.Type == "urn:ietf:params:acme:error:badNonce" && attempt == 0 {
+      continue
+    }
+    return nil, problem
+  }
+}
+
+func (c *ACMEClient) signedBody(url string, payloadJSON []byte) ([]byte, error) {
+  if c.nonce == "" {
+    response, err := c.HTTPClient.Head(c.directory.NewNonce)
+    if err != nil {
+      return nil, err
+    }
+    response.Body.Close()
+    c.nonce = response.Header.Get("Replay-Nonce")
+    if c.nonce == "" {
+      return nil, errors.New("ACME server gave no nonce")
+    }
+  }
+
+  protected := map[string]interface{}{"alg": "ES256", "nonce": c.nonce, "url": url}
+  if c.accountURL == "" {
+    protected["jwk"] = jwk(&c.accountKey.PublicKey)
+  } else {
+    protected["kid"] = c.accountURL
+  }
+  c.nonce = ""
+
+  protectedJSON, err := json.Marshal(protected)
+  if err != nil {
+    return nil, err
+  }
+
+  encodedProtected := base64.RawURLEncoding.EncodeToString(protectedJSON)
+  encodedPayload := base64.RawURLEncoding.EncodeToString(payloadJSON)
+
+  digest := sha256.Sum256([]byte(encodedProtected + "." + encodedPayload))
+  r, s, err := ecdsa.Sign(rand.Reader, c.accountKey, digest[:])
+  if err != nil {
+    return nil, err
+  }
+  signature := append(paddedBigInt(r, 32), paddedBigInt(s, 32)...)
+
+  return json.Marshal(map[string]string{
+    "protected": encodedProtected,
+    "payload": encodedPayload,
+    "signature": base64.RawURLEncoding.EncodeToString(signature),
+  })
+}
+
+func jwk(publicKey *ecdsa.PublicKey) map[string]string {
+  return map[string]string{
+    "kty": "EC",
+    "crv": "P-256",
+    "x": base64.RawURLEncoding.EncodeToString(paddedBigInt(publicKey.X, 32)),
+    "y": base64.RawURLEncoding.EncodeToString(paddedBigInt(publicKey.Y, 32)),
+  }
+}
+
+// RFC 7638: SHA-256 of the required members in lexicographic order.
+func jwkThumbprint(publicKey *ecdsa.PublicKey) (string, error) {
+  key := jwk(publicKey)
+  canonical := `{"crv":"` + key["crv"] + `","kty":"` + key["kty"] + `","x":"` + key["x"] + `","y":"` + key["y"] + `"}`
+  digest := sha256.Sum256([]byte(canonical))
+  return base64.RawURLEncoding.EncodeToString(digest[:]), nil
+}
+
+func paddedBigInt(n *big.Int, size int) []byte {
+  padded := make([]byte, size)
+  n.FillBytes(padded)
+  return padded
+}
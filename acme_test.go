@@ -0,0 +1,517 @@
+package main_test
+
+import (
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/tls"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/base64"
+  "encoding/json"
+  "encoding/pem"
+  "fmt"
+  "github.com/brianhempel/sneakynote.com"
+  "io/ioutil"
+  "math/big"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+)
+
+// A small stand-in for an ACME CA like Pebble. Checks signatures, nonces,
+// and URLs on every request, validates http-01 challenges by fetching them
+// from challengeServer (in place of port 80 on the domain), and signs
+// certificates valid for lifetime.
+type acmeStandIn struct {
+  server *httptest.Server
+  challengeServer string
+  lifetime time.Duration
+
+  caKey *ecdsa.PrivateKey
+  caCertificate *x509.Certificate
+
+  mutex sync.Mutex
+  nonces map[string]bool
+  accounts map[string]*ecdsa.PublicKey
+  orders map[string]*acmeStandInOrder
+  nextId int
+}
+
+type acmeStandInOrder struct {
+  account string
+  domains []string
+  status string
+  tokens map[string]string
+  validated map[string]bool
+  certificate []byte
+}
+
+func newACMEStandIn(t *testing.T, challengeServer string, lifetime time.Duration) *acmeStandIn {
+  caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    t.Fatal(err)
+  }
+  caTemplate := &x509.Certificate{
+    SerialNumber: big.NewInt(1),
+    Subject: pkix.Name{CommonName: "ACME Stand-in CA"},
+    NotBefore: time.Now().Add(-time.Hour),
+    NotAfter: time.Now().Add(365 * 24 * time.Hour),
+    IsCA: true,
+    BasicConstraintsValid: true,
+    KeyUsage: x509.KeyUsageCertSign,
+  }
+  caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+  if err != nil {
+    t.Fatal(err)
+  }
+  caCertificate, _ := x509.ParseCertificate(caDER)
+
+  ca := &acmeStandIn{
+    challengeServer: challengeServer,
+    lifetime: lifetime,
+    caKey: caKey,
+    caCertificate: caCertificate,
+    nonces: map[string]bool{},
+    accounts: map[string]*ecdsa.PublicKey{},
+    orders: map[string]*acmeStandInOrder{},
+  }
+  ca.server = httptest.NewServer(http.HandlerFunc(ca.serveHTTP))
+  return ca
+}
+
+func (ca *acmeStandIn) directoryURL() string {
+  return ca.server.URL + "/directory"
+}
+
+func (ca *acmeStandIn) accountCount() int {
+  ca.mutex.Lock()
+  defer ca.mutex.Unlock()
+  return len(ca.accounts)
+}
+
+func (ca *acmeStandIn) problem(response http.ResponseWriter, status int, problemType string, detail string) {
+  response.Header().Set("Content-Type", "application/problem+json")
+  response.WriteHeader(status)
+  json.NewEncoder(response).Encode(map[string]string{"type": "urn:ietf:params:acme:error:" + problemType, "detail": detail})
+}
+
+func (ca *acmeStandIn) serveHTTP(response http.ResponseWriter, request *http.Request) {
+  ca.mutex.Lock()
+  ca.nextId++
+  nonce := fmt.Sprintf("nonce%d", ca.nextId)
+  ca.nonces[nonce] = true
+  ca.mutex.Unlock()
+  response.Header().Set("Replay-Nonce", nonce)
+
+  switch {
+  case request.URL.Path == "/directory":
+    json.NewEncoder(response).Encode(map[string]string{
+      "newNonce": ca.server.URL + "/new-nonce",
+      "newAccount": ca.server.URL + "/new-account",
+      "newOrder": ca.server.URL + "/new-order",
+    })
+    return
+  case request.URL.Path == "/new-nonce":
+    return
+  }
+
+  account, payload, ok := ca.verify(response, request)
+  if !ok {
+    return
+  }
+
+  ca.mutex.Lock()
+  defer ca.mutex.Unlock()
+
+  parts := strings.Split(strings.TrimPrefix(request.URL.Path, "/"), "/")
+  switch parts[0] {
+  case "new-account":
+    response.Header().Set("Location", account)
+    response.WriteHeader(http.StatusCreated)
+    json.NewEncoder(response).Encode(map[string]string{"status": "valid"})
+
+  case "new-order":
+    var newOrder struct {
+      Identifiers []struct{ Value string }
+    }
+    json.Unmarshal(payload, &newOrder)
+    order := &acmeStandInOrder{account: account, status: "pending", tokens: map[string]string{}, validated: map[string]bool{}}
+    for _, identifier := range newOrder.Identifiers {
+      order.domains = append(order.domains, identifier.Value)
+      order.tokens[identifier.Value] = fmt.Sprintf("token%d-%s", ca.nextId, identifier.Value)
+    }
+    ca.nextId++
+    id := fmt.Sprint(ca.nextId)
+    ca.orders[id] = order
+    response.Header().Set("Location", ca.server.URL + "/order/" + id)
+    response.WriteHeader(http.StatusCreated)
+    ca.writeOrder(response, id, order)
+
+  case "order":
+    ca.writeOrder(response, parts[1], ca.orders[parts[1]])
+
+  case "authz", "chall":
+    order := ca.orders[parts[1]]
+    domain := parts[2]
+    if parts[0] == "chall" && !order.validated[domain] {
+      // Unlocked so the client can take its time answering.
+      token, accountKey := order.tokens[domain], ca.accounts[account]
+      ca.mutex.Unlock()
+      validated := ca.validate(token, accountKey)
+      ca.mutex.Lock()
+      order.validated[domain] = validated
+      if !validated {
+        order.status = "invalid"
+      }
+    }
+    status := "pending"
+    if order.validated[domain] {
+      status = "valid"
+    } else if order.status == "invalid" {
+      status = "invalid"
+    }
+    json.NewEncoder(response).Encode(map[string]interface{}{
+      "status": status,
+      "identifier": map[string]string{"type": "dns", "value": domain},
+      "challenges": []map[string]string{
+        {"type": "dns-01", "url": ca.server.URL + "/chall-dns/" + parts[1] + "/" + domain, "token": "unused", "status": "pending"},
+        {"type": "http-01", "url": ca.server.URL + "/chall/" + parts[1] + "/" + domain, "token": order.tokens[domain], "status": status},
+      },
+    })
+
+  case "finalize":
+    order := ca.orders[parts[1]]
+    for _, domain := range order.domains {
+      if !order.validated[domain] {
+        ca.problem(response, http.StatusForbidden, "orderNotReady", domain + " isn't authorized")
+        return
+      }
+    }
+    var finalize struct{ CSR string }
+    json.Unmarshal(payload, &finalize)
+    csrDER, _ := base64.RawURLEncoding.DecodeString(finalize.CSR)
+    csr, err := x509.ParseCertificateRequest(csrDER)
+    if err != nil || csr.CheckSignature() != nil || strings.Join(csr.DNSNames, ",") != strings.Join(order.domains, ",") {
+      ca.problem(response, http.StatusBadRequest, "badCSR", "CSR doesn't match the order")
+      return
+    }
+    template := &x509.Certificate{
+      SerialNumber: big.NewInt(int64(ca.nextId)),
+      Subject: pkix.Name{CommonName: order.domains[0]},
+      NotBefore: time.Now().Add(-time.Minute),
+      NotAfter: time.Now().Add(ca.lifetime),
+      KeyUsage: x509.KeyUsageDigitalSignature,
+      ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+      DNSNames: order.domains,
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, ca.caCertificate, csr.PublicKey, ca.caKey)
+    if err != nil {
+      ca.problem(response, http.StatusInternalServerError, "serverInternal", err.Error())
+      return
+    }
+    order.certificate = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.caCertificate.Raw})...)
+    // Makes the client poll once.
+    order.status = "processing"
+    ca.writeOrder(response, parts[1], order)
+    order.status = "valid"
+
+  case "cert":
+    response.Header().Set("Content-Type", "application/pem-certificate-chain")
+    response.Write(ca.orders[parts[1]].certificate)
+
+  default:
+    http.NotFound(response, request)
+  }
+}
+
+func (ca *acmeStandIn) writeOrder(response http.ResponseWriter, id string, order *acmeStandInOrder) {
+  authorizations := []string{}
+  for _, domain := range order.domains {
+    authorizations = append(authorizations, ca.server.URL + "/authz/" + id + "/" + domain)
+  }
+  body := map[string]interface{}{
+    "status": order.status,
+    "authorizations": authorizations,
+    "finalize": ca.server.URL + "/finalize/" + id,
+  }
+  if order.status == "valid" {
+    body["certificate"] = ca.server.URL + "/cert/" + id
+  }
+  json.NewEncoder(response).Encode(body)
+}
+
+func (ca *acmeStandIn) validate(token string, accountKey *ecdsa.PublicKey) bool {
+  response, err := http.Get(ca.challengeServer + "/.well-known/acme-challenge/" + token)
+  if err != nil {
+    return false
+  }
+  defer response.Body.Close()
+  body, _ := ioutil.ReadAll(response.Body)
+  return response.StatusCode == http.StatusOK && string(body) == token + "." + standInThumbprint(accountKey)
+}
+
+func standInThumbprint(key *ecdsa.PublicKey) string {
+  x, y := make([]byte, 32), make([]byte, 32)
+  key.X.FillBytes(x)
+  key.Y.FillBytes(y)
+  canonical := `{"crv":"P-256","kty":"EC","x":"` + base64.RawURLEncoding.EncodeToString(x) + `","y":"` + base64.RawURLEncoding.EncodeToString(y) + `"}`
+  digest := sha256.Sum256([]byte(canonical))
+  return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+// Checks the JWS and returns the account URL and payload.
+func (ca *acmeStandIn) verify(response http.ResponseWriter, request *http.Request) (string, []byte, bool) {
+  if request.Method != "POST" || request.Header.Get("Content-Type") != "application/jose+json" {
+    ca.problem(response, http.StatusMethodNotAllowed, "malformed", "Expected a JWS POST")
+    return "", nil, false
+  }
+
+  var jws struct{ Protected, Payload, Signature string }
+  json.NewDecoder(request.Body).Decode(&jws)
+  protectedJSON, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+  payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+  signature, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+
+  var protected struct {
+    Alg, Nonce, URL, Kid string
+    JWK *struct{ Kty, Crv, X, Y string }
+  }
+  json.Unmarshal(protectedJSON, &protected)
+
+  ca.mutex.Lock()
+  defer ca.mutex.Unlock()
+
+  if !ca.nonces[protected.Nonce] {
+    ca.problem(response, http.StatusBadRequest, "badNonce", "Unknown or reused nonce")
+    return "", nil, false
+  }
+  delete(ca.nonces, protected.Nonce)
+
+  if protected.Alg != "ES256" || protected.URL != ca.server.URL + request.URL.Path || len(signature) != 64 {
+    ca.problem(response, http.StatusBadRequest, "malformed", "Bad protected header")
+    return "", nil, false
+  }
+
+  var key *ecdsa.PublicKey
+  account := protected.Kid
+  if request.URL.Path == "/new-account" {
+    if protected.JWK == nil {
+      ca.problem(response, http.StatusBadRequest, "malformed", "newAccount needs a jwk")
+      return "", nil, false
+    }
+    x, _ := base64.RawURLEncoding.DecodeString(protected.JWK.X)
+    y, _ := base64.RawURLEncoding.DecodeString(protected.JWK.Y)
+    key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+    account = ca.server.URL + "/account/" + standInThumbprint(key)
+  } else {
+    key = ca.accounts[account]
+    if key == nil {
+      ca.problem(response, http.StatusUnauthorized, "accountDoesNotExist", "Unknown kid")
+      return "", nil, false
+    }
+  }
+
+  digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+  if !ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+    ca.problem(response, http.StatusUnauthorized, "unauthorized", "Bad signature")
+    return "", nil, false
+  }
+
+  ca.accounts[account] = key
+  return account, payload, true
+}
+
+func newTestACMEClient(t *testing.T, lifetime time.Duration) (*main.ACMEClient, *acmeStandIn, func()) {
+  storageDir, err := ioutil.TempDir("", "sneakynote_acme")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  var handler http.Handler
+  port80 := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+    handler.ServeHTTP(response, request)
+  }))
+  ca := newACMEStandIn(t, port80.URL, lifetime)
+
+  client := main.NewACMEClient(ca.directoryURL(), []string{"sneakynote.test", "www.sneakynote.test"}, storageDir)
+  client.PollInterval = 10 * time.Millisecond
+  handler = client.HTTPHandler(main.RedirectToHTTPSHandler())
+
+  return client, ca, func() {
+    ca.server.Close()
+    port80.Close()
+    os.RemoveAll(storageDir)
+  }
+}
+
+func TestACMEObtainCertificate(t *testing.T) {
+  client, ca, cleanup := newTestACMEClient(t, 90 * 24 * time.Hour)
+  defer cleanup()
+
+  if !client.NeedsRenewal() {
+    t.Error("Expected renewal needed without a certificate")
+  }
+
+  err := client.ObtainCertificate()
+  if err != nil {
+    t.Fatal("Error on ObtainCertificate:", err)
+  }
+
+  certificate, err := tls.LoadX509KeyPair(client.CertificatePath(), client.KeyPath())
+  if err != nil {
+    t.Fatal("Expected a matching pair, got", err)
+  }
+  if len(certificate.Certificate) != 2 {
+    t.Errorf("Expected the chain saved, got %d certificates", len(certificate.Certificate))
+  }
+  leaf, _ := x509.ParseCertificate(certificate.Certificate[0])
+  if leaf.VerifyHostname("www.sneakynote.test") != nil || leaf.CheckSignatureFrom(ca.caCertificate) != nil {
+    t.Errorf("Expected a CA signed certificate for both domains, got %v", leaf.DNSNames)
+  }
+
+  if keyInfo, err := os.Stat(client.KeyPath()); err != nil || keyInfo.Mode().Perm() != 0600 {
+    t.Error("Expected the private key readable only by its owner")
+  }
+
+  if client.NeedsRenewal() {
+    t.Error("Expected no renewal needed for a fresh 90 day certificate")
+  }
+}
+
+func TestACMERenewsAheadOfExpiry(t *testing.T) {
+  client, ca, cleanup := newTestACMEClient(t, 10 * 24 * time.Hour)
+  defer cleanup()
+
+  err := client.ObtainCertificate()
+  if err != nil {
+    t.Fatal("Error on ObtainCertificate:", err)
+  }
+
+  reloader, err := main.NewCertificateReloader(client.CertificatePath(), client.KeyPath())
+  if err != nil {
+    t.Fatal("Error on NewCertificateReloader:", err)
+  }
+  firstSerial := reloader.Certificate().Leaf.SerialNumber.Int64()
+
+  if !client.NeedsRenewal() {
+    t.Error("Expected renewal needed within 30 days of expiry")
+  }
+
+  // A new client with the same directory, as after a restart, keeps the account.
+  client2 := main.NewACMEClient(client.DirectoryURL, client.Domains, client.StorageDir)
+  client2.PollInterval = client.PollInterval
+  port80 := httptest.NewServer(client2.HTTPHandler(main.RedirectToHTTPSHandler()))
+  defer port80.Close()
+  ca.challengeServer = port80.URL
+  err = client2.ObtainCertificate()
+  if err != nil {
+    t.Fatal("Error renewing:", err)
+  }
+  if ca.accountCount() != 1 {
+    t.Errorf("Expected the account key reused, got %d accounts", ca.accountCount())
+  }
+
+  os.Chtimes(client.CertificatePath(), time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+  if tried, err := reloader.ReloadIfChanged(); !tried || err != nil {
+    t.Fatalf("Expected the renewed pair reloaded, got %v %v", tried, err)
+  }
+  if reloader.Certificate().Leaf.SerialNumber.Int64() == firstSerial {
+    t.Error("Expected the renewed certificate served")
+  }
+}
+
+func TestACMEFinishesCertificateSwap(t *testing.T) {
+  client, _, cleanup := newTestACMEClient(t, 90 * 24 * time.Hour)
+  defer cleanup()
+
+  if err := client.ObtainCertificate(); err != nil {
+    t.Fatal("Error on ObtainCertificate:", err)
+  }
+  if _, err := os.Stat(client.CertificatePath() + ".new"); !os.IsNotExist(err) {
+    t.Error("Expected nothing left waiting after a swap")
+  }
+  oldCertificate, _ := ioutil.ReadFile(client.CertificatePath())
+  oldKey, _ := ioutil.ReadFile(client.KeyPath())
+
+  if err := client.ObtainCertificate(); err != nil {
+    t.Fatal("Error renewing:", err)
+  }
+  newCertificate, _ := ioutil.ReadFile(client.CertificatePath())
+
+  // A crash between the key going in and the certificate.
+  ioutil.WriteFile(client.CertificatePath(), oldCertificate, 0644)
+  ioutil.WriteFile(client.CertificatePath() + ".new", newCertificate, 0644)
+  if _, err := tls.LoadX509KeyPair(client.CertificatePath(), client.KeyPath()); err == nil {
+    t.Fatal("Expected a mismatched pair to set up the test")
+  }
+
+  if err := client.FinishCertificateSwap(); err != nil {
+    t.Fatal("Error on FinishCertificateSwap:", err)
+  }
+  if certificate, _ := ioutil.ReadFile(client.CertificatePath()); string(certificate) != string(newCertificate) {
+    t.Error("Expected the new certificate put in")
+  }
+  if _, err := tls.LoadX509KeyPair(client.CertificatePath(), client.KeyPath()); err != nil {
+    t.Error("Expected a matching pair, got", err)
+  }
+
+  // A crash while writing: the half written key is thrown away.
+  currentKey, _ := ioutil.ReadFile(client.KeyPath())
+  ioutil.WriteFile(client.KeyPath() + ".new", oldKey[:len(oldKey) / 2], 0600)
+  if err := client.FinishCertificateSwap(); err == nil {
+    t.Error("Expected an error for a key without its certificate")
+  }
+  if _, err := os.Stat(client.KeyPath() + ".new"); !os.IsNotExist(err) {
+    t.Error("Expected the half written key removed")
+  }
+  if key, _ := ioutil.ReadFile(client.KeyPath()); string(key) != string(currentKey) {
+    t.Error("Expected the pair in place kept")
+  }
+}
+
+func TestACMEChallengeFailure(t *testing.T) {
+  client, ca, cleanup := newTestACMEClient(t, 90 * 24 * time.Hour)
+  defer cleanup()
+
+  // Challenges go to a server that doesn't answer them.
+  ca.challengeServer = ca.server.URL
+
+  if err := client.ObtainCertificate(); err == nil {
+    t.Error("Expected an error when the challenge can't be validated")
+  }
+  if _, err := os.Stat(client.CertificatePath()); !os.IsNotExist(err) {
+    t.Error("Expected no certificate written")
+  }
+}
+
+func TestACMEHTTPHandler(t *testing.T) {
+  client := main.NewACMEClient("http://127.0.0.1:1/directory", []string{"sneakynote.test"}, "/tmp/sneakynote_acme_unused")
+  server := httptest.NewServer(client.HTTPHandler(main.RedirectToHTTPSHandler()))
+  defer server.Close()
+
+  noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+  response, err := noRedirects.Get(server.URL + "/send")
+  if err != nil {
+    t.Fatal(err)
+  }
+  response.Body.Close()
+  if response.StatusCode != http.StatusMovedPermanently || response.Header.Get("Location") != "https://sneakynote.com/send" {
+    t.Errorf("Expected other paths redirected to HTTPS, got %d %s", response.StatusCode, response.Header.Get("Location"))
+  }
+
+  response, err = noRedirects.Get(server.URL + "/.well-known/acme-challenge/unknown")
+  if err != nil {
+    t.Fatal(err)
+  }
+  response.Body.Close()
+  if response.StatusCode != http.StatusNotFound {
+    t.Errorf("Expected 404 for an unknown token, got %d", response.StatusCode)
+  }
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "github.com/brianhempel/sneakynote.com/logs"
+  "github.com/brianhempel/sneakynote.com/store"
+  "io"
+  "io/ioutil"
+  "log/slog"
+  "net"
+  "net/http"
+  "os"
+  "path"
+  "sync/atomic"
+  "time"
+)
+
+// An admin API for operators on the box, over a Unix socket:
+//
+//   GET  /stats      counters, capacity and state
+//   POST /sweep      sweeps now
+//   POST /drain/on   turns maintenance on: new notes are refused, by every
+//   POST /drain/off  server on the store, and /readyz reports not ready
+//   POST /reload     rereads the security header overrides and certificate
+//   POST /shred      destroys every unopened note
+//
+// `./sneakynote.com admin ...` talks to it. The socket is at
+// SNEAKYNOTE_ADMIN_SOCKET, by default admin/admin.sock in the store's control
+// folder, or "off". It is made 0600 in a folder of its own made 0700, and on
+// Linux connections from other users but root are refused as well.
+//
+// Reload only rereads those two. Rate limits and proof of work are read from
+// the environment at start, and the integrity manifest is built in, so
+// changing those takes a handoff (restart.sh).
+
+const (
+  adminSocketName = "admin.sock"
+)
+
+var (
+  adminSocketPath string
+
+  // Set when serving TLS, for reloading.
+  tlsCertificateReloader *CertificateReloader
+)
+
+type adminStats struct {
+  // By metric name and labels, as on /metrics.
+  Counters map[string]uint64 `json:"counters"`
+  LiveNotes int `json:"live_notes"`
+  StoreEmptyAt time.Time `json:"store_empty_at"`
+  OpenedRecords int `json:"opened_records"`
+  ExpiredRecords int `json:"expired_records"`
+  AvailableMemory int `json:"available_memory_bytes"`
+  InFlightNoteRequests int64 `json:"in_flight_note_requests"`
+  Draining bool `json:"draining"`
+  Maintenance bool `json:"maintenance"`
+  LastSweep *time.Time `json:"last_sweep"`
+  SweeperBehind bool `json:"sweeper_behind"`
+  Ready bool `json:"ready"`
+}
+
+func defaultAdminSocketPath() string {
+  return path.Join(store.Get().ControlPath, "admin", adminSocketName)
+}
+
+func ConfigureAdmin() {
+  adminSocketPath = os.Getenv("SNEAKYNOTE_ADMIN_SOCKET")
+  if adminSocketPath == "" {
+    adminSocketPath = defaultAdminSocketPath()
+  } else if adminSocketPath == "off" {
+    adminSocketPath = ""
+  }
+}
+
+// Nil if the admin socket is off. Not handed off: the new process makes its
+// own socket in the old one's place.
+func StartAdminServer() *http.Server {
+  if adminSocketPath == "" {
+    return nil
+  }
+
+  err := os.MkdirAll(path.Dir(adminSocketPath), 0700)
+  if err == nil {
+    err = os.Chmod(path.Dir(adminSocketPath), 0700)
+  }
+  if err != nil {
+    logs.Fatal("Making admin socket folder", logs.Err(err))
+  }
+  // Left by an old process, or one that handed off.
+  os.Remove(adminSocketPath)
+
+  listener, err := net.Listen("unix", adminSocketPath)
+  if err != nil {
+    logs.Fatal("Listen", logs.Err(err))
+  }
+  // The old process closing its listener mustn't remove the new one's socket.
+  listener.(*net.UnixListener).SetUnlinkOnClose(false)
+  if err = os.Chmod(adminSocketPath, 0600); err != nil {
+    logs.Fatal("Restricting admin socket", logs.Err(err))
+  }
+
+  server := &http.Server{Handler: AdminHandlers()}
+  go server.Serve(sameUserListener{listener})
+  slog.Info("Serving admin API", "socket", adminSocketPath)
+  return server
+}
+
+type sameUserListener struct {
+  net.Listener
+}
+
+func (l sameUserListener) Accept() (net.Conn, error) {
+  for {
+    conn, err := l.Listener.Accept()
+    if err != nil {
+      return nil, err
+    }
+    if sameUser(conn) {
+      return conn, nil
+    }
+    slog.Warn("Refused admin connection from another user")
+    conn.Close()
+  }
+}
+
+func AdminHandlers() *http.ServeMux {
+  mux := http.NewServeMux()
+
+  mux.HandleFunc("/stats", adminMethod("GET", adminStatsHandler))
+  mux.HandleFunc("/sweep", adminMethod("POST", adminSweep))
+  mux.HandleFunc("/drain/on", adminMethod("POST", adminDrain(true)))
+  mux.HandleFunc("/drain/off", adminMethod("POST", adminDrain(false)))
+  mux.HandleFunc("/reload", adminMethod("POST", adminReload))
+  mux.HandleFunc("/shred", adminMethod("POST", adminShred))
+
+  return mux
+}
+
+func adminMethod(method string, handler http.HandlerFunc) http.HandlerFunc {
+  return func(response http.ResponseWriter, request *http.Request) {
+    if request.Method != method {
+      response.Header().Set("Allow", method)
+      respondError(response, http.StatusMethodNotAllowed, "method_not_allowed", "Use " + method + " for " + request.URL.Path + ".") // 405
+      return
+    }
+    handler(response, request)
+  }
+}
+
+func adminStatsHandler(response http.ResponseWriter, request *http.Request) {
+  stats := adminStats{
+    Counters: map[string]uint64{},
+    AvailableMemory: mainStore.AvailableMemory(),
+    InFlightNoteRequests: atomic.LoadInt64(&inFlightNoteRequestCount),
+    Draining: Draining(),
+    SweeperBehind: SweeperBehind(),
+    Ready: checkReadiness().Ready,
+  }
+  for _, counter := range counterMetrics {
+    stats.Counters[counter.name + labelSet(counter.labels)] = atomic.LoadUint64(counter.count)
+  }
+
+  var err error
+  stats.LiveNotes, stats.StoreEmptyAt, err = mainStore.LiveNotes()
+  if err == nil {
+    stats.OpenedRecords, stats.ExpiredRecords, err = mainStore.Tombstones()
+  }
+  if err != nil {
+    slog.Error("Returning 500", logs.Err(err))
+    respondInternalError(response)
+    return
+  }
+  stats.Maintenance, _ = mainStore.Maintenance()
+  if lastSweep := mainStore.LastSweep(); !lastSweep.IsZero() {
+    stats.LastSweep = &lastSweep
+  }
+
+  respondJSON(response, http.StatusOK, stats)
+}
+
+func adminSweep(response http.ResponseWriter, request *http.Request) {
+  phases, err := mainStore.SweepAndReport()
+  if err != nil {
+    slog.Error("Returning 500", logs.Err(err))
+    respondInternalError(response)
+    return
+  }
+
+  report := map[string]interface{}{}
+  for _, phase := range phases {
+    report[phase.Name] = map[string]interface{}{"items": phase.Items, "seconds": phase.Duration.Seconds()}
+  }
+  slog.Info("Swept on admin request")
+  respondJSON(response, http.StatusOK, report)
+}
+
+// Maintenance rather than draining, which is for a process on its way out:
+// the store's flag is seen by every process using it, and outlasts handoffs.
+func adminDrain(on bool) http.HandlerFunc {
+  return func(response http.ResponseWriter, request *http.Request) {
+    var err error
+    if on {
+      err = mainStore.StartMaintenance()
+    } else {
+      err = mainStore.StopMaintenance()
+    }
+    if err != nil {
+      slog.Error("Returning 500", logs.Err(err))
+      respondInternalError(response)
+      return
+    }
+    slog.Info("Maintenance set on admin request", "maintenance", on)
+    respondJSON(response, http.StatusOK, map[string]bool{"maintenance": inMaintenance()})
+  }
+}
+
+func adminReload(response http.ResponseWriter, request *http.Request) {
+  results := map[string]string{"security_headers": "ok", "certificate": "ok"}
+  failed := false
+
+  if err := ReloadSecurityHeaders(); err != nil {
+    results["security_headers"] = err.Error()
+    failed = true
+  }
+  if tlsCertificateReloader == nil {
+    results["certificate"] = "not serving TLS"
+  } else if err := tlsCertificateReloader.Reload(); err != nil {
+    results["certificate"] = err.Error()
+    failed = true
+  }
+
+  slog.Info("Reloaded on admin request", "security_headers", results["security_headers"], "certificate", results["certificate"])
+  if failed {
+    respondJSON(response, http.StatusInternalServerError, results)
+  } else {
+    respondJSON(response, http.StatusOK, results)
+  }
+}
+
+func adminShred(response http.ResponseWriter, request *http.Request) {
+  shredded, err := mainStore.Shred()
+  slog.Warn("Shredded all unopened notes on admin request", "count", shredded)
+  if err != nil {
+    slog.Error("Returning 500", logs.Err(err))
+    respondInternalError(response)
+    return
+  }
+  respondJSON(response, http.StatusOK, map[string]int{"shredded": shredded})
+}
+
+// ./sneakynote.com admin stats|sweep|drain on|off|reload|shred --yes
+//
+// Prints the server's JSON answer.
+func AdminCommand(args []string, stdout io.Writer) error {
+  usage := errors.New("admin takes stats, sweep, drain on|off (maintenance), reload (security headers and certificate), or shred --yes")
+  if len(args) == 0 {
+    return usage
+  }
+
+  method, urlPath := "POST", "/" + args[0]
+  switch {
+  case args[0] == "stats" && len(args) == 1: method = "GET"
+  case args[0] == "sweep" && len(args) == 1:
+  case args[0] == "reload" && len(args) == 1:
+  case args[0] == "drain" && len(args) == 2 && (args[1] == "on" || args[1] == "off"): urlPath += "/" + args[1]
+  case args[0] == "shred" && len(args) == 2 && args[1] == "--yes":
+  case args[0] == "shred": return errors.New("shred destroys every unopened note; run it with --yes")
+  default: return usage
+  }
+
+  socketPath := os.Getenv("SNEAKYNOTE_ADMIN_SOCKET")
+  if socketPath == "" {
+    socketPath = defaultAdminSocketPath()
+  }
+  client := &http.Client{
+    Timeout: time.Minute,
+    Transport: &http.Transport{
+      DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+        var dialer net.Dialer
+        return dialer.DialContext(ctx, "unix", socketPath)
+      },
+    },
+  }
+
+  request, _ := http.NewRequest(method, "http://admin" + urlPath, nil)
+  response, err := client.Do(request)
+  if err != nil {
+    return fmt.Errorf("Can't reach the server's admin socket at %s: %v", socketPath, err)
+  }
+  defer response.Body.Close()
+  body, err := ioutil.ReadAll(response.Body)
+  if err != nil {
+    return err
+  }
+
+  if response.StatusCode != http.StatusOK {
+    errorBody := errorBody{}
+    if json.Unmarshal(body, &errorBody) == nil && errorBody.ErrorMessage != "" {
+      return errors.New(errorBody.ErrorMessage)
+    }
+    stdout.Write(body)
+    return errors.New("Admin request failed: " + response.Status)
+  }
+  _, err = stdout.Write(body)
+  return err
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+  "net"
+)
+
+// The socket's permissions already keep other users out; the syscall
+// package can't ask macOS who the peer is.
+func sameUser(conn net.Conn) bool {
+  return true
+}
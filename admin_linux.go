@@ -0,0 +1,30 @@
+package main
+
+import (
+  "net"
+  "os"
+  "syscall"
+)
+
+// Whether the peer runs as this process's user, or root.
+func sameUser(conn net.Conn) bool {
+  unixConn, ok := conn.(*net.UnixConn)
+  if !ok {
+    return false
+  }
+  rawConn, err := unixConn.SyscallConn()
+  if err != nil {
+    return false
+  }
+
+  var credentials *syscall.Ucred
+  var credentialsErr error
+  err = rawConn.Control(func(fd uintptr) {
+    credentials, credentialsErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+  })
+  if err != nil || credentialsErr != nil {
+    return false
+  }
+
+  return credentials.Uid == 0 || int(credentials.Uid) == os.Getuid()
+}
@@ -0,0 +1,161 @@
+package main_test
+
+import (
+  "bytes"
+  "encoding/json"
+  "github.com/brianhempel/sneakynote.com"
+  "github.com/brianhempel/sneakynote.com/store"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path"
+  "strings"
+  "testing"
+)
+
+func withAdminServer(t *testing.T) func() {
+  socketPath := path.Join(t.TempDir(), "admin", "admin.sock")
+  os.Setenv("SNEAKYNOTE_ADMIN_SOCKET", socketPath)
+  main.ConfigureAdmin()
+  server := main.StartAdminServer()
+
+  return func() {
+    server.Close()
+    os.Unsetenv("SNEAKYNOTE_ADMIN_SOCKET")
+  }
+}
+
+func adminCommand(t *testing.T, args ...string) map[string]interface{} {
+  stdout := &bytes.Buffer{}
+  if err := main.AdminCommand(args, stdout); err != nil {
+    t.Fatalf("Error on admin %v: %v", args, err)
+  }
+  result := map[string]interface{}{}
+  if err := json.Unmarshal(stdout.Bytes(), &result); err != nil {
+    t.Fatalf("Expected JSON from admin %v, got %q", args, stdout.String())
+  }
+  return result
+}
+
+func TestAdminSocketPermissions(t *testing.T) {
+  main.SetupStore()
+  defer main.TeardownStore()
+  defer withAdminServer(t)()
+
+  socketPath := os.Getenv("SNEAKYNOTE_ADMIN_SOCKET")
+  socketInfo, err := os.Stat(socketPath)
+  if err != nil {
+    t.Fatal(err)
+  }
+  folderInfo, _ := os.Stat(path.Dir(socketPath))
+  if socketInfo.Mode().Perm() != 0600 || folderInfo.Mode().Perm() != 0700 {
+    t.Errorf("Expected the socket 0600 in a 0700 folder, got %v in %v", socketInfo.Mode().Perm(), folderInfo.Mode().Perm())
+  }
+}
+
+func TestAdminStatsAndDrain(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+  defer withAdminServer(t)()
+  defer store.Get().StopMaintenance()
+
+  postSecret(t, testServer.URL + "/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27", []byte("this is my secret"))
+
+  stats := adminCommand(t, "stats")
+  if stats["live_notes"] != 1.0 || stats["draining"] != false {
+    t.Errorf("Expected 1 live note and not draining, got %v", stats)
+  }
+  if counters, _ := stats["counters"].(map[string]interface{}); counters[`sneakynote_notes_total{outcome="created"}`] == nil {
+    t.Errorf("Expected the created counter, got %v", stats["counters"])
+  }
+
+  if result := adminCommand(t, "drain", "on"); result["maintenance"] != true || main.Draining() {
+    t.Errorf("Expected maintenance on and this process not draining, got %v", result)
+  }
+  if on, _ := store.Get().Maintenance(); !on {
+    t.Error("Expected the store's maintenance flag set")
+  }
+  response, err := http.Post(testServer.URL + "/notes/3bd5ff31-2a37-4b6f-9a0c-5d39e9a4c0a1", "application/octet-stream", strings.NewReader("another secret"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if response.StatusCode != http.StatusServiceUnavailable {
+    t.Errorf("Expected new notes refused in maintenance, got %d", response.StatusCode)
+  }
+  expectErrorType(t, response, "maintenance")
+  if _, result := getReadiness(t, testServer.URL); result.Checks["maintenance"] == "ok" {
+    t.Errorf("Expected not ready in maintenance, got %v", result.Checks)
+  }
+
+  if result := adminCommand(t, "drain", "off"); result["maintenance"] != false {
+    t.Errorf("Expected maintenance off, got %v", result)
+  }
+  if on, _ := store.Get().Maintenance(); on {
+    t.Error("Expected the store's maintenance flag cleared")
+  }
+}
+
+func TestAdminSweepAndReload(t *testing.T) {
+  main.SetupStore()
+  defer main.TeardownStore()
+  defer withAdminServer(t)()
+
+  report := adminCommand(t, "sweep")
+  for _, phase := range []string{"secrets", "being_accessed", "accessed", "expiring", "expired"} {
+    if report[phase] == nil {
+      t.Errorf("Expected the %s phase in the sweep report, got %v", phase, report)
+    }
+  }
+
+  result := adminCommand(t, "reload")
+  if result["security_headers"] != "ok" || result["certificate"] != "not serving TLS" {
+    t.Errorf("Expected security headers reloaded, got %v", result)
+  }
+}
+
+func TestAdminShred(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+  defer withAdminServer(t)()
+
+  noteURL := testServer.URL + "/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27"
+  code := postSecret(t, noteURL, []byte("this is my secret"))
+
+  if err := main.AdminCommand([]string{"shred"}, &bytes.Buffer{}); err == nil {
+    t.Error("Expected shred to need --yes")
+  }
+
+  if result := adminCommand(t, "shred", "--yes"); result["shredded"] != 1.0 {
+    t.Errorf("Expected 1 note shredded, got %v", result)
+  }
+
+  request, _ := http.NewRequest("GET", testServer.URL + "/api/v1/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27/status", nil)
+  request.Header.Set("X-Note-Code", code)
+  response, err := http.DefaultClient.Do(request)
+  if err != nil {
+    t.Fatal(err)
+  }
+  status := map[string]interface{}{}
+  json.NewDecoder(response.Body).Decode(&status)
+  response.Body.Close()
+  if status["state"] != "destroyed" || status["destroyed_reason"] != "shredded" {
+    t.Errorf("Expected the note destroyed by shredding, got %v", status)
+  }
+}
+
+func TestAdminCommandWithoutServer(t *testing.T) {
+  os.Setenv("SNEAKYNOTE_ADMIN_SOCKET", path.Join(t.TempDir(), "admin.sock"))
+  defer os.Unsetenv("SNEAKYNOTE_ADMIN_SOCKET")
+
+  err := main.AdminCommand([]string{"stats"}, &bytes.Buffer{})
+  if err == nil || !strings.Contains(err.Error(), "admin socket") {
+    t.Errorf("Expected an error reaching the socket, got %v", err)
+  }
+  if err = main.AdminCommand([]string{"drain", "sideways"}, &bytes.Buffer{}); err == nil {
+    t.Error("Expected an error for an unknown argument")
+  }
+}
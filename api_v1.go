@@ -0,0 +1,430 @@
+package main
+
+import (
+  "bytes"
+  "encoding/base64"
+  "encoding/json"
+  "github.com/brianhempel/sneakynote.com/logs"
+  "github.com/brianhempel/sneakynote.com/store"
+  "io"
+  "log/slog"
+  "net/http"
+  "regexp"
+  "strconv"
+  "sync/atomic"
+  "time"
+)
+
+const (
+  apiV1PathPrefix = "/api/v1/"
+  apiV1MaxBatchSize = 50
+)
+
+var (
+  apiV1NotePathRegexp = regexp.MustCompile("\\A/api/v1/notes/([0-9a-fA-F]{8}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{12})/?\\z")
+  apiV1NoteStatusPathRegexp = regexp.MustCompile("\\A/api/v1/notes/([0-9a-fA-F]{8}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{12})/status/?\\z")
+  apiV1GroupStatusPathRegexp = regexp.MustCompile("\\A/api/v1/groups/([0-9a-fA-F]{8}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{12})/status/?\\z")
+  apiV1GroupRevokePathRegexp = regexp.MustCompile("\\A/api/v1/groups/([0-9a-fA-F]{8}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{12})/revoke/?\\z")
+  uuidRegexp = regexp.MustCompile("\\A[0-9a-fA-F]{8}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{12}\\z")
+
+  legacyNotesDeprecatedAt = time.Date(2026, time.October, 18, 0, 0, 0, 0, time.UTC)
+)
+
+// POST /api/v1/notes/{id}
+// Ciphertext is base64 in JSON.
+type apiV1NoteRequest struct {
+  Ciphertext []byte `json:"ciphertext"`
+}
+
+// 201 response to POST /api/v1/notes/{id}
+type apiV1NoteCreated struct {
+  Id string `json:"id"`
+  Code string `json:"code"`
+}
+
+// POST /api/v1/notes:batch
+// With a group, the notes are shares of which threshold must be opened for a
+// quorum.
+type apiV1BatchRequest struct {
+  Notes []struct {
+    Id string `json:"id"`
+    Ciphertext []byte `json:"ciphertext"`
+  } `json:"notes"`
+  Group *struct {
+    Id string `json:"id"`
+    Threshold int `json:"threshold"`
+  } `json:"group"`
+}
+
+// 201 response to POST /api/v1/notes:batch, in request order
+type apiV1BatchCreated struct {
+  Notes []apiV1NoteCreated `json:"notes"`
+  Group *apiV1GroupCreated `json:"group,omitempty"`
+}
+
+// The code is needed for group status and revocation.
+type apiV1GroupCreated struct {
+  Id string `json:"id"`
+  Code string `json:"code"`
+}
+
+func apiV1(response http.ResponseWriter, request *http.Request) {
+  atomic.AddUint64(&totalRequestCount, 1)
+
+  response.Header()["Cache-Control"] = []string{"private, max-age=0, no-cache, no-store"}
+
+  requestPath := request.URL.Path
+
+  if requestPath == apiV1PathPrefix + "notes:batch" {
+    switch request.Method {
+    case "POST": takingNewNotes(postNotesBatchV1)(response, request)
+    default: respondMethodNotAllowed(response)
+    }
+  } else if requestPath == apiV1PathPrefix + "openapi.json" {
+    switch request.Method {
+    case "GET": getOpenAPI(response, request)
+    default: respondMethodNotAllowed(response)
+    }
+  } else if apiV1GroupStatusPathRegexp.MatchString(requestPath) {
+    switch request.Method {
+    case "GET": rateLimited(statusRateLimiter, getGroupStatusV1)(response, request)
+    default: respondMethodNotAllowed(response)
+    }
+  } else if apiV1GroupRevokePathRegexp.MatchString(requestPath) {
+    switch request.Method {
+    case "POST": rateLimited(statusRateLimiter, postGroupRevokeV1)(response, request)
+    default: respondMethodNotAllowed(response)
+    }
+  } else if apiV1NoteStatusPathRegexp.MatchString(requestPath) {
+    switch request.Method {
+    case "GET": rateLimited(statusRateLimiter, getNoteStatusV1)(response, request)
+    default: respondMethodNotAllowed(response)
+    }
+  } else if apiV1NotePathRegexp.MatchString(requestPath) {
+    switch request.Method {
+    case "GET": rateLimited(retrieveRateLimiter, getNoteV1)(response, request)
+    case "POST": takingNewNotes(rateLimited(createRateLimiter, proofOfWorkRequired(postNoteV1)))(response, request)
+    default: respondMethodNotAllowed(response)
+    }
+  } else {
+    respondNotFound(response)
+  }
+}
+
+// Base64 and the JSON wrapper make the body bigger than the secret.
+func apiV1MaxBodySize() int {
+  return base64.StdEncoding.EncodedLen(mainStore.MaxSecretSize) + 1024
+}
+
+func postNoteV1(response http.ResponseWriter, request *http.Request) {
+  defer zeroRequestBuffers(response, request)()
+
+  maxBodySize := apiV1MaxBodySize()
+
+  if request.ContentLength > int64(maxBodySize) {
+    atomic.AddUint64(&noteTooLargeRequestCount, 1)
+    respondSecretTooLarge(response)
+    return
+  }
+
+  id := apiV1NotePathRegexp.FindStringSubmatch(request.URL.Path)[1]
+
+  body := make([]byte, maxBodySize + 1)
+  defer zeroBuffer(body)
+
+  nRead, err := io.ReadFull(request.Body, body)
+  if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+    respondInvalidRequest(response, "Could not read request body.")
+    return
+  } else if nRead > maxBodySize {
+    atomic.AddUint64(&noteTooLargeRequestCount, 1)
+    respondSecretTooLarge(response)
+    return
+  }
+
+  noteRequest := apiV1NoteRequest{}
+  err = json.Unmarshal(body[:nRead], &noteRequest)
+  defer zeroBuffer(noteRequest.Ciphertext)
+  if err != nil {
+    respondInvalidRequest(response, "Request body must be JSON like {\"ciphertext\": \"<base64>\"}.")
+    return
+  }
+
+  code, err := mainStore.Save(bytes.NewReader(noteRequest.Ciphertext), id)
+
+  if err == store.SecretTooLarge {
+    atomic.AddUint64(&noteTooLargeRequestCount, 1)
+    respondSecretTooLarge(response)
+    return
+  } else if err == store.DuplicateId {
+    atomic.AddUint64(&noteDuplicateIdRequestCount, 1)
+    slog.Warn("Duplicate ID", logs.Note(id), logs.Client(clientIP(request)))
+    respondDuplicateId(response)
+    return
+  } else if err == store.StorageFull {
+    atomic.AddUint64(&noteStorageFullRequestCount, 1)
+    respondStorageFull(response)
+    return
+  } else if err != nil {
+    respondInternalError(response)
+    slog.Error("Returning 500", logs.Client(clientIP(request)), logs.Err(err))
+    return
+  }
+
+  atomic.AddUint64(&notesCreatedCount, 1)
+  respondJSON(response, http.StatusCreated, apiV1NoteCreated{Id: id, Code: code}) // 201
+}
+
+func postNotesBatchV1(response http.ResponseWriter, request *http.Request) {
+  defer zeroRequestBuffers(response, request)()
+
+  maxBodySize := apiV1MaxBodySize() * apiV1MaxBatchSize
+
+  // A batch can be 50 times the size of a note, too much to set aside for
+  // every request, so the buffer is only as big as the body said it is.
+  if request.ContentLength < 0 {
+    respondError(response, http.StatusLengthRequired, "length_required", "Send batches with a Content-Length.") // 411
+    return
+  } else if request.ContentLength > int64(maxBodySize) {
+    atomic.AddUint64(&noteTooLargeRequestCount, 1)
+    respondBatchTooLarge(response)
+    return
+  }
+
+  body := make([]byte, request.ContentLength)
+  defer zeroBuffer(body)
+
+  _, err := io.ReadFull(request.Body, body)
+  if err != nil {
+    respondInvalidRequest(response, "Could not read request body.")
+    return
+  }
+
+  batchRequest := apiV1BatchRequest{}
+  err = json.Unmarshal(body, &batchRequest)
+  defer func() {
+    for _, note := range batchRequest.Notes {
+      zeroBuffer(note.Ciphertext)
+    }
+  }()
+  if err != nil {
+    respondInvalidRequest(response, "Request body must be JSON like {\"notes\": [{\"id\": \"<uuid>\", \"ciphertext\": \"<base64>\"}]}.")
+    return
+  }
+
+  if len(batchRequest.Notes) == 0 {
+    respondInvalidRequest(response, "A batch needs at least one note.")
+    return
+  } else if len(batchRequest.Notes) > apiV1MaxBatchSize {
+    atomic.AddUint64(&noteTooLargeRequestCount, 1)
+    respondBatchTooLarge(response)
+    return
+  }
+
+  // Priced per note, not per request. Otherwise a batch would be a way
+  // around both.
+  if !withinRateLimit(createRateLimiter, len(batchRequest.Notes), response, request) || !proofOfWorkDone(response, request, len(batchRequest.Notes)) {
+    return
+  }
+
+  ids := make([]string, len(batchRequest.Notes))
+  secrets := make([][]byte, len(batchRequest.Notes))
+  for i, note := range batchRequest.Notes {
+    if !uuidRegexp.MatchString(note.Id) {
+      respondInvalidRequest(response, "Note " + strconv.Itoa(i) + " does not have a UUID id.")
+      return
+    }
+    ids[i] = note.Id
+    secrets[i] = note.Ciphertext
+  }
+
+  var groupCode string
+  var codes []string
+
+  if batchRequest.Group != nil {
+    if !uuidRegexp.MatchString(batchRequest.Group.Id) {
+      respondInvalidRequest(response, "The group does not have a UUID id.")
+      return
+    }
+    groupCode, codes, _, err = mainStore.SaveGroupBatch(batchRequest.Group.Id, batchRequest.Group.Threshold, ids, secrets)
+  } else {
+    codes, _, err = mainStore.SaveBatch(ids, secrets)
+  }
+
+  if err == store.InvalidThreshold {
+    respondInvalidRequest(response, "The group threshold must be between 1 and the number of notes.")
+    return
+  } else if err == store.DuplicateGroupId {
+    respondDuplicateGroupId(response)
+    return
+  } else if err == store.SecretTooLarge {
+    atomic.AddUint64(&noteTooLargeRequestCount, 1)
+    respondSecretTooLarge(response)
+    return
+  } else if err == store.DuplicateId {
+    atomic.AddUint64(&noteDuplicateIdRequestCount, 1)
+    slog.Warn("Duplicate ID in batch", logs.Client(clientIP(request)))
+    respondDuplicateId(response)
+    return
+  } else if err == store.StorageFull {
+    atomic.AddUint64(&noteStorageFullRequestCount, 1)
+    respondStorageFull(response)
+    return
+  } else if err != nil {
+    respondInternalError(response)
+    slog.Error("Returning 500", logs.Client(clientIP(request)), logs.Err(err))
+    return
+  }
+
+  batchCreated := apiV1BatchCreated{Notes: make([]apiV1NoteCreated, len(ids))}
+  for i, id := range ids {
+    batchCreated.Notes[i] = apiV1NoteCreated{Id: id, Code: codes[i]}
+  }
+  if batchRequest.Group != nil {
+    batchCreated.Group = &apiV1GroupCreated{Id: batchRequest.Group.Id, Code: groupCode}
+  }
+
+  atomic.AddUint64(&notesCreatedCount, uint64(len(ids)))
+  respondJSON(response, http.StatusCreated, batchCreated) // 201
+}
+
+func getNoteV1(response http.ResponseWriter, request *http.Request) {
+  id := apiV1NotePathRegexp.FindStringSubmatch(request.URL.Path)[1]
+
+  // Room for padding.
+  secureBuf, err := store.NewSecureBuffer(mainStore.MaxSecretSize + 1)
+  if err != nil {
+    respondInternalError(response)
+    slog.Error("Returning 500", logs.Client(clientIP(request)), logs.Err(err))
+    return
+  }
+  defer secureBuf.Free()
+  buf := secureBuf.Bytes()
+
+  nRead, code, err := mainStore.Retrieve(id, buf)
+
+  if err == store.SecretAlreadyAccessed {
+    atomic.AddUint64(&noteAlreadyOpenedRequestCount, 1)
+    respondNoteAlreadyAccessed(response)
+    return
+  } else if err == store.SecretExpired {
+    atomic.AddUint64(&noteExpiredRequestCount, 1)
+    respondNoteExpired(response)
+    return
+  } else if err == store.SecretNotFound {
+    atomic.AddUint64(&noteNotFoundCount, 1)
+    respondNoteNotFound(response)
+    return
+  } else if err != nil {
+    respondInternalError(response)
+    slog.Error("Returning 500", logs.Client(clientIP(request)), logs.Err(err))
+    return
+  }
+
+  // Built by hand rather than with encoding/json so every copy of the
+  // ciphertext is in a buffer we can zero.
+  idJSON, _ := json.Marshal(id)
+  codeJSON, _ := json.Marshal(code)
+  prefix := "{\n  \"id\": " + string(idJSON) + ",\n  \"code\": " + string(codeJSON) + ",\n  \"ciphertext\": \""
+  suffix := "\n}\n"
+
+  ciphertextLength := base64.StdEncoding.EncodedLen(nRead)
+  paddingLength := 0
+  if equalizing() {
+    // JSON ignores whitespace, so pad with spaces to the length of the
+    // biggest secret in the same bucket.
+    paddingLength = base64.StdEncoding.EncodedLen(mainStore.PaddedSize(nRead) - 1) - ciphertextLength
+  }
+
+  secureBody, err := store.NewSecureBuffer(len(prefix) + ciphertextLength + 1 + paddingLength + len(suffix))
+  if err != nil {
+    respondInternalError(response)
+    slog.Error("Returning 500", logs.Client(clientIP(request)), logs.Err(err))
+    return
+  }
+  defer secureBody.Free()
+  body := secureBody.Bytes()
+  copy(body, prefix)
+  base64.StdEncoding.Encode(body[len(prefix):], buf[:nRead])
+  body[len(prefix) + ciphertextLength] = '"'
+  for i := len(prefix) + ciphertextLength + 1; i < len(body) - len(suffix); i++ {
+    body[i] = ' '
+  }
+  copy(body[len(body)-len(suffix):], suffix)
+
+  atomic.AddUint64(&notesOpenedCount, 1)
+  response.Header().Set("Content-Type", "application/json")
+  respondSecret(response, request, http.StatusOK, body) // 200
+}
+
+// Unlike the legacy route, opened and expired notes are not errors here: the
+// status document says what happened.
+func getNoteStatusV1(response http.ResponseWriter, request *http.Request) {
+  atomic.AddUint64(&statusRequestCount, 1)
+
+  id := apiV1NoteStatusPathRegexp.FindStringSubmatch(request.URL.Path)[1]
+
+  noteStatus, err := waitForNoteStatus(request, id)
+
+  if err == nil || err == store.SecretAlreadyAccessed || err == store.SecretExpired {
+    respondNoteStatus(response, http.StatusOK, noteStatus) // 200
+  } else if err == store.SecretNotFound {
+    respondNoteNotFound(response)
+  } else if err == store.CodeLockedOut {
+    atomic.AddUint64(&statusLockedOutRequestCount, 1)
+    respondCodeLockedOut(response, mainStore.CodeLockedUntil(id))
+  } else if err == store.AttemptsNotRecorded {
+    respondAttemptsNotRecorded(response)
+  } else {
+    respondInternalError(response)
+    slog.Error("Returning 500", logs.Client(clientIP(request)), logs.Err(err))
+  }
+}
+
+func getGroupStatusV1(response http.ResponseWriter, request *http.Request) {
+  atomic.AddUint64(&statusRequestCount, 1)
+
+  groupId := apiV1GroupStatusPathRegexp.FindStringSubmatch(request.URL.Path)[1]
+
+  groupStatus, err := mainStore.GroupStatus(groupId, request.Header.Get("X-Group-Code"))
+
+  if err == store.GroupNotFound {
+    respondGroupNotFound(response)
+  } else if err == store.CodeLockedOut {
+    atomic.AddUint64(&statusLockedOutRequestCount, 1)
+    respondCodeLockedOut(response, mainStore.GroupCodeLockedUntil(groupId))
+  } else if err == store.AttemptsNotRecorded {
+    respondAttemptsNotRecorded(response)
+  } else if err != nil {
+    respondInternalError(response)
+    slog.Error("Returning 500", logs.Client(clientIP(request)), logs.Err(err))
+  } else {
+    respondJSON(response, http.StatusOK, groupStatus) // 200
+  }
+}
+
+func postGroupRevokeV1(response http.ResponseWriter, request *http.Request) {
+  groupId := apiV1GroupRevokePathRegexp.FindStringSubmatch(request.URL.Path)[1]
+
+  groupStatus, err := mainStore.RevokeGroup(groupId, request.Header.Get("X-Group-Code"))
+
+  if err == store.GroupNotFound {
+    respondGroupNotFound(response)
+  } else if err == store.CodeLockedOut {
+    atomic.AddUint64(&statusLockedOutRequestCount, 1)
+    respondCodeLockedOut(response, mainStore.GroupCodeLockedUntil(groupId))
+  } else if err == store.AttemptsNotRecorded {
+    respondAttemptsNotRecorded(response)
+  } else if err != nil {
+    respondInternalError(response)
+    slog.Error("Returning 500", logs.Client(clientIP(request)), logs.Err(err))
+  } else {
+    respondJSON(response, http.StatusOK, groupStatus) // 200
+  }
+}
+
+func getOpenAPI(response http.ResponseWriter, request *http.Request) {
+  response.Header().Set("Content-Type", "application/json")
+  response.WriteHeader(http.StatusOK) // 200
+  response.Write([]byte(openAPIDocument))
+}
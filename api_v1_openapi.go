@@ -0,0 +1,398 @@
+package main
+
+// Served at /api/v1/openapi.json. Keep in sync with api_v1.go.
+const openAPIDocument = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "SneakyNote API",
+    "version": "1",
+    "description": "Store and retrieve one-time, client-side encrypted notes. The server only ever sees ciphertext."
+  },
+  "servers": [
+    { "url": "/api/v1" }
+  ],
+  "paths": {
+    "/notes:batch": {
+      "post": {
+        "summary": "Create up to 50 notes at once. All are created or none are. With a group, the notes are tracked as k-of-n shares. Costs a rate limit token per note, and any proof of work is harder by log2 of the number of notes.",
+        "parameters": [
+          { "$ref": "#/components/parameters/PowChallenge" },
+          { "$ref": "#/components/parameters/PowNonce" }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": { "$ref": "#/components/schemas/BatchRequest" }
+            }
+          }
+        },
+        "responses": {
+          "201": {
+            "description": "All notes created, in request order.",
+            "content": {
+              "application/json": {
+                "schema": { "$ref": "#/components/schemas/BatchCreated" }
+              }
+            }
+          },
+          "400": { "$ref": "#/components/responses/Error" },
+          "403": { "$ref": "#/components/responses/Error" },
+          "411": { "$ref": "#/components/responses/Error" },
+          "413": { "$ref": "#/components/responses/Error" },
+          "428": { "$ref": "#/components/responses/ProofOfWorkRequired" },
+          "429": { "$ref": "#/components/responses/RateLimited" },
+          "500": { "$ref": "#/components/responses/Error" },
+          "507": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/groups/{id}/status": {
+      "parameters": [
+        { "$ref": "#/components/parameters/GroupId" },
+        { "$ref": "#/components/parameters/GroupCode" }
+      ],
+      "get": {
+        "summary": "How many of a group's shares have been opened",
+        "responses": {
+          "200": {
+            "description": "The group's status.",
+            "content": {
+              "application/json": {
+                "schema": { "$ref": "#/components/schemas/GroupStatus" }
+              }
+            }
+          },
+          "404": { "$ref": "#/components/responses/Error" },
+          "429": { "$ref": "#/components/responses/RateLimited" },
+          "500": { "$ref": "#/components/responses/Error" },
+          "503": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/groups/{id}/revoke": {
+      "parameters": [
+        { "$ref": "#/components/parameters/GroupId" },
+        { "$ref": "#/components/parameters/GroupCode" }
+      ],
+      "post": {
+        "summary": "Destroy every share of the group that has not been opened",
+        "responses": {
+          "200": {
+            "description": "The group's status after revocation.",
+            "content": {
+              "application/json": {
+                "schema": { "$ref": "#/components/schemas/GroupStatus" }
+              }
+            }
+          },
+          "404": { "$ref": "#/components/responses/Error" },
+          "429": { "$ref": "#/components/responses/RateLimited" },
+          "500": { "$ref": "#/components/responses/Error" },
+          "503": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/notes/{id}": {
+      "parameters": [
+        { "$ref": "#/components/parameters/NoteId" }
+      ],
+      "post": {
+        "summary": "Create a note",
+        "parameters": [
+          { "$ref": "#/components/parameters/PowChallenge" },
+          { "$ref": "#/components/parameters/PowNonce" }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": { "$ref": "#/components/schemas/NoteRequest" }
+            }
+          }
+        },
+        "responses": {
+          "201": {
+            "description": "Note created. Give the code to the recipient out of band.",
+            "content": {
+              "application/json": {
+                "schema": { "$ref": "#/components/schemas/NoteCreated" }
+              }
+            }
+          },
+          "400": { "$ref": "#/components/responses/Error" },
+          "403": { "$ref": "#/components/responses/Error" },
+          "413": { "$ref": "#/components/responses/Error" },
+          "428": { "$ref": "#/components/responses/ProofOfWorkRequired" },
+          "429": { "$ref": "#/components/responses/RateLimited" },
+          "500": { "$ref": "#/components/responses/Error" },
+          "507": { "$ref": "#/components/responses/Error" }
+        }
+      },
+      "get": {
+        "summary": "Open a note. This destroys it.",
+        "responses": {
+          "200": {
+            "description": "The note's ciphertext.",
+            "content": {
+              "application/json": {
+                "schema": { "$ref": "#/components/schemas/Note" }
+              }
+            }
+          },
+          "403": { "$ref": "#/components/responses/Error" },
+          "404": { "$ref": "#/components/responses/Error" },
+          "410": { "$ref": "#/components/responses/Error" },
+          "429": { "$ref": "#/components/responses/RateLimited" },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/notes/{id}/status": {
+      "parameters": [
+        { "$ref": "#/components/parameters/NoteId" },
+        {
+          "name": "X-Note-Code",
+          "in": "header",
+          "required": true,
+          "description": "The code returned when the note was created.",
+          "schema": { "type": "string" }
+        },
+        {
+          "name": "X-Long-Poll",
+          "in": "header",
+          "required": false,
+          "description": "If \"true\", wait up to 8 seconds for an unopened note to change state.",
+          "schema": { "type": "string", "enum": ["true"] }
+        }
+      ],
+      "get": {
+        "summary": "Check whether a note has been opened",
+        "responses": {
+          "200": {
+            "description": "The note's status.",
+            "content": {
+              "application/json": {
+                "schema": { "$ref": "#/components/schemas/NoteStatus" }
+              }
+            }
+          },
+          "404": { "$ref": "#/components/responses/Error" },
+          "429": { "$ref": "#/components/responses/RateLimited" },
+          "500": { "$ref": "#/components/responses/Error" },
+          "503": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    }
+  },
+  "components": {
+    "parameters": {
+      "NoteId": {
+        "name": "id",
+        "in": "path",
+        "required": true,
+        "description": "Random UUID chosen by the client.",
+        "schema": { "type": "string", "format": "uuid" }
+      },
+      "GroupId": {
+        "name": "id",
+        "in": "path",
+        "required": true,
+        "description": "Random UUID chosen by the client.",
+        "schema": { "type": "string", "format": "uuid" }
+      },
+      "PowChallenge": {
+        "name": "X-Pow-Challenge",
+        "in": "header",
+        "required": false,
+        "description": "A challenge from an earlier 428 response. Each challenge is good once, for 5 minutes, for the note or number of batch notes it was issued for.",
+        "schema": { "type": "string" }
+      },
+      "PowNonce": {
+        "name": "X-Pow-Nonce",
+        "in": "header",
+        "required": false,
+        "description": "A nonce where sha256(challenge + \":\" + nonce) starts with the challenge's difficulty in zero bits.",
+        "schema": { "type": "string" }
+      },
+      "GroupCode": {
+        "name": "X-Group-Code",
+        "in": "header",
+        "required": true,
+        "description": "The group code returned when the group was created.",
+        "schema": { "type": "string" }
+      }
+    },
+    "responses": {
+      "ProofOfWorkRequired": {
+        "description": "Storage is nearly full. Solve the challenge and resend the same request with X-Pow-Challenge and X-Pow-Nonce.",
+        "headers": {
+          "X-Pow-Challenge": { "schema": { "type": "string" } },
+          "X-Pow-Difficulty": { "schema": { "type": "integer" } }
+        },
+        "content": {
+          "application/json": {
+            "schema": {
+              "allOf": [
+                { "$ref": "#/components/schemas/Error" },
+                {
+                  "type": "object",
+                  "properties": {
+                    "challenge": { "type": "string" },
+                    "difficulty": { "type": "integer", "description": "Leading zero bits required." }
+                  }
+                }
+              ]
+            }
+          }
+        }
+      },
+      "RateLimited": {
+        "description": "Too many requests from this client (rate_limited), or too many wrong codes for this note or group (code_locked_out). Retry after the number of seconds in the Retry-After header.",
+        "headers": {
+          "Retry-After": { "schema": { "type": "integer" } }
+        },
+        "content": {
+          "application/json": {
+            "schema": { "$ref": "#/components/schemas/Error" }
+          }
+        }
+      },
+      "Error": {
+        "description": "Something went wrong. Switch on error_type.",
+        "content": {
+          "application/json": {
+            "schema": { "$ref": "#/components/schemas/Error" }
+          }
+        }
+      }
+    },
+    "schemas": {
+      "NoteRequest": {
+        "type": "object",
+        "required": ["ciphertext"],
+        "properties": {
+          "ciphertext": { "type": "string", "format": "byte", "description": "Base64 ciphertext, at most 16384 bytes decoded." }
+        }
+      },
+      "NoteCreated": {
+        "type": "object",
+        "properties": {
+          "id": { "type": "string", "format": "uuid" },
+          "code": { "type": "string", "example": "234 567 abcd" }
+        }
+      },
+      "BatchRequest": {
+        "type": "object",
+        "required": ["notes"],
+        "properties": {
+          "notes": {
+            "type": "array",
+            "minItems": 1,
+            "maxItems": 50,
+            "items": {
+              "type": "object",
+              "required": ["id", "ciphertext"],
+              "properties": {
+                "id": { "type": "string", "format": "uuid" },
+                "ciphertext": { "type": "string", "format": "byte" }
+              }
+            }
+          },
+          "group": {
+            "type": "object",
+            "required": ["id", "threshold"],
+            "properties": {
+              "id": { "type": "string", "format": "uuid" },
+              "threshold": { "type": "integer", "minimum": 1, "description": "Shares needed for a quorum." }
+            }
+          }
+        }
+      },
+      "BatchCreated": {
+        "type": "object",
+        "properties": {
+          "notes": {
+            "type": "array",
+            "items": { "$ref": "#/components/schemas/NoteCreated" }
+          },
+          "group": {
+            "type": "object",
+            "properties": {
+              "id": { "type": "string", "format": "uuid" },
+              "code": { "type": "string", "example": "234 567 abcd" }
+            }
+          }
+        }
+      },
+      "GroupStatus": {
+        "type": "object",
+        "properties": {
+          "threshold": { "type": "integer" },
+          "shares": { "type": "integer" },
+          "unopened": { "type": "integer" },
+          "opened": { "type": "integer" },
+          "expired": { "type": "integer" },
+          "destroyed": { "type": "integer" },
+          "quorum_reached": { "type": "boolean" },
+          "quorum_possible": { "type": "boolean" },
+          "created_at": { "type": "string", "format": "date-time" },
+          "revoked_at": { "type": "string", "format": "date-time", "nullable": true },
+          "share_states": { "type": "array", "items": { "type": "string", "enum": ["unopened", "opened", "expired", "destroyed"] } }
+        }
+      },
+      "Note": {
+        "type": "object",
+        "properties": {
+          "id": { "type": "string", "format": "uuid" },
+          "code": { "type": "string", "example": "234 567 abcd" },
+          "ciphertext": { "type": "string", "format": "byte" }
+        }
+      },
+      "NoteStatus": {
+        "type": "object",
+        "properties": {
+          "state": { "type": "string", "enum": ["unopened", "opened", "expired", "destroyed"] },
+          "created_at": { "type": "string", "format": "date-time", "nullable": true },
+          "expires_at": { "type": "string", "format": "date-time", "nullable": true },
+          "opened_at": { "type": "string", "format": "date-time", "nullable": true },
+          "destroyed_at": { "type": "string", "format": "date-time", "nullable": true },
+          "views_remaining": { "type": "integer" },
+          "destroyed_reason": { "type": "string", "enum": ["opened", "expired", "duplicate_id", "revoked", "shredded"] },
+          "failed_code_attempts": { "type": "integer", "description": "Wrong codes tried for this note." },
+          "flagged": { "type": "boolean", "description": "Enough wrong codes were tried to lock out status checks. Someone may be guessing." }
+        }
+      },
+      "Error": {
+        "type": "object",
+        "properties": {
+          "error_type": {
+            "type": "string",
+            "enum": [
+              "invalid_request",
+              "not_found",
+              "method_not_allowed",
+              "secret_too_large",
+              "batch_too_large",
+              "length_required",
+              "duplicate_id",
+              "duplicate_group_id",
+              "group_not_found",
+              "storage_full",
+              "note_not_found",
+              "note_already_accessed",
+              "note_expired",
+              "proof_of_work_required",
+              "rate_limited",
+              "code_locked_out",
+              "attempts_not_recorded",
+              "internal_error"
+            ]
+          },
+          "error_message": { "type": "string" }
+        }
+      }
+    }
+  }
+}
+`
@@ -0,0 +1,590 @@
+package main_test
+
+import (
+  "bytes"
+  "encoding/json"
+  "github.com/brianhempel/sneakynote.com"
+  "github.com/brianhempel/sneakynote.com/store"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "strings"
+  "testing"
+)
+
+func TestApiV1PostAndGetNote(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  noteURL := testServer.URL + "/api/v1/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27"
+
+  // "this is my secret"
+  reqBodyReader := strings.NewReader("{\"ciphertext\": \"dGhpcyBpcyBteSBzZWNyZXQ=\"}")
+  response, err := http.Post(noteURL, "application/json", reqBodyReader)
+
+  if err != nil {
+    t.Error(err)
+    return
+  }
+
+  if response.StatusCode != 201 {
+    t.Errorf("Expected status 201, got %d", response.StatusCode)
+  }
+
+  created := map[string]string{}
+  json.NewDecoder(response.Body).Decode(&created)
+  response.Body.Close()
+
+  if created["id"] != "fc2a4122-e81e-4b10-a31b-d79fbdb33a27" {
+    t.Errorf("Expected id in response, got %#v", created)
+  }
+  if len(created["code"]) != 12 {
+    t.Errorf("Expected code in response, got %#v", created)
+  }
+
+  response, err = http.Get(noteURL)
+
+  if err != nil {
+    t.Error(err)
+    return
+  }
+
+  if response.StatusCode != 200 {
+    t.Errorf("Expected status 200, got %d", response.StatusCode)
+  }
+
+  note := map[string][]byte{}
+  json.NewDecoder(response.Body).Decode(&note)
+  response.Body.Close()
+
+  if !bytes.Equal(note["ciphertext"], []byte("this is my secret")) {
+    t.Errorf("Expected ciphertext to be \"this is my secret\", got %s", note["ciphertext"])
+  }
+
+  // Second time is a JSON error
+
+  response, err = http.Get(noteURL)
+
+  if err != nil {
+    t.Error(err)
+    return
+  }
+
+  if response.StatusCode != 403 {
+    t.Errorf("Expected status 403, got %d", response.StatusCode)
+  }
+
+  expectErrorType(t, response, "note_already_accessed")
+}
+
+func TestApiV1GetNoteNotFound(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  response, err := http.Get(testServer.URL + "/api/v1/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27")
+
+  if err != nil {
+    t.Error(err)
+    return
+  }
+
+  if response.StatusCode != 404 {
+    t.Errorf("Expected status 404, got %d", response.StatusCode)
+  }
+
+  expectErrorType(t, response, "note_not_found")
+}
+
+func TestApiV1PostNoteInvalidJSON(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  reqBodyReader := strings.NewReader("this is my secret")
+  response, err := http.Post(testServer.URL + "/api/v1/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27", "application/json", reqBodyReader)
+
+  if err != nil {
+    t.Error(err)
+    return
+  }
+
+  if response.StatusCode != 400 {
+    t.Errorf("Expected status 400, got %d", response.StatusCode)
+  }
+
+  expectErrorType(t, response, "invalid_request")
+}
+
+func TestApiV1PostNoteSecretTooLarge(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  // 12288 base64 "AAAA" quads decode to 36864 bytes
+  reqBodyReader := strings.NewReader("{\"ciphertext\": \"" + strings.Repeat("AAAA", 1024*12) + "\"}")
+  response, err := http.Post(testServer.URL + "/api/v1/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27", "application/json", reqBodyReader)
+
+  if err != nil {
+    t.Error(err)
+    return
+  }
+
+  if response.StatusCode != 413 {
+    t.Errorf("Expected status 413, got %d", response.StatusCode)
+  }
+
+  expectErrorType(t, response, "secret_too_large")
+}
+
+func TestApiV1GetNoteStatus(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  noteURL := testServer.URL + "/api/v1/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27"
+
+  response, err := http.Post(noteURL, "application/json", strings.NewReader("{\"ciphertext\": \"c2VjcmV0\"}"))
+  if err != nil {
+    t.Error(err)
+    return
+  }
+  created := map[string]string{}
+  json.NewDecoder(response.Body).Decode(&created)
+  response.Body.Close()
+
+  response, err = http.Get(noteURL)
+  if err != nil {
+    t.Error(err)
+    return
+  }
+  response.Body.Close()
+
+  // Opened notes are a 200 with the state in the document
+
+  request, _ := http.NewRequest("GET", noteURL + "/status", nil)
+  request.Header.Set("X-Note-Code", created["code"])
+  response, err = http.DefaultClient.Do(request)
+
+  if err != nil {
+    t.Error(err)
+    return
+  }
+
+  if response.StatusCode != 200 {
+    t.Errorf("Expected status 200, got %d", response.StatusCode)
+  }
+
+  body, _ := ioutil.ReadAll(response.Body)
+  response.Body.Close()
+
+  if !strings.Contains(string(body), "\"state\": \"opened\"") {
+    t.Errorf("Expected to find \"\"state\": \"opened\"\" in %s", body)
+  }
+
+  // Bad code
+
+  request, _ = http.NewRequest("GET", noteURL + "/status", nil)
+  request.Header.Set("X-Note-Code", "bad code")
+  response, err = http.DefaultClient.Do(request)
+
+  if err != nil {
+    t.Error(err)
+    return
+  }
+
+  if response.StatusCode != 404 {
+    t.Errorf("Expected status 404, got %d", response.StatusCode)
+  }
+
+  expectErrorType(t, response, "note_not_found")
+}
+
+func TestApiV1UnknownRouteAndMethod(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+
+  response, err := http.Get(testServer.URL + "/api/v1/nope")
+
+  if err != nil {
+    t.Error(err)
+    return
+  }
+
+  if response.StatusCode != 404 {
+    t.Errorf("Expected status 404, got %d", response.StatusCode)
+  }
+
+  expectErrorType(t, response, "not_found")
+
+  request, _ := http.NewRequest("DELETE", testServer.URL + "/api/v1/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27", nil)
+  response, err = http.DefaultClient.Do(request)
+
+  if err != nil {
+    t.Error(err)
+    return
+  }
+
+  if response.StatusCode != 405 {
+    t.Errorf("Expected status 405, got %d", response.StatusCode)
+  }
+
+  expectErrorType(t, response, "method_not_allowed")
+}
+
+func TestApiV1OpenAPI(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+
+  response, err := http.Get(testServer.URL + "/api/v1/openapi.json")
+
+  if err != nil {
+    t.Error(err)
+    return
+  }
+
+  if response.StatusCode != 200 {
+    t.Errorf("Expected status 200, got %d", response.StatusCode)
+  }
+
+  document := map[string]interface{}{}
+  err = json.NewDecoder(response.Body).Decode(&document)
+  response.Body.Close()
+
+  if err != nil {
+    t.Error("Expected OpenAPI document to be valid JSON:", err)
+  }
+
+  if document["openapi"] != "3.0.3" {
+    t.Errorf("Expected an OpenAPI 3 document, got %#v", document["openapi"])
+  }
+}
+
+func TestLegacyNotesDeprecationHeaders(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  response, err := http.Get(testServer.URL + "/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27")
+
+  if err != nil {
+    t.Error(err)
+    return
+  }
+  response.Body.Close()
+
+  if !strings.HasPrefix(response.Header.Get("Deprecation"), "@") {
+    t.Errorf("Expected a Deprecation header, got %#v", response.Header.Get("Deprecation"))
+  }
+
+  expectedLink := "</api/v1/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27>; rel=\"successor-version\""
+  if response.Header.Get("Link") != expectedLink {
+    t.Errorf("Expected Link header %s, got %s", expectedLink, response.Header.Get("Link"))
+  }
+}
+
+func expectErrorType(t *testing.T, response *http.Response, errorType string) {
+  defer response.Body.Close()
+
+  if response.Header.Get("Content-Type") != "application/json" {
+    t.Errorf("Expected \"Content-Type: application/json\", got %s", response.Header.Get("Content-Type"))
+  }
+
+  body, _ := ioutil.ReadAll(response.Body)
+
+  if !strings.Contains(string(body), "\"error_type\": \"" + errorType + "\"") {
+    t.Errorf("Expected to find \"\"error_type\": \"%s\"\" in %s", errorType, body)
+  }
+}
+
+func TestApiV1PostNotesBatch(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  reqBodyReader := strings.NewReader("{\"notes\": [" +
+    "{\"id\": \"fc2a4122-e81e-4b10-a31b-d79fbdb33a27\", \"ciphertext\": \"c2VjcmV0IDE=\"}," +
+    "{\"id\": \"0b8e4a5c-2a53-4c5e-9d0a-3f1f5a7e6c11\", \"ciphertext\": \"c2VjcmV0IDI=\"}" +
+    "]}")
+  response, err := http.Post(testServer.URL + "/api/v1/notes:batch", "application/json", reqBodyReader)
+
+  if err != nil {
+    t.Error(err)
+    return
+  }
+
+  if response.StatusCode != 201 {
+    t.Errorf("Expected status 201, got %d", response.StatusCode)
+  }
+
+  created := map[string][]map[string]string{}
+  json.NewDecoder(response.Body).Decode(&created)
+  response.Body.Close()
+
+  if len(created["notes"]) != 2 {
+    t.Errorf("Expected 2 notes in response, got %#v", created)
+    return
+  }
+
+  if created["notes"][1]["id"] != "0b8e4a5c-2a53-4c5e-9d0a-3f1f5a7e6c11" || len(created["notes"][1]["code"]) != 12 {
+    t.Errorf("Expected notes in request order with codes, got %#v", created)
+  }
+
+  response, err = http.Get(testServer.URL + "/api/v1/notes/0b8e4a5c-2a53-4c5e-9d0a-3f1f5a7e6c11")
+
+  if err != nil {
+    t.Error(err)
+    return
+  }
+  response.Body.Close()
+
+  if response.StatusCode != 200 {
+    t.Errorf("Expected status 200, got %d", response.StatusCode)
+  }
+}
+
+func TestApiV1PostNotesBatchDuplicateIdRollsBack(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  reqBodyReader := strings.NewReader("{\"notes\": [" +
+    "{\"id\": \"fc2a4122-e81e-4b10-a31b-d79fbdb33a27\", \"ciphertext\": \"c2VjcmV0IDE=\"}," +
+    "{\"id\": \"fc2a4122-e81e-4b10-a31b-d79fbdb33a27\", \"ciphertext\": \"c2VjcmV0IDI=\"}" +
+    "]}")
+  response, err := http.Post(testServer.URL + "/api/v1/notes:batch", "application/json", reqBodyReader)
+
+  if err != nil {
+    t.Error(err)
+    return
+  }
+
+  if response.StatusCode != 403 {
+    t.Errorf("Expected status 403, got %d", response.StatusCode)
+  }
+
+  expectErrorType(t, response, "duplicate_id")
+
+  response, err = http.Get(testServer.URL + "/api/v1/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27")
+
+  if err != nil {
+    t.Error(err)
+    return
+  }
+
+  if response.StatusCode != 404 {
+    t.Errorf("Expected status 404, got %d", response.StatusCode)
+  }
+
+  expectErrorType(t, response, "note_not_found")
+}
+
+func TestApiV1PostNotesBatchTooLarge(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  notes := make([]string, 51)
+  for i := range notes {
+    notes[i] = "{\"id\": \"" + store.GenerateUuid() + "\", \"ciphertext\": \"c2VjcmV0\"}"
+  }
+
+  reqBodyReader := strings.NewReader("{\"notes\": [" + strings.Join(notes, ",") + "]}")
+  response, err := http.Post(testServer.URL + "/api/v1/notes:batch", "application/json", reqBodyReader)
+
+  if err != nil {
+    t.Error(err)
+    return
+  }
+
+  if response.StatusCode != 413 {
+    t.Errorf("Expected status 413, got %d", response.StatusCode)
+  }
+
+  expectErrorType(t, response, "batch_too_large")
+}
+
+func TestApiV1PostNotesBatchNeedsLength(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  // An io.Reader of unknown length goes out chunked, without a Content-Length.
+  reqBodyReader := io.MultiReader(strings.NewReader("{\"notes\": [{\"id\": \"fc2a4122-e81e-4b10-a31b-d79fbdb33a27\", \"ciphertext\": \"c2VjcmV0\"}]}"))
+  response, err := http.Post(testServer.URL + "/api/v1/notes:batch", "application/json", reqBodyReader)
+
+  if err != nil {
+    t.Error(err)
+    return
+  }
+
+  if response.StatusCode != 411 {
+    t.Errorf("Expected status 411, got %d", response.StatusCode)
+  }
+
+  expectErrorType(t, response, "length_required")
+}
+
+func TestApiV1Groups(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  reqBodyReader := strings.NewReader("{\"group\": {\"id\": \"5d7c0a52-1f7e-4d0b-8b8f-2b6f1c9e4a10\", \"threshold\": 2}, \"notes\": [" +
+    "{\"id\": \"fc2a4122-e81e-4b10-a31b-d79fbdb33a27\", \"ciphertext\": \"c2hhcmUgMQ==\"}," +
+    "{\"id\": \"0b8e4a5c-2a53-4c5e-9d0a-3f1f5a7e6c11\", \"ciphertext\": \"c2hhcmUgMg==\"}" +
+    "]}")
+  response, err := http.Post(testServer.URL + "/api/v1/notes:batch", "application/json", reqBodyReader)
+
+  if err != nil {
+    t.Error(err)
+    return
+  }
+
+  if response.StatusCode != 201 {
+    t.Errorf("Expected status 201, got %d", response.StatusCode)
+  }
+
+  created := struct {
+    Group struct {
+      Id string `json:"id"`
+      Code string `json:"code"`
+    } `json:"group"`
+  }{}
+  json.NewDecoder(response.Body).Decode(&created)
+  response.Body.Close()
+
+  if len(created.Group.Code) != 12 {
+    t.Errorf("Expected a group code, got %#v", created)
+  }
+
+  groupURL := testServer.URL + "/api/v1/groups/5d7c0a52-1f7e-4d0b-8b8f-2b6f1c9e4a10"
+
+  request, _ := http.NewRequest("POST", groupURL + "/revoke", nil)
+  request.Header.Set("X-Group-Code", created.Group.Code)
+  response, err = http.DefaultClient.Do(request)
+
+  if err != nil {
+    t.Error(err)
+    return
+  }
+  response.Body.Close()
+
+  if response.StatusCode != 200 {
+    t.Errorf("Expected status 200, got %d", response.StatusCode)
+  }
+
+  request, _ = http.NewRequest("GET", groupURL + "/status", nil)
+  request.Header.Set("X-Group-Code", created.Group.Code)
+  response, err = http.DefaultClient.Do(request)
+
+  if err != nil {
+    t.Error(err)
+    return
+  }
+
+  body, _ := ioutil.ReadAll(response.Body)
+  response.Body.Close()
+
+  if !strings.Contains(string(body), "\"destroyed\": 2") || !strings.Contains(string(body), "\"quorum_possible\": false") {
+    t.Errorf("Expected both shares destroyed and no quorum possible in %s", body)
+  }
+
+  // Wrong code
+
+  request, _ = http.NewRequest("GET", groupURL + "/status", nil)
+  request.Header.Set("X-Group-Code", "bad code")
+  response, err = http.DefaultClient.Do(request)
+
+  if err != nil {
+    t.Error(err)
+    return
+  }
+
+  if response.StatusCode != 404 {
+    t.Errorf("Expected status 404, got %d", response.StatusCode)
+  }
+
+  expectErrorType(t, response, "group_not_found")
+}
+
+func TestApiV1NoteStatusCodeLockout(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  id := "fc2a4122-e81e-4b10-a31b-d79fbdb33a27"
+  response, _ := http.Post(testServer.URL + "/api/v1/notes/" + id, "application/json", strings.NewReader("{\"ciphertext\": \"c2VjcmV0\"}"))
+  response.Body.Close()
+
+  statusWithCode := func(code string) *http.Response {
+    request, _ := http.NewRequest("GET", testServer.URL + "/api/v1/notes/" + id + "/status", nil)
+    request.Header.Set("X-Note-Code", code)
+    response, err := http.DefaultClient.Do(request)
+    if err != nil {
+      t.Fatal(err)
+    }
+    return response
+  }
+
+  for i := 0; i < store.DefaultMaxFailedCodeAttempts; i++ {
+    response = statusWithCode("bad code")
+    expectErrorType(t, response, "note_not_found")
+  }
+
+  response = statusWithCode("bad code")
+
+  if response.StatusCode != 429 {
+    t.Errorf("Expected status 429, got %d", response.StatusCode)
+  }
+
+  if response.Header.Get("Retry-After") != "60" {
+    t.Errorf("Expected \"Retry-After: 60\", got %s", response.Header.Get("Retry-After"))
+  }
+
+  expectErrorType(t, response, "code_locked_out")
+}
+
+func TestApiV1NoteStatusWithoutAttemptsRecord(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  id := "fc2a4122-e81e-4b10-a31b-d79fbdb33a27"
+  response, _ := http.Post(testServer.URL + "/api/v1/notes/" + id, "application/json", strings.NewReader("{\"ciphertext\": \"c2VjcmV0\"}"))
+  response.Body.Close()
+
+  attemptsPath := store.Get().AttemptsPath
+  os.Remove(attemptsPath)
+  ioutil.WriteFile(attemptsPath, []byte("not a folder"), 0600)
+  defer os.Remove(attemptsPath)
+
+  request, _ := http.NewRequest("GET", testServer.URL + "/api/v1/notes/" + id + "/status", nil)
+  request.Header.Set("X-Note-Code", "bad code")
+  response, err := http.DefaultClient.Do(request)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if response.StatusCode != 503 {
+    t.Errorf("Expected status 503, got %d", response.StatusCode)
+  }
+
+  expectErrorType(t, response, "attempts_not_recorded")
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+  "crypto/tls"
+  "crypto/x509"
+  "errors"
+  "github.com/brianhempel/sneakynote.com/logs"
+  "log/slog"
+  "os"
+  "os/signal"
+  "sync"
+  "syscall"
+  "time"
+)
+
+// Serves the certificate from files that may be replaced while running, as
+// certbot does on renewal. The files are checked every
+// SNEAKYNOTE_CERT_RELOAD_INTERVAL (default 1m) and on SIGHUP. A new pair is
+// swapped in whole for later handshakes, and only if it loads, the key
+// matches, and it is currently valid; otherwise the last good pair stays.
+
+const (
+  defaultCertReloadInterval = time.Minute
+)
+
+var (
+  certReloadInterval = defaultCertReloadInterval
+
+  CertificateNotValidNow = errors.New("Certificate is expired or not yet valid")
+)
+
+type CertificateReloader struct {
+  certPath string
+  keyPath string
+
+  mutex sync.RWMutex
+  certificate *tls.Certificate
+  // Of the files last tried, good or not, so a bad pair isn't retried
+  // until one of them changes again.
+  certFileVersion fileVersion
+  keyFileVersion fileVersion
+}
+
+type fileVersion struct {
+  modTime time.Time
+  size int64
+}
+
+func statFileVersion(filePath string) fileVersion {
+  fileInfo, err := os.Stat(filePath)
+  if err != nil {
+    return fileVersion{}
+  }
+  return fileVersion{modTime: fileInfo.ModTime(), size: fileInfo.Size()}
+}
+
+// The first pair must load.
+func NewCertificateReloader(certPath string, keyPath string) (*CertificateReloader, error) {
+  reloader := &CertificateReloader{certPath: certPath, keyPath: keyPath}
+  err := reloader.Reload()
+  if err != nil {
+    return nil, err
+  }
+  return reloader, nil
+}
+
+// Loads the pair now, keeping the current one if the new one is bad.
+func (r *CertificateReloader) Reload() error {
+  certFileVersion := statFileVersion(r.certPath)
+  keyFileVersion := statFileVersion(r.keyPath)
+
+  r.mutex.Lock()
+  r.certFileVersion = certFileVersion
+  r.keyFileVersion = keyFileVersion
+  r.mutex.Unlock()
+
+  certificate, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+  if err != nil {
+    return err
+  }
+
+  if certificate.Leaf == nil {
+    certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0])
+    if err != nil {
+      return err
+    }
+  }
+
+  now := time.Now()
+  if now.Before(certificate.Leaf.NotBefore) || now.After(certificate.Leaf.NotAfter) {
+    return CertificateNotValidNow
+  }
+
+  r.mutex.Lock()
+  r.certificate = &certificate
+  r.mutex.Unlock()
+
+  return nil
+}
+
+// Reloads if either file has changed since the last try. Returns whether it
+// tried, and why a new pair was rejected.
+func (r *CertificateReloader) ReloadIfChanged() (bool, error) {
+  r.mutex.RLock()
+  unchanged := statFileVersion(r.certPath) == r.certFileVersion && statFileVersion(r.keyPath) == r.keyFileVersion
+  r.mutex.RUnlock()
+
+  if unchanged {
+    return false, nil
+  }
+  return true, r.Reload()
+}
+
+// Checks for new files every interval and on SIGHUP. Returns a func to stop.
+func (r *CertificateReloader) StartWatching(interval time.Duration) func() {
+  ticker := time.NewTicker(interval)
+  hangups := make(chan os.Signal, 1)
+  signal.Notify(hangups, syscall.SIGHUP)
+  stop := make(chan struct{})
+
+  go func() {
+    for {
+      select {
+      case <-ticker.C:
+        r.logReload(r.ReloadIfChanged())
+      case <-hangups:
+        r.logReload(true, r.Reload())
+      case <-stop:
+        return
+      }
+    }
+  }()
+
+  return func() {
+    ticker.Stop()
+    signal.Stop(hangups)
+    close(stop)
+  }
+}
+
+func (r *CertificateReloader) logReload(tried bool, err error) {
+  if err != nil {
+    slog.Error("Rejected new certificate, keeping the last good one", "path", r.certPath, logs.Err(err))
+  } else if tried {
+    slog.Info("Reloaded certificate", "path", r.certPath, "not_after", r.Certificate().Leaf.NotAfter)
+  }
+}
+
+func (r *CertificateReloader) Certificate() *tls.Certificate {
+  r.mutex.RLock()
+  defer r.mutex.RUnlock()
+  return r.certificate
+}
+
+// For tls.Config.GetCertificate.
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+  return r.Certificate(), nil
+}
@@ -0,0 +1,160 @@
+package main_test
+
+import (
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/tls"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/pem"
+  "github.com/brianhempel/sneakynote.com"
+  "io/ioutil"
+  "math/big"
+  "net"
+  "os"
+  "testing"
+  "time"
+)
+
+const (
+  reloadCertPath = "/tmp/sneakynote_test_fullchain.pem"
+  reloadKeyPath = "/tmp/sneakynote_test_privkey.pem"
+)
+
+// Writes a PEM pair for 127.0.0.1 and bumps the files' modification time
+// so the change is seen even within the file system's time resolution.
+func writeCertificateFiles(t *testing.T, serialNumber int64, notAfter time.Time, modTime time.Time) {
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  template := &x509.Certificate{
+    SerialNumber: big.NewInt(serialNumber),
+    Subject: pkix.Name{CommonName: "127.0.0.1"},
+    NotBefore: notAfter.Add(-24 * time.Hour),
+    NotAfter: notAfter,
+    KeyUsage: x509.KeyUsageDigitalSignature,
+    ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+    IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+  }
+
+  der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+  if err != nil {
+    t.Fatal(err)
+  }
+  keyDER, err := x509.MarshalECPrivateKey(key)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  ioutil.WriteFile(reloadCertPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+  ioutil.WriteFile(reloadKeyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+  os.Chtimes(reloadCertPath, modTime, modTime)
+  os.Chtimes(reloadKeyPath, modTime, modTime)
+}
+
+func servedSerialNumber(t *testing.T, address string) int64 {
+  state, err := tlsHandshake(address, &tls.Config{})
+  if err != nil {
+    t.Fatal(err)
+  }
+  return state.PeerCertificates[0].SerialNumber.Int64()
+}
+
+func TestCertificateReload(t *testing.T) {
+  defer os.Remove(reloadCertPath)
+  defer os.Remove(reloadKeyPath)
+
+  start := time.Now().Add(-time.Hour)
+  writeCertificateFiles(t, 1, time.Now().Add(time.Hour), start)
+
+  reloader, err := main.NewCertificateReloader(reloadCertPath, reloadKeyPath)
+  if err != nil {
+    t.Fatal("Error on NewCertificateReloader:", err)
+  }
+
+  config := main.TLSConfig()
+  config.GetCertificate = reloader.GetCertificate
+  address, stop := newTLSConfigTestServer(t, config)
+  defer stop()
+
+  if serial := servedSerialNumber(t, address); serial != 1 {
+    t.Errorf("Expected certificate 1, got %d", serial)
+  }
+
+  if tried, err := reloader.ReloadIfChanged(); tried || err != nil {
+    t.Errorf("Expected no reload for unchanged files, got %v %v", tried, err)
+  }
+
+  writeCertificateFiles(t, 2, time.Now().Add(time.Hour), start.Add(time.Minute))
+  if tried, err := reloader.ReloadIfChanged(); !tried || err != nil {
+    t.Fatalf("Expected a reload, got %v %v", tried, err)
+  }
+  if serial := servedSerialNumber(t, address); serial != 2 {
+    t.Errorf("Expected certificate 2 after reload, got %d", serial)
+  }
+
+  // A certificate with another pair's key.
+  certPEM, _ := ioutil.ReadFile(reloadCertPath)
+  writeCertificateFiles(t, 3, time.Now().Add(time.Hour), start.Add(2 * time.Minute))
+  ioutil.WriteFile(reloadCertPath, certPEM, 0600)
+  os.Chtimes(reloadCertPath, start.Add(3 * time.Minute), start.Add(3 * time.Minute))
+  if _, err := reloader.ReloadIfChanged(); err == nil {
+    t.Error("Expected a mismatched key rejected")
+  }
+
+  writeCertificateFiles(t, 4, time.Now().Add(-time.Minute), start.Add(4 * time.Minute))
+  if _, err := reloader.ReloadIfChanged(); err != main.CertificateNotValidNow {
+    t.Error("Expected CertificateNotValidNow for an expired certificate, got", err)
+  }
+
+  ioutil.WriteFile(reloadCertPath, []byte("half written"), 0600)
+  os.Chtimes(reloadCertPath, start.Add(5 * time.Minute), start.Add(5 * time.Minute))
+  if _, err := reloader.ReloadIfChanged(); err == nil {
+    t.Error("Expected a garbage certificate rejected")
+  }
+
+  if serial := servedSerialNumber(t, address); serial != 2 {
+    t.Errorf("Expected the last good certificate 2 still served, got %d", serial)
+  }
+
+  // Bad files aren't retried until they change.
+  if tried, _ := reloader.ReloadIfChanged(); tried {
+    t.Error("Expected no retry of unchanged bad files")
+  }
+}
+
+func TestCertificateReloadWatching(t *testing.T) {
+  defer os.Remove(reloadCertPath)
+  defer os.Remove(reloadKeyPath)
+
+  start := time.Now().Add(-time.Hour)
+  writeCertificateFiles(t, 1, time.Now().Add(time.Hour), start)
+
+  reloader, err := main.NewCertificateReloader(reloadCertPath, reloadKeyPath)
+  if err != nil {
+    t.Fatal("Error on NewCertificateReloader:", err)
+  }
+  stopWatching := reloader.StartWatching(10 * time.Millisecond)
+  defer stopWatching()
+
+  writeCertificateFiles(t, 2, time.Now().Add(time.Hour), start.Add(time.Minute))
+
+  deadline := time.Now().Add(time.Second)
+  for reloader.Certificate().Leaf.SerialNumber.Int64() != 2 && time.Now().Before(deadline) {
+    time.Sleep(10 * time.Millisecond)
+  }
+
+  if serial := reloader.Certificate().Leaf.SerialNumber.Int64(); serial != 2 {
+    t.Errorf("Expected the watcher to load certificate 2, got %d", serial)
+  }
+}
+
+func TestCertificateReloaderNeedsFirstPair(t *testing.T) {
+  _, err := main.NewCertificateReloader("/tmp/sneakynote_no_such_cert.pem", "/tmp/sneakynote_no_such_key.pem")
+  if err == nil {
+    t.Error("Expected an error without certificate files")
+  }
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+  "errors"
+  "flag"
+  "fmt"
+  "github.com/brianhempel/sneakynote.com/client"
+  "io"
+  "io/ioutil"
+  "os"
+  "strings"
+  "time"
+)
+
+// ./sneakynote.com send [--origin URL] [--wait] [FILE]
+//
+// Encrypts FILE (or stdin) locally, the same way the send page does, and
+// prints the URL and the code.
+func SendCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+  flags := flag.NewFlagSet("send", flag.ContinueOnError)
+  origin := flags.String("origin", defaultOrigin(), "SneakyNote server")
+  wait := flags.Bool("wait", false, "wait for the note to be opened or expire")
+  err := flags.Parse(args)
+  if err != nil {
+    return err
+  }
+
+  input := stdin
+  if flags.NArg() > 1 {
+    return errors.New("send takes at most one file")
+  } else if flags.NArg() == 1 && flags.Arg(0) != "-" {
+    file, err := os.Open(flags.Arg(0))
+    if err != nil {
+      return err
+    }
+    defer file.Close()
+    input = file
+  }
+
+  plaintext, err := ioutil.ReadAll(input)
+  defer zeroBuffer(plaintext)
+  if err != nil {
+    return err
+  }
+
+  sneakyNote := client.New(*origin)
+
+  note, err := sneakyNote.Send(plaintext)
+  if err != nil {
+    return err
+  }
+
+  fmt.Fprintln(stdout, note.URL())
+  fmt.Fprintln(stdout, "Code:", note.Code)
+
+  if *wait {
+    status, err := sneakyNote.Wait(note.Id, note.Code)
+    if err != nil {
+      return err
+    }
+    fmt.Fprintln(stdout, describeNoteStatus(status))
+  }
+
+  return nil
+}
+
+// ./sneakynote.com get [--out FILE] URL
+//
+// Opens the note, which destroys it on the server. The plaintext goes to
+// stdout or to a new FILE only the current user can read. The code goes to
+// stderr so it can be checked with the sender.
+func GetCommand(args []string, stdout io.Writer, stderr io.Writer) error {
+  flags := flag.NewFlagSet("get", flag.ContinueOnError)
+  outPath := flags.String("out", "", "write the note to this new file, mode 0400")
+  err := flags.Parse(args)
+  if err != nil {
+    return err
+  }
+
+  if flags.NArg() != 1 {
+    return errors.New("get takes exactly one URL")
+  }
+
+  plaintext, code, err := client.New(defaultOrigin()).Get(flags.Arg(0))
+  defer zeroBuffer(plaintext)
+  if err != nil {
+    return err
+  }
+
+  fmt.Fprintln(stderr, "Code:", code, "(check that it matches the sender's)")
+
+  if *outPath == "" {
+    _, err = stdout.Write(plaintext)
+    return err
+  }
+
+  // O_EXCL: never overwrite, never write into a file someone else can read.
+  file, err := os.OpenFile(*outPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+  if err != nil {
+    return err
+  }
+
+  _, err = file.Write(plaintext)
+  if err != nil {
+    file.Close()
+    return err
+  }
+
+  return file.Close()
+}
+
+// ./sneakynote.com status URL CODE
+//
+// Follows a sent note until it is opened, expires or is destroyed.
+func StatusCommand(args []string, stdout io.Writer) error {
+  if len(args) < 2 {
+    return errors.New("status takes a URL and a code")
+  }
+
+  origin, urlKey, err := client.ParseURL(args[0])
+  if err != nil {
+    return err
+  }
+
+  // Codes have spaces; let them be passed unquoted.
+  code := strings.Join(args[1:], " ")
+  id := client.UuidFromUrlKey(urlKey)
+  sneakyNote := client.New(origin)
+
+  status, err := sneakyNote.Status(id, code, false)
+  if err != nil {
+    return err
+  }
+  fmt.Fprintln(stdout, describeNoteStatus(status))
+
+  if !status.Final() {
+    status, err = sneakyNote.Wait(id, code)
+    if err != nil {
+      return err
+    }
+    fmt.Fprintln(stdout, describeNoteStatus(status))
+  }
+
+  return nil
+}
+
+func defaultOrigin() string {
+  if origin := os.Getenv("SNEAKYNOTE_ORIGIN"); origin != "" {
+    return origin
+  }
+  return client.DefaultOrigin
+}
+
+func describeNoteStatus(status *client.NoteStatus) string {
+  description := describeNoteState(status)
+
+  if status.Flagged {
+    description += fmt.Sprintf(" Warning: %d wrong codes were tried for this note. Someone may be guessing.", status.FailedCodeAttempts)
+  }
+
+  return description
+}
+
+func describeNoteState(status *client.NoteStatus) string {
+  switch status.State {
+  case client.StateUnopened:
+    return "Unopened. Expires " + formatStatusTime(status.ExpiresAt) + "."
+  case client.StateOpened:
+    return "Opened " + formatStatusTime(status.OpenedAt) + "."
+  case client.StateExpired:
+    return "Expired " + formatStatusTime(status.DestroyedAt) + " without being opened."
+  default:
+    return "Destroyed " + formatStatusTime(status.DestroyedAt) + " (" + status.DestroyedReason + ")."
+  }
+}
+
+func formatStatusTime(t *time.Time) string {
+  if t == nil {
+    return "at an unknown time"
+  }
+  return "at " + t.Local().Format("2006-01-02 15:04:05 MST")
+}
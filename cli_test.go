@@ -0,0 +1,68 @@
+package main_test
+
+import (
+  "bytes"
+  "github.com/brianhempel/sneakynote.com"
+  "io/ioutil"
+  "net/http/httptest"
+  "os"
+  "path"
+  "strings"
+  "testing"
+)
+
+func TestSendGetStatusCommands(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  sendOut := &bytes.Buffer{}
+  err := main.SendCommand([]string{"--origin", testServer.URL}, strings.NewReader("this is my secret"), sendOut)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  lines := strings.Split(strings.TrimSpace(sendOut.String()), "\n")
+  if len(lines) != 2 || !strings.HasPrefix(lines[0], testServer.URL + "/get#") || !strings.HasPrefix(lines[1], "Code: ") {
+    t.Fatalf("Expected URL and code, got %q", sendOut.String())
+  }
+  noteURL := lines[0]
+  code := strings.TrimPrefix(lines[1], "Code: ")
+
+  tempDir, _ := ioutil.TempDir("", "sneakynote_cli_test")
+  defer os.RemoveAll(tempDir)
+  outPath := path.Join(tempDir, "secret.txt")
+
+  getErr := &bytes.Buffer{}
+  err = main.GetCommand([]string{"--out", outPath, noteURL}, &bytes.Buffer{}, getErr)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if !strings.Contains(getErr.String(), code) {
+    t.Errorf("Expected code %s on stderr, got %q", code, getErr.String())
+  }
+
+  info, err := os.Stat(outPath)
+  if err != nil || info.Mode().Perm() != 0400 {
+    t.Errorf("Expected %s with mode 0400, got %v %v", outPath, info, err)
+  }
+
+  contents, _ := ioutil.ReadFile(outPath)
+  if string(contents) != "this is my secret" {
+    t.Errorf("Expected \"this is my secret\", got %q", contents)
+  }
+
+  statusOut := &bytes.Buffer{}
+  // Unquoted, the code arrives as three arguments.
+  err = main.StatusCommand(append([]string{noteURL}, strings.Split(code, " ")...), statusOut)
+  if err != nil || !strings.HasPrefix(statusOut.String(), "Opened at ") {
+    t.Errorf("Expected \"Opened at ...\", got %q %v", statusOut.String(), err)
+  }
+
+  err = main.GetCommand([]string{noteURL}, &bytes.Buffer{}, &bytes.Buffer{})
+  if err == nil || !strings.Contains(err.Error(), "already been accessed") {
+    t.Errorf("Expected already accessed error, got %v", err)
+  }
+}
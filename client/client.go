@@ -0,0 +1,291 @@
+// Package client sends and opens SneakyNotes from Go. Notes are encrypted
+// exactly as public/send does it, so a note sent from here opens in the
+// browser and vice versa. The server only ever sees ciphertext.
+
+package client
+
+import (
+  "bytes"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+  "time"
+)
+
+const (
+  DefaultOrigin = "https://sneakynote.com"
+
+  StateUnopened = "unopened"
+  StateOpened = "opened"
+  StateExpired = "expired"
+  StateDestroyed = "destroyed"
+)
+
+// Mirror the store's errors, so callers can switch on what happened to a
+// note the same way the server does.
+var (
+  SecretTooLarge = errors.New("Secret too large")
+  DuplicateId = errors.New("ID has been used before")
+  StorageFull = errors.New("Secret storage full")
+  SecretAlreadyAccessed = errors.New("Secret has already been accessed")
+  SecretExpired = errors.New("Secret has expired without being accessed")
+  SecretNotFound = errors.New("Secret not found")
+  CodeLockedOut = errors.New("Too many wrong codes; status checks locked out")
+
+  DecryptionFailed = errors.New("Could not decrypt secret")
+  InvalidURL = errors.New("Not a SneakyNote URL")
+  // Still challenged after solving several proofs of work.
+  ProofOfWorkRequired = errors.New("Secret storage nearly full and proof of work not accepted")
+)
+
+// Any other error response from the API.
+type APIError struct {
+  StatusCode int
+  ErrorType string `json:"error_type"`
+  ErrorMessage string `json:"error_message"`
+}
+
+func (e *APIError) Error() string {
+  return fmt.Sprintf("SneakyNote API returned %d %s: %s", e.StatusCode, e.ErrorType, e.ErrorMessage)
+}
+
+type Client struct {
+  // Scheme and host, without a trailing slash.
+  Origin string
+  HTTPClient *http.Client
+}
+
+// A sent note. Give URL() to the recipient and Code to them out of band.
+type Note struct {
+  Origin string
+  UrlKey string
+  Id string
+  Code string
+}
+
+// Same as the server's store.NoteStatus.
+type NoteStatus struct {
+  State string `json:"state"`
+  CreatedAt *time.Time `json:"created_at"`
+  ExpiresAt *time.Time `json:"expires_at"`
+  OpenedAt *time.Time `json:"opened_at"`
+  DestroyedAt *time.Time `json:"destroyed_at"`
+  ViewsRemaining int `json:"views_remaining"`
+  DestroyedReason string `json:"destroyed_reason,omitempty"`
+  FailedCodeAttempts int `json:"failed_code_attempts"`
+  Flagged bool `json:"flagged"`
+}
+
+type noteRequest struct {
+  Ciphertext []byte `json:"ciphertext"`
+}
+
+type noteResponse struct {
+  Id string `json:"id"`
+  Code string `json:"code"`
+  Ciphertext []byte `json:"ciphertext"`
+}
+
+func New(origin string) *Client {
+  return &Client{Origin: strings.TrimRight(origin, "/"), HTTPClient: http.DefaultClient}
+}
+
+// The shareable link, same as the send page shows.
+func (n *Note) URL() string {
+  return n.Origin + "/get#" + n.UrlKey
+}
+
+// Final once the note can no longer change.
+func (s *NoteStatus) Final() bool {
+  return s.State != StateUnopened
+}
+
+// Splits a link like https://sneakynote.com/get#<url key> into the origin
+// and the URL key.
+func ParseURL(noteURL string) (string, string, error) {
+  parsed, err := url.Parse(noteURL)
+  if err != nil || parsed.Scheme == "" || parsed.Host == "" || len(parsed.Fragment) != urlKeyLength {
+    return "", "", InvalidURL
+  }
+
+  urlKeyCharacters := strings.Join(urlKeyAlphabet, "")
+  for _, c := range parsed.Fragment {
+    if !strings.ContainsRune(urlKeyCharacters, c) {
+      return "", "", InvalidURL
+    }
+  }
+
+  return parsed.Scheme + "://" + parsed.Host, parsed.Fragment, nil
+}
+
+// Encrypts plaintext under a fresh URL key and stores it.
+func (c *Client) Send(plaintext []byte) (*Note, error) {
+  urlKey, err := NewUrlKey()
+  if err != nil {
+    return nil, err
+  }
+
+  ciphertext, err := Encrypt(urlKey, plaintext)
+  if err != nil {
+    return nil, err
+  }
+
+  id := UuidFromUrlKey(urlKey)
+
+  body, err := json.Marshal(noteRequest{Ciphertext: ciphertext})
+  if err != nil {
+    return nil, err
+  }
+
+  response, err := c.postSolvingProofOfWork(c.Origin + "/api/v1/notes/" + id, body)
+  if err != nil {
+    return nil, err
+  }
+  defer response.Body.Close()
+
+  if response.StatusCode != http.StatusCreated {
+    return nil, responseError(response)
+  }
+
+  created := noteResponse{}
+  err = json.NewDecoder(response.Body).Decode(&created)
+  if err != nil {
+    return nil, err
+  }
+
+  return &Note{Origin: c.Origin, UrlKey: urlKey, Id: id, Code: created.Code}, nil
+}
+
+// When the server's storage is nearly full it answers 428 with a challenge.
+// Solve it and resend, a few times at most since the difficulty may rise in
+// between.
+func (c *Client) postSolvingProofOfWork(postURL string, body []byte) (*http.Response, error) {
+  challenge, nonce := "", ""
+
+  for attempt := 0; ; attempt++ {
+    request, err := http.NewRequest("POST", postURL, bytes.NewReader(body))
+    if err != nil {
+      return nil, err
+    }
+
+    request.Header.Set("Content-Type", "application/json")
+    if challenge != "" {
+      request.Header.Set("X-Pow-Challenge", challenge)
+      request.Header.Set("X-Pow-Nonce", nonce)
+    }
+
+    response, err := c.HTTPClient.Do(request)
+    if err != nil || response.StatusCode != http.StatusPreconditionRequired || attempt >= 2 {
+      return response, err
+    }
+
+    challenge = response.Header.Get("X-Pow-Challenge")
+    difficulty, err := strconv.Atoi(response.Header.Get("X-Pow-Difficulty"))
+    response.Body.Close()
+    if err != nil || challenge == "" {
+      return nil, errors.New("Server sent an invalid proof of work challenge")
+    }
+
+    nonce = SolveProofOfWork(challenge, difficulty)
+  }
+}
+
+// Opens the note at noteURL, which destroys it on the server. Returns the
+// plaintext and the note's code, which the recipient should check with the
+// sender.
+func (c *Client) Get(noteURL string) ([]byte, string, error) {
+  origin, urlKey, err := ParseURL(noteURL)
+  if err != nil {
+    return nil, "", err
+  }
+
+  response, err := c.HTTPClient.Get(origin + "/api/v1/notes/" + UuidFromUrlKey(urlKey))
+  if err != nil {
+    return nil, "", err
+  }
+  defer response.Body.Close()
+
+  if response.StatusCode != http.StatusOK {
+    return nil, "", responseError(response)
+  }
+
+  opened := noteResponse{}
+  err = json.NewDecoder(response.Body).Decode(&opened)
+  if err != nil {
+    return nil, "", err
+  }
+
+  plaintext, err := Decrypt(urlKey, opened.Ciphertext)
+  if err != nil {
+    return nil, "", err
+  }
+
+  return plaintext, opened.Code, nil
+}
+
+// With longPoll, the server holds the request for a few seconds until the
+// note is opened or expires.
+func (c *Client) Status(id string, code string, longPoll bool) (*NoteStatus, error) {
+  request, err := http.NewRequest("GET", c.Origin + "/api/v1/notes/" + id + "/status", nil)
+  if err != nil {
+    return nil, err
+  }
+
+  request.Header.Set("X-Note-Code", code)
+  if longPoll {
+    request.Header.Set("X-Long-Poll", "true")
+  }
+
+  response, err := c.HTTPClient.Do(request)
+  if err != nil {
+    return nil, err
+  }
+  defer response.Body.Close()
+
+  if response.StatusCode != http.StatusOK {
+    return nil, responseError(response)
+  }
+
+  status := &NoteStatus{}
+  err = json.NewDecoder(response.Body).Decode(status)
+  if err != nil {
+    return nil, err
+  }
+
+  return status, nil
+}
+
+// Long-polls until the note is opened, expires or is destroyed.
+func (c *Client) Wait(id string, code string) (*NoteStatus, error) {
+  for {
+    status, err := c.Status(id, code, true)
+    if err != nil || status.Final() {
+      return status, err
+    }
+  }
+}
+
+func responseError(response *http.Response) error {
+  body, _ := ioutil.ReadAll(response.Body)
+
+  apiError := &APIError{StatusCode: response.StatusCode}
+  json.Unmarshal(body, apiError)
+
+  switch apiError.ErrorType {
+  case "secret_too_large": return SecretTooLarge
+  case "duplicate_id": return DuplicateId
+  case "storage_full": return StorageFull
+  case "note_already_accessed": return SecretAlreadyAccessed
+  case "note_expired": return SecretExpired
+  case "note_not_found": return SecretNotFound
+  case "code_locked_out": return CodeLockedOut
+  case "proof_of_work_required": return ProofOfWorkRequired
+  }
+
+  return apiError
+}
@@ -0,0 +1,28 @@
+package client
+
+import (
+  "crypto/sha256"
+  "math/bits"
+  "strconv"
+)
+
+// Finds a nonce where sha256(challenge + ":" + nonce) starts with difficulty
+// zero bits. The server asks for one when its storage is nearly full.
+func SolveProofOfWork(challenge string, difficulty int) string {
+  for i := 0; ; i++ {
+    nonce := strconv.Itoa(i)
+    hash := sha256.Sum256([]byte(challenge + ":" + nonce))
+
+    zeroBits := 0
+    for _, b := range hash {
+      zeroBits += bits.LeadingZeros8(b)
+      if b != 0 {
+        break
+      }
+    }
+
+    if zeroBits >= difficulty {
+      return nonce
+    }
+  }
+}
@@ -0,0 +1,219 @@
+// Ports of the key derivation and encryption in public/send and public/get.
+// Everything here must stay byte-for-byte compatible with the browser, so it
+// follows the JavaScript (and SJCL's quirks) rather than what we'd pick today.
+
+package client
+
+import (
+  "crypto/aes"
+  "crypto/cipher"
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/subtle"
+  "encoding/binary"
+  "errors"
+)
+
+const (
+  urlKeyLength = 33
+  // SJCL's default CCM tag is 64 bits.
+  ccmTagSize = 8
+)
+
+var (
+  urlKeyAlphabet []string = []string{"2", "3", "4", "5", "6", "7", "8", "9", "a", "b", "c", "d", "e", "f", "g", "h", "j", "k", "m", "n", "p", "q", "r", "s", "t", "v", "w", "x", "y", "z"}
+  hexAlphabet []string = []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9", "a", "b", "c", "d", "e", "f"}
+)
+
+// A fresh key for the URL fragment. The note ID, cipher key and IV are all
+// derived from it.
+func NewUrlKey() (string, error) {
+  // Way more than we will need.
+  randomBytes := make([]byte, 200)
+  _, err := rand.Read(randomBytes)
+  if err != nil {
+    return "", err
+  }
+
+  urlKey := pseudoRandomStringFromBytes(randomBytes, urlKeyAlphabet, urlKeyLength)
+  if len(urlKey) != urlKeyLength {
+    return "", errors.New("Ran out of random bytes generating URL key")
+  }
+
+  return urlKey, nil
+}
+
+// A version 4 UUID, the way uuidFromUrlKey in public/get computes it.
+func UuidFromUrlKey(urlKey string) string {
+  uuidHash := sha256.Sum256([]byte("uuid" + urlKey))
+
+  hex := []byte(pseudoRandomStringFromBytes(uuidHash[:], hexAlphabet, 32))
+
+  hex[12] = '4'
+  // 8, 9, a or b
+  hex[16] = hexAlphabet[8 | (hexIndex(hex[16]) & 3)][0]
+
+  return string(hex[0:8]) + "-" + string(hex[8:12]) + "-" + string(hex[12:16]) + "-" + string(hex[16:20]) + "-" + string(hex[20:32])
+}
+
+// AES-CCM as sjcl.mode.ccm.encrypt does it. Returns ciphertext followed by
+// the tag.
+func Encrypt(urlKey string, plaintext []byte) ([]byte, error) {
+  block, err := aes.NewCipher(cipherKeyFromUrlKey(urlKey))
+  if err != nil {
+    return nil, err
+  }
+
+  return ccmSeal(block, ivFromUrlKey(urlKey), plaintext), nil
+}
+
+func Decrypt(urlKey string, ciphertext []byte) ([]byte, error) {
+  block, err := aes.NewCipher(cipherKeyFromUrlKey(urlKey))
+  if err != nil {
+    return nil, err
+  }
+
+  return ccmOpen(block, ivFromUrlKey(urlKey), ciphertext)
+}
+
+func cipherKeyFromUrlKey(urlKey string) []byte {
+  cipherKey := sha256.Sum256([]byte("cipherKey" + urlKey))
+  return cipherKey[:]
+}
+
+func ivFromUrlKey(urlKey string) []byte {
+  iv := sha256.Sum256([]byte("iv" + urlKey))
+  return iv[:]
+}
+
+// Not a true base conversion, but fine for extracting random strings from
+// pseudorandom data. Skips chunks that land past the end of the alphabet.
+// Stops early if the data runs out.
+func pseudoRandomStringFromBytes(data []byte, alphabet []string, length int) string {
+  bitsConsumedPerChar := 0
+  for (1 << uint(bitsConsumedPerChar)) < len(alphabet) {
+    bitsConsumedPerChar++
+  }
+
+  str := ""
+  bitIndex := 0
+
+  for len(str) < length && bitIndex + bitsConsumedPerChar <= len(data)*8 {
+    alphabetIndex := extractBits(data, bitIndex, bitsConsumedPerChar)
+    if alphabetIndex < len(alphabet) {
+      str += alphabet[alphabetIndex]
+    }
+    bitIndex += bitsConsumedPerChar
+  }
+
+  return str
+}
+
+// Big-endian, like sjcl.bitArray.extract.
+func extractBits(data []byte, bitIndex int, bitCount int) int {
+  value := 0
+  for i := bitIndex; i < bitIndex + bitCount; i++ {
+    value = value<<1 | int((data[i/8] >> uint(7 - i%8)) & 1)
+  }
+  return value
+}
+
+func hexIndex(c byte) int {
+  for i, hexChar := range hexAlphabet {
+    if hexChar[0] == c {
+      return i
+    }
+  }
+  return 0
+}
+
+// SJCL sizes the length field L to fit the message (never less than 2) and
+// truncates the IV to the 15-L bytes that leaves for the nonce.
+func ccmNonce(iv []byte, messageLength int) ([]byte, int) {
+  L := 2
+  for L < 4 && messageLength >> uint(8*L) != 0 {
+    L++
+  }
+  return iv[:15-L], L
+}
+
+func ccmSeal(block cipher.Block, iv []byte, plaintext []byte) []byte {
+  nonce, L := ccmNonce(iv, len(plaintext))
+
+  tag := ccmMac(block, nonce, L, plaintext)
+
+  out := make([]byte, len(plaintext) + ccmTagSize)
+  stream := ccmStream(block, nonce, L)
+
+  encryptedTag := make([]byte, aes.BlockSize)
+  stream.XORKeyStream(encryptedTag, tag)
+  stream.XORKeyStream(out, plaintext)
+  copy(out[len(plaintext):], encryptedTag[:ccmTagSize])
+
+  return out
+}
+
+func ccmOpen(block cipher.Block, iv []byte, ciphertext []byte) ([]byte, error) {
+  if len(ciphertext) < ccmTagSize {
+    return nil, DecryptionFailed
+  }
+
+  messageLength := len(ciphertext) - ccmTagSize
+  nonce, L := ccmNonce(iv, messageLength)
+
+  stream := ccmStream(block, nonce, L)
+
+  tagMask := make([]byte, aes.BlockSize)
+  stream.XORKeyStream(tagMask, tagMask)
+
+  plaintext := make([]byte, messageLength)
+  stream.XORKeyStream(plaintext, ciphertext[:messageLength])
+
+  tag := ccmMac(block, nonce, L, plaintext)
+  for i := 0; i < ccmTagSize; i++ {
+    tag[i] ^= tagMask[i]
+  }
+
+  if subtle.ConstantTimeCompare(tag[:ccmTagSize], ciphertext[messageLength:]) != 1 {
+    for i := range plaintext {
+      plaintext[i] = 0
+    }
+    return nil, DecryptionFailed
+  }
+
+  return plaintext, nil
+}
+
+// CBC-MAC over B0 and the zero-padded message. No associated data.
+// Returns the full block; callers truncate to ccmTagSize.
+func ccmMac(block cipher.Block, nonce []byte, L int, message []byte) []byte {
+  mac := make([]byte, aes.BlockSize)
+
+  mac[0] = byte((ccmTagSize - 2) << 2 | (L - 1))
+  copy(mac[1:], nonce)
+  var length [8]byte
+  binary.BigEndian.PutUint64(length[:], uint64(len(message)))
+  copy(mac[aes.BlockSize-L:], length[8-L:])
+  block.Encrypt(mac, mac)
+
+  for i := 0; i < len(message); i += aes.BlockSize {
+    end := i + aes.BlockSize
+    if end > len(message) {
+      end = len(message)
+    }
+    for j, b := range message[i:end] {
+      mac[j] ^= b
+    }
+    block.Encrypt(mac, mac)
+  }
+
+  return mac
+}
+
+// Counter 0 masks the tag, counters 1 and up encrypt the message.
+func ccmStream(block cipher.Block, nonce []byte, L int) cipher.Stream {
+  counter := make([]byte, aes.BlockSize)
+  counter[0] = byte(L - 1)
+  copy(counter[1:], nonce)
+  return cipher.NewCTR(block, counter)
+}
@@ -0,0 +1,125 @@
+package client
+
+import (
+  "bytes"
+  "encoding/hex"
+  "strings"
+  "testing"
+)
+
+// Vectors from running public/send's JavaScript in Node.
+const vectorUrlKey = "2345678abcdefghjkmnpqrstvwxyz2345"
+
+func TestUuidFromUrlKey(t *testing.T) {
+  uuid := UuidFromUrlKey(vectorUrlKey)
+
+  if uuid != "ab1bdd94-59c5-46d4-8f01-5da743008d4c" {
+    t.Errorf("Expected ab1bdd94-59c5-46d4-8f01-5da743008d4c, got %s", uuid)
+  }
+}
+
+func TestEncryptMatchesBrowser(t *testing.T) {
+  vectors := []struct {
+    plaintext string
+    ciphertextHex string
+  }{
+    {"this is my secret ✓", "6f18cd98fcc1b10538a2208a5ecbf995da256d7574eafd11424e73200a"},
+    {"", "3d1452ab026be8f0"},
+  }
+
+  for _, vector := range vectors {
+    ciphertext, err := Encrypt(vectorUrlKey, []byte(vector.plaintext))
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    if hex.EncodeToString(ciphertext) != vector.ciphertextHex {
+      t.Errorf("Expected %q to encrypt to %s, got %x", vector.plaintext, vector.ciphertextHex, ciphertext)
+    }
+
+    expectedCiphertext, _ := hex.DecodeString(vector.ciphertextHex)
+    plaintext, err := Decrypt(vectorUrlKey, expectedCiphertext)
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    if string(plaintext) != vector.plaintext {
+      t.Errorf("Expected %s to decrypt to %q, got %q", vector.ciphertextHex, vector.plaintext, plaintext)
+    }
+  }
+}
+
+func TestEncryptDecryptLongSecret(t *testing.T) {
+  // Past 64KiB SJCL switches to a 3 byte length field.
+  for _, size := range []int{15, 16, 17, 16*1024, 70000} {
+    plaintext := bytes.Repeat([]byte("x"), size)
+
+    ciphertext, _ := Encrypt(vectorUrlKey, plaintext)
+    decrypted, err := Decrypt(vectorUrlKey, ciphertext)
+
+    if err != nil || !bytes.Equal(decrypted, plaintext) {
+      t.Errorf("Round trip failed for %d bytes: %v", size, err)
+    }
+  }
+}
+
+func TestDecryptWrongKeyOrTampered(t *testing.T) {
+  ciphertext, _ := Encrypt(vectorUrlKey, []byte("this is my secret"))
+
+  _, err := Decrypt("zzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzz", ciphertext)
+  if err != DecryptionFailed {
+    t.Errorf("Expected DecryptionFailed with the wrong key, got %v", err)
+  }
+
+  ciphertext[0] ^= 1
+  _, err = Decrypt(vectorUrlKey, ciphertext)
+  if err != DecryptionFailed {
+    t.Errorf("Expected DecryptionFailed with tampered ciphertext, got %v", err)
+  }
+
+  _, err = Decrypt(vectorUrlKey, []byte("short"))
+  if err != DecryptionFailed {
+    t.Errorf("Expected DecryptionFailed with truncated ciphertext, got %v", err)
+  }
+}
+
+func TestPseudoRandomStringFromBytes(t *testing.T) {
+  data, _ := hex.DecodeString("00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff")
+
+  str := pseudoRandomStringFromBytes(data, urlKeyAlphabet, urlKeyLength)
+
+  if str != "22am6ew6cqn9h46vqczyvshgy234aknak" {
+    t.Errorf("Expected 22am6ew6cqn9h46vqczyvshgy234aknak, got %s", str)
+  }
+}
+
+func TestNewUrlKey(t *testing.T) {
+  urlKey, err := NewUrlKey()
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if len(urlKey) != urlKeyLength {
+    t.Errorf("Expected %d characters, got %q", urlKeyLength, urlKey)
+  }
+
+  for _, c := range urlKey {
+    if !strings.ContainsRune(strings.Join(urlKeyAlphabet, ""), c) {
+      t.Errorf("Unexpected character %q in %q", c, urlKey)
+    }
+  }
+}
+
+func TestParseURL(t *testing.T) {
+  origin, urlKey, err := ParseURL("https://sneakynote.com/get#" + vectorUrlKey)
+
+  if err != nil || origin != "https://sneakynote.com" || urlKey != vectorUrlKey {
+    t.Errorf("Expected https://sneakynote.com and %s, got %s %s %v", vectorUrlKey, origin, urlKey, err)
+  }
+
+  for _, badURL := range []string{"https://sneakynote.com/get", "https://sneakynote.com/get#short", "https://sneakynote.com/get#" + strings.Repeat("1", urlKeyLength), "/get#" + vectorUrlKey} {
+    if _, _, err := ParseURL(badURL); err != InvalidURL {
+      t.Errorf("Expected InvalidURL for %s, got %v", badURL, err)
+    }
+  }
+}
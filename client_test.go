@@ -0,0 +1,82 @@
+package main_test
+
+import (
+  "bytes"
+  "github.com/brianhempel/sneakynote.com"
+  "github.com/brianhempel/sneakynote.com/client"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+)
+
+func TestClientSendStatusGet(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  sneakyNote := client.New(testServer.URL)
+
+  note, err := sneakyNote.Send([]byte("this is my secret"))
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  status, err := sneakyNote.Status(note.Id, note.Code, false)
+  if err != nil || status.State != client.StateUnopened {
+    t.Errorf("Expected unopened status, got %v %v", status, err)
+  }
+
+  plaintext, code, err := sneakyNote.Get(note.URL())
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if string(plaintext) != "this is my secret" {
+    t.Errorf("Expected \"this is my secret\", got %q", plaintext)
+  }
+
+  if code != note.Code {
+    t.Errorf("Expected code %s, got %s", note.Code, code)
+  }
+
+  status, err = sneakyNote.Wait(note.Id, note.Code)
+  if err != nil || status.State != client.StateOpened {
+    t.Errorf("Expected opened status, got %v %v", status, err)
+  }
+
+  _, _, err = sneakyNote.Get(note.URL())
+  if err != client.SecretAlreadyAccessed {
+    t.Errorf("Expected SecretAlreadyAccessed, got %v", err)
+  }
+
+  _, err = sneakyNote.Status(client.UuidFromUrlKey("zzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzz"), "234 567 abcd", false)
+  if err != client.SecretNotFound {
+    t.Errorf("Expected SecretNotFound, got %v", err)
+  }
+}
+
+// A note posted the way public/send does it opens with the client.
+func TestClientGetBrowserNote(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  urlKey, _ := client.NewUrlKey()
+  ciphertext, _ := client.Encrypt(urlKey, []byte("this is my secret"))
+
+  response, err := http.Post(testServer.URL + "/notes/" + client.UuidFromUrlKey(urlKey), "application/octet-stream", bytes.NewReader(ciphertext))
+  if err != nil || response.StatusCode != 201 {
+    t.Fatalf("Expected status 201, got %v %v", response, err)
+  }
+
+  plaintext, code, err := client.New(testServer.URL).Get(testServer.URL + "/get#" + urlKey)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if string(plaintext) != "this is my secret" || code != response.Header.Get("X-Note-Code") {
+    t.Errorf("Expected \"this is my secret\" and %s, got %q and %s", response.Header.Get("X-Note-Code"), plaintext, code)
+  }
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+  "crypto/rand"
+  "github.com/brianhempel/sneakynote.com/logs"
+  "github.com/brianhempel/sneakynote.com/store"
+  "log/slog"
+  "math/big"
+  "net/http"
+  "os"
+  "time"
+)
+
+// Closes the oracles in how note requests are answered. A missing note, an
+// expired one, an opened one and a present one each take a different path
+// through the store, and a big secret makes a bigger download. With
+// equalization on, every note endpoint response waits out the same minimum
+// latency plus random jitter, and secrets are padded to fixed size buckets in
+// the store and on the wire.
+
+const (
+  defaultNoteMinLatency = 250 * time.Millisecond
+  defaultNoteLatencyJitter = 50 * time.Millisecond
+)
+
+var (
+  // Zero means off, which is what tests get unless they configure it.
+  noteMinLatency time.Duration = 0
+  noteLatencyJitter time.Duration = 0
+)
+
+// Reads SNEAKYNOTE_EQUALIZE ("on" to enable), and
+// SNEAKYNOTE_NOTE_MIN_LATENCY and SNEAKYNOTE_NOTE_LATENCY_JITTER, durations
+// like "250ms". The minimum should be above the slowest path, the 150ms the
+// store spends retrying before it decides a note isn't there. Call after the
+// store is set up.
+func ConfigureEqualization() {
+  if os.Getenv("SNEAKYNOTE_EQUALIZE") != "on" {
+    DisableEqualization()
+    return
+  }
+
+  noteMinLatency = envDuration("SNEAKYNOTE_NOTE_MIN_LATENCY", defaultNoteMinLatency)
+  noteLatencyJitter = envDuration("SNEAKYNOTE_NOTE_LATENCY_JITTER", defaultNoteLatencyJitter)
+
+  if noteMinLatency <= 0 || noteLatencyJitter < 0 {
+    logs.Fatal("Note latency must be positive and jitter not negative")
+  }
+
+  mainStore.PadSecrets = true
+
+  slog.Info("Equalizing note responses, padding secrets", "min_latency", noteMinLatency.String(), "jitter", noteLatencyJitter.String())
+}
+
+func DisableEqualization() {
+  noteMinLatency = 0
+  noteLatencyJitter = 0
+  if mainStore != nil {
+    mainStore.PadSecrets = false
+  }
+}
+
+func equalizing() bool {
+  return noteMinLatency > 0
+}
+
+func envDuration(name string, defaultValue time.Duration) time.Duration {
+  value := os.Getenv(name)
+  if value == "" {
+    return defaultValue
+  }
+
+  duration, err := time.ParseDuration(value)
+  if err != nil {
+    logs.Fatal("Invalid " + name, logs.Err(err))
+  }
+  return duration
+}
+
+// Wraps a note endpoint. Nothing goes out before the request's deadline,
+// whether the handler writes early, late or not at all.
+func equalizeLatency(handler http.HandlerFunc) http.HandlerFunc {
+  return func(response http.ResponseWriter, request *http.Request) {
+    if !equalizing() {
+      handler(response, request)
+      return
+    }
+
+    delayed := &delayedResponseWriter{ResponseWriter: response, until: time.Now().Add(noteMinLatency + randomJitter())}
+    handler(delayed, request)
+    delayed.wait()
+  }
+}
+
+// Uniform in [0, noteLatencyJitter). From crypto/rand so it can't be
+// predicted and subtracted out.
+func randomJitter() time.Duration {
+  if noteLatencyJitter <= 0 {
+    return 0
+  }
+
+  jitter, err := rand.Int(rand.Reader, big.NewInt(int64(noteLatencyJitter)))
+  if err != nil {
+    return noteLatencyJitter / 2
+  }
+  return time.Duration(jitter.Int64())
+}
+
+type delayedResponseWriter struct {
+  http.ResponseWriter
+  until time.Time
+  waited bool
+}
+
+func (w *delayedResponseWriter) wait() {
+  if !w.waited {
+    time.Sleep(time.Until(w.until))
+    w.waited = true
+  }
+}
+
+func (w *delayedResponseWriter) WriteHeader(statusCode int) {
+  w.wait()
+  w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *delayedResponseWriter) Write(data []byte) (int, error) {
+  w.wait()
+  return w.ResponseWriter.Write(data)
+}
+
+// Padded like the store pads it: 0x80 then zeros to the bucket size. Only
+// for clients that say they can strip it; they see X-Note-Padded.
+func padLegacyNote(response http.ResponseWriter, request *http.Request, buf []byte, nRead int) []byte {
+  if !equalizing() || request.Header.Get("X-Accept-Padding") != "true" {
+    return buf[:nRead]
+  }
+
+  response.Header().Set("X-Note-Padded", "true")
+  return store.PadSecret(buf, nRead, mainStore.PaddedSize(nRead))
+}
@@ -0,0 +1,281 @@
+package main_test
+
+import (
+  "bytes"
+  "encoding/json"
+  "github.com/brianhempel/sneakynote.com"
+  "github.com/brianhempel/sneakynote.com/store"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path"
+  "sort"
+  "sync"
+  "testing"
+  "time"
+)
+
+// Above the 150ms the store spends retrying before it decides a note
+// isn't there.
+const (
+  equalizedMinLatency = 200 * time.Millisecond
+  equalizedJitter = 20 * time.Millisecond
+)
+
+// Call after the store is set up.
+func withEqualization() func() {
+  os.Setenv("SNEAKYNOTE_EQUALIZE", "on")
+  os.Setenv("SNEAKYNOTE_NOTE_MIN_LATENCY", equalizedMinLatency.String())
+  os.Setenv("SNEAKYNOTE_NOTE_LATENCY_JITTER", equalizedJitter.String())
+  main.ConfigureEqualization()
+
+  return func() {
+    os.Unsetenv("SNEAKYNOTE_EQUALIZE")
+    os.Unsetenv("SNEAKYNOTE_NOTE_MIN_LATENCY")
+    os.Unsetenv("SNEAKYNOTE_NOTE_LATENCY_JITTER")
+    main.DisableEqualization()
+  }
+}
+
+func postSecret(t *testing.T, url string, secret []byte) string {
+  response, err := http.Post(url, "application/octet-stream", bytes.NewReader(secret))
+  if err != nil {
+    t.Fatal(err)
+  }
+  response.Body.Close()
+
+  if response.StatusCode != 201 {
+    t.Fatalf("Expected status 201, got %d", response.StatusCode)
+  }
+  return response.Header.Get("X-Note-Code")
+}
+
+// Safe to call from other goroutines: fails the test without stopping it.
+func timedRequest(t *testing.T, method string, url string, code string) (time.Duration, int) {
+  request, _ := http.NewRequest(method, url, nil)
+  if code != "" {
+    request.Header.Set("X-Note-Code", code)
+  }
+
+  start := time.Now()
+  response, err := http.DefaultClient.Do(request)
+  if err != nil {
+    t.Error(err)
+    return time.Since(start), 0
+  }
+  ioutil.ReadAll(response.Body)
+  response.Body.Close()
+
+  return time.Since(start), response.StatusCode
+}
+
+// The latencies of each outcome should be drawn from the same distribution:
+// none faster than the minimum, and each outcome's quartiles within the
+// middle of all the latencies pooled. A path slower than the minimum, or one
+// answered early, shifts its outcome's quartiles out to the edge. The bands
+// are wide enough, with this many samples, that chance alone won't fail it.
+func expectEqualizedLatencies(t *testing.T, latencies map[string][]time.Duration) {
+  const band = 0.35
+
+  var pooled []time.Duration
+  for outcome, durations := range latencies {
+    if len(durations) < 30 {
+      t.Fatalf("Expected at least 30 samples of %s, got %d", outcome, len(durations))
+    }
+    pooled = append(pooled, durations...)
+  }
+
+  for outcome, durations := range latencies {
+    for _, duration := range durations {
+      if duration < equalizedMinLatency {
+        t.Errorf("Expected %s to take at least %v, took %v", outcome, equalizedMinLatency, duration)
+      }
+    }
+
+    for _, q := range []float64{0.25, 0.5, 0.75} {
+      low, high := quantile(pooled, q - band), quantile(pooled, q + band)
+      if actual := quantile(durations, q); actual < low || actual > high {
+        t.Errorf("Expected the %v quantile of %s between %v and %v like all outcomes, got %v", q, outcome, low, high, actual)
+      }
+    }
+  }
+}
+
+// Nearest rank, with q clamped to [0, 1].
+func quantile(durations []time.Duration, q float64) time.Duration {
+  sorted := append([]time.Duration{}, durations...)
+  sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+  if q < 0 {
+    q = 0
+  } else if q > 1 {
+    q = 1
+  }
+  return sorted[int(q * float64(len(sorted) - 1) + 0.5)]
+}
+
+func TestEqualizedNoteLatencies(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  // Rounds run a few at a time, or sampling would take minutes.
+  const samples = 40
+  const concurrency = 8
+
+  type round struct {
+    expiredId string
+    presentUrl string
+    code string
+  }
+  rounds := make([]round, samples)
+  oldTime := time.Now().Add(-store.DefaultSecretLifetime - time.Minute)
+  for i := range rounds {
+    rounds[i].expiredId = store.GenerateUuid()
+    postSecret(t, testServer.URL + "/notes/" + rounds[i].expiredId, []byte("this is my secret"))
+    os.Chtimes(path.Join(store.DefaultStorePath, store.Get().UuidToFileName(rounds[i].expiredId)), oldTime, oldTime)
+
+    rounds[i].presentUrl = testServer.URL + "/notes/" + store.GenerateUuid()
+    rounds[i].code = postSecret(t, rounds[i].presentUrl, []byte("this is my secret"))
+  }
+
+  // Only now, so posting the notes above isn't slowed.
+  defer withEqualization()()
+
+  var latenciesMutex sync.Mutex
+  latencies := map[string][]time.Duration{}
+
+  sample := func(outcome string, expectedStatus int, method string, url string, code string) {
+    latency, status := timedRequest(t, method, url, code)
+    if status != expectedStatus {
+      t.Errorf("Expected %s to be %d, got %d", outcome, expectedStatus, status)
+    }
+    latenciesMutex.Lock()
+    latencies[outcome] = append(latencies[outcome], latency)
+    latenciesMutex.Unlock()
+  }
+
+  var wait sync.WaitGroup
+  next := make(chan round)
+  for i := 0; i < concurrency; i++ {
+    wait.Add(1)
+    go func() {
+      defer wait.Done()
+      for r := range next {
+        sample("not found", 404, "GET", testServer.URL + "/notes/" + store.GenerateUuid(), "")
+        sample("expired", 410, "GET", testServer.URL + "/notes/" + r.expiredId, "")
+
+        sample("status present", 200, "GET", r.presentUrl + "/status", r.code)
+        sample("status wrong code", 404, "GET", r.presentUrl + "/status", "234 567 abcd")
+        sample("present", 200, "GET", r.presentUrl, "")
+        sample("accessed", 403, "GET", r.presentUrl, "")
+
+        sample("v1 not found", 404, "GET", testServer.URL + "/api/v1/notes/" + store.GenerateUuid(), "")
+        sample("v1 status not found", 404, "GET", testServer.URL + "/api/v1/notes/" + store.GenerateUuid() + "/status", "234 567 abcd")
+      }
+    }()
+  }
+  for _, r := range rounds {
+    next <- r
+  }
+  close(next)
+  wait.Wait()
+
+  expectEqualizedLatencies(t, latencies)
+}
+
+func TestEqualizedLegacyNoteSizes(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+  defer withEqualization()()
+
+  var lengths []int
+
+  for _, secret := range [][]byte{[]byte("short"), bytes.Repeat([]byte("long "), 50)} {
+    url := testServer.URL + "/notes/" + store.GenerateUuid()
+    postSecret(t, url, secret)
+
+    request, _ := http.NewRequest("GET", url, nil)
+    request.Header.Set("X-Accept-Padding", "true")
+    response, err := http.DefaultClient.Do(request)
+    if err != nil {
+      t.Fatal(err)
+    }
+    body, _ := ioutil.ReadAll(response.Body)
+    response.Body.Close()
+
+    if response.Header.Get("X-Note-Padded") != "true" {
+      t.Error("Expected X-Note-Padded: true, got", response.Header.Get("X-Note-Padded"))
+    }
+
+    nRead, err := store.UnpaddedSize(body)
+    if err != nil || !bytes.Equal(body[:nRead], secret) {
+      t.Errorf("Expected %q padded, got %q", secret, body)
+    }
+
+    lengths = append(lengths, len(body))
+  }
+
+  if lengths[0] != 256 || lengths[1] != 256 {
+    t.Error("Expected both downloads to be 256 bytes, got", lengths)
+  }
+
+  // Old pages don't ask for padding and get the secret as is.
+  url := testServer.URL + "/notes/" + store.GenerateUuid()
+  postSecret(t, url, []byte("short"))
+  response, err := http.Get(url)
+  if err != nil {
+    t.Fatal(err)
+  }
+  body, _ := ioutil.ReadAll(response.Body)
+  response.Body.Close()
+
+  if string(body) != "short" || response.Header.Get("X-Note-Padded") != "" {
+    t.Errorf("Expected unpadded \"short\", got %q", body)
+  }
+}
+
+func TestEqualizedApiV1NoteSizes(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+  defer withEqualization()()
+
+  var lengths []int
+
+  for _, secret := range [][]byte{[]byte("short"), bytes.Repeat([]byte("long "), 50)} {
+    url := testServer.URL + "/api/v1/notes/" + store.GenerateUuid()
+    requestBody, _ := json.Marshal(map[string][]byte{"ciphertext": secret})
+    response, err := http.Post(url, "application/json", bytes.NewReader(requestBody))
+    if err != nil {
+      t.Fatal(err)
+    }
+    response.Body.Close()
+
+    response, err = http.Get(url)
+    if err != nil {
+      t.Fatal(err)
+    }
+    body, _ := ioutil.ReadAll(response.Body)
+    response.Body.Close()
+
+    opened := struct {
+      Ciphertext []byte `json:"ciphertext"`
+    }{}
+    err = json.Unmarshal(body, &opened)
+    if err != nil || !bytes.Equal(opened.Ciphertext, secret) {
+      t.Errorf("Expected ciphertext %q, got %s", secret, body)
+    }
+
+    lengths = append(lengths, len(body))
+  }
+
+  if lengths[0] != lengths[1] {
+    t.Error("Expected both responses to be the same length, got", lengths)
+  }
+}
@@ -1,22 +1,22 @@
 package main
 
 import (
-  "bufio"
+  "encoding/json"
+  "github.com/brianhempel/sneakynote.com/logs"
   "github.com/brianhempel/sneakynote.com/store"
   "fmt"
-  "log"
+  "log/slog"
+  "math"
   "mime"
   "net/http"
   "path"
   "path/filepath"
   "regexp"
-  "reflect"
   "runtime"
   "strconv"
   "strings"
   "sync/atomic"
   "time"
-  "unsafe" // For forcing a flush of the response bufios
 )
 
 var (
@@ -32,6 +32,7 @@ var (
   noteAlreadyOpenedRequestCount uint64 = 0
   noteNotFoundCount uint64 = 0
   statusRequestCount uint64 = 0
+  statusLockedOutRequestCount uint64 = 0
   assetRequestCount uint64 = 0
   totalRequestCount uint64 = 0
 )
@@ -40,11 +41,21 @@ func Handlers() *http.ServeMux {
   mux := http.NewServeMux()
 
   publicDir := http.Dir(publicPath())
-  mux.Handle("/", CountAnAssetRequest(Cache1Day(MaybeGzip(publicDir, http.FileServer(publicDir)))))
+  mux.Handle("/", measured(AddSecurityHeaders(CountAnAssetRequest(Cache1Day(ServePinnedAssets(MaybeGzip(publicDir, http.FileServer(publicDir))))))))
 
-  mux.HandleFunc("/free_space", freeSpace)
+  mux.Handle(integrityManifestURLPath, measured(AddSecurityHeaders(http.HandlerFunc(integrityManifestHandler))))
 
-  mux.HandleFunc("/notes/", note)
+  mux.Handle(metricsURLPath, measured(AddSecurityHeaders(http.HandlerFunc(metricsHandler))))
+
+  mux.Handle(healthzURLPath, measured(AddSecurityHeaders(http.HandlerFunc(healthz))))
+
+  mux.Handle(readyzURLPath, measured(AddSecurityHeaders(http.HandlerFunc(readyz))))
+
+  mux.Handle("/free_space", measured(AddSecurityHeaders(http.HandlerFunc(freeSpace))))
+
+  mux.Handle("/notes/", measured(AddSecurityHeaders(drainable(equalizeLatency(note)))))
+
+  mux.Handle("/api/v1/", measured(AddSecurityHeaders(drainable(equalizeLatency(apiV1)))))
 
   return mux;
 }
@@ -116,9 +127,10 @@ func note(response http.ResponseWriter, request *http.Request) {
   atomic.AddUint64(&totalRequestCount, 1)
 
   response.Header()["Cache-Control"] = []string{"private, max-age=0, no-cache, no-store"}
+  addDeprecationHeaders(response, request)
 
   if noteStatusPathRegexp.MatchString(request.URL.Path) {
-    noteStatus(response, request)
+    rateLimited(statusRateLimiter, noteStatus)(response, request)
     return
   }
   if !notePathRegexp.MatchString(request.URL.Path) {
@@ -127,8 +139,8 @@ func note(response http.ResponseWriter, request *http.Request) {
   }
 
   switch request.Method {
-  case "GET": getNote(response, request)
-  case "POST": postNote(response, request)
+  case "GET": rateLimited(retrieveRateLimiter, getNote)(response, request)
+  case "POST": takingNewNotes(rateLimited(createRateLimiter, proofOfWorkRequired(postNote)))(response, request)
   default: http.NotFoundHandler().ServeHTTP(response, request)
   }
 }
@@ -142,7 +154,7 @@ func noteStatus(response http.ResponseWriter, request *http.Request) {
 }
 
 func postNote(response http.ResponseWriter, request *http.Request) {
-  defer zeroRequestBuffer(request)
+  defer zeroRequestBuffers(response, request)()
 
   if request.ContentLength > int64(mainStore.MaxSecretSize) {
     atomic.AddUint64(&noteTooLargeRequestCount, 1)
@@ -162,7 +174,7 @@ func postNote(response http.ResponseWriter, request *http.Request) {
     return
   } else if err == store.DuplicateId {
     atomic.AddUint64(&noteDuplicateIdRequestCount, 1)
-    log.Print("Duplicate ID User Agent: ", request.UserAgent())
+    slog.Warn("Duplicate ID", logs.Note(id), logs.Client(clientIP(request)))
     respondDuplicateId(response)
     return
   } else if err == store.StorageFull {
@@ -171,7 +183,7 @@ func postNote(response http.ResponseWriter, request *http.Request) {
     return
   } else if err != nil {
     response.WriteHeader(http.StatusInternalServerError) // 500
-    log.Print("Returning 500:", err)
+    slog.Error("Returning 500", logs.Client(clientIP(request)), logs.Err(err))
     return
   }
 
@@ -185,8 +197,15 @@ func getNote(response http.ResponseWriter, request *http.Request) {
 
   id := parts[1]
 
-  buf := make([]byte, mainStore.MaxSecretSize)
-  defer zeroBuffer(buf)
+  // Room for padding.
+  secureBuf, err := store.NewSecureBuffer(mainStore.MaxSecretSize + 1)
+  if err != nil {
+    response.WriteHeader(http.StatusInternalServerError) // 500
+    slog.Error("Returning 500", logs.Client(clientIP(request)), logs.Err(err))
+    return
+  }
+  defer secureBuf.Free()
+  buf := secureBuf.Bytes()
 
   nRead, code, err := mainStore.Retrieve(id, buf)
 
@@ -204,16 +223,15 @@ func getNote(response http.ResponseWriter, request *http.Request) {
     return
   } else if err != nil {
     response.WriteHeader(http.StatusInternalServerError) // 500
-    log.Print("Returning 500:", err)
+    slog.Error("Returning 500", logs.Client(clientIP(request)), logs.Err(err))
     return
   }
 
   atomic.AddUint64(&notesOpenedCount, 1)
   response.Header().Set("Content-Type", "application/octet-stream")
   response.Header().Set("X-Note-Code", code)
-  response.WriteHeader(http.StatusOK) // 200
-  response.Write(buf[:nRead])
-  zeroResponseBuffer(response)
+  body := padLegacyNote(response, request, buf, nRead)
+  respondSecret(response, request, http.StatusOK, body) // 200
 }
 
 func getNoteStatus(response http.ResponseWriter, request *http.Request) {
@@ -223,40 +241,58 @@ func getNoteStatus(response http.ResponseWriter, request *http.Request) {
 
   id := parts[1]
 
+  noteStatus, err := waitForNoteStatus(request, id)
+
+  if err == store.SecretAlreadyAccessed {
+    respondNoteStatus(response, http.StatusForbidden, noteStatus) // 403
+  } else if err == store.SecretExpired {
+    respondNoteStatus(response, http.StatusGone, noteStatus) // 410
+  } else if err == store.SecretNotFound {
+    response.WriteHeader(http.StatusNotFound) // 404
+  } else if err == store.CodeLockedOut {
+    atomic.AddUint64(&statusLockedOutRequestCount, 1)
+    respondCodeLockedOut(response, mainStore.CodeLockedUntil(id))
+  } else if err == store.AttemptsNotRecorded {
+    respondAttemptsNotRecorded(response)
+  } else if err != nil {
+    response.WriteHeader(http.StatusInternalServerError) // 500
+    slog.Error("Returning 500", logs.Client(clientIP(request)), logs.Err(err))
+  } else {
+    respondNoteStatus(response, http.StatusOK, noteStatus) // 200
+  }
+}
+
+// With "X-Long-Poll: true", waits up to 8 seconds for an unopened note to
+// change state before answering.
+func waitForNoteStatus(request *http.Request, id string) (*store.NoteStatus, error) {
   code := request.Header.Get("X-Note-Code")
 
+  longPoll := request.Header.Get("X-Long-Poll") == "true"
   timeout := time.Second * 0
-  if request.Header.Get("X-Long-Poll") == "true" {
+  if longPoll {
     timeout = time.Second * 8
   }
-  timeoutTime := time.Now().Add(timeout)
+  start := time.Now()
+  timeoutTime := start.Add(timeout)
 
   for {
-    err := mainStore.Status(id, code)
-
-    if err == store.SecretAlreadyAccessed {
-      response.WriteHeader(http.StatusForbidden) // 403
-      return
-    } else if err == store.SecretExpired {
-      response.WriteHeader(http.StatusGone) // 410
-      return
-    } else if err == store.SecretNotFound {
-      response.WriteHeader(http.StatusNotFound) // 404
-      return
-    } else if err != nil {
-      response.WriteHeader(http.StatusInternalServerError) // 500
-      log.Print("Returning 500:", err)
-      return
-    }
+    noteStatus, err := mainStore.StatusDetails(id, code)
 
-    if time.Now().After(timeoutTime) {
-      break
-    } else {
-      time.Sleep(time.Millisecond * 300)
+    if err != nil || time.Now().After(timeoutTime) {
+      if longPoll {
+        longPollSeconds.Observe(time.Since(start).Seconds())
+      }
+      return noteStatus, err
     }
+
+    time.Sleep(time.Millisecond * 300)
   }
+}
 
-  response.WriteHeader(http.StatusOK) // 200
+// The legacy /notes/ routes still work, but new clients should use /api/v1.
+func addDeprecationHeaders(response http.ResponseWriter, request *http.Request) {
+  response.Header().Set("Deprecation", "@" + strconv.FormatInt(legacyNotesDeprecatedAt.Unix(), 10))
+  response.Header().Set("Link", "<" + apiV1PathPrefix + strings.TrimPrefix(request.URL.Path, "/") + ">; rel=\"successor-version\"")
 }
 
 func freeSpace(response http.ResponseWriter, request *http.Request) {
@@ -281,247 +317,129 @@ func projectPath() string {
   return path.Dir(thisFilePath);
 }
 
-func respondSecretTooLarge(response http.ResponseWriter) {
+func respondNoteStatus(response http.ResponseWriter, statusCode int, noteStatus *store.NoteStatus) {
+  respondJSON(response, statusCode, noteStatus)
+}
+
+func respondJSON(response http.ResponseWriter, statusCode int, value interface{}) {
+  body, err := json.MarshalIndent(value, "", "  ")
+  if err != nil {
+    response.WriteHeader(http.StatusInternalServerError) // 500
+    slog.Error("Returning 500", logs.Err(err))
+    return
+  }
+
   response.Header().Set("Content-Type", "application/json")
-  response.WriteHeader(http.StatusRequestEntityTooLarge) // 413
-  response.Write([]byte("{\n  \"error_type\": \"secret_too_large\",\n  \"error_message\": \"Secret too large. Maximum allowed secret size is " + strconv.FormatInt(int64(mainStore.MaxSecretSize), 10) + " bytes.\"\n}\n"))
+  response.WriteHeader(statusCode)
+  response.Write(append(body, '\n'))
+}
+
+// Every JSON error body has this shape. Keep error types stable: clients
+// switch on them.
+type errorBody struct {
+  ErrorType string `json:"error_type"`
+  ErrorMessage string `json:"error_message"`
+}
+
+// An errorBody with the challenge to solve.
+type proofOfWorkBody struct {
+  ErrorType string `json:"error_type"`
+  ErrorMessage string `json:"error_message"`
+  Challenge string `json:"challenge"`
+  Difficulty int `json:"difficulty"`
+}
+
+func respondError(response http.ResponseWriter, statusCode int, errorType string, errorMessage string) {
+  respondJSON(response, statusCode, errorBody{ErrorType: errorType, ErrorMessage: errorMessage})
+}
+
+func respondSecretTooLarge(response http.ResponseWriter) {
+  respondError(response, http.StatusRequestEntityTooLarge, "secret_too_large", "Secret too large. Maximum allowed secret size is " + strconv.FormatInt(int64(mainStore.MaxSecretSize), 10) + " bytes.") // 413
+}
+
+func respondBatchTooLarge(response http.ResponseWriter) {
+  respondError(response, http.StatusRequestEntityTooLarge, "batch_too_large", "Batch too large. At most " + strconv.Itoa(apiV1MaxBatchSize) + " notes may be sent at once.") // 413
 }
 
 func respondDuplicateId(response http.ResponseWriter) {
-  response.Header().Set("Content-Type", "application/json")
-  response.WriteHeader(http.StatusForbidden) // 403
-  response.Write([]byte("{\n  \"error_type\": \"duplicate_id\",\n  \"error_message\": \"A secret with that ID has already been created. If you are not an attacker trying to replace the secret, this indicates a bug in your program and a potentially insecure source of randomness. As a precaution/penalty, the secret has been destroyed (if it has not already expired or been accessed).\"\n}\n"))
+  respondError(response, http.StatusForbidden, "duplicate_id", "A secret with that ID has already been created. If you are not an attacker trying to replace the secret, this indicates a bug in your program and a potentially insecure source of randomness. As a precaution/penalty, the secret has been destroyed (if it has not already expired or been accessed).") // 403
 }
-func respondStorageFull(response http.ResponseWriter) {
-  response.Header().Set("Content-Type", "application/json")
-  response.WriteHeader(507) // 507 Insufficient Storage
-  response.Write([]byte("{\n  \"error_type\": \"storage_full\",\n  \"error_message\": \"Sorry, server secret storage is full right now. Try again later.\"\n}\n"))
-}
-
-// Wow, this works.
-func zeroRequestBuffer(request *http.Request) {
-  // log.Printf("%#v", request)
-  // bodyType := reflect.TypeOf(request.Body)
-  // log.Printf("type name %s", bodyType.Name())
-  // log.Printf("type string %s", bodyType.String())
-  // log.Printf("type kind %s", bodyType.Kind().String())
-
-  bodyPtr := reflect.ValueOf(request.Body)
-  // log.Printf("bodyPtr value %#v", bodyPtr)
-  // log.Printf("bodyPtr value type %s", bodyPtr.Type().String())
-  // log.Printf("bodyPtr value kind %s", bodyPtr.Kind().String())
-
-  bodyValue := bodyPtr.Elem()
-  // log.Printf("bodyValue value %#v", bodyValue)
-  // log.Printf("bodyValue value type %s", bodyValue.Type().String())
-  // log.Printf("bodyValue value kind %s", bodyValue.Kind().String())
-
-  // If the client asked for a 100 response then the reader has one extra
-  // wrapper we have to dive through.
-  if (bodyValue.Type().String() == "http.expectContinueReader") {
-    bodyPtr := bodyValue.FieldByName("readCloser").Elem()
-    // log.Printf("bodyPtr value %#v", bodyPtr)
-    // log.Printf("bodyPtr value type %s", bodyPtr.Type().String())
-    // log.Printf("bodyPtr value kind %s", bodyPtr.Kind().String())
-    bodyValue = bodyPtr.Elem()
+
+func respondDuplicateGroupId(response http.ResponseWriter) {
+  respondError(response, http.StatusForbidden, "duplicate_group_id", "A group with that ID has already been created. Pick a new random ID.") // 403
+}
+
+func respondGroupNotFound(response http.ResponseWriter) {
+  respondError(response, http.StatusNotFound, "group_not_found", "No group with that ID and code was found.") // 404
+}
+
+func respondRateLimited(response http.ResponseWriter, wait time.Duration) {
+  retryAfter := setRetryAfter(response, wait)
+  respondError(response, http.StatusTooManyRequests, "rate_limited", "Too many requests. Try again in " + strconv.Itoa(retryAfter) + " seconds.") // 429
+}
+
+// Whole seconds, at least one. Returns what it set.
+func setRetryAfter(response http.ResponseWriter, wait time.Duration) int {
+  retryAfter := int(math.Ceil(wait.Seconds()))
+  if retryAfter < 1 {
+    retryAfter = 1
   }
 
-  bodySrcInt := bodyValue.FieldByName("src")
-  // typeOfBodyDeref := bodyDeref.Type()
-  // for i := 0; i < bodyDeref.NumField(); i++ {
-  //     f := bodyDeref.Field(i)
-  //     if typeOfBodyDeref.Field(i).Name == "src" {
-  //       bodySrc = f
-  //       log.Printf("%d: %s %s\n", i, typeOfBodyDeref.Field(i).Name, f.Type())
-  //     }
-  // }
-  // log.Printf("bodySrc %#v", bodySrc)
-  // log.Printf("bodySrc type %s", bodySrc.Type().String())
-  // log.Printf("bodySrc kind %s", bodySrc.Kind().String())
-
-  bodySrcLimitedReaderPtr := bodySrcInt.Elem()
-  // log.Printf("bodySrc value %#v", bodySrcValue)
-  // log.Printf("bodySrc value type %s", bodySrcValue.Type().String())
-  // log.Printf("bodySrc value kind %s", bodySrcValue.Kind().String())
-
-  bodySrcLimitedReader := bodySrcLimitedReaderPtr.Elem()
-  // log.Printf("bodySrc value2 %#v", bodySrcValue2)
-  // log.Printf("bodySrc value2 type %s", bodySrcValue2.Type().String())
-  // log.Printf("bodySrc value2 kind %s", bodySrcValue2.Kind().String())
-
-  bodyReader := bodySrcLimitedReader.FieldByName("R")
-  // log.Printf("bodyReader %#v", bodyReader)
-  // log.Printf("bodyReader type %s", bodyReader.Type().String())
-  // log.Printf("bodyReader kind %s", bodyReader.Kind().String())
-
-  bufioReaderPtr := bodyReader.Elem()
-  // log.Printf("bufioReaderPtr %#v", bufioReaderPtr)
-  // log.Printf("bufioReaderPtr type %s", bufioReaderPtr.Type().String())
-  // log.Printf("bufioReaderPtr kind %s", bufioReaderPtr.Kind().String())
-
-  bufioReader := bufioReaderPtr.Elem()
-  // log.Printf("bufioReader %#v", bufioReader)
-  // log.Printf("bufioReader type %s", bufioReader.Type().String())
-  // log.Printf("bufioReader kind %s", bufioReader.Kind().String())
-
-  // need to clear the bufioReader.buf []byte buffer
-
-  bufioBuf := bufioReader.FieldByName("buf")
-
-  bufioBufSlice := bufioBuf.Bytes()
-
-  // log.Printf("slice before: %#v", bufioBufSlice)
-
-  zeroBuffer(bufioBufSlice)
-
-  // log.Printf("slice after: %#v", bufioBufSlice)
-
-  // drilling further...
-
-  // bufioRd := bufioReader.FieldByName("rd")
-  // log.Printf("bufioRd %#v", bufioRd)
-  // log.Printf("bufioRd type %s", bufioRd.Type().String())
-  // log.Printf("bufioRd kind %s", bufioRd.Kind().String())
-  //
-  // bufioRdLimitedPtr := bufioRd.Elem()
-  // log.Printf("bufioRd value %#v", bufioRdLimitedPtr)
-  // log.Printf("bufioRd value type %s", bufioRdLimitedPtr.Type().String())
-  // log.Printf("bufioRd value kind %s", bufioRdLimitedPtr.Kind().String())
-  //
-  // bufioRdLimited := bufioRdLimitedPtr.Elem()
-  // log.Printf("bufioRdLimited value %#v", bufioRdLimited)
-  // log.Printf("bufioRdLimited value type %s", bufioRdLimited.Type().String())
-  // log.Printf("bufioRdLimited value kind %s", bufioRdLimited.Kind().String())
-  //
-  // bufioRdLimitedSrcInt := bufioRdLimited.FieldByName("R")
-  // log.Printf("bufioRdLimitedSrcInt %#v", bufioRdLimitedSrcInt)
-  // log.Printf("bufioRdLimitedSrcInt type %s", bufioRdLimitedSrcInt.Type().String())
-  // log.Printf("bufioRdLimitedSrcInt kind %s", bufioRdLimitedSrcInt.Kind().String())
-  //
-  // bufioRdLimitedSrc := bufioRdLimitedSrcInt.Elem()
-  // log.Printf("bufioRdLimitedSrc %#v", bufioRdLimitedSrc)
-  // log.Printf("bufioRdLimitedSrc type %s", bufioRdLimitedSrc.Type().String())
-  // log.Printf("bufioRdLimitedSrc kind %s", bufioRdLimitedSrc.Kind().String())
-  //
-  // httpLiveSwitchReader := bufioRdLimitedSrc.Elem()
-  // log.Printf("httpLiveSwitchReader %#v", httpLiveSwitchReader)
-  // log.Printf("httpLiveSwitchReader type %s", httpLiveSwitchReader.Type().String())
-  // log.Printf("httpLiveSwitchReader kind %s", httpLiveSwitchReader.Kind().String())
-  //
-  // httpLiveSwitchReaderR := httpLiveSwitchReader.FieldByName("r")
-  // log.Printf("httpLiveSwitchReaderR %#v", httpLiveSwitchReaderR)
-  // log.Printf("httpLiveSwitchReaderR type %s", httpLiveSwitchReaderR.Type().String())
-  // log.Printf("httpLiveSwitchReaderR kind %s", httpLiveSwitchReaderR.Kind().String())
-  //
-  // httpLiveSwitchReaderRValue := httpLiveSwitchReaderR.Elem()
-  // log.Printf("httpLiveSwitchReaderRValue %#v", httpLiveSwitchReaderRValue)
-  // log.Printf("httpLiveSwitchReaderRValue type %s", httpLiveSwitchReaderRValue.Type().String())
-  // log.Printf("httpLiveSwitchReaderRValue kind %s", httpLiveSwitchReaderRValue.Kind().String())
-  //
-  // tcpConn := httpLiveSwitchReaderRValue.Elem()
-  // log.Printf("tcpConn %#v", tcpConn)
-  // log.Printf("tcpConn type %s", tcpConn.Type().String())
-  // log.Printf("tcpConn kind %s", tcpConn.Kind().String())
-  //
-  // // typeOfTcpConn := tcpConn.Type()
-  // // for i := 0; i < tcpConn.NumField(); i++ {
-  // //     f := tcpConn.Field(i)
-  // //     log.Printf("%d: %s %s\n", i, typeOfTcpConn.Field(i).Name, f.Type())
-  // // }
-  //
-  // netConn := tcpConn.FieldByName("conn")
-  // log.Printf("netConn %#v", netConn)
-  // log.Printf("netConn type %s", netConn.Type().String())
-  // log.Printf("netConn kind %s", netConn.Kind().String())
-  //
-  // netConnFdPtr := netConn.FieldByName("fd")
-  // log.Printf("netConnFdPtr %#v", netConnFdPtr)
-  // log.Printf("netConnFdPtr type %s", netConnFdPtr.Type().String())
-  // log.Printf("netConnFdPtr kind %s", netConnFdPtr.Kind().String())
-  //
-  // netConnFd := netConnFdPtr.Elem()
-  // log.Printf("netConnFd %#v", netConnFd)
-  // log.Printf("netConnFd type %s", netConnFd.Type().String())
-  // log.Printf("netConnFd kind %s", netConnFd.Kind().String())
-  //
-  // // I think this is the bottom...
-  //
-  // // type netFD struct {
-  // //   // locking/lifetime of sysfd + serialize access to Read and Write methods
-  // //   fdmu fdMutex
-  // //
-  // //   // immutable until Close
-  // //   sysfd       int
-  // //   family      int
-  // //   sotype      int
-  // //   isConnected bool
-  // //   net         string
-  // //   laddr       Addr
-  // //   raddr       Addr
-  // //
-  // //   // wait server
-  // //   pd pollDesc
-  // // }
-  // //
-}
-
-func zeroResponseBuffer(response http.ResponseWriter) {
-  responseWriter := reflect.ValueOf(response).Elem()
-  // log.Printf("responseWriter %#v", responseWriter)
-  // log.Printf("responseWriter type %s", responseWriter.Type().String())
-  // log.Printf("responseWriter kind %s", responseWriter.Kind().String())
-
-  bufioWriterPtr := responseWriter.FieldByName("w")
-  // log.Printf("bufioWriterPtr %#v", bufioWriterPtr)
-  // log.Printf("bufioWriterPtr type %s", bufioWriterPtr.Type().String())
-  // log.Printf("bufioWriterPtr kind %s", bufioWriterPtr.Kind().String())
-
-  // Force a flush!
-
-  bufioWriterPtrForRealz := (*bufio.Writer)((unsafe.Pointer)(bufioWriterPtr.Pointer()))
-  bufioWriterPtrForRealz.Flush()
-
-  // Clear the buffer
-
-  bufioWriter := bufioWriterPtr.Elem()
-  // log.Printf("bufioWriter %#v", bufioWriter)
-  // log.Printf("bufioWriter type %s", bufioWriter.Type().String())
-  // log.Printf("bufioWriter kind %s", bufioWriter.Kind().String())
-
-  bufioBuf := bufioWriter.FieldByName("buf")
-
-  bufioBufSlice := bufioBuf.Bytes()
-
-  zeroBuffer(bufioBufSlice)
-
-  // httpChunkWriterPtr := bufioWriter.FieldByName("wr").Elem()
-  // log.Printf("httpChunkWriterPtr %#v", httpChunkWriterPtr)
-  // log.Printf("httpChunkWriterPtr type %s", httpChunkWriterPtr.Type().String())
-  // log.Printf("httpChunkWriterPtr kind %s", httpChunkWriterPtr.Kind().String())
-
-  // httpChunkWriter := httpChunkWriterPtr.Elem()
-  // log.Printf("httpChunkWriter %#v", httpChunkWriter)
-  // log.Printf("httpChunkWriter type %s", httpChunkWriter.Type().String())
-  // log.Printf("httpChunkWriter kind %s", httpChunkWriter.Kind().String())
-
-  conn := responseWriter.FieldByName("conn").Elem()
-  connBufioReadWriter := conn.FieldByName("buf").Elem()
-  connBufioWriterPtr := connBufioReadWriter.FieldByName("Writer")
-
-  // Flush conn's buffered io
-
-  connBufioWriterPtrForRealz := (*bufio.Writer)((unsafe.Pointer)(connBufioWriterPtr.Pointer()))
-  connBufioWriterPtrForRealz.Flush()
-
-  // Clear conn's buffer
-
-  connBufioWriter := connBufioWriterPtr.Elem()
-
-  connBufioWriterBuf := connBufioWriter.FieldByName("buf")
-
-  connBufioWriterBufSlice := connBufioWriterBuf.Bytes()
-
-  zeroBuffer(connBufioWriterBufSlice)
+  response.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+  return retryAfter
+}
+
+func respondCodeLockedOut(response http.ResponseWriter, lockedUntil time.Time) {
+  retryAfter := setRetryAfter(response, lockedUntil.Sub(time.Now()))
+  respondError(response, http.StatusTooManyRequests, "code_locked_out", "Too many wrong codes. Status checks are locked for " + strconv.Itoa(retryAfter) + " seconds.") // 429
+}
+
+// Without a lockout the code could be guessed, so the check is refused.
+func respondAttemptsNotRecorded(response http.ResponseWriter) {
+  respondError(response, http.StatusServiceUnavailable, "attempts_not_recorded", "Code checks are unavailable right now. Try again shortly.") // 503
+}
+
+func respondProofOfWorkRequired(response http.ResponseWriter, challenge string, difficulty int) {
+  response.Header().Set("X-Pow-Challenge", challenge)
+  response.Header().Set("X-Pow-Difficulty", strconv.Itoa(difficulty))
+  respondJSON(response, http.StatusPreconditionRequired, proofOfWorkBody{
+    ErrorType: "proof_of_work_required",
+    ErrorMessage: "Secret storage is nearly full. Find a nonce where sha256(challenge + \":\" + nonce) starts with " + strconv.Itoa(difficulty) + " zero bits and resend with X-Pow-Challenge and X-Pow-Nonce headers.",
+    Challenge: challenge,
+    Difficulty: difficulty,
+  }) // 428
+}
+
+func respondStorageFull(response http.ResponseWriter) {
+  respondError(response, 507, "storage_full", "Sorry, server secret storage is full right now. Try again later.") // 507 Insufficient Storage
+}
+
+func respondNoteAlreadyAccessed(response http.ResponseWriter) {
+  respondError(response, http.StatusForbidden, "note_already_accessed", "This note has already been opened.") // 403
+}
+
+func respondNoteExpired(response http.ResponseWriter) {
+  respondError(response, http.StatusGone, "note_expired", "This note expired before it was opened.") // 410
+}
+
+func respondNoteNotFound(response http.ResponseWriter) {
+  respondError(response, http.StatusNotFound, "note_not_found", "No note with that ID (and code, if given) was found.") // 404
+}
+
+func respondNotFound(response http.ResponseWriter) {
+  respondError(response, http.StatusNotFound, "not_found", "No such endpoint.") // 404
+}
+
+func respondMethodNotAllowed(response http.ResponseWriter) {
+  respondError(response, http.StatusMethodNotAllowed, "method_not_allowed", "That method is not allowed on this endpoint.") // 405
+}
+
+func respondInvalidRequest(response http.ResponseWriter, errorMessage string) {
+  respondError(response, http.StatusBadRequest, "invalid_request", errorMessage) // 400
+}
+
+func respondInternalError(response http.ResponseWriter) {
+  respondError(response, http.StatusInternalServerError, "internal_error", "Something went wrong on our end.") // 500
 }
 
 func zeroBuffer(buf []byte) {
@@ -0,0 +1,203 @@
+package main
+
+import (
+  "errors"
+  "github.com/brianhempel/sneakynote.com/logs"
+  "log/slog"
+  "net"
+  "net/http"
+  "os"
+  "os/exec"
+  "os/signal"
+  "strconv"
+  "strings"
+  "syscall"
+  "time"
+)
+
+// Upgrades without dropping connections. On SIGUSR2 the server execs its
+// binary again, handing over the listening sockets, and once the new
+// process says it is serving, the old one drains and exits (see Shutdown).
+// The ramdisk store is shared, so notes carry over. If the new process
+// fails to start, the old one carries on serving.
+//
+// The sockets are passed as extra files, fd 3 onward, named in
+// SNEAKYNOTE_LISTENERS. The file after them is a pipe the new process
+// writes to when it is ready, and the one after that a pipe holding the
+// proof of work key, so challenges already issued still check out.
+
+const (
+  inheritedListenersEnv = "SNEAKYNOTE_LISTENERS"
+  handoffReadyTimeout = time.Minute
+)
+
+var (
+  // In the order they were opened, for handing off.
+  listenerNames []string
+  listenerFiles = map[string]*os.File{}
+
+  readyPipe *os.File
+)
+
+var inheritedListeners = takeInheritedListeners()
+
+// Takes the sockets from the old process, if this is a handoff.
+func takeInheritedListeners() map[string]*os.File {
+  names := os.Getenv(inheritedListenersEnv)
+  if names == "" {
+    return nil
+  }
+  os.Unsetenv(inheritedListenersEnv)
+
+  inherited := map[string]*os.File{}
+  nameList := strings.Split(names, ",")
+  for i, name := range nameList {
+    inherited[name] = os.NewFile(uintptr(3 + i), name)
+  }
+  readyPipe = os.NewFile(uintptr(3 + len(nameList)), "ready")
+  inheritedProofOfWorkKey = readInheritedProofOfWorkKey(os.NewFile(uintptr(4 + len(nameList)), "proof of work key"))
+  return inherited
+}
+
+// Listens on address, or takes over the socket of the same name from the
+// old process.
+func Listen(name string, address string) (net.Listener, error) {
+  var listener net.Listener
+  var err error
+
+  if file, ok := inheritedListeners[name]; ok {
+    delete(inheritedListeners, name)
+    listener, err = net.FileListener(file)
+    file.Close()
+    if err == nil {
+      slog.Info("Took over listener", "name", name, "address", listener.Addr().String())
+    }
+  } else {
+    listener, err = net.Listen("tcp", address)
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  tcpListener, ok := listener.(*net.TCPListener)
+  if !ok {
+    return nil, errors.New("Can't hand off a non-TCP listener")
+  }
+  // A dup, so it stays open for the handoff whatever the server does.
+  file, err := tcpListener.File()
+  if err != nil {
+    listener.Close()
+    return nil, err
+  }
+
+  // Listening again under a name replaces the old socket.
+  if oldFile, ok := listenerFiles[name]; ok {
+    oldFile.Close()
+  } else {
+    listenerNames = append(listenerNames, name)
+  }
+  listenerFiles[name] = file
+  return listener, nil
+}
+
+// Tells the old process, if any, to start draining.
+func SignalReady() {
+  if readyPipe == nil {
+    return
+  }
+  readyPipe.Write([]byte{1})
+  readyPipe.Close()
+  readyPipe = nil
+}
+
+// On SIGUSR2, hands off to a new process and shuts the servers down.
+func HandOffOnSignal(servers ...*http.Server) {
+  signalChan := make(chan os.Signal, 1)
+  signal.Notify(signalChan, syscall.SIGUSR2)
+  go func() {
+    handedOff := false
+    for range signalChan {
+      // Still caught, since by default SIGUSR2 would end the drain early.
+      if handedOff {
+        slog.Warn("Received SIGUSR2, but already handed off")
+        continue
+      }
+
+      slog.Info("Received SIGUSR2, handing off to a new process")
+      process, err := HandOff(os.Args[1:]...)
+      if err != nil {
+        slog.Error("Handoff failed, still serving", logs.Err(err))
+        continue
+      }
+      slog.Info("Handed off", "pid", process.Pid)
+      handedOff = true
+      go Shutdown(servers...)
+    }
+  }()
+}
+
+// Execs this binary with args and the listening sockets, and waits for it
+// to be ready.
+func HandOff(args ...string) (*os.Process, error) {
+  executable, err := os.Executable()
+  if err != nil {
+    return nil, err
+  }
+
+  readyReader, readyWriter, err := os.Pipe()
+  if err != nil {
+    return nil, err
+  }
+  defer readyReader.Close()
+
+  keyReader, err := proofOfWorkKeyPipe()
+  if err != nil {
+    readyWriter.Close()
+    return nil, err
+  }
+  defer keyReader.Close()
+
+  command := exec.Command(executable, args...)
+  command.Stdin = os.Stdin
+  command.Stdout = os.Stdout
+  command.Stderr = os.Stderr
+  for _, name := range listenerNames {
+    command.ExtraFiles = append(command.ExtraFiles, listenerFiles[name])
+  }
+  command.ExtraFiles = append(command.ExtraFiles, readyWriter, keyReader)
+
+  for _, variable := range os.Environ() {
+    if !strings.HasPrefix(variable, inheritedListenersEnv + "=") {
+      command.Env = append(command.Env, variable)
+    }
+  }
+  command.Env = append(command.Env, inheritedListenersEnv + "=" + strings.Join(listenerNames, ","))
+
+  err = command.Start()
+  readyWriter.Close()
+  if err != nil {
+    return nil, err
+  }
+
+  // Reads a byte when the new process is ready, or EOF if it dies first.
+  ready := make(chan bool, 1)
+  go func() {
+    buf := make([]byte, 1)
+    n, _ := readyReader.Read(buf)
+    ready <- n == 1
+  }()
+
+  select {
+  case ok := <-ready:
+    if ok {
+      go command.Wait()
+      return command.Process, nil
+    }
+    command.Wait()
+    return nil, errors.New("New process exited before it was ready: " + command.ProcessState.String())
+  case <-time.After(handoffReadyTimeout):
+    command.Process.Kill()
+    command.Wait()
+    return nil, errors.New("New process wasn't ready within " + strconv.Itoa(int(handoffReadyTimeout.Seconds())) + " seconds")
+  }
+}
@@ -0,0 +1,176 @@
+package main_test
+
+import (
+  "fmt"
+  "github.com/brianhempel/sneakynote.com"
+  "github.com/brianhempel/sneakynote.com/client"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "strconv"
+  "strings"
+  "testing"
+  "time"
+)
+
+func servingPid(t *testing.T, url string) int {
+  // A new connection each time, so it's accepted by whoever is listening now.
+  client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+  response, err := client.Get(url)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer response.Body.Close()
+  body, _ := ioutil.ReadAll(response.Body)
+  pid, _ := strconv.Atoi(string(body))
+  return pid
+}
+
+// Keeps the new process's test output out of this one's.
+func handOffQuietly(args ...string) (*os.Process, error) {
+  stdout, stderr := os.Stdout, os.Stderr
+  devNull, _ := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+  os.Stdout, os.Stderr = devNull, devNull
+  defer func() {
+    os.Stdout, os.Stderr = stdout, stderr
+    devNull.Close()
+  }()
+  return main.HandOff(args...)
+}
+
+func pidHandler() http.Handler {
+  return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+    fmt.Fprint(response, os.Getpid())
+  })
+}
+
+// The new process in TestHandOff.
+func TestHandOffChild(t *testing.T) {
+  if os.Getenv("SNEAKYNOTE_HANDOFF_TEST") == "" {
+    t.Skip("Run by TestHandOff")
+  }
+
+  listener, err := main.Listen("main", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  go http.Serve(listener, pidHandler())
+  main.SignalReady()
+
+  // Killed by the parent test well before this.
+  time.Sleep(10 * time.Second)
+}
+
+func TestHandOff(t *testing.T) {
+  os.Setenv("SNEAKYNOTE_HANDOFF_TEST", "true")
+  defer os.Unsetenv("SNEAKYNOTE_HANDOFF_TEST")
+  defer main.StopDraining()
+
+  listener, err := main.Listen("main", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  server := &http.Server{Handler: pidHandler()}
+  go server.Serve(listener)
+  url := "http://" + listener.Addr().String() + "/"
+
+  if pid := servingPid(t, url); pid != os.Getpid() {
+    t.Fatalf("Expected this process serving, got %d", pid)
+  }
+
+  process, err := handOffQuietly("-test.run=^TestHandOffChild$")
+  if err != nil {
+    t.Fatal("Error on HandOff:", err)
+  }
+  defer process.Kill()
+
+  main.Shutdown(server)
+
+  for i := 0; i < 3; i++ {
+    if pid := servingPid(t, url); pid != process.Pid {
+      t.Errorf("Expected the new process %d serving on the same socket, got %d", process.Pid, pid)
+    }
+  }
+}
+
+func TestHandOffNewProcessNotReady(t *testing.T) {
+  _, err := handOffQuietly("-test.run=^$")
+  if err == nil {
+    t.Error("Expected an error when the new process exits without signaling ready")
+  }
+}
+
+// The new process in TestHandOffKeepsProofOfWorkKey.
+func TestHandOffProofOfWorkChild(t *testing.T) {
+  if os.Getenv("SNEAKYNOTE_HANDOFF_TEST") == "" {
+    t.Skip("Run by TestHandOffKeepsProofOfWorkKey")
+  }
+
+  main.OpenStore()
+  main.ConfigureProofOfWork()
+  listener, err := main.Listen("main", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  go http.Serve(listener, main.Handlers())
+  main.SignalReady()
+
+  time.Sleep(10 * time.Second)
+}
+
+func TestHandOffKeepsProofOfWorkKey(t *testing.T) {
+  os.Setenv("SNEAKYNOTE_HANDOFF_TEST", "true")
+  defer os.Unsetenv("SNEAKYNOTE_HANDOFF_TEST")
+  defer main.StopDraining()
+  main.SetupStore()
+  defer main.TeardownStore()
+  defer withProofOfWork()()
+
+  listener, err := main.Listen("main", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  server := &http.Server{Handler: main.Handlers()}
+  go server.Serve(listener)
+  notesURL := "http://" + listener.Addr().String() + "/notes/"
+
+  // A new connection each time, so whoever is listening now answers.
+  httpClient := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+  post := func(id string, challenge string, nonce string) *http.Response {
+    request, _ := http.NewRequest("POST", notesURL + id, strings.NewReader("this is my secret"))
+    request.Header.Set("X-Pow-Challenge", challenge)
+    request.Header.Set("X-Pow-Nonce", nonce)
+    response, err := httpClient.Do(request)
+    if err != nil {
+      t.Fatal(err)
+    }
+    response.Body.Close()
+    return response
+  }
+  solve := func(id string) (string, string) {
+    response := post(id, "", "")
+    challenge := response.Header.Get("X-Pow-Challenge")
+    difficulty, _ := strconv.Atoi(response.Header.Get("X-Pow-Difficulty"))
+    return challenge, client.SolveProofOfWork(challenge, difficulty)
+  }
+
+  spentChallenge, spentNonce := solve("3bd5ff31-2a37-4b6f-9a0c-5d39e9a4c0a1")
+  if response := post("3bd5ff31-2a37-4b6f-9a0c-5d39e9a4c0a1", spentChallenge, spentNonce); response.StatusCode != 201 {
+    t.Fatalf("Expected the old process to accept its challenge, got %d", response.StatusCode)
+  }
+  challenge, nonce := solve("fc2a4122-e81e-4b10-a31b-d79fbdb33a27")
+
+  process, err := handOffQuietly("-test.run=^TestHandOffProofOfWorkChild$")
+  if err != nil {
+    t.Fatal("Error on HandOff:", err)
+  }
+  defer process.Kill()
+  main.Shutdown(server)
+
+  if response := post("fc2a4122-e81e-4b10-a31b-d79fbdb33a27", challenge, nonce); response.StatusCode != 201 {
+    t.Errorf("Expected the new process to accept the old one's challenge, got %d", response.StatusCode)
+  }
+  if response := post("3bd5ff31-2a37-4b6f-9a0c-5d39e9a4c0a1", spentChallenge, spentNonce); response.StatusCode != 428 {
+    t.Errorf("Expected the new process to refuse a challenge spent on the old one, got %d", response.StatusCode)
+  }
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+  "github.com/brianhempel/sneakynote.com/logs"
+  "log/slog"
+  "net/http"
+  "sync/atomic"
+  "time"
+)
+
+// /healthz answers whenever the process is serving, for restarting it if it
+// stops. /readyz answers 200 only while the server can take notes, for
+// sending traffic elsewhere when it can't.
+//
+// The server isn't ready until the store has passed a self check at boot:
+// throwaway notes saved, opened and swept in a scratch store. See
+// store_health.go. Nor, on a handoff, is the old process told to hand over
+// until then.
+
+const (
+  healthzURLPath = "/healthz"
+  readyzURLPath = "/readyz"
+
+  // The sweeper sweeps every minute.
+  sweeperStaleAfter = 3 * time.Minute
+  selfCheckRetry = 10 * time.Second
+)
+
+var (
+  selfCheckPassed int32 = 0
+)
+
+type readiness struct {
+  Ready bool `json:"ready"`
+  // "ok" or what's wrong, per check.
+  Checks map[string]string `json:"checks"`
+}
+
+// Retries until the self check passes, then signals ready. If it hasn't
+// passed within handoffReadyTimeout, the old process keeps serving.
+func StartSelfCheck() {
+  go func() {
+    for RunSelfCheck() != nil {
+      time.Sleep(selfCheckRetry)
+    }
+    SignalReady()
+  }()
+}
+
+func RunSelfCheck() error {
+  err := mainStore.SelfCheck()
+  if err != nil {
+    slog.Error("Store self check failed, not ready", logs.Err(err))
+    return err
+  }
+  atomic.StoreInt32(&selfCheckPassed, 1)
+  slog.Info("Store self check passed, ready")
+  return nil
+}
+
+// For tests.
+func ForgetSelfCheck() {
+  atomic.StoreInt32(&selfCheckPassed, 0)
+}
+
+func healthz(response http.ResponseWriter, request *http.Request) {
+  response.Header().Set("Cache-Control", "no-store")
+  respondJSON(response, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func readyz(response http.ResponseWriter, request *http.Request) {
+  response.Header().Set("Cache-Control", "no-store")
+
+  result := checkReadiness()
+  if result.Ready {
+    respondJSON(response, http.StatusOK, result)
+  } else {
+    respondJSON(response, http.StatusServiceUnavailable, result)
+  }
+}
+
+func checkReadiness() readiness {
+  checks := map[string]string{
+    "self_check": "ok",
+    "store": "ok",
+    "memory": "ok",
+    "sweeper": "ok",
+    "draining": "ok",
+    "maintenance": "ok",
+  }
+
+  if atomic.LoadInt32(&selfCheckPassed) == 0 {
+    checks["self_check"] = "not passed yet"
+  }
+
+  if mainStore == nil {
+    checks["store"] = "no store"
+    checks["memory"] = "no store"
+    checks["sweeper"] = "no store"
+  } else {
+    if err := mainStore.CheckFolders(); err != nil {
+      checks["store"] = err.Error()
+    }
+    if mainStore.AvailableMemory() <= 0 {
+      checks["memory"] = "at or below headroom"
+    }
+    if lastSweep := mainStore.LastSweep(); lastSweep.IsZero() {
+      checks["sweeper"] = "hasn't swept yet"
+    } else if time.Since(lastSweep) > sweeperStaleAfter || SweeperBehind() {
+      checks["sweeper"] = "last swept " + time.Since(lastSweep).Round(time.Second).String() + " ago"
+    }
+  }
+
+  if Draining() {
+    checks["draining"] = "shutting down"
+  }
+  if mainStore != nil && inMaintenance() {
+    checks["maintenance"] = "not taking new notes"
+  }
+
+  ready := true
+  for _, result := range checks {
+    if result != "ok" {
+      ready = false
+    }
+  }
+  return readiness{Ready: ready, Checks: checks}
+}
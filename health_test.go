@@ -0,0 +1,98 @@
+package main_test
+
+import (
+  "encoding/json"
+  "github.com/brianhempel/sneakynote.com"
+  "github.com/brianhempel/sneakynote.com/store"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "strings"
+  "testing"
+  "time"
+)
+
+type readiness struct {
+  Ready bool `json:"ready"`
+  Checks map[string]string `json:"checks"`
+}
+
+func getReadiness(t *testing.T, url string) (int, readiness) {
+  response, err := http.Get(url + "/readyz")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer response.Body.Close()
+
+  result := readiness{}
+  if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+    t.Fatal("Error decoding readiness:", err)
+  }
+  return response.StatusCode, result
+}
+
+func TestHealthz(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+
+  response, err := http.Get(testServer.URL + "/healthz")
+  if err != nil {
+    t.Fatal(err)
+  }
+  response.Body.Close()
+  if response.StatusCode != http.StatusOK {
+    t.Errorf("Expected 200 for healthz, got %d", response.StatusCode)
+  }
+}
+
+func TestReadyz(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+  defer main.ForgetSelfCheck()
+
+  status, result := getReadiness(t, testServer.URL)
+  if status != http.StatusServiceUnavailable || result.Ready {
+    t.Errorf("Expected not ready before the self check and a sweep, got %d %v", status, result)
+  }
+  if result.Checks["self_check"] == "ok" || result.Checks["sweeper"] == "ok" || result.Checks["store"] != "ok" {
+    t.Errorf("Expected the self check and sweeper not ok, got %v", result.Checks)
+  }
+
+  if err := main.RunSelfCheck(); err != nil {
+    t.Fatal("Self check failed:", err)
+  }
+  main.StartSweeper()
+  defer main.StopSweeper()
+
+  deadline := time.Now().Add(5 * time.Second)
+  for !result.Ready && time.Now().Before(deadline) {
+    time.Sleep(10 * time.Millisecond)
+    status, result = getReadiness(t, testServer.URL)
+  }
+  if status != http.StatusOK || !result.Ready {
+    t.Fatalf("Expected ready after the self check and a sweep, got %d %v", status, result)
+  }
+
+  main.StartDraining()
+  status, result = getReadiness(t, testServer.URL)
+  main.StopDraining()
+  if status != http.StatusServiceUnavailable || result.Checks["draining"] == "ok" {
+    t.Errorf("Expected not ready while draining, got %d %v", status, result)
+  }
+}
+
+func TestReadyzMissingStoreFolder(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  os.RemoveAll(store.Get().ExpiringPath)
+
+  status, result := getReadiness(t, testServer.URL)
+  if status != http.StatusServiceUnavailable || !strings.Contains(result.Checks["store"], "expiring") {
+    t.Errorf("Expected the missing expiring folder named, got %d %v", status, result)
+  }
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+  "bytes"
+  "compress/gzip"
+  "crypto/sha256"
+  _ "embed"
+  "encoding/base64"
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "github.com/brianhempel/sneakynote.com/logs"
+  "io"
+  "io/ioutil"
+  "log/slog"
+  "net/http"
+  "os"
+  "path"
+  "sort"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// The send and get pages hold all the cryptography, so they are pinned:
+// integrity_manifest.json records the SHA-256 of each, and the server won't
+// start if the files on disk differ, nor serve a pinned page that has changed
+// since. Pinned pages are served from the bytes that were checked, so a file
+// swapped in after the check isn't served either. Their .gz files are checked
+// by what they decompress to, whether served for the page or asked for by
+// name. The manifest is published at /.well-known/sneakynote-integrity.json
+// for auditors and browser extensions to compare against what they receive.
+//
+// The manifest is built into the binary, so whoever can change the pages on
+// disk can't change their pins too. After changing a pinned page, run
+// ./sneakynote.com pin, commit the manifest with it, and rebuild.
+
+const (
+  integrityManifestURLPath = "/.well-known/sneakynote-integrity.json"
+)
+
+//go:embed integrity_manifest.json
+var embeddedIntegrityManifest []byte
+
+var (
+  defaultPinnedAssets = []string{"/send", "/get"}
+
+  // Nil when integrity checking is off.
+  integrityManifest *IntegrityManifest
+  integrityManifestJSON []byte
+
+  pinnedAssetsMutex sync.Mutex
+  pinnedAssetsCache = map[string]*pinnedAsset{}
+
+  AssetModified = errors.New("Asset does not match the integrity manifest")
+)
+
+type IntegrityManifest struct {
+  Version int `json:"version"`
+  // URL path to "sha256-" and the base64 hash, as in Subresource Integrity.
+  Assets map[string]string `json:"assets"`
+}
+
+// Verified contents of a pinned file, good while its modification time and
+// size are unchanged.
+type pinnedAsset struct {
+  modTime time.Time
+  size int64
+  content []byte
+}
+
+func integrityManifestPath() string {
+  return path.Join(projectPath(), "integrity_manifest.json")
+}
+
+// Reads SNEAKYNOTE_INTEGRITY ("off" to disable, for development) and
+// checks every pinned asset against the built-in manifest, exiting if any
+// has been modified.
+func ConfigureIntegrity() {
+  if os.Getenv("SNEAKYNOTE_INTEGRITY") == "off" {
+    slog.Warn("Integrity checking is off, pinned assets are served unchecked")
+    DisableIntegrity()
+    return
+  }
+
+  err := LoadIntegrityManifest(embeddedIntegrityManifest)
+  if err != nil {
+    logs.Fatal("Loading integrity manifest", logs.Err(err))
+  }
+
+  failed := false
+  for _, urlPath := range integrityManifest.sortedPaths() {
+    for _, filePath := range []string{publicFilePath(urlPath), publicFilePath(urlPath) + ".gz"} {
+      _, err := verifiedAsset(urlPath, filePath)
+      if err != nil && !(os.IsNotExist(err) && strings.HasSuffix(filePath, ".gz")) {
+        slog.Error("Pinned asset changed", "path", filePath, logs.Err(err))
+        failed = true
+      }
+    }
+  }
+  if failed {
+    logs.Fatal("Refusing to serve modified assets. If the change is intended, run ./sneakynote.com pin and rebuild")
+  }
+
+  slog.Info("Verified pinned assets", "count", len(integrityManifest.Assets))
+}
+
+func LoadIntegrityManifest(manifestJSON []byte) error {
+  manifest := &IntegrityManifest{}
+  err := json.Unmarshal(manifestJSON, manifest)
+  if err != nil {
+    return err
+  }
+  if manifest.Version != 1 || len(manifest.Assets) == 0 {
+    return errors.New("Integrity manifest must be version 1 and pin at least one asset")
+  }
+
+  pinnedAssetsMutex.Lock()
+  pinnedAssetsCache = map[string]*pinnedAsset{}
+  pinnedAssetsMutex.Unlock()
+
+  integrityManifest = manifest
+  integrityManifestJSON = manifestJSON
+  return nil
+}
+
+func DisableIntegrity() {
+  integrityManifest = nil
+  integrityManifestJSON = nil
+}
+
+func (m *IntegrityManifest) sortedPaths() []string {
+  var urlPaths []string
+  for urlPath := range m.Assets {
+    urlPaths = append(urlPaths, urlPath)
+  }
+  sort.Strings(urlPaths)
+  return urlPaths
+}
+
+func integrityHash(content []byte) string {
+  sum := sha256.Sum256(content)
+  return "sha256-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Reads and checks filePath against the pin for urlPath. A .gz file is
+// checked by what it decompresses to.
+func verifiedAsset(urlPath string, filePath string) (*pinnedAsset, error) {
+  fileInfo, err := os.Stat(filePath)
+  if err != nil {
+    return nil, err
+  }
+
+  pinnedAssetsMutex.Lock()
+  cached := pinnedAssetsCache[filePath]
+  pinnedAssetsMutex.Unlock()
+
+  if cached != nil && cached.modTime.Equal(fileInfo.ModTime()) && cached.size == fileInfo.Size() {
+    return cached, nil
+  }
+
+  content, err := ioutil.ReadFile(filePath)
+  if err != nil {
+    return nil, err
+  }
+
+  plain := content
+  if strings.HasSuffix(filePath, ".gz") {
+    reader, err := gzip.NewReader(bytes.NewReader(content))
+    if err != nil {
+      return nil, err
+    }
+    plain, err = ioutil.ReadAll(reader)
+    if err != nil {
+      return nil, err
+    }
+  }
+
+  if integrityHash(plain) != integrityManifest.Assets[urlPath] {
+    return nil, AssetModified
+  }
+
+  asset := &pinnedAsset{modTime: fileInfo.ModTime(), size: fileInfo.Size(), content: content}
+
+  pinnedAssetsMutex.Lock()
+  pinnedAssetsCache[filePath] = asset
+  pinnedAssetsMutex.Unlock()
+
+  return asset, nil
+}
+
+// The pinned URL path whose file urlPath would be served from, and that
+// file, or "" if it isn't pinned. Matching by file catches a pinned page's
+// .gz asked for by name, and the page under any other name the filesystem
+// gives it.
+func pinnedAssetFor(urlPath string) (string, string) {
+  if integrityManifest.Assets[urlPath] != "" {
+    return urlPath, publicFilePath(urlPath)
+  }
+
+  filePath := publicFilePath(urlPath)
+  fileInfo, err := os.Stat(filePath)
+  if err != nil {
+    return "", ""
+  }
+  for _, pinnedPath := range integrityManifest.sortedPaths() {
+    for _, pinnedFilePath := range []string{publicFilePath(pinnedPath), publicFilePath(pinnedPath) + ".gz"} {
+      if pinnedInfo, err := os.Stat(pinnedFilePath); err == nil && os.SameFile(fileInfo, pinnedInfo) {
+        return pinnedPath, pinnedFilePath
+      }
+    }
+  }
+  return "", ""
+}
+
+// Serves pinned assets from verified bytes, gzipped when there is a .gz the
+// way MaybeGzip does it, and refuses ones that no longer match. Everything
+// else goes to `original`.
+func ServePinnedAssets(original http.Handler) http.Handler {
+  return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+    if integrityManifest == nil {
+      original.ServeHTTP(response, request)
+      return
+    }
+
+    urlPath := path.Clean("/" + request.URL.Path)
+    pinnedPath, filePath := pinnedAssetFor(urlPath)
+    if pinnedPath == "" {
+      original.ServeHTTP(response, request)
+      return
+    }
+
+    // Unless the .gz was asked for by name, in which case it's served as is.
+    gzipped := false
+    if !strings.HasSuffix(filePath, ".gz") && strings.Contains(request.Header.Get("Accept-Encoding"), "gzip") {
+      if _, err := os.Stat(filePath + ".gz"); err == nil {
+        filePath += ".gz"
+        gzipped = true
+      }
+    }
+
+    asset, err := verifiedAsset(pinnedPath, filePath)
+    if os.IsNotExist(err) {
+      http.NotFound(response, request)
+      return
+    } else if err != nil {
+      slog.Error("Refusing to serve changed asset", "path", filePath, logs.Err(err))
+      http.Error(response, "This page failed its integrity check and is unavailable.", http.StatusServiceUnavailable)
+      return
+    }
+
+    if gzipped {
+      response.Header().Set("Content-Type", "text/html; charset=utf-8")
+      response.Header().Set("Content-Encoding", "gzip")
+    }
+    http.ServeContent(response, request, path.Base(urlPath), asset.modTime, bytes.NewReader(asset.content))
+  })
+}
+
+func integrityManifestHandler(response http.ResponseWriter, request *http.Request) {
+  atomic.AddUint64(&totalRequestCount, 1)
+
+  if integrityManifestJSON == nil {
+    http.NotFound(response, request)
+    return
+  }
+
+  response.Header().Set("Content-Type", "application/json")
+  response.Header().Set("Cache-Control", "no-cache")
+  response.Header().Set("Access-Control-Allow-Origin", "*")
+  response.Write(integrityManifestJSON)
+}
+
+// ./sneakynote.com pin [--manifest FILE] [PATH...]
+//
+// Records the current hashes of the pinned assets, or of the given URL
+// paths, in the integrity manifest. The server only uses the manifest it was
+// built with.
+func PinCommand(args []string, stdout io.Writer) error {
+  flags := flag.NewFlagSet("pin", flag.ContinueOnError)
+  manifestPath := flags.String("manifest", integrityManifestPath(), "manifest to write")
+  err := flags.Parse(args)
+  if err != nil {
+    return err
+  }
+
+  urlPaths := flags.Args()
+  if len(urlPaths) == 0 {
+    urlPaths = defaultPinnedAssets
+    if manifestJSON, err := ioutil.ReadFile(*manifestPath); err == nil {
+      existing := &IntegrityManifest{}
+      if json.Unmarshal(manifestJSON, existing) == nil && len(existing.Assets) > 0 {
+        urlPaths = existing.sortedPaths()
+      }
+    }
+  }
+
+  manifest := &IntegrityManifest{Version: 1, Assets: map[string]string{}}
+  for _, urlPath := range urlPaths {
+    urlPath = path.Clean("/" + urlPath)
+    content, err := ioutil.ReadFile(publicFilePath(urlPath))
+    if err != nil {
+      return err
+    }
+    manifest.Assets[urlPath] = integrityHash(content)
+    fmt.Fprintln(stdout, urlPath, manifest.Assets[urlPath])
+  }
+
+  manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+  if err != nil {
+    return err
+  }
+  err = ioutil.WriteFile(*manifestPath, append(manifestJSON, '\n'), 0644)
+  if err != nil {
+    return err
+  }
+  fmt.Fprintln(stdout, "Wrote", *manifestPath + ". Rebuild to build it in.")
+  return nil
+}
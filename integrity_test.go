@@ -0,0 +1,215 @@
+package main_test
+
+import (
+  "bytes"
+  "compress/gzip"
+  "encoding/json"
+  "github.com/brianhempel/sneakynote.com"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "testing"
+  "time"
+)
+
+const pinnedTestPage = "public/integrity_test_page"
+
+// Pins a test page and checks integrity against it.
+func withPinnedTestPage(t *testing.T, content string) func() {
+  writeTestPage(t, pinnedTestPage, []byte(content), time.Now().Add(-time.Minute))
+
+  err := main.PinCommand([]string{"--manifest", "/tmp/integrity_manifest.json", "/integrity_test_page"}, ioutil.Discard)
+  if err != nil {
+    t.Fatal("Error on PinCommand:", err)
+  }
+
+  manifestJSON, err := ioutil.ReadFile("/tmp/integrity_manifest.json")
+  if err != nil {
+    t.Fatal(err)
+  }
+  err = main.LoadIntegrityManifest(manifestJSON)
+  if err != nil {
+    t.Fatal("Error on LoadIntegrityManifest:", err)
+  }
+
+  return func() {
+    main.DisableIntegrity()
+    os.Remove("/tmp/integrity_manifest.json")
+    os.Remove(pinnedTestPage)
+    os.Remove(pinnedTestPage + ".gz")
+  }
+}
+
+func writeTestPage(t *testing.T, filePath string, content []byte, modTime time.Time) {
+  err := ioutil.WriteFile(filePath, content, 0644)
+  if err != nil {
+    t.Fatal(err)
+  }
+  os.Chtimes(filePath, modTime, modTime)
+}
+
+func gzipped(content string) []byte {
+  compressed := &bytes.Buffer{}
+  writer := gzip.NewWriter(compressed)
+  writer.Write([]byte(content))
+  writer.Close()
+  return compressed.Bytes()
+}
+
+func getTestPage(t *testing.T, url string, acceptEncoding string) (*http.Response, []byte) {
+  request, _ := http.NewRequest("GET", url + "/integrity_test_page", nil)
+  if acceptEncoding != "" {
+    request.Header.Set("Accept-Encoding", acceptEncoding)
+  }
+  response, err := http.DefaultClient.Do(request)
+  if err != nil {
+    t.Fatal(err)
+  }
+  body, _ := ioutil.ReadAll(response.Body)
+  response.Body.Close()
+  return response, body
+}
+
+func TestIntegrityManifestMatchesPublicPages(t *testing.T) {
+  manifestJSON, err := ioutil.ReadFile("integrity_manifest.json")
+  if err != nil {
+    t.Fatal(err)
+  }
+  err = main.LoadIntegrityManifest(manifestJSON)
+  if err != nil {
+    t.Fatal("Error on LoadIntegrityManifest:", err)
+  }
+  defer main.DisableIntegrity()
+
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+
+  for _, page := range []string{"/send", "/get"} {
+    response, err := http.Get(testServer.URL + page)
+    if err != nil {
+      t.Fatal(err)
+    }
+    response.Body.Close()
+
+    if response.StatusCode != 200 {
+      t.Errorf("Expected %s to match integrity_manifest.json, got status %d. Run ./sneakynote.com pin after changing it.", page, response.StatusCode)
+    }
+  }
+}
+
+func TestPinnedAssetServedUntilModified(t *testing.T) {
+  defer withPinnedTestPage(t, "<script>pinned()</script>")()
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+
+  response, body := getTestPage(t, testServer.URL, "")
+  if response.StatusCode != 200 || string(body) != "<script>pinned()</script>" {
+    t.Errorf("Expected the pinned page, got %d %q", response.StatusCode, body)
+  }
+  if response.Header.Get("Content-Security-Policy") == "" || response.Header.Get("Cache-Control") == "" {
+    t.Error("Expected the usual asset headers, got", response.Header)
+  }
+
+  writeTestPage(t, pinnedTestPage, []byte("<script>stealKeys()</script>"), time.Now())
+
+  response, body = getTestPage(t, testServer.URL, "")
+  if response.StatusCode != 503 || bytes.Contains(body, []byte("stealKeys")) {
+    t.Errorf("Expected the modified page refused with 503, got %d %q", response.StatusCode, body)
+  }
+
+  // Putting it back is fine.
+  writeTestPage(t, pinnedTestPage, []byte("<script>pinned()</script>"), time.Now().Add(time.Minute))
+
+  response, _ = getTestPage(t, testServer.URL, "")
+  if response.StatusCode != 200 {
+    t.Errorf("Expected the restored page served, got %d", response.StatusCode)
+  }
+}
+
+func TestPinnedAssetGzipChecked(t *testing.T) {
+  defer withPinnedTestPage(t, "<script>pinned()</script>")()
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+
+  writeTestPage(t, pinnedTestPage + ".gz", gzipped("<script>pinned()</script>"), time.Now())
+
+  response, body := getTestPage(t, testServer.URL, "gzip")
+  if response.StatusCode != 200 || response.Header.Get("Content-Encoding") != "gzip" || !bytes.Equal(body, gzipped("<script>pinned()</script>")) {
+    t.Errorf("Expected the pinned page gzipped, got %d %v", response.StatusCode, response.Header)
+  }
+
+  writeTestPage(t, pinnedTestPage + ".gz", gzipped("<script>stealKeys()</script>"), time.Now().Add(time.Minute))
+
+  response, _ = getTestPage(t, testServer.URL, "gzip")
+  if response.StatusCode != 503 {
+    t.Errorf("Expected a modified .gz refused with 503, got %d", response.StatusCode)
+  }
+
+  // Clients that don't take gzip still get the good copy.
+  response, body = getTestPage(t, testServer.URL, "identity")
+  if response.StatusCode != 200 || string(body) != "<script>pinned()</script>" {
+    t.Errorf("Expected the pinned page, got %d %q", response.StatusCode, body)
+  }
+}
+
+func TestPinnedAssetCheckedUnderOtherNames(t *testing.T) {
+  defer withPinnedTestPage(t, "<script>pinned()</script>")()
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+
+  const alias = "public/integrity_test_alias"
+  os.Link(pinnedTestPage, alias)
+  defer os.Remove(alias)
+  writeTestPage(t, pinnedTestPage + ".gz", gzipped("<script>stealKeys()</script>"), time.Now())
+
+  for _, urlPath := range []string{"/integrity_test_page.gz", "/integrity_test_alias"} {
+    if urlPath == "/integrity_test_alias" {
+      writeTestPage(t, pinnedTestPage, []byte("<script>stealKeys()</script>"), time.Now().Add(time.Minute))
+    }
+
+    response, err := http.Get(testServer.URL + urlPath)
+    if err != nil {
+      t.Fatal(err)
+    }
+    response.Body.Close()
+
+    if response.StatusCode != 503 {
+      t.Errorf("Expected the modified page refused at %s with 503, got %d", urlPath, response.StatusCode)
+    }
+  }
+}
+
+func TestIntegrityManifestPublished(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+
+  response, err := http.Get(testServer.URL + "/.well-known/sneakynote-integrity.json")
+  if err != nil {
+    t.Fatal(err)
+  }
+  response.Body.Close()
+  if response.StatusCode != 404 {
+    t.Error("Expected 404 with integrity off, got", response.StatusCode)
+  }
+
+  defer withPinnedTestPage(t, "<script>pinned()</script>")()
+
+  response, err = http.Get(testServer.URL + "/.well-known/sneakynote-integrity.json")
+  if err != nil {
+    t.Fatal(err)
+  }
+  body, _ := ioutil.ReadAll(response.Body)
+  response.Body.Close()
+
+  manifestJSON, _ := ioutil.ReadFile("/tmp/integrity_manifest.json")
+  if response.StatusCode != 200 || !bytes.Equal(body, manifestJSON) {
+    t.Errorf("Expected the manifest as written, got %d %s", response.StatusCode, body)
+  }
+
+  manifest := &main.IntegrityManifest{}
+  err = json.Unmarshal(body, manifest)
+  if err != nil || manifest.Assets["/integrity_test_page"] != "sha256-rVv/TFURdOXyfWfKWjJuW657tFQyVKqrTXaqUF6qpMc=" {
+    t.Errorf("Expected the test page pinned, got %v", manifest)
+  }
+}
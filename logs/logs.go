@@ -0,0 +1,147 @@
+package logs
+
+import (
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/hex"
+  "fmt"
+  "io"
+  "log"
+  "log/slog"
+  "net"
+  "os"
+  "strconv"
+  "strings"
+)
+
+// Leveled JSON lines through log/slog, one object per line.
+//
+// Nothing in the logs should let someone match a line to a note or a person.
+// Note IDs go in only as Note(id), a keyed hash whose key is made fresh each
+// boot, so lines from one run can be matched to each other but not to an ID.
+// Client IPs go in only as Client(ip), cut down to a network prefix.
+//
+// Until Configure is called, as for the CLI commands and tests, slog writes
+// plain lines through the log package.
+
+var (
+  noteSalt = make([]byte, 32)
+
+  ipv4PrefixBits = 24
+  ipv6PrefixBits = 48
+
+  logFile *RotatingFile
+)
+
+func init() {
+  if _, err := rand.Read(noteSalt); err != nil {
+    log.Fatal("Generating note log salt: ", err)
+  }
+}
+
+// Reads SNEAKYNOTE_LOG_LEVEL (debug, info, warn or error), SNEAKYNOTE_LOG_FILE
+// (stderr if unset), SNEAKYNOTE_LOG_MAX_MB and SNEAKYNOTE_LOG_KEEP for
+// rotation, and SNEAKYNOTE_LOG_IPV4_PREFIX and SNEAKYNOTE_LOG_IPV6_PREFIX, the
+// bits of client IPs kept.
+func Configure() {
+  level := slog.LevelInfo
+  if levelName := os.Getenv("SNEAKYNOTE_LOG_LEVEL"); levelName != "" {
+    if err := level.UnmarshalText([]byte(levelName)); err != nil {
+      log.Fatal("Invalid SNEAKYNOTE_LOG_LEVEL: ", err)
+    }
+  }
+
+  ipv4PrefixBits = envBits("SNEAKYNOTE_LOG_IPV4_PREFIX", 24, 32)
+  ipv6PrefixBits = envBits("SNEAKYNOTE_LOG_IPV6_PREFIX", 48, 128)
+
+  var out io.Writer = os.Stderr
+  if path := os.Getenv("SNEAKYNOTE_LOG_FILE"); path != "" {
+    maxMB := envInt("SNEAKYNOTE_LOG_MAX_MB", 10)
+    keep := envInt("SNEAKYNOTE_LOG_KEEP", 5)
+    if maxMB < 1 || keep < 0 {
+      log.Fatal("SNEAKYNOTE_LOG_MAX_MB must be positive and SNEAKYNOTE_LOG_KEEP not negative")
+    }
+
+    file, err := OpenRotatingFile(path, int64(maxMB) << 20, keep)
+    if err != nil {
+      log.Fatal("Opening log file: ", err)
+    }
+    if logFile != nil {
+      logFile.Close()
+    }
+    logFile = file
+    out = file
+  }
+
+  slog.SetDefault(slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: level})))
+  slog.Info("Logging", "level", level.String(), "ipv4_prefix", ipv4PrefixBits, "ipv6_prefix", ipv6PrefixBits)
+}
+
+// For failures the server can't run with. Logs at error level and exits.
+func Fatal(message string, args ...any) {
+  slog.Error(message, args...)
+  if logFile != nil {
+    logFile.Close()
+  }
+  os.Exit(1)
+}
+
+func Err(err error) slog.Attr {
+  return slog.Any("error", err)
+}
+
+// The note's ID as a keyed hash, the same for the same ID until restart.
+func Note(id string) slog.Attr {
+  return slog.String("note", NoteHash(id))
+}
+
+func NoteHash(id string) string {
+  mac := hmac.New(sha256.New, noteSalt)
+  mac.Write([]byte(id))
+  return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// The client's network, e.g. 203.0.113.0/24.
+func Client(ip string) slog.Attr {
+  return slog.String("client", TruncateIP(ip))
+}
+
+func TruncateIP(ip string) string {
+  return MaskIP(ip, ipv4PrefixBits, ipv6PrefixBits)
+}
+
+// The network of ip with the given prefix lengths, e.g. 2001:db8::/64.
+func MaskIP(ip string, ipv4Bits int, ipv6Bits int) string {
+  parsed := net.ParseIP(ip)
+  if parsed == nil {
+    return "invalid"
+  }
+
+  bits := ipv6Bits
+  if ipv4 := parsed.To4(); ipv4 != nil {
+    parsed, bits = ipv4, ipv4Bits
+  }
+  network := net.IPNet{IP: parsed.Mask(net.CIDRMask(bits, len(parsed) * 8)), Mask: net.CIDRMask(bits, len(parsed) * 8)}
+  return network.String()
+}
+
+func envInt(name string, defaultValue int) int {
+  value := os.Getenv(name)
+  if value == "" {
+    return defaultValue
+  }
+  parsed, err := strconv.Atoi(strings.TrimSpace(value))
+  if err != nil {
+    log.Fatal("Invalid ", name, ": ", err)
+  }
+  return parsed
+}
+
+func envBits(name string, defaultBits int, maxBits int) int {
+  bits := envInt(name, defaultBits)
+  if bits < 0 || bits > maxBits {
+    log.Fatal(fmt.Sprintf("%s must be between 0 and %d", name, maxBits))
+  }
+  return bits
+}
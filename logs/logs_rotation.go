@@ -0,0 +1,155 @@
+package logs
+
+import (
+  "fmt"
+  "os"
+  "sync"
+  "syscall"
+)
+
+// A log file that moves itself aside once it reaches maxSize: path becomes
+// path.1, path.1 becomes path.2, and so on, keeping keep old files.
+//
+// Safe to share with other processes, as during a handoff while the old one
+// drains: it appends, sizes the file by Stat so it counts their lines too,
+// reopens the path once another process has moved the file aside, and only
+// rotates holding a lock on path.lock, so two don't both rotate.
+type RotatingFile struct {
+  Path string
+  MaxSize int64
+  Keep int
+
+  mutex sync.Mutex
+  file *os.File
+}
+
+func OpenRotatingFile(path string, maxSize int64, keep int) (*RotatingFile, error) {
+  file, err := openAppending(path)
+  if err != nil {
+    return nil, err
+  }
+  return &RotatingFile{Path: path, MaxSize: maxSize, Keep: keep, file: file}, nil
+}
+
+func openAppending(path string) (*os.File, error) {
+  return os.OpenFile(path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0600)
+}
+
+// A line that doesn't fit goes at the start of the next file, so lines are
+// never split across files.
+func (f *RotatingFile) Write(line []byte) (int, error) {
+  f.mutex.Lock()
+  defer f.mutex.Unlock()
+
+  if f.file == nil {
+    return 0, os.ErrClosed
+  }
+
+  err := f.reopenIfMoved()
+  if err == nil && f.full(len(line)) {
+    err = f.withLock(func() error {
+      // Another process may have rotated while we waited for the lock.
+      if err := f.reopenIfMoved(); err != nil || !f.full(len(line)) {
+        return err
+      }
+      return f.rotate()
+    })
+  }
+  if err != nil {
+    // Better an oversized log than a lost line.
+    fmt.Fprintln(os.Stderr, "Error rotating log file:", err)
+  }
+
+  return f.file.Write(line)
+}
+
+func (f *RotatingFile) Rotate() error {
+  f.mutex.Lock()
+  defer f.mutex.Unlock()
+
+  if f.file == nil {
+    return os.ErrClosed
+  }
+  return f.withLock(func() error {
+    if err := f.reopenIfMoved(); err != nil {
+      return err
+    }
+    return f.rotate()
+  })
+}
+
+func (f *RotatingFile) full(incoming int) bool {
+  info, err := f.file.Stat()
+  return err == nil && info.Size() > 0 && info.Size() + int64(incoming) > f.MaxSize
+}
+
+// Switches to the file now at Path if it isn't the one open. Keeps the open
+// file if the new one can't be opened.
+func (f *RotatingFile) reopenIfMoved() error {
+  pathInfo, err := os.Stat(f.Path)
+  if err == nil {
+    openInfo, err := f.file.Stat()
+    if err == nil && os.SameFile(pathInfo, openInfo) {
+      return nil
+    }
+  } else if !os.IsNotExist(err) {
+    return err
+  }
+
+  file, err := openAppending(f.Path)
+  if err != nil {
+    return err
+  }
+  f.file.Close()
+  f.file = file
+  return nil
+}
+
+// Holds an exclusive lock on path.lock, shared with other processes, while
+// running locked.
+func (f *RotatingFile) withLock(locked func() error) error {
+  lockFile, err := os.OpenFile(f.Path + ".lock", os.O_WRONLY | os.O_CREATE, 0600)
+  if err != nil {
+    return err
+  }
+  defer lockFile.Close()
+
+  if err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+    return err
+  }
+  defer syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+
+  return locked()
+}
+
+func (f *RotatingFile) rotate() error {
+  if f.Keep == 0 {
+    return f.file.Truncate(0)
+  }
+
+  os.Remove(rotatedPath(f.Path, f.Keep))
+  for i := f.Keep - 1; i >= 1; i-- {
+    os.Rename(rotatedPath(f.Path, i), rotatedPath(f.Path, i + 1))
+  }
+  if err := os.Rename(f.Path, rotatedPath(f.Path, 1)); err != nil {
+    return err
+  }
+
+  return f.reopenIfMoved()
+}
+
+func (f *RotatingFile) Close() error {
+  f.mutex.Lock()
+  defer f.mutex.Unlock()
+
+  if f.file == nil {
+    return nil
+  }
+  err := f.file.Close()
+  f.file = nil
+  return err
+}
+
+func rotatedPath(path string, i int) string {
+  return fmt.Sprintf("%s.%d", path, i)
+}
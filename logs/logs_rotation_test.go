@@ -0,0 +1,103 @@
+package logs_test
+
+import (
+  "github.com/brianhempel/sneakynote.com/logs"
+  "io/ioutil"
+  "os"
+  "path"
+  "strconv"
+  "strings"
+  "testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+  logPath := path.Join(t.TempDir(), "log.txt")
+
+  file, err := logs.OpenRotatingFile(logPath, 100, 2)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer file.Close()
+
+  line := strings.Repeat("x", 39) + "\n"
+  for i := 0; i < 10; i++ {
+    if _, err := file.Write([]byte(line)); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  for _, kept := range []string{logPath, logPath + ".1", logPath + ".2"} {
+    contents, err := ioutil.ReadFile(kept)
+    if err != nil {
+      t.Fatalf("Expected %s kept, got %v", kept, err)
+    }
+    if len(contents) == 0 || len(contents) > 100 || len(contents) % len(line) != 0 {
+      t.Errorf("Expected whole lines up to 100 bytes in %s, got %d bytes", kept, len(contents))
+    }
+  }
+  if _, err := os.Stat(logPath + ".3"); !os.IsNotExist(err) {
+    t.Error("Expected only 2 old files kept")
+  }
+}
+
+func TestRotatingFileKeepingNone(t *testing.T) {
+  logPath := path.Join(t.TempDir(), "log.txt")
+  ioutil.WriteFile(logPath, []byte("from before\n"), 0600)
+
+  file, err := logs.OpenRotatingFile(logPath, 20, 0)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer file.Close()
+
+  file.Write([]byte("a line too long\n"))
+
+  contents, _ := ioutil.ReadFile(logPath)
+  if string(contents) != "a line too long\n" {
+    t.Errorf("Expected the file started over, got %q", contents)
+  }
+  if _, err := os.Stat(logPath + ".1"); !os.IsNotExist(err) {
+    t.Error("Expected no old files kept")
+  }
+}
+
+// As during a handoff, when the old and new processes both log to the file.
+func TestRotatingFileShared(t *testing.T) {
+  logPath := path.Join(t.TempDir(), "log.txt")
+
+  old, err := logs.OpenRotatingFile(logPath, 100, 10)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer old.Close()
+  current, err := logs.OpenRotatingFile(logPath, 100, 10)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer current.Close()
+
+  line := strings.Repeat("x", 39) + "\n"
+  for i := 0; i < 10; i++ {
+    old.Write([]byte(line))
+    current.Write([]byte(line))
+  }
+
+  lines := 0
+  for i := 0; i <= 10; i++ {
+    kept := logPath
+    if i > 0 {
+      kept += "." + strconv.Itoa(i)
+    }
+    contents, err := ioutil.ReadFile(kept)
+    if os.IsNotExist(err) {
+      continue
+    }
+    if len(contents) > 100 {
+      t.Errorf("Expected at most 100 bytes in %s, got %d", kept, len(contents))
+    }
+    lines += strings.Count(string(contents), "\n")
+  }
+  if lines != 20 {
+    t.Errorf("Expected all 20 lines kept, got %d", lines)
+  }
+}
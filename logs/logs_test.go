@@ -0,0 +1,101 @@
+package logs_test
+
+import (
+  "bufio"
+  "encoding/json"
+  "github.com/brianhempel/sneakynote.com/logs"
+  "log/slog"
+  "os"
+  "path"
+  "strings"
+  "testing"
+)
+
+func withLogEnv(env map[string]string) func() {
+  previous := slog.Default()
+  for name, value := range env {
+    os.Setenv(name, value)
+  }
+  logs.Configure()
+
+  return func() {
+    for name := range env {
+      os.Unsetenv(name)
+    }
+    logs.Configure()
+    slog.SetDefault(previous)
+  }
+}
+
+func TestNoteHash(t *testing.T) {
+  id := "fc2a4122-e81e-4b10-a31b-d79fbdb33a27"
+  hash := logs.NoteHash(id)
+
+  if hash != logs.NoteHash(id) {
+    t.Error("Expected the same hash for the same ID")
+  }
+  if hash == logs.NoteHash("3bd5ff31-2a37-4b6f-9a0c-5d39e9a4c0a1") {
+    t.Error("Expected different hashes for different IDs")
+  }
+  if len(hash) != 16 || strings.Contains(id, hash) || strings.Contains(hash, "fc2a4122") {
+    t.Errorf("Expected 16 hex digits unrelated to the ID, got %q", hash)
+  }
+}
+
+func TestTruncateIP(t *testing.T) {
+  expectations := map[string]string{
+    "203.0.113.77": "203.0.113.0/24",
+    "::ffff:203.0.113.77": "203.0.113.0/24",
+    "2001:db8:abcd:1234::1": "2001:db8:abcd::/48",
+    "not an ip": "invalid",
+  }
+  for ip, expected := range expectations {
+    if truncated := logs.TruncateIP(ip); truncated != expected {
+      t.Errorf("Expected %s truncated to %s, got %s", ip, expected, truncated)
+    }
+  }
+
+  defer withLogEnv(map[string]string{"SNEAKYNOTE_LOG_IPV4_PREFIX": "16", "SNEAKYNOTE_LOG_IPV6_PREFIX": "32"})()
+
+  if truncated := logs.TruncateIP("203.0.113.77"); truncated != "203.0.0.0/16" {
+    t.Errorf("Expected a /16, got %s", truncated)
+  }
+  if truncated := logs.TruncateIP("2001:db8:abcd:1234::1"); truncated != "2001:db8::/32" {
+    t.Errorf("Expected a /32, got %s", truncated)
+  }
+}
+
+func TestConfigureLogsJSONToFile(t *testing.T) {
+  logPath := path.Join(t.TempDir(), "log.txt")
+  defer withLogEnv(map[string]string{"SNEAKYNOTE_LOG_FILE": logPath, "SNEAKYNOTE_LOG_LEVEL": "warn"})()
+
+  slog.Info("Not at warn level")
+  slog.Warn("Duplicate ID", logs.Note("fc2a4122-e81e-4b10-a31b-d79fbdb33a27"), logs.Client("203.0.113.77"))
+
+  file, err := os.Open(logPath)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer file.Close()
+
+  lines := []map[string]interface{}{}
+  scanner := bufio.NewScanner(file)
+  for scanner.Scan() {
+    line := map[string]interface{}{}
+    if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+      t.Fatalf("Expected JSON lines, got %q", scanner.Text())
+    }
+    lines = append(lines, line)
+  }
+
+  if len(lines) != 1 {
+    t.Fatalf("Expected only the warning logged, got %v", lines)
+  }
+  line := lines[0]
+  if line["level"] != "WARN" || line["msg"] != "Duplicate ID" || line["client"] != "203.0.113.0/24" {
+    t.Errorf("Expected a warning with the client's network, got %v", line)
+  }
+  if line["note"] != logs.NoteHash("fc2a4122-e81e-4b10-a31b-d79fbdb33a27") {
+    t.Errorf("Expected the note's hash, got %v", line["note"])
+  }
+}
@@ -1,20 +1,23 @@
 package main
 
 import (
-  "crypto/tls"
+  "github.com/brianhempel/sneakynote.com/logs"
   "github.com/brianhempel/sneakynote.com/store"
   "log"
+  "log/slog"
   "net/http"
+  "sync"
   "sync/atomic"
   "time"
   "os"
-  "os/signal"
-  "syscall"
 )
 
 var (
   mainStore *store.Store
   lastStatusLogTime time.Time
+
+  stopSweeper chan struct{}
+  sweeperStopped chan struct{}
 )
 
 func main() {
@@ -24,6 +27,18 @@ func main() {
     SetupStore()
   } else if os.Args[1] == "teardown" {
     TeardownStore()
+  } else if os.Args[1] == "send" {
+    exitOnError(SendCommand(os.Args[2:], os.Stdin, os.Stdout))
+  } else if os.Args[1] == "get" {
+    exitOnError(GetCommand(os.Args[2:], os.Stdout, os.Stderr))
+  } else if os.Args[1] == "status" {
+    exitOnError(StatusCommand(os.Args[2:], os.Stdout))
+  } else if os.Args[1] == "pin" {
+    exitOnError(PinCommand(os.Args[2:], os.Stdout))
+  } else if os.Args[1] == "maintenance" {
+    exitOnError(MaintenanceCommand(os.Args[2:], os.Stdout))
+  } else if os.Args[1] == "admin" {
+    exitOnError(AdminCommand(os.Args[2:], os.Stdout))
   } else {
     log.Print("Invalid argument ", os.Args[1])
     log.Print("  ")
@@ -34,83 +49,162 @@ func main() {
     log.Print("  ")
     log.Print("./sneakynote.com teardown")
     log.Print("will tear down the datastore.")
+    log.Print("  ")
+    log.Print("./sneakynote.com send [--origin URL] [--wait] [FILE]")
+    log.Print("will encrypt FILE or stdin and print the note's URL and code.")
+    log.Print("  ")
+    log.Print("./sneakynote.com get [--out FILE] URL")
+    log.Print("will open a note to stdout or to a new FILE with mode 0400.")
+    log.Print("  ")
+    log.Print("./sneakynote.com status URL CODE")
+    log.Print("will follow a sent note until it is opened or expires.")
+    log.Print("  ")
+    log.Print("./sneakynote.com pin [--manifest FILE] [PATH...]")
+    log.Print("will record the hashes of the crypto pages in the integrity manifest.")
+    log.Print("  ")
+    log.Print("./sneakynote.com maintenance [on|off]")
+    log.Print("will stop or resume new notes and report when the store will be empty.")
+    log.Print("  ")
+    log.Print("./sneakynote.com admin stats|sweep|drain on|off|reload|shred --yes")
+    log.Print("will ask the running server for its counters, or to sweep, turn maintenance on or off, reread its security headers and certificate, or destroy every note.")
     os.Exit(1)
   }
 }
 
+func exitOnError(err error) {
+  if err != nil {
+    log.Fatal(err)
+  }
+}
+
 func StartServer() {
+  logs.Configure()
   MaybeSetupStore()
+  ConfigureRateLimits()
+  ConfigureProofOfWork()
+  ConfigureEqualization()
+  ConfigureSecurityHeaders()
+  ConfigureIntegrity()
+  ConfigureTLS()
+  ConfigureACME()
+  ConfigureShutdown()
+  ConfigureMaintenance()
+  ConfigureMetrics()
+  ConfigureAdmin()
   StartPeriodicStatusLogger()
 
-  log.Printf("Starting sweeper...")
+  slog.Info("Starting sweeper")
   StartSweeper()
+  WatchMaintenance()
 
   port := os.Getenv("SNEAKYNOTE_PORT")
   certs := os.Getenv("SNEAKYNOTE_CERTS")
   privateKey := os.Getenv("SNEAKYNOTE_PRIVATE_KEY")
 
+  if acmeClient != nil {
+    certs, privateKey = acmeClient.CertificatePath(), acmeClient.KeyPath()
+  }
+
   if port == "" {
     port = "8080"
   }
 
-  log.Printf("Starting SneakyNote server on port " + port + "!")
+  slog.Info("Starting SneakyNote server", "port", port)
 
+  listener, err := Listen("main", ":" + port)
+  if err != nil {
+    logs.Fatal("Listen", logs.Err(err))
+  }
+
+  // Shut down and handed off along with the main server.
+  otherServers := []*http.Server{}
+  if metricsServer := StartMetricsServer(); metricsServer != nil {
+    otherServers = append(otherServers, metricsServer)
+  }
+  if adminServer := StartAdminServer(); adminServer != nil {
+    otherServers = append(otherServers, adminServer)
+  }
+
+  var serveErr error
   if certs == "" || privateKey == "" {
-    err := http.ListenAndServe(":" + port, Handlers())
+    server := &http.Server{Handler: Handlers()}
+    ShutdownOnSignal(append(otherServers, server)...)
+    HandOffOnSignal(append(otherServers, server)...)
+    StartSelfCheck()
+    serveErr = server.Serve(OwnConnections(server, listener))
+  } else {
+    redirectListener, err := Listen("redirect", ":80")
     if err != nil {
-      log.Fatal("ListenAndServe: ", err)
+      logs.Fatal("Listen", logs.Err(err))
     }
-  } else {
-    go http.ListenAndServe(":80", RedirectToHTTPSHandler())
-    log.Print("Using TLS")
-    server := &http.Server{
-      Addr:      ":" + port,
-      Handler:   AddHSTSHeader(Handlers()),
-      TLSConfig: TLSConfig(),
+    redirectServer := &http.Server{Handler: RedirectToHTTPSHandler()}
+    if acmeClient != nil {
+      redirectServer.Handler = acmeClient.HTTPHandler(redirectServer.Handler)
     }
-    err := server.ListenAndServeTLS(certs, privateKey)
+    go redirectServer.Serve(redirectListener)
+    if acmeClient != nil {
+      acmeClient.StartRenewing()
+    }
+    slog.Info("Using TLS", "profile", tlsProfile)
+    tlsConfig := TLSConfig()
+    reloader, err := NewCertificateReloader(certs, privateKey)
     if err != nil {
-      log.Fatal("ListenAndServeTLS: ", err)
+      logs.Fatal("Loading certificate", logs.Err(err))
+    }
+    reloader.StartWatching(certReloadInterval)
+    tlsCertificateReloader = reloader
+    tlsConfig.GetCertificate = reloader.GetCertificate
+    if ocspResponsePath != "" {
+      stapler := NewOCSPStapler(ocspResponsePath)
+      stapler.StartRefreshing(ocspRefresh)
+      tlsConfig.GetCertificate = stapler.GetCertificate(reloader.GetCertificate)
     }
+    StartSessionTicketKeyRotation(tlsConfig, ticketKeyRotation)
+    server := &http.Server{Handler: AddHSTSHeader(Handlers())}
+    otherServers = append(otherServers, redirectServer)
+    ShutdownOnSignal(append(otherServers, server)...)
+    HandOffOnSignal(append(otherServers, server)...)
+    StartSelfCheck()
+    serveErr = server.Serve(OwnTLSConnections(server, listener, tlsConfig))
   }
-}
 
-func TLSConfig() *tls.Config {
-  return &tls.Config{
-    MinVersion: tls.VersionTLS10,
-    PreferServerCipherSuites: true,
-    CipherSuites: []uint16{
-      tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-      tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-      tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
-      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-      tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
-      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
-      tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-      tls.TLS_RSA_WITH_AES_128_CBC_SHA,
-    },
+  if serveErr != http.ErrServerClosed {
+    logs.Fatal("Serve", logs.Err(serveErr))
   }
+  // Serve returns as soon as the drain starts.
+  <-shutdownComplete
 }
 
 func GetStore() {
   mainStore = store.Get()
+  observeStore(mainStore)
 }
 
 func MaybeSetupStore() {
   if _, err := os.Stat(store.Get().ExpiredPath); os.IsNotExist(err) {
     SetupStore()
   } else {
-    GetStore()
+    OpenStore()
+  }
+}
+
+func OpenStore() {
+  var err error
+  mainStore, err = store.Open()
+  if err != nil {
+    logs.Fatal("Opening datastore", logs.Err(err))
   }
+  observeStore(mainStore)
 }
 
 func SetupStore() {
-  log.Printf("Setting up datastore...")
+  slog.Info("Setting up datastore")
   mainStore = store.Setup()
+  observeStore(mainStore)
 }
 
 func TeardownStore() {
-  log.Printf("Tearing down datastore...")
+  slog.Info("Tearing down datastore")
   if mainStore == nil {
     GetStore()
   }
@@ -118,7 +212,22 @@ func TeardownStore() {
 }
 
 func StartSweeper() {
-  go mainStore.SweepContinuously()
+  stopSweeper = make(chan struct{})
+  sweeperStopped = make(chan struct{})
+  go func() {
+    SuperviseSweeper(mainStore, stopSweeper)
+    close(sweeperStopped)
+  }()
+}
+
+// Waits for a sweep underway to finish.
+func StopSweeper() {
+  if stopSweeper == nil {
+    return
+  }
+  close(stopSweeper)
+  <-sweeperStopped
+  stopSweeper = nil
 }
 
 func StartPeriodicStatusLogger() {
@@ -130,46 +239,65 @@ func StartPeriodicStatusLogger() {
       logStatus()
     }
   }()
+}
 
-  signalChan := make(chan os.Signal, 1)
-  signal.Notify(signalChan, os.Interrupt, os.Kill, syscall.SIGTERM)
-  go func() {
-    <-signalChan
-    logStatus()
-    os.Exit(0)
-  }()
+// Counters are never reset, for /metrics, so these remember what was last
+// logged.
+var (
+  statusLogMutex sync.Mutex
+  loggedCounts = map[*uint64]uint64{}
+)
+
+func sinceLastLog(counter *uint64) uint64 {
+  count := atomic.LoadUint64(counter)
+  change := count - loggedCounts[counter]
+  loggedCounts[counter] = count
+  return change
 }
 
 func logStatus() {
+  statusLogMutex.Lock()
+  defer statusLogMutex.Unlock()
+
   now := time.Now()
 
-  created := atomic.SwapUint64(&notesCreatedCount, 0)
-  full := atomic.SwapUint64(&noteStorageFullRequestCount, 0)
-  tooLarge := atomic.SwapUint64(&noteTooLargeRequestCount, 0)
-  duplicateId := atomic.SwapUint64(&noteDuplicateIdRequestCount, 0)
-  opened := atomic.SwapUint64(&notesOpenedCount, 0)
-  expired := atomic.SwapUint64(&noteExpiredRequestCount, 0)
-  alreadyOpened := atomic.SwapUint64(&noteAlreadyOpenedRequestCount, 0)
-  notFound := atomic.SwapUint64(&noteNotFoundCount, 0)
-  status := atomic.SwapUint64(&statusRequestCount, 0)
-  assets := atomic.SwapUint64(&assetRequestCount, 0)
-  total := atomic.SwapUint64(&totalRequestCount, 0)
+  created := sinceLastLog(&notesCreatedCount)
+  full := sinceLastLog(&noteStorageFullRequestCount)
+  tooLarge := sinceLastLog(&noteTooLargeRequestCount)
+  duplicateId := sinceLastLog(&noteDuplicateIdRequestCount)
+  opened := sinceLastLog(&notesOpenedCount)
+  expired := sinceLastLog(&noteExpiredRequestCount)
+  alreadyOpened := sinceLastLog(&noteAlreadyOpenedRequestCount)
+  notFound := sinceLastLog(&noteNotFoundCount)
+  status := sinceLastLog(&statusRequestCount)
+  wrongCodes := sinceLastLog(&store.FailedCodeAttemptCount)
+  lockedOut := sinceLastLog(&statusLockedOutRequestCount)
+  assets := sinceLastLog(&assetRequestCount)
+  total := sinceLastLog(&totalRequestCount)
+  createLimited := sinceLastLog(&createRateLimitedCount)
+  retrieveLimited := sinceLastLog(&retrieveRateLimitedCount)
+  statusLimited := sinceLastLog(&statusRateLimitedCount)
+  challenged := sinceLastLog(&proofOfWorkChallengedCount)
+  solved := sinceLastLog(&proofOfWorkSolvedCount)
 
   requestsPerSecond := float64(total) / now.Sub(lastStatusLogTime).Seconds()
 
-  log.Printf("Requests: total=%d rps=%.6f assets=%d Notes: created=%d opened=%d alreadyOpened=%d expired=%d notFound=%d full=%d tooLarge=%d duplicateId=%d status=%d",
-    total,
-    requestsPerSecond,
-    assets,
-    created,
-    opened,
-    alreadyOpened,
-    expired,
-    notFound,
-    full,
-    tooLarge,
-    duplicateId,
-    status)
+  slog.Info("Status",
+    slog.Group("requests", "total", total, "rps", requestsPerSecond, "assets", assets),
+    slog.Group("notes",
+      "created", created,
+      "opened", opened,
+      "already_opened", alreadyOpened,
+      "expired", expired,
+      "not_found", notFound,
+      "full", full,
+      "too_large", tooLarge,
+      "duplicate_id", duplicateId,
+      "status", status,
+      "wrong_codes", wrongCodes,
+      "locked_out", lockedOut),
+    slog.Group("rate_limited", "create", createLimited, "retrieve", retrieveLimited, "status", statusLimited),
+    slog.Group("proof_of_work", "challenged", challenged, "solved", solved))
 
   lastStatusLogTime = now
 }
\ No newline at end of file
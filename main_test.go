@@ -370,7 +370,7 @@ func TestPostNoteSecretStorageFull(t *testing.T) {
 }
 
 func TestPostNoteSecretClearedFromMemory(t *testing.T) {
-  testServer := httptest.NewServer(main.Handlers())
+  testServer := newOwnedTestServer()
   defer testServer.Close()
   main.SetupStore()
   defer main.TeardownStore()
@@ -559,7 +559,10 @@ func TestGetNoteNotFound(t *testing.T) {
 }
 
 func TestGetNoteSecretClearedFromMemory(t *testing.T) {
-  testServer := httptest.NewServer(main.Handlers())
+  // curl makes a connection for each request, and the server closes each
+  // once it's done with the secret.
+  closed := make(chan struct{}, 2)
+  testServer := newOwnedTestServerNotifyingCloses(closed)
   defer testServer.Close()
   main.SetupStore()
   defer main.TeardownStore()
@@ -586,6 +589,15 @@ func TestGetNoteSecretClearedFromMemory(t *testing.T) {
     return
   }
 
+  // The client can finish reading before the server finishes closing.
+  for i := 0; i < 2; i++ {
+    select {
+    case <-closed:
+    case <-time.After(5 * time.Second):
+      t.Fatal("Expected the server to close both connections")
+    }
+  }
+
   // Do a heap dump to see if the secret was cleared from our memory
 
   f, err := os.Create("/tmp/heapdump")
@@ -653,8 +665,8 @@ func TestGetNoteStatus(t *testing.T) {
 
   body, _ := ioutil.ReadAll(response.Body)
 
-  if !bytes.Equal(body, []byte("")) {
-    t.Errorf("Expected returned data to be blank, got %s", string(body))
+  if !strings.Contains(string(body), "\"state\": \"unopened\"") {
+    t.Errorf("Expected to find \"\"state\": \"unopened\"\" in %s", body)
   }
 
   // 404 if code doesn't match
@@ -732,8 +744,8 @@ func TestGetNoteStatusAccessed(t *testing.T) {
 
   body, _ := ioutil.ReadAll(response.Body)
 
-  if !bytes.Equal(body, []byte("")) {
-    t.Errorf("Expected returned data to be blank, got %s", string(body))
+  if !strings.Contains(string(body), "\"state\": \"opened\"") {
+    t.Errorf("Expected to find \"\"state\": \"opened\"\" in %s", body)
   }
 
   // 404 if code doesn't match
@@ -820,8 +832,8 @@ func TestGetNoteStatusExpiredSecretNotSwept(t *testing.T) {
 
   body, _ := ioutil.ReadAll(response.Body)
 
-  if !bytes.Equal(body, []byte("")) {
-    t.Errorf("Expected returned data to be blank, got %s", string(body))
+  if !strings.Contains(string(body), "\"state\": \"expired\"") {
+    t.Errorf("Expected to find \"\"state\": \"expired\"\" in %s", body)
   }
 
   // 404 if code doesn't match
@@ -905,8 +917,8 @@ func TestGetNoteStatusExpiredSecretSwept(t *testing.T) {
 
   body, _ := ioutil.ReadAll(response.Body)
 
-  if !bytes.Equal(body, []byte("")) {
-    t.Errorf("Expected returned data to be blank, got %s", string(body))
+  if !strings.Contains(string(body), "\"state\": \"expired\"") {
+    t.Errorf("Expected to find \"\"state\": \"expired\"\" in %s", body)
   }
 
   // 404 if code doesn't match
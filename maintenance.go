@@ -0,0 +1,149 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "github.com/brianhempel/sneakynote.com/logs"
+  "github.com/brianhempel/sneakynote.com/store"
+  "io"
+  "log/slog"
+  "net/http"
+  "os"
+  "os/signal"
+  "syscall"
+  "time"
+)
+
+// Maintenance mode stops new notes while those already stored can be read or
+// expire, so the store empties out on its own (see store_maintenance.go). It
+// is turned on and off with `./sneakynote.com maintenance on|off` or SIGUSR1,
+// which toggles it. Requests to create notes then get a 503 with a
+// Retry-After of SNEAKYNOTE_MAINTENANCE_RETRY_AFTER (default 15m); everything
+// else, revoking groups included, still works. While it's on, the server logs
+// every minute how many notes are left and when the store will be empty.
+
+const (
+  defaultMaintenanceRetryAfter = 15 * time.Minute
+  // Long enough for a new process to take over after a handoff.
+  shuttingDownRetryAfter = 5 * time.Second
+  maintenanceReportInterval = time.Minute
+)
+
+var (
+  maintenanceRetryAfter = defaultMaintenanceRetryAfter
+)
+
+func ConfigureMaintenance() {
+  maintenanceRetryAfter = envDuration("SNEAKYNOTE_MAINTENANCE_RETRY_AFTER", defaultMaintenanceRetryAfter)
+}
+
+// Toggles maintenance on SIGUSR1 and reports on the store while it's on.
+func WatchMaintenance() {
+  signalChan := make(chan os.Signal, 1)
+  signal.Notify(signalChan, syscall.SIGUSR1)
+  go func() {
+    for range signalChan {
+      var err error
+      if inMaintenance() {
+        err = mainStore.StopMaintenance()
+      } else {
+        err = mainStore.StartMaintenance()
+      }
+      if err != nil {
+        slog.Error("Error toggling maintenance", logs.Err(err))
+      }
+      logMaintenance(true)
+    }
+  }()
+
+  ticker := time.NewTicker(maintenanceReportInterval)
+  go func() {
+    for range ticker.C {
+      logMaintenance(false)
+    }
+  }()
+}
+
+// Only says it's off if asked to say so regardless.
+func logMaintenance(always bool) {
+  if !inMaintenance() {
+    if always {
+      slog.Info("Maintenance off, taking new notes")
+    }
+    return
+  }
+
+  report, err := maintenanceReport(mainStore)
+  if err != nil {
+    slog.Error("Error reading store for maintenance report", logs.Err(err))
+    return
+  }
+  slog.Info("Maintenance on", "report", report)
+}
+
+// Like "3 live notes, store empty in 4m10s".
+func maintenanceReport(s *store.Store) (string, error) {
+  count, emptyAt, err := s.LiveNotes()
+  if err != nil {
+    return "", err
+  }
+
+  if count == 0 {
+    return "0 live notes, store empty", nil
+  }
+  return fmt.Sprintf("%d live notes, store empty in %v", count, time.Until(emptyAt).Round(time.Second)), nil
+}
+
+func inMaintenance() bool {
+  on, _ := mainStore.Maintenance()
+  return on
+}
+
+func respondMaintenance(response http.ResponseWriter) {
+  setRetryAfter(response, maintenanceRetryAfter)
+  respondError(response, http.StatusServiceUnavailable, "maintenance", "The server is down for maintenance and not taking new notes. Notes already sent can still be opened.") // 503
+}
+
+// ./sneakynote.com maintenance [on|off]
+//
+// Turns maintenance on or off for every server using the store, then prints
+// whether it's on, how many notes are left, and when the store will be
+// empty.
+func MaintenanceCommand(args []string, stdout io.Writer) error {
+  if len(args) > 1 {
+    return errors.New("maintenance takes on, off, or nothing")
+  }
+
+  if _, err := os.Stat(store.Get().ExpiredPath); os.IsNotExist(err) {
+    return errors.New("No store at " + store.Get().Root)
+  }
+  s, err := store.Open()
+  if err != nil {
+    return err
+  }
+
+  if len(args) == 1 {
+    switch args[0] {
+    case "on": err = s.StartMaintenance()
+    case "off": err = s.StopMaintenance()
+    default: return errors.New("maintenance takes on, off, or nothing")
+    }
+    if err != nil {
+      return err
+    }
+  }
+
+  if on, since := s.Maintenance(); on {
+    fmt.Fprintln(stdout, "Maintenance on since", since.Local().Format(time.RFC1123))
+  } else {
+    fmt.Fprintln(stdout, "Maintenance off")
+  }
+
+  report, err := maintenanceReport(s)
+  if err != nil {
+    return err
+  }
+  fmt.Fprintln(stdout, report)
+
+  return nil
+}
@@ -0,0 +1,142 @@
+package main_test
+
+import (
+  "bytes"
+  "encoding/json"
+  "github.com/brianhempel/sneakynote.com"
+  "github.com/brianhempel/sneakynote.com/store"
+  "net/http"
+  "net/http/httptest"
+  "regexp"
+  "strings"
+  "testing"
+)
+
+func TestMaintenanceRefusesNewNotes(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  noteURL := testServer.URL + "/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27"
+  code := postSecret(t, noteURL, []byte("this is my secret"))
+
+  // As the CLI would, from another process.
+  store.Get().StartMaintenance()
+
+  for _, url := range []string{testServer.URL + "/notes/3bd5ff31-2a37-4b6f-9a0c-5d39e9a4c0a1", testServer.URL + "/api/v1/notes/3bd5ff31-2a37-4b6f-9a0c-5d39e9a4c0a1"} {
+    response, err := http.Post(url, "application/octet-stream", strings.NewReader("another secret"))
+    if err != nil {
+      t.Fatal(err)
+    }
+    errorBody := map[string]string{}
+    json.NewDecoder(response.Body).Decode(&errorBody)
+    response.Body.Close()
+
+    if response.StatusCode != http.StatusServiceUnavailable || errorBody["error_type"] != "maintenance" {
+      t.Errorf("Expected 503 maintenance for %s, got %d %v", url, response.StatusCode, errorBody)
+    }
+    if response.Header.Get("Retry-After") != "900" {
+      t.Errorf("Expected Retry-After of 15 minutes, got %q", response.Header.Get("Retry-After"))
+    }
+  }
+
+  request, _ := http.NewRequest("GET", noteURL + "/status", nil)
+  request.Header.Set("X-Note-Code", code)
+  response, err := http.DefaultClient.Do(request)
+  if err != nil {
+    t.Fatal(err)
+  }
+  response.Body.Close()
+  if response.StatusCode != http.StatusOK {
+    t.Errorf("Expected status still answered in maintenance, got %d", response.StatusCode)
+  }
+
+  response, err = http.Get(noteURL)
+  if err != nil {
+    t.Fatal(err)
+  }
+  response.Body.Close()
+  if response.StatusCode != http.StatusOK {
+    t.Errorf("Expected notes still readable in maintenance, got %d", response.StatusCode)
+  }
+
+  store.Get().StopMaintenance()
+  postSecret(t, testServer.URL + "/notes/3bd5ff31-2a37-4b6f-9a0c-5d39e9a4c0a1", []byte("another secret"))
+}
+
+func TestMaintenanceCommand(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  postSecret(t, testServer.URL + "/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27", []byte("this is my secret"))
+
+  stdout := &bytes.Buffer{}
+  err := main.MaintenanceCommand([]string{"on"}, stdout)
+  if err != nil {
+    t.Fatal("Error on maintenance on:", err)
+  }
+  if !strings.HasPrefix(stdout.String(), "Maintenance on since") || !regexp.MustCompile("1 live notes, store empty in (10m0s|9m5\\ds)").MatchString(stdout.String()) {
+    t.Errorf("Expected maintenance on with 1 note left for 10 minutes, got %q", stdout.String())
+  }
+
+  stdout.Reset()
+  main.MaintenanceCommand([]string{"off"}, stdout)
+  if !strings.HasPrefix(stdout.String(), "Maintenance off") {
+    t.Errorf("Expected maintenance off, got %q", stdout.String())
+  }
+
+  if err = main.MaintenanceCommand([]string{"sideways"}, stdout); err == nil {
+    t.Error("Expected an error for an unknown argument")
+  }
+}
+
+func TestMaintenanceStillRevokesGroups(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  reqBodyReader := strings.NewReader("{\"group\": {\"id\": \"5d7c0a52-1f7e-4d0b-8b8f-2b6f1c9e4a10\", \"threshold\": 2}, \"notes\": [" +
+    "{\"id\": \"fc2a4122-e81e-4b10-a31b-d79fbdb33a27\", \"ciphertext\": \"c2hhcmUgMQ==\"}," +
+    "{\"id\": \"0b8e4a5c-2a53-4c5e-9d0a-3f1f5a7e6c11\", \"ciphertext\": \"c2hhcmUgMg==\"}" +
+    "]}")
+  response, err := http.Post(testServer.URL + "/api/v1/notes:batch", "application/json", reqBodyReader)
+  if err != nil {
+    t.Fatal(err)
+  }
+  created := struct {
+    Group struct {
+      Code string `json:"code"`
+    } `json:"group"`
+  }{}
+  json.NewDecoder(response.Body).Decode(&created)
+  response.Body.Close()
+
+  store.Get().StartMaintenance()
+  defer store.Get().StopMaintenance()
+
+  request, _ := http.NewRequest("POST", testServer.URL + "/api/v1/groups/5d7c0a52-1f7e-4d0b-8b8f-2b6f1c9e4a10/revoke", nil)
+  request.Header.Set("X-Group-Code", created.Group.Code)
+  response, err = http.DefaultClient.Do(request)
+  if err != nil {
+    t.Fatal(err)
+  }
+  response.Body.Close()
+
+  if response.StatusCode != http.StatusOK {
+    t.Errorf("Expected group revoked in maintenance, got %d", response.StatusCode)
+  }
+
+  response, err = http.Get(testServer.URL + "/api/v1/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27")
+  if err != nil {
+    t.Fatal(err)
+  }
+  response.Body.Close()
+
+  if response.StatusCode == http.StatusOK {
+    t.Errorf("Expected revoked share gone, got %d", response.StatusCode)
+  }
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+  "bytes"
+  "crypto/subtle"
+  "fmt"
+  "github.com/brianhempel/sneakynote.com/logs"
+  "github.com/brianhempel/sneakynote.com/store"
+  "io"
+  "log/slog"
+  "net/http"
+  "os"
+  "sort"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// Serves the counters, a few gauges of the store, and histograms at
+// /metrics in the Prometheus text format. It's off unless
+// SNEAKYNOTE_METRICS_ADDRESS gives a separate listener for it (e.g.
+// "127.0.0.1:9100"), or SNEAKYNOTE_METRICS_TOKEN a bearer token for it on
+// the main server.
+//
+// Counters are never reset; logStatus logs what changed since its last line.
+
+const (
+  metricsURLPath = "/metrics"
+)
+
+var (
+  metricsAddress string
+  metricsToken string
+
+  noteSizeBytes = newHistogram(64, 256, 1024, 4096, 16384, 65536)
+  timeToOpenSeconds = newHistogram(5, 15, 30, 60, 120, 300, 600, 1200)
+  longPollSeconds = newHistogram(0.5, 1, 2, 4, 6, 8, 10)
+  requestLatencySeconds = newHistogramVec(0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10)
+)
+
+type counterMetric struct {
+  name string
+  labels string
+  help string
+  count *uint64
+}
+
+// Grouped by name, since each name gets one HELP and TYPE.
+var counterMetrics = []counterMetric{
+  {"sneakynote_requests_total", "", "Requests to any route.", &totalRequestCount},
+  {"sneakynote_asset_requests_total", "", "Requests for static files.", &assetRequestCount},
+  {"sneakynote_notes_total", `outcome="created"`, "Note requests by outcome.", &notesCreatedCount},
+  {"sneakynote_notes_total", `outcome="opened"`, "", &notesOpenedCount},
+  {"sneakynote_notes_total", `outcome="already_opened"`, "", &noteAlreadyOpenedRequestCount},
+  {"sneakynote_notes_total", `outcome="expired"`, "", &noteExpiredRequestCount},
+  {"sneakynote_notes_total", `outcome="not_found"`, "", &noteNotFoundCount},
+  {"sneakynote_notes_total", `outcome="storage_full"`, "", &noteStorageFullRequestCount},
+  {"sneakynote_notes_total", `outcome="too_large"`, "", &noteTooLargeRequestCount},
+  {"sneakynote_notes_total", `outcome="duplicate_id"`, "", &noteDuplicateIdRequestCount},
+  {"sneakynote_status_requests_total", "", "Note status requests.", &statusRequestCount},
+  {"sneakynote_wrong_codes_total", "", "Status requests with the wrong code.", &store.FailedCodeAttemptCount},
+  {"sneakynote_status_locked_out_total", "", "Status requests refused during a wrong code lockout.", &statusLockedOutRequestCount},
+  {"sneakynote_rate_limited_total", `limit="create"`, "Requests refused by a rate limit.", &createRateLimitedCount},
+  {"sneakynote_rate_limited_total", `limit="retrieve"`, "", &retrieveRateLimitedCount},
+  {"sneakynote_rate_limited_total", `limit="status"`, "", &statusRateLimitedCount},
+  {"sneakynote_proof_of_work_total", `outcome="challenged"`, "Note creations asked for proof of work, and proofs accepted.", &proofOfWorkChallengedCount},
+  {"sneakynote_proof_of_work_total", `outcome="solved"`, "", &proofOfWorkSolvedCount},
+  {"sneakynote_sweeper_restarts_total", "", "Sweeper restarts after a panic.", &sweeperRestartCount},
+}
+
+func ConfigureMetrics() {
+  metricsAddress = os.Getenv("SNEAKYNOTE_METRICS_ADDRESS")
+  metricsToken = os.Getenv("SNEAKYNOTE_METRICS_TOKEN")
+
+  if metricsAddress != "" {
+    slog.Info("Serving metrics", "address", metricsAddress)
+  }
+  if metricsToken != "" {
+    slog.Info("Serving metrics to bearers of SNEAKYNOTE_METRICS_TOKEN", "path", metricsURLPath)
+  }
+}
+
+func DisableMetrics() {
+  metricsAddress = ""
+  metricsToken = ""
+}
+
+// Nil unless SNEAKYNOTE_METRICS_ADDRESS is set.
+func StartMetricsServer() *http.Server {
+  if metricsAddress == "" {
+    return nil
+  }
+
+  listener, err := Listen("metrics", metricsAddress)
+  if err != nil {
+    logs.Fatal("Listen", logs.Err(err))
+  }
+
+  mux := http.NewServeMux()
+  mux.HandleFunc(metricsURLPath, serveMetrics)
+  server := &http.Server{Addr: listener.Addr().String(), Handler: mux}
+  go server.Serve(listener)
+  return server
+}
+
+// On the main server, only with the token.
+func metricsHandler(response http.ResponseWriter, request *http.Request) {
+  given := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+  if metricsToken == "" {
+    http.NotFound(response, request)
+    return
+  } else if subtle.ConstantTimeCompare([]byte(given), []byte(metricsToken)) != 1 {
+    response.Header().Set("WWW-Authenticate", "Bearer")
+    http.Error(response, "Unauthorized", http.StatusUnauthorized)
+    return
+  }
+
+  serveMetrics(response, request)
+}
+
+func serveMetrics(response http.ResponseWriter, request *http.Request) {
+  out := &bytes.Buffer{}
+
+  lastName := ""
+  for _, counter := range counterMetrics {
+    if counter.name != lastName {
+      fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s counter\n", counter.name, counter.help, counter.name)
+      lastName = counter.name
+    }
+    fmt.Fprintf(out, "%s%s %d\n", counter.name, labelSet(counter.labels), atomic.LoadUint64(counter.count))
+  }
+
+  sweptItemsMutex.Lock()
+  phaseNames := make([]string, 0, len(sweptItemCounts))
+  for name := range sweptItemCounts {
+    phaseNames = append(phaseNames, name)
+  }
+  sort.Strings(phaseNames)
+  fmt.Fprintf(out, "# HELP sneakynote_swept_items_total Files swept away, by sweep phase.\n# TYPE sneakynote_swept_items_total counter\n")
+  for _, name := range phaseNames {
+    fmt.Fprintf(out, "sneakynote_swept_items_total{phase=\"%s\"} %d\n", name, sweptItemCounts[name])
+  }
+  sweptItemsMutex.Unlock()
+
+  writeGauge(out, "sneakynote_in_flight_note_requests", "Note requests being handled.", "", float64(atomic.LoadInt64(&inFlightNoteRequestCount)))
+  behind := 0.0
+  if SweeperBehind() {
+    behind = 1
+  }
+  writeGauge(out, "sneakynote_sweeper_behind", "1 while the last successful sweep is older than the secret lifetime.", "", behind)
+  if mainStore != nil {
+    if liveNotes, _, err := mainStore.LiveNotes(); err == nil {
+      writeGauge(out, "sneakynote_live_notes", "Unopened notes stored.", "", float64(liveNotes))
+    }
+    if opened, expired, err := mainStore.Tombstones(); err == nil {
+      writeGauge(out, "sneakynote_tombstones", "Records of opened and expired notes, kept so IDs aren't reused.", `reason="opened"`, float64(opened))
+      fmt.Fprintf(out, "sneakynote_tombstones{reason=\"expired\"} %d\n", expired)
+    }
+    writeGauge(out, "sneakynote_available_memory_bytes", "Room left in the store for secrets.", "", float64(mainStore.AvailableMemory()))
+    if lastSweep := mainStore.LastSweep(); !lastSweep.IsZero() {
+      writeGauge(out, "sneakynote_last_sweep_timestamp_seconds", "When the last successful sweep finished.", "", float64(lastSweep.UnixNano()) / 1e9)
+    }
+  }
+
+  noteSizeBytes.write(out, "sneakynote_note_size_bytes", "Sizes of notes stored, before padding.", "")
+  timeToOpenSeconds.write(out, "sneakynote_time_to_open_seconds", "Time from a note being stored to being opened.", "")
+  longPollSeconds.write(out, "sneakynote_long_poll_seconds", "Time status long polls waited.", "")
+  requestLatencySeconds.write(out, "sneakynote_request_duration_seconds", "Time to handle requests, by route and method.")
+  sweepPhaseSeconds.write(out, "sneakynote_sweep_phase_seconds", "Time each phase of a sweep took.")
+
+  response.Header().Set("Content-Type", "text/plain; version=0.0.4")
+  response.Header().Set("Cache-Control", "no-store")
+  response.Write(out.Bytes())
+}
+
+func writeGauge(out io.Writer, name string, help string, labels string, value float64) {
+  fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s gauge\n%s%s %g\n", name, help, name, name, labelSet(labels), value)
+}
+
+func labelSet(labels string) string {
+  if labels == "" {
+    return ""
+  }
+  return "{" + labels + "}"
+}
+
+// Feeds the store's save and open events to the histograms.
+func observeStore(s *store.Store) {
+  s.OnSave = func(size int) {
+    noteSizeBytes.Observe(float64(size))
+  }
+  s.OnOpen = func(age time.Duration) {
+    timeToOpenSeconds.Observe(age.Seconds())
+  }
+  s.OnSweep = observeSweep
+}
+
+// Times the request under a route name with IDs left out.
+func measured(original http.Handler) http.Handler {
+  return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+    start := time.Now()
+    original.ServeHTTP(response, request)
+    labels := fmt.Sprintf(`route="%s",method="%s"`, metricsRoute(request.URL.Path), metricsMethod(request.Method))
+    requestLatencySeconds.With(labels).Observe(time.Since(start).Seconds())
+  })
+}
+
+func metricsRoute(requestPath string) string {
+  switch {
+  case noteStatusPathRegexp.MatchString(requestPath): return "/notes/:id/status"
+  case notePathRegexp.MatchString(requestPath): return "/notes/:id"
+  case requestPath == apiV1PathPrefix + "notes:batch": return "/api/v1/notes:batch"
+  case requestPath == apiV1PathPrefix + "openapi.json": return "/api/v1/openapi.json"
+  case apiV1NoteStatusPathRegexp.MatchString(requestPath): return "/api/v1/notes/:id/status"
+  case apiV1NotePathRegexp.MatchString(requestPath): return "/api/v1/notes/:id"
+  case apiV1GroupStatusPathRegexp.MatchString(requestPath): return "/api/v1/groups/:id/status"
+  case apiV1GroupRevokePathRegexp.MatchString(requestPath): return "/api/v1/groups/:id/revoke"
+  case requestPath == "/free_space", requestPath == integrityManifestURLPath, requestPath == metricsURLPath, requestPath == healthzURLPath, requestPath == readyzURLPath: return requestPath
+  case strings.HasPrefix(requestPath, "/notes/"), strings.HasPrefix(requestPath, "/api/"): return "other"
+  default: return "asset"
+  }
+}
+
+// Anything odd is lumped together, so clients can't add label values.
+func metricsMethod(method string) string {
+  switch method {
+  case "GET", "HEAD", "POST", "DELETE": return method
+  default: return "other"
+  }
+}
+
+type histogram struct {
+  bounds []float64
+
+  mutex sync.Mutex
+  // Per bucket, not cumulative. The last is above every bound.
+  counts []uint64
+  sum float64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+  return &histogram{bounds: bounds, counts: make([]uint64, len(bounds) + 1)}
+}
+
+func (h *histogram) Observe(value float64) {
+  i := sort.SearchFloat64s(h.bounds, value)
+
+  h.mutex.Lock()
+  h.counts[i]++
+  h.sum += value
+  h.mutex.Unlock()
+}
+
+// HELP and TYPE are left out when help is empty, for a family's later
+// members.
+func (h *histogram) write(out io.Writer, name string, help string, labels string) {
+  if help != "" {
+    fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+  }
+  separator := ""
+  if labels != "" {
+    separator = ","
+  }
+
+  h.mutex.Lock()
+  defer h.mutex.Unlock()
+
+  cumulative := uint64(0)
+  for i, bound := range h.bounds {
+    cumulative += h.counts[i]
+    fmt.Fprintf(out, "%s_bucket{%s%sle=\"%g\"} %d\n", name, labels, separator, bound, cumulative)
+  }
+  cumulative += h.counts[len(h.bounds)]
+  fmt.Fprintf(out, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, separator, cumulative)
+  fmt.Fprintf(out, "%s_sum%s %g\n", name, labelSet(labels), h.sum)
+  fmt.Fprintf(out, "%s_count%s %d\n", name, labelSet(labels), cumulative)
+}
+
+// Histograms with the same buckets, one per label set.
+type histogramVec struct {
+  bounds []float64
+
+  mutex sync.Mutex
+  histograms map[string]*histogram
+}
+
+func newHistogramVec(bounds ...float64) *histogramVec {
+  return &histogramVec{bounds: bounds, histograms: map[string]*histogram{}}
+}
+
+func (v *histogramVec) With(labels string) *histogram {
+  v.mutex.Lock()
+  defer v.mutex.Unlock()
+
+  h, ok := v.histograms[labels]
+  if !ok {
+    h = newHistogram(v.bounds...)
+    v.histograms[labels] = h
+  }
+  return h
+}
+
+func (v *histogramVec) write(out io.Writer, name string, help string) {
+  v.mutex.Lock()
+  labelSets := make([]string, 0, len(v.histograms))
+  for labels := range v.histograms {
+    labelSets = append(labelSets, labels)
+  }
+  v.mutex.Unlock()
+  sort.Strings(labelSets)
+
+  fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+  for _, labels := range labelSets {
+    v.With(labels).write(out, name, "", labels)
+  }
+}
@@ -0,0 +1,153 @@
+package main_test
+
+import (
+  "github.com/brianhempel/sneakynote.com"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "regexp"
+  "strconv"
+  "testing"
+)
+
+func withMetrics(env map[string]string) func() {
+  for name, value := range env {
+    os.Setenv(name, value)
+  }
+  main.ConfigureMetrics()
+
+  return func() {
+    for name := range env {
+      os.Unsetenv(name)
+    }
+    main.DisableMetrics()
+  }
+}
+
+func scrapeMetrics(t *testing.T, url string, token string) string {
+  request, _ := http.NewRequest("GET", url, nil)
+  if token != "" {
+    request.Header.Set("Authorization", "Bearer " + token)
+  }
+  response, err := http.DefaultClient.Do(request)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer response.Body.Close()
+  body, _ := ioutil.ReadAll(response.Body)
+
+  if response.StatusCode != http.StatusOK {
+    t.Fatalf("Expected status 200 for metrics, got %d", response.StatusCode)
+  }
+  return string(body)
+}
+
+// The value of the series, which must be present.
+func metricValue(t *testing.T, metrics string, series string) float64 {
+  match := regexp.MustCompile("(?m)^" + regexp.QuoteMeta(series) + " (\\S+)$").FindStringSubmatch(metrics)
+  if match == nil {
+    t.Fatalf("Expected %s in the metrics", series)
+  }
+  value, _ := strconv.ParseFloat(match[1], 64)
+  return value
+}
+
+func TestMetricsNeedsToken(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+
+  response, err := http.Get(testServer.URL + "/metrics")
+  if err != nil {
+    t.Fatal(err)
+  }
+  response.Body.Close()
+  if response.StatusCode != http.StatusNotFound {
+    t.Errorf("Expected metrics off by default, got %d", response.StatusCode)
+  }
+
+  defer withMetrics(map[string]string{"SNEAKYNOTE_METRICS_TOKEN": "s3cret"})()
+
+  for _, token := range []string{"", "wrong"} {
+    request, _ := http.NewRequest("GET", testServer.URL + "/metrics", nil)
+    request.Header.Set("Authorization", "Bearer " + token)
+    response, err = http.DefaultClient.Do(request)
+    if err != nil {
+      t.Fatal(err)
+    }
+    response.Body.Close()
+    if response.StatusCode != http.StatusUnauthorized {
+      t.Errorf("Expected 401 for token %q, got %d", token, response.StatusCode)
+    }
+  }
+
+  scrapeMetrics(t, testServer.URL + "/metrics", "s3cret")
+}
+
+func TestMetrics(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+  defer withMetrics(map[string]string{"SNEAKYNOTE_METRICS_ADDRESS": "127.0.0.1:0"})()
+
+  metricsServer := main.StartMetricsServer()
+  defer metricsServer.Close()
+  metricsURL := "http://" + metricsServer.Addr + "/metrics"
+
+  before := scrapeMetrics(t, metricsURL, "")
+
+  noteURL := testServer.URL + "/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27"
+  code := postSecret(t, noteURL, []byte("this is my secret"))
+
+  middle := scrapeMetrics(t, metricsURL, "")
+  if live := metricValue(t, middle, "sneakynote_live_notes"); live != 1 {
+    t.Errorf("Expected 1 live note, got %v", live)
+  }
+
+  response, err := http.Get(noteURL)
+  if err != nil {
+    t.Fatal(err)
+  }
+  response.Body.Close()
+
+  // Answers at once, the note being opened.
+  request, _ := http.NewRequest("GET", noteURL + "/status", nil)
+  request.Header.Set("X-Note-Code", code)
+  request.Header.Set("X-Long-Poll", "true")
+  response, err = http.DefaultClient.Do(request)
+  if err != nil {
+    t.Fatal(err)
+  }
+  response.Body.Close()
+
+  after := scrapeMetrics(t, metricsURL, "")
+
+  increased := func(series string, by float64) {
+    if change := metricValue(t, after, series) - metricValue(t, before, series); change != by {
+      t.Errorf("Expected %s up by %v, got %v", series, by, change)
+    }
+  }
+  increased(`sneakynote_notes_total{outcome="created"}`, 1)
+  increased(`sneakynote_notes_total{outcome="opened"}`, 1)
+  increased(`sneakynote_status_requests_total`, 1)
+  increased(`sneakynote_note_size_bytes_bucket{le="64"}`, 1)
+  increased(`sneakynote_note_size_bytes_sum`, 17)
+  increased(`sneakynote_time_to_open_seconds_count`, 1)
+  increased(`sneakynote_long_poll_seconds_bucket{le="0.5"}`, 1)
+
+  if live := metricValue(t, after, "sneakynote_live_notes"); live != 0 {
+    t.Errorf("Expected no live notes after opening, got %v", live)
+  }
+  if opened := metricValue(t, after, `sneakynote_tombstones{reason="opened"}`); opened != 1 {
+    t.Errorf("Expected 1 opened tombstone, got %v", opened)
+  }
+  metricValue(t, after, "sneakynote_available_memory_bytes")
+
+  if posts := metricValue(t, after, `sneakynote_request_duration_seconds_count{route="/notes/:id",method="POST"}`); posts < 1 {
+    t.Errorf("Expected the POST timed under its route, got %v", posts)
+  }
+  if regexp.MustCompile("fc2a4122").MatchString(after) {
+    t.Error("Expected no note IDs in the metrics")
+  }
+}
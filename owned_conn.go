@@ -0,0 +1,243 @@
+package main
+
+import (
+  "bytes"
+  "context"
+  "crypto/tls"
+  "net"
+  "net/http"
+  "strconv"
+  "sync"
+  "time"
+)
+
+// SneakyNote serves every connection through an ownedConn so it knows which
+// buffers have held a secret and can zero them, without reaching into
+// net/http's private fields.
+//
+// Reads hand the reader's buffer to the connection: net/http's bufio.Reader
+// fills itself with conn.Read(buf), and over TLS the tls.Conn reads into the
+// record buffer it decrypts in place. An ownedConn remembers each buffer it
+// was handed, so the buffers that held a request are the ones it zeroes.
+//
+// Secrets go out through respondSecret, which hijacks the connection and
+// writes from a buffer we own, so net/http's response buffers never see
+// them. tls.Conn seals records in place, so plaintext it copies in is
+// overwritten by ciphertext before it is sent.
+//
+// HTTP/2 multiplexes streams over buffers we can't see, so it is off.
+
+type ownedConnContextKey struct{}
+
+type ownedListener struct {
+  net.Listener
+  // Nil for plain HTTP.
+  tlsConfig *tls.Config
+}
+
+type ownedConn struct {
+  net.Conn
+  // The conn beneath TLS, if any.
+  lower *ownedConn
+  // Only for conns beneath TLS, whose buffers belong to the tls.Conn alone.
+  // net/http pools its buffers before closing, so they must be zeroed while
+  // a handler still owns the connection.
+  zeroOnClose bool
+
+  mutex sync.Mutex
+  // Widest slice seen of each buffer handed to Read, keyed by its last byte.
+  buffers map[*byte][]byte
+  readingBuffer *byte
+  closed bool
+}
+
+var ownedBufferPool = sync.Pool{
+  New: func() interface{} { return []byte(nil) },
+}
+
+// Serve plain HTTP connections from listener through owned buffers.
+func OwnConnections(server *http.Server, listener net.Listener) net.Listener {
+  server.ConnContext = func(ctx context.Context, conn net.Conn) context.Context {
+    return context.WithValue(ctx, ownedConnContextKey{}, conn)
+  }
+  server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+  return &ownedListener{Listener: listener}
+}
+
+// Like OwnConnections, but terminates TLS between two owned conns. Sets
+// config.NextProtos; config stays live, so session ticket keys set on it
+// later take effect.
+func OwnTLSConnections(server *http.Server, listener net.Listener, config *tls.Config) net.Listener {
+  config.NextProtos = []string{"http/1.1"}
+
+  ownedListener := OwnConnections(server, listener).(*ownedListener)
+  ownedListener.tlsConfig = config
+  return ownedListener
+}
+
+func (l *ownedListener) Accept() (net.Conn, error) {
+  conn, err := l.Listener.Accept()
+  if err != nil {
+    return nil, err
+  }
+
+  if l.tlsConfig == nil {
+    return newOwnedConn(conn), nil
+  }
+
+  lower := newOwnedConn(conn)
+  lower.zeroOnClose = true
+  upper := newOwnedConn(tls.Server(lower, l.tlsConfig))
+  upper.lower = lower
+  return upper, nil
+}
+
+func newOwnedConn(conn net.Conn) *ownedConn {
+  return &ownedConn{Conn: conn, buffers: make(map[*byte][]byte)}
+}
+
+func (c *ownedConn) Read(p []byte) (int, error) {
+  c.remember(p)
+
+  n, err := c.Conn.Read(p)
+
+  c.mutex.Lock()
+  defer c.mutex.Unlock()
+  c.readingBuffer = nil
+  if c.closed && c.zeroOnClose {
+    c.zeroBuffersLocked()
+  }
+
+  return n, err
+}
+
+func (c *ownedConn) Close() error {
+  err := c.Conn.Close()
+
+  c.mutex.Lock()
+  c.closed = true
+  if c.zeroOnClose {
+    c.zeroBuffersLocked()
+  }
+  c.mutex.Unlock()
+
+  return err
+}
+
+func (c *ownedConn) remember(p []byte) {
+  if cap(p) == 0 {
+    return
+  }
+
+  whole := p[:cap(p)]
+  key := &whole[len(whole)-1]
+
+  c.mutex.Lock()
+  defer c.mutex.Unlock()
+
+  if seen, ok := c.buffers[key]; !ok || len(whole) > len(seen) {
+    c.buffers[key] = whole
+  }
+  c.readingBuffer = key
+}
+
+// Zeroes every buffer this conn and the conn beneath it have read into,
+// except one a read is blocked on right now. Only safe while nothing else
+// will use them: in a handler, or after hijacking.
+func (c *ownedConn) zeroBuffers() {
+  c.mutex.Lock()
+  c.zeroBuffersLocked()
+  c.mutex.Unlock()
+
+  if c.lower != nil {
+    c.lower.zeroBuffers()
+  }
+}
+
+func (c *ownedConn) zeroBuffersLocked() {
+  for key, buffer := range c.buffers {
+    if key != c.readingBuffer {
+      zeroBuffer(buffer)
+    }
+  }
+}
+
+func ownedConnFromRequest(request *http.Request) *ownedConn {
+  conn, _ := request.Context().Value(ownedConnContextKey{}).(*ownedConn)
+  return conn
+}
+
+// For handlers that read a secret from the request body. Call at the start
+// and defer what it returns:
+//
+//   defer zeroRequestBuffers(response, request)()
+//
+// The connection closes after the response so nothing more is read into its
+// buffers, and they are zeroed once the handler is done.
+func zeroRequestBuffers(response http.ResponseWriter, request *http.Request) func() {
+  conn := ownedConnFromRequest(request)
+  if conn == nil {
+    return func() {}
+  }
+
+  response.Header().Set("Connection", "close")
+  return conn.zeroBuffers
+}
+
+// Writes a response carrying a secret straight to the connection from a
+// buffer we own, then closes the connection and zeroes its buffers. When the
+// connection isn't one of ours, writes through the ResponseWriter instead.
+func respondSecret(response http.ResponseWriter, request *http.Request, statusCode int, body []byte) {
+  if delayed, ok := response.(*delayedResponseWriter); ok {
+    delayed.wait()
+    response = delayed.ResponseWriter
+  }
+
+  conn := ownedConnFromRequest(request)
+  hijacker, ok := response.(http.Hijacker)
+  if conn == nil || !ok {
+    response.WriteHeader(statusCode)
+    response.Write(body)
+    return
+  }
+
+  header := response.Header()
+  header.Set("Content-Length", strconv.Itoa(len(body)))
+  header.Set("Connection", "close")
+  header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+
+  head := &bytes.Buffer{}
+  head.WriteString("HTTP/1.1 " + strconv.Itoa(statusCode) + " " + http.StatusText(statusCode) + "\r\n")
+  header.Write(head)
+  head.WriteString("\r\n")
+
+  hijackedConn, _, err := hijacker.Hijack()
+  if err != nil {
+    response.WriteHeader(statusCode)
+    response.Write(body)
+    return
+  }
+  defer hijackedConn.Close()
+  defer conn.zeroBuffers()
+
+  out := getOwnedBuffer(head.Len() + len(body))
+  defer putOwnedBuffer(out)
+
+  out = append(out, head.Bytes()...)
+  out = append(out, body...)
+
+  hijackedConn.Write(out)
+}
+
+func getOwnedBuffer(size int) []byte {
+  buffer := ownedBufferPool.Get().([]byte)
+  if cap(buffer) < size {
+    buffer = make([]byte, 0, size)
+  }
+  return buffer[:0]
+}
+
+func putOwnedBuffer(buffer []byte) {
+  zeroBuffer(buffer[:cap(buffer)])
+  ownedBufferPool.Put(buffer[:0])
+}
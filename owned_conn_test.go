@@ -0,0 +1,218 @@
+package main_test
+
+import (
+  "bytes"
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/tls"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "github.com/brianhempel/sneakynote.com"
+  "io/ioutil"
+  "math/big"
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "os/exec"
+  "runtime/debug"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+)
+
+func newOwnedTestServer() *httptest.Server {
+  testServer := httptest.NewUnstartedServer(main.Handlers())
+  testServer.Listener = main.OwnConnections(testServer.Config, testServer.Listener)
+  testServer.Start()
+  return testServer
+}
+
+// Like newOwnedTestServer, but sends on closed as each connection closes,
+// which the server does only once it's done with the connection's buffers.
+func newOwnedTestServerNotifyingCloses(closed chan<- struct{}) *httptest.Server {
+  testServer := httptest.NewUnstartedServer(main.Handlers())
+  testServer.Listener = main.OwnConnections(testServer.Config, &closeNotifyingListener{Listener: testServer.Listener, closed: closed})
+  testServer.Start()
+  return testServer
+}
+
+type closeNotifyingListener struct {
+  net.Listener
+  closed chan<- struct{}
+}
+
+func (l *closeNotifyingListener) Accept() (net.Conn, error) {
+  conn, err := l.Listener.Accept()
+  if err != nil {
+    return nil, err
+  }
+  return &closeNotifyingConn{Conn: conn, closed: l.closed}, nil
+}
+
+type closeNotifyingConn struct {
+  net.Conn
+  closed chan<- struct{}
+  once sync.Once
+}
+
+func (c *closeNotifyingConn) Close() error {
+  err := c.Conn.Close()
+  c.once.Do(func() {
+    select {
+    case c.closed <- struct{}{}:
+    default:
+    }
+  })
+  return err
+}
+
+// Serves over TLS the way StartServer does. Returns the URL and a func to
+// stop it.
+func newOwnedTLSTestServer(t *testing.T) (string, func()) {
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  tlsConfig := main.TLSConfig()
+  tlsConfig.Certificates = []tls.Certificate{selfSignedCertificate(t, "127.0.0.1")}
+
+  server := &http.Server{Handler: main.Handlers()}
+  go server.Serve(main.OwnTLSConnections(server, listener, tlsConfig))
+
+  return "https://" + listener.Addr().String(), func() { server.Close() }
+}
+
+func selfSignedCertificate(t *testing.T, host string) tls.Certificate {
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  template := &x509.Certificate{
+    SerialNumber: big.NewInt(1),
+    Subject: pkix.Name{CommonName: host},
+    NotBefore: time.Now().Add(-time.Hour),
+    NotAfter: time.Now().Add(time.Hour),
+    KeyUsage: x509.KeyUsageDigitalSignature,
+    ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+    IPAddresses: []net.IP{net.ParseIP(host)},
+  }
+
+  der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestOwnedConnSecretResponse(t *testing.T) {
+  testServer := newOwnedTestServer()
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  response, err := http.Post(testServer.URL + "/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27", "application/octet-stream", strings.NewReader("this is my secret"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  response.Body.Close()
+
+  if response.StatusCode != 201 || !response.Close {
+    t.Errorf("Expected 201 and the connection closed, got %d and close=%v", response.StatusCode, response.Close)
+  }
+
+  response, err = http.Get(testServer.URL + "/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27")
+  if err != nil {
+    t.Fatal(err)
+  }
+  body, _ := ioutil.ReadAll(response.Body)
+  response.Body.Close()
+
+  if response.StatusCode != 200 {
+    t.Errorf("Expected status 200, got %d", response.StatusCode)
+  }
+
+  if string(body) != "this is my secret" {
+    t.Errorf("Expected \"this is my secret\", got %q", body)
+  }
+
+  if !response.Close || response.ContentLength != int64(len("this is my secret")) {
+    t.Errorf("Expected a closed connection and Content-Length, got close=%v length=%d", response.Close, response.ContentLength)
+  }
+
+  if response.Header.Get("X-Note-Code") == "" || response.Header.Get("Deprecation") == "" {
+    t.Errorf("Expected the handler's headers, got %v", response.Header)
+  }
+
+  // Non-secret responses keep the connection alive.
+  response, err = http.Get(testServer.URL + "/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27")
+  if err != nil {
+    t.Fatal(err)
+  }
+  response.Body.Close()
+
+  if response.StatusCode != 403 || response.Close {
+    t.Errorf("Expected 403 on a kept-alive connection, got %d and close=%v", response.StatusCode, response.Close)
+  }
+}
+
+func TestOwnedTLSConnSecretClearedFromMemory(t *testing.T) {
+  url, stop := newOwnedTLSTestServer(t)
+  defer stop()
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  err := exec.Command("sh", "-c", "head -c 16 /dev/urandom > /tmp/random_secret").Run()
+  defer os.Remove("/tmp/random_secret")
+  if err != nil {
+    t.Fatal("Error generating random secret:", err)
+  }
+
+  out, err := exec.Command("curl", "-k", "-s", "--data-binary", "@/tmp/random_secret", url + "/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27").Output()
+  if err != nil {
+    t.Fatal("Error POSTing random secret:", err, out)
+  }
+
+  // Compared with cmp so the test process never holds the secret itself.
+  err = exec.Command("curl", "-k", "-s", "-o", "/tmp/opened_secret", url + "/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27").Run()
+  defer os.Remove("/tmp/opened_secret")
+  if err != nil {
+    t.Fatal("Error GETing secret:", err)
+  }
+
+  err = exec.Command("cmp", "-s", "/tmp/random_secret", "/tmp/opened_secret").Run()
+  if err != nil {
+    t.Error("Expected the opened secret to match the sent one")
+  }
+
+  // The client can finish reading before the server finishes closing.
+  time.Sleep(100 * time.Millisecond)
+
+  f, err := os.Create("/tmp/heapdump")
+  if err != nil {
+    t.Fatal("Error creating /tmp/heapdump:", err)
+  }
+  defer os.Remove("/tmp/heapdump")
+
+  debug.WriteHeapDump(f.Fd())
+  f.Close()
+
+  dump, err := ioutil.ReadFile("/tmp/heapdump")
+  if err != nil {
+    t.Fatal("Error reading /tmp/heapdump:", err)
+  }
+
+  randomSecret, err := ioutil.ReadFile("/tmp/random_secret")
+  if err != nil {
+    t.Fatal("Error reading random secret:", err)
+  }
+
+  if bytes.Contains(dump, randomSecret) {
+    t.Error("Secret not cleared from memory", randomSecret)
+  }
+}
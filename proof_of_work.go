@@ -0,0 +1,251 @@
+package main
+
+import (
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/hex"
+  "github.com/brianhempel/sneakynote.com/logs"
+  "io"
+  "log/slog"
+  "math/bits"
+  "net/http"
+  "os"
+  "strconv"
+  "strings"
+  "sync/atomic"
+  "time"
+)
+
+// Hashcash-style admission control. While the store has plenty of room,
+// creating a note costs nothing. Below the threshold, POSTs must carry the
+// solution to a challenge, and the challenges get harder as the room runs
+// out, so filling the ramdisk gets expensive before it gets full.
+//
+// A solution is a nonce where sha256(challenge + ":" + nonce) starts with
+// the challenge's difficulty in zero bits.
+
+const (
+  proofOfWorkChallengeLifetime = 5 * time.Minute
+  // Browsers solve with SJCL, so keep the worst case to a few seconds.
+  defaultProofOfWorkMinDifficulty = 12
+  defaultProofOfWorkMaxDifficulty = 20
+)
+
+var (
+  // Zero means proof of work is off, which is what tests get unless they
+  // configure it.
+  proofOfWorkThreshold int = 0
+  proofOfWorkMinDifficulty int = defaultProofOfWorkMinDifficulty
+  proofOfWorkMaxDifficulty int = defaultProofOfWorkMaxDifficulty
+
+  // Challenges are signed rather than remembered. Made at start, or read
+  // from the old process on handoff (see handoff.go), so challenges issued
+  // before it are still good after. Solved ones are remembered in the store,
+  // so each is only good once.
+  proofOfWorkKey []byte
+  inheritedProofOfWorkKey []byte
+
+  proofOfWorkChallengedCount uint64 = 0
+  proofOfWorkSolvedCount uint64 = 0
+)
+
+// Reads SNEAKYNOTE_POW_THRESHOLD, the available bytes below which proof of
+// work is required (default 16MB, "off" to disable), and
+// SNEAKYNOTE_POW_MIN_DIFFICULTY and SNEAKYNOTE_POW_MAX_DIFFICULTY in bits.
+func ConfigureProofOfWork() {
+  threshold := os.Getenv("SNEAKYNOTE_POW_THRESHOLD")
+  if threshold == "off" {
+    proofOfWorkThreshold = 0
+    return
+  }
+
+  proofOfWorkThreshold = envInt("SNEAKYNOTE_POW_THRESHOLD", 1024*1024*16)
+  proofOfWorkMinDifficulty = envInt("SNEAKYNOTE_POW_MIN_DIFFICULTY", defaultProofOfWorkMinDifficulty)
+  proofOfWorkMaxDifficulty = envInt("SNEAKYNOTE_POW_MAX_DIFFICULTY", defaultProofOfWorkMaxDifficulty)
+
+  if proofOfWorkMinDifficulty < 1 || proofOfWorkMaxDifficulty < proofOfWorkMinDifficulty || proofOfWorkMaxDifficulty > 32 {
+    logs.Fatal("Proof of work difficulty must satisfy 1 <= min <= max <= 32")
+  }
+
+  if inheritedProofOfWorkKey != nil {
+    proofOfWorkKey = inheritedProofOfWorkKey
+  } else {
+    proofOfWorkKey = make([]byte, 32)
+    _, err := rand.Read(proofOfWorkKey)
+    if err != nil {
+      logs.Fatal("Generating proof of work key", logs.Err(err))
+    }
+  }
+
+  slog.Info("Proof of work", "below_bytes", proofOfWorkThreshold, "min_difficulty", proofOfWorkMinDifficulty, "max_difficulty", proofOfWorkMaxDifficulty)
+}
+
+// The read end of a pipe holding the key, for the new process on handoff.
+// Empty if there's no key. A pipe rather than the environment, which anyone
+// who can read /proc/<pid>/environ could see.
+func proofOfWorkKeyPipe() (*os.File, error) {
+  reader, writer, err := os.Pipe()
+  if err != nil {
+    return nil, err
+  }
+  defer writer.Close()
+
+  if proofOfWorkKey != nil {
+    if _, err = writer.Write(proofOfWorkKey); err != nil {
+      reader.Close()
+      return nil, err
+    }
+  }
+  return reader, nil
+}
+
+// Reads the key the old process wrote with proofOfWorkKeyPipe. Nil if it
+// sent none.
+func readInheritedProofOfWorkKey(file *os.File) []byte {
+  defer file.Close()
+
+  key, err := io.ReadAll(io.LimitReader(file, 64))
+  if err != nil || len(key) == 0 {
+    return nil
+  }
+  if len(key) != 32 {
+    slog.Warn("Ignoring invalid proof of work key from the old process")
+    return nil
+  }
+  return key
+}
+
+func DisableProofOfWork() {
+  proofOfWorkThreshold = 0
+}
+
+func envInt(name string, defaultValue int) int {
+  value := os.Getenv(name)
+  if value == "" {
+    return defaultValue
+  }
+
+  i, err := strconv.Atoi(value)
+  if err != nil {
+    logs.Fatal("Invalid " + name, logs.Err(err))
+  }
+  return i
+}
+
+// Zero when no work is needed. Rises linearly from the minimum at the
+// threshold to the maximum when the store is full.
+func proofOfWorkDifficulty(available int) int {
+  if proofOfWorkThreshold <= 0 || available >= proofOfWorkThreshold {
+    return 0
+  }
+
+  if available < 0 {
+    available = 0
+  }
+
+  scarcity := 1 - float64(available) / float64(proofOfWorkThreshold)
+  return proofOfWorkMinDifficulty + int(scarcity * float64(proofOfWorkMaxDifficulty - proofOfWorkMinDifficulty) + 0.5)
+}
+
+// Wraps a note-creating handler. When the store is short on room and the
+// request doesn't carry a fresh solution, responds 428 with a challenge.
+func proofOfWorkRequired(handler http.HandlerFunc) http.HandlerFunc {
+  return func(response http.ResponseWriter, request *http.Request) {
+    if proofOfWorkDone(response, request, 1) {
+      handler(response, request)
+    }
+  }
+}
+
+// Whether the request carries a fresh solution, if one is needed. If not,
+// responds 428 with a challenge. A request creating more than one note gets
+// a challenge harder by log2 of the count, good only for that many notes.
+func proofOfWorkDone(response http.ResponseWriter, request *http.Request, notes int) bool {
+  difficulty := proofOfWorkDifficulty(mainStore.AvailableMemory())
+
+  if difficulty == 0 {
+    return true
+  }
+
+  boundTo := request.URL.Path
+  if notes > 1 {
+    difficulty += bits.Len(uint(notes - 1))
+    boundTo += "?notes=" + strconv.Itoa(notes)
+  }
+
+  challenge := request.Header.Get("X-Pow-Challenge")
+  nonce := request.Header.Get("X-Pow-Nonce")
+
+  if challenge != "" && checkProofOfWork(boundTo, challenge, nonce, time.Now()) {
+    atomic.AddUint64(&proofOfWorkSolvedCount, 1)
+    return true
+  }
+
+  // Even if the body wasn't read, net/http may have buffered some of it.
+  defer zeroRequestBuffers(response, request)()
+
+  atomic.AddUint64(&proofOfWorkChallengedCount, 1)
+  respondProofOfWorkRequired(response, newProofOfWorkChallenge(boundTo, difficulty, time.Now()), difficulty)
+  return false
+}
+
+// Like "1760745600.14.<random hex>.<hmac hex>". Bound to the request path,
+// so a solution only works for the note, or size of batch, it was issued
+// for.
+func newProofOfWorkChallenge(requestPath string, difficulty int, now time.Time) string {
+  random := make([]byte, 16)
+  rand.Read(random)
+
+  unsigned := strconv.FormatInt(now.Add(proofOfWorkChallengeLifetime).Unix(), 10) + "." + strconv.Itoa(difficulty) + "." + hex.EncodeToString(random)
+
+  return unsigned + "." + proofOfWorkSignature(requestPath, unsigned)
+}
+
+func proofOfWorkSignature(requestPath string, unsigned string) string {
+  mac := hmac.New(sha256.New, proofOfWorkKey)
+  mac.Write([]byte(requestPath + "|" + unsigned))
+  return hex.EncodeToString(mac.Sum(nil))
+}
+
+func checkProofOfWork(requestPath string, challenge string, nonce string, now time.Time) bool {
+  parts := strings.Split(challenge, ".")
+  if len(parts) != 4 {
+    return false
+  }
+
+  unsigned := strings.Join(parts[:3], ".")
+  if !hmac.Equal([]byte(parts[3]), []byte(proofOfWorkSignature(requestPath, unsigned))) {
+    return false
+  }
+
+  expiresAt, err := strconv.ParseInt(parts[0], 10, 64)
+  if err != nil || now.Unix() > expiresAt {
+    return false
+  }
+
+  difficulty, err := strconv.Atoi(parts[1])
+  if err != nil || proofOfWorkLeadingZeroBits(challenge, nonce) < difficulty {
+    return false
+  }
+
+  spent, err := mainStore.SpendChallenge(challenge, time.Unix(expiresAt, 0))
+  if err != nil {
+    slog.Error("Error recording proof of work challenge", logs.Err(err))
+    return false
+  }
+  return spent
+}
+
+func proofOfWorkLeadingZeroBits(challenge string, nonce string) int {
+  hash := sha256.Sum256([]byte(challenge + ":" + nonce))
+
+  zeroBits := 0
+  for _, b := range hash {
+    zeroBits += bits.LeadingZeros8(b)
+    if b != 0 {
+      break
+    }
+  }
+  return zeroBits
+}
@@ -0,0 +1,198 @@
+package main_test
+
+import (
+  "crypto/sha256"
+  "github.com/brianhempel/sneakynote.com"
+  "github.com/brianhempel/sneakynote.com/client"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "strconv"
+  "strings"
+  "testing"
+)
+
+// A threshold no store reaches, so every POST is challenged.
+func withProofOfWork() func() {
+  os.Setenv("SNEAKYNOTE_POW_THRESHOLD", "4611686018427387904")
+  os.Setenv("SNEAKYNOTE_POW_MIN_DIFFICULTY", "4")
+  os.Setenv("SNEAKYNOTE_POW_MAX_DIFFICULTY", "8")
+  main.ConfigureProofOfWork()
+
+  return func() {
+    os.Unsetenv("SNEAKYNOTE_POW_THRESHOLD")
+    os.Unsetenv("SNEAKYNOTE_POW_MIN_DIFFICULTY")
+    os.Unsetenv("SNEAKYNOTE_POW_MAX_DIFFICULTY")
+    main.DisableProofOfWork()
+  }
+}
+
+func postWithProofOfWork(t *testing.T, url string, challenge string, nonce string) *http.Response {
+  request, _ := http.NewRequest("POST", url, strings.NewReader("this is my secret"))
+  request.Header.Set("Content-Type", "application/octet-stream")
+  if challenge != "" {
+    request.Header.Set("X-Pow-Challenge", challenge)
+    request.Header.Set("X-Pow-Nonce", nonce)
+  }
+
+  response, err := http.DefaultClient.Do(request)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return response
+}
+
+func TestPostNoteProofOfWork(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+  defer withProofOfWork()()
+
+  noteURL := testServer.URL + "/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27"
+
+  response := postWithProofOfWork(t, noteURL, "", "")
+
+  if response.StatusCode != 428 {
+    t.Errorf("Expected status 428, got %d", response.StatusCode)
+  }
+
+  // Nearly empty, so nearly the maximum.
+  if response.Header.Get("X-Pow-Difficulty") != "8" {
+    t.Errorf("Expected \"X-Pow-Difficulty: 8\", got %s", response.Header.Get("X-Pow-Difficulty"))
+  }
+
+  challenge := response.Header.Get("X-Pow-Challenge")
+  expectErrorType(t, response, "proof_of_work_required")
+
+  // Wrong nonce: the first byte of its hash isn't zero.
+  wrongNonce := 0
+  for sha256.Sum256([]byte(challenge + ":" + strconv.Itoa(wrongNonce)))[0] == 0 {
+    wrongNonce++
+  }
+  response = postWithProofOfWork(t, noteURL, challenge, strconv.Itoa(wrongNonce))
+  response.Body.Close()
+  if response.StatusCode != 428 {
+    t.Errorf("Expected status 428 for a wrong nonce, got %d", response.StatusCode)
+  }
+
+  nonce := client.SolveProofOfWork(challenge, 8)
+
+  // Solutions are bound to the note they were issued for.
+  response = postWithProofOfWork(t, testServer.URL + "/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a28", challenge, nonce)
+  response.Body.Close()
+  if response.StatusCode != 428 {
+    t.Errorf("Expected status 428 for another note, got %d", response.StatusCode)
+  }
+
+  response = postWithProofOfWork(t, noteURL, challenge, nonce)
+  response.Body.Close()
+  if response.StatusCode != 201 {
+    t.Errorf("Expected status 201, got %d", response.StatusCode)
+  }
+
+  // And only work once.
+  response = postWithProofOfWork(t, noteURL, challenge, nonce)
+  response.Body.Close()
+  if response.StatusCode != 428 {
+    t.Errorf("Expected status 428 for a reused solution, got %d", response.StatusCode)
+  }
+}
+
+func TestClientSolvesProofOfWork(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+  defer withProofOfWork()()
+
+  sneakyNote := client.New(testServer.URL)
+
+  note, err := sneakyNote.Send([]byte("this is my secret"))
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  plaintext, _, err := sneakyNote.Get(note.URL())
+  if err != nil || string(plaintext) != "this is my secret" {
+    t.Errorf("Expected \"this is my secret\", got %q %v", plaintext, err)
+  }
+}
+
+func TestNoProofOfWorkWithRoomToSpare(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  os.Setenv("SNEAKYNOTE_POW_THRESHOLD", "1")
+  main.ConfigureProofOfWork()
+  defer main.DisableProofOfWork()
+  defer os.Unsetenv("SNEAKYNOTE_POW_THRESHOLD")
+
+  response := postWithProofOfWork(t, testServer.URL + "/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27", "", "")
+  response.Body.Close()
+  if response.StatusCode != 201 {
+    t.Errorf("Expected status 201, got %d", response.StatusCode)
+  }
+}
+
+func batchOf(ids ...string) string {
+  notes := []string{}
+  for _, id := range ids {
+    notes = append(notes, "{\"id\": \"" + id + "\", \"ciphertext\": \"c2hhcmU=\"}")
+  }
+  return "{\"notes\": [" + strings.Join(notes, ",") + "]}"
+}
+
+func TestPostNotesBatchProofOfWork(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+  defer withProofOfWork()()
+
+  batchURL := testServer.URL + "/api/v1/notes:batch"
+  post := func(body string, challenge string, nonce string) *http.Response {
+    request, _ := http.NewRequest("POST", batchURL, strings.NewReader(body))
+    request.Header.Set("Content-Type", "application/json")
+    if challenge != "" {
+      request.Header.Set("X-Pow-Challenge", challenge)
+      request.Header.Set("X-Pow-Nonce", nonce)
+    }
+    response, err := http.DefaultClient.Do(request)
+    if err != nil {
+      t.Fatal(err)
+    }
+    response.Body.Close()
+    return response
+  }
+
+  oneNote := batchOf("fc2a4122-e81e-4b10-a31b-d79fbdb33a27")
+  fourNotes := batchOf("fc2a4122-e81e-4b10-a31b-d79fbdb33a27", "fc2a4122-e81e-4b10-a31b-d79fbdb33a28", "fc2a4122-e81e-4b10-a31b-d79fbdb33a29", "fc2a4122-e81e-4b10-a31b-d79fbdb33a2a")
+
+  response := post(oneNote, "", "")
+  if response.StatusCode != 428 || response.Header.Get("X-Pow-Difficulty") != "8" {
+    t.Errorf("Expected 428 at difficulty 8 for one note, got %d at %s", response.StatusCode, response.Header.Get("X-Pow-Difficulty"))
+  }
+  oneNoteChallenge := response.Header.Get("X-Pow-Challenge")
+  oneNoteNonce := client.SolveProofOfWork(oneNoteChallenge, 8)
+
+  // Two more bits for four notes.
+  response = post(fourNotes, "", "")
+  if response.StatusCode != 428 || response.Header.Get("X-Pow-Difficulty") != "10" {
+    t.Errorf("Expected 428 at difficulty 10 for four notes, got %d at %s", response.StatusCode, response.Header.Get("X-Pow-Difficulty"))
+  }
+  challenge := response.Header.Get("X-Pow-Challenge")
+
+  // A solution for one note doesn't buy four.
+  response = post(fourNotes, oneNoteChallenge, oneNoteNonce)
+  if response.StatusCode != 428 {
+    t.Errorf("Expected status 428 for a one note solution, got %d", response.StatusCode)
+  }
+
+  response = post(fourNotes, challenge, client.SolveProofOfWork(challenge, 10))
+  if response.StatusCode != 201 {
+    t.Errorf("Expected status 201, got %d", response.StatusCode)
+  }
+}
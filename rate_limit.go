@@ -0,0 +1,287 @@
+package main
+
+import (
+  "errors"
+  "github.com/brianhempel/sneakynote.com/logs"
+  "log/slog"
+  "math"
+  "net"
+  "net/http"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+const (
+  // Enough for every client of a busy day.
+  defaultRateLimitMaxClients = 100000
+)
+
+// Nil means unlimited, which is what tests get unless they configure limits.
+var (
+  createRateLimiter *rateLimiter
+  retrieveRateLimiter *rateLimiter
+  statusRateLimiter *rateLimiter
+
+  // X-Forwarded-For is only believed when the connection comes from one of
+  // these.
+  trustedProxies []*net.IPNet
+
+  // Buckets each limiter keeps before forgetting the longest idle.
+  rateLimitMaxClients = defaultRateLimitMaxClients
+
+  createRateLimitedCount uint64 = 0
+  retrieveRateLimitedCount uint64 = 0
+  statusRateLimitedCount uint64 = 0
+)
+
+// Token buckets per client IP, or per /64 for IPv6. A bucket holds up to
+// capacity tokens and refills completely over period.
+type rateLimiter struct {
+  capacity float64
+  period time.Duration
+  limitedCount *uint64
+  maxBuckets int
+
+  mutex sync.Mutex
+  buckets map[string]*tokenBucket
+  lastPruneTime time.Time
+}
+
+type tokenBucket struct {
+  tokens float64
+  updatedAt time.Time
+}
+
+// Reads SNEAKYNOTE_CREATE_RATE_LIMIT, SNEAKYNOTE_RETRIEVE_RATE_LIMIT and
+// SNEAKYNOTE_STATUS_RATE_LIMIT, each like "30/1m" or "off",
+// SNEAKYNOTE_RATE_LIMIT_CLIENTS, how many clients each limit keeps track of
+// (default 100000), and SNEAKYNOTE_TRUSTED_PROXIES, a comma separated list of
+// IPs and CIDRs.
+func ConfigureRateLimits() {
+  rateLimitMaxClients = envInt("SNEAKYNOTE_RATE_LIMIT_CLIENTS", defaultRateLimitMaxClients)
+  if rateLimitMaxClients < 1 {
+    logs.Fatal("SNEAKYNOTE_RATE_LIMIT_CLIENTS must be at least 1")
+  }
+
+  createRateLimiter = rateLimiterFromEnv("SNEAKYNOTE_CREATE_RATE_LIMIT", "30/1m", &createRateLimitedCount)
+  retrieveRateLimiter = rateLimiterFromEnv("SNEAKYNOTE_RETRIEVE_RATE_LIMIT", "60/1m", &retrieveRateLimitedCount)
+  // Generous enough for a send page long-polling the status of a few notes.
+  statusRateLimiter = rateLimiterFromEnv("SNEAKYNOTE_STATUS_RATE_LIMIT", "300/1m", &statusRateLimitedCount)
+
+  trustedProxies = nil
+  for _, proxy := range strings.Split(os.Getenv("SNEAKYNOTE_TRUSTED_PROXIES"), ",") {
+    proxy = strings.TrimSpace(proxy)
+    if proxy == "" {
+      continue
+    }
+    if !strings.Contains(proxy, "/") {
+      if strings.Contains(proxy, ":") {
+        proxy += "/128"
+      } else {
+        proxy += "/32"
+      }
+    }
+    _, network, err := net.ParseCIDR(proxy)
+    if err != nil {
+      logs.Fatal("Invalid SNEAKYNOTE_TRUSTED_PROXIES entry", "entry", proxy)
+    }
+    trustedProxies = append(trustedProxies, network)
+  }
+}
+
+func DisableRateLimits() {
+  createRateLimiter = nil
+  retrieveRateLimiter = nil
+  statusRateLimiter = nil
+  trustedProxies = nil
+}
+
+func rateLimiterFromEnv(name string, defaultLimit string, limitedCount *uint64) *rateLimiter {
+  limit := os.Getenv(name)
+  if limit == "" {
+    limit = defaultLimit
+  }
+
+  if limit == "off" {
+    return nil
+  }
+
+  limiter, err := newRateLimiter(limit, limitedCount)
+  if err != nil {
+    logs.Fatal("Invalid " + name, logs.Err(err))
+  }
+
+  slog.Info("Rate limit", "name", name, "limit", limit)
+  return limiter
+}
+
+// limit is like "30/1m": 30 requests, refilled over a minute.
+func newRateLimiter(limit string, limitedCount *uint64) (*rateLimiter, error) {
+  parts := strings.SplitN(limit, "/", 2)
+  if len(parts) != 2 {
+    return nil, errors.New("Rate limit must look like 30/1m")
+  }
+
+  capacity, err := strconv.Atoi(parts[0])
+  if err != nil || capacity < 1 {
+    return nil, errors.New("Rate limit must allow at least 1 request")
+  }
+
+  period, err := time.ParseDuration(parts[1])
+  if err != nil || period <= 0 {
+    return nil, errors.New("Rate limit period must be a positive duration like 1m")
+  }
+
+  return &rateLimiter{
+    capacity: float64(capacity),
+    period: period,
+    limitedCount: limitedCount,
+    maxBuckets: rateLimitMaxClients,
+    buckets: make(map[string]*tokenBucket),
+    lastPruneTime: time.Now(),
+  }, nil
+}
+
+// Takes tokens from the client's bucket. If there aren't enough, returns how
+// long until there will be. Costing more than the bucket holds needs it
+// full, and leaves it owing the rest.
+func (l *rateLimiter) take(client string, tokens float64, now time.Time) (bool, time.Duration) {
+  l.mutex.Lock()
+  defer l.mutex.Unlock()
+
+  if now.Sub(l.lastPruneTime) > l.period {
+    l.prune(now)
+  }
+
+  bucket, ok := l.buckets[client]
+  if !ok {
+    if len(l.buckets) >= l.maxBuckets {
+      l.prune(now)
+    }
+    if len(l.buckets) >= l.maxBuckets {
+      l.forgetLongestIdle()
+    }
+    bucket = &tokenBucket{tokens: l.capacity, updatedAt: now}
+    l.buckets[client] = bucket
+  }
+
+  refillPerSecond := l.capacity / l.period.Seconds()
+
+  bucket.tokens = math.Min(l.capacity, bucket.tokens + now.Sub(bucket.updatedAt).Seconds() * refillPerSecond)
+  bucket.updatedAt = now
+
+  needed := math.Min(tokens, l.capacity)
+  if bucket.tokens < needed {
+    wait := time.Duration((needed - bucket.tokens) / refillPerSecond * float64(time.Second))
+    return false, wait
+  }
+
+  bucket.tokens -= tokens
+  return true, 0
+}
+
+// Buckets that have refilled are the same as no bucket.
+func (l *rateLimiter) prune(now time.Time) {
+  refillPerSecond := l.capacity / l.period.Seconds()
+  for client, bucket := range l.buckets {
+    if bucket.tokens + now.Sub(bucket.updatedAt).Seconds() * refillPerSecond >= l.capacity {
+      delete(l.buckets, client)
+    }
+  }
+  l.lastPruneTime = now
+}
+
+// Forgets the longest idle tenth of the buckets, so a client cycling through
+// addresses can't grow the map without bound. A tenth at once, so a full map
+// isn't sorted for every new client.
+func (l *rateLimiter) forgetLongestIdle() {
+  updatedAts := make([]time.Time, 0, len(l.buckets))
+  for _, bucket := range l.buckets {
+    updatedAts = append(updatedAts, bucket.updatedAt)
+  }
+  sort.Slice(updatedAts, func(i, j int) bool { return updatedAts[i].Before(updatedAts[j]) })
+
+  cutoff := updatedAts[len(updatedAts) / 10]
+  for client, bucket := range l.buckets {
+    if !bucket.updatedAt.After(cutoff) {
+      delete(l.buckets, client)
+    }
+  }
+}
+
+// Wraps a note handler. Over the limit, responds 429 instead.
+func rateLimited(limiter *rateLimiter, handler http.HandlerFunc) http.HandlerFunc {
+  return func(response http.ResponseWriter, request *http.Request) {
+    if withinRateLimit(limiter, 1, response, request) {
+      handler(response, request)
+    }
+  }
+}
+
+// For requests that cost more than one token, like a batch of notes, once
+// the handler knows how many. Over the limit, responds 429 and returns false.
+func withinRateLimit(limiter *rateLimiter, tokens int, response http.ResponseWriter, request *http.Request) bool {
+  if limiter == nil {
+    return true
+  }
+
+  ok, wait := limiter.take(rateLimitKey(clientIP(request)), float64(tokens), time.Now())
+  if !ok {
+    atomic.AddUint64(limiter.limitedCount, 1)
+    respondRateLimited(response, wait)
+  }
+  return ok
+}
+
+// A client with IPv6 usually has a whole /64 to pick addresses from, so it
+// gets one bucket for all of them. IPv4 clients get one each.
+func rateLimitKey(ip string) string {
+  return logs.MaskIP(ip, 32, 64)
+}
+
+// The connecting IP, unless that's a trusted proxy. Then the rightmost
+// X-Forwarded-For entry that isn't a trusted proxy, since everything left of
+// it could have been made up by the client.
+func clientIP(request *http.Request) string {
+  host, _, err := net.SplitHostPort(request.RemoteAddr)
+  if err != nil {
+    host = request.RemoteAddr
+  }
+
+  if !isTrustedProxy(host) {
+    return host
+  }
+
+  forwardedFor := strings.Split(strings.Join(request.Header["X-Forwarded-For"], ","), ",")
+  for i := len(forwardedFor) - 1; i >= 0; i-- {
+    forwarded := strings.TrimSpace(forwardedFor[i])
+    if forwarded == "" {
+      continue
+    }
+    host = forwarded
+    if !isTrustedProxy(forwarded) {
+      break
+    }
+  }
+
+  return host
+}
+
+func isTrustedProxy(host string) bool {
+  ip := net.ParseIP(host)
+  if ip == nil {
+    return false
+  }
+
+  for _, network := range trustedProxies {
+    if network.Contains(ip) {
+      return true
+    }
+  }
+  return false
+}
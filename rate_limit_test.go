@@ -0,0 +1,215 @@
+package main_test
+
+import (
+  "github.com/brianhempel/sneakynote.com"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "strconv"
+  "strings"
+  "testing"
+)
+
+func withRateLimits(env map[string]string) func() {
+  for name, value := range env {
+    os.Setenv(name, value)
+  }
+  main.ConfigureRateLimits()
+
+  return func() {
+    for name := range env {
+      os.Unsetenv(name)
+    }
+    main.DisableRateLimits()
+  }
+}
+
+func TestCreateRateLimit(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+  defer withRateLimits(map[string]string{"SNEAKYNOTE_CREATE_RATE_LIMIT": "2/1h"})()
+
+  ids := []string{"fc2a4122-e81e-4b10-a31b-d79fbdb33a27", "fc2a4122-e81e-4b10-a31b-d79fbdb33a28", "fc2a4122-e81e-4b10-a31b-d79fbdb33a29"}
+
+  for i, id := range ids {
+    response, err := http.Post(testServer.URL + "/notes/" + id, "application/octet-stream", strings.NewReader("this is my secret"))
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    if i < 2 {
+      response.Body.Close()
+      if response.StatusCode != 201 {
+        t.Errorf("Expected status 201, got %d", response.StatusCode)
+      }
+      continue
+    }
+
+    if response.StatusCode != 429 {
+      t.Errorf("Expected status 429, got %d", response.StatusCode)
+    }
+
+    // A token every 30 minutes.
+    if response.Header.Get("Retry-After") != "1800" {
+      t.Errorf("Expected \"Retry-After: 1800\", got %s", response.Header.Get("Retry-After"))
+    }
+
+    expectErrorType(t, response, "rate_limited")
+  }
+
+  // Other limits are separate.
+  response, _ := http.Get(testServer.URL + "/api/v1/notes/" + ids[0])
+  response.Body.Close()
+  if response.StatusCode != 200 {
+    t.Errorf("Expected status 200, got %d", response.StatusCode)
+  }
+}
+
+func TestRateLimitTrustedProxies(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  statusFrom := func(forwardedFor string) int {
+    request, _ := http.NewRequest("GET", testServer.URL + "/api/v1/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27/status", nil)
+    request.Header.Set("X-Forwarded-For", forwardedFor)
+    response, err := http.DefaultClient.Do(request)
+    if err != nil {
+      t.Fatal(err)
+    }
+    response.Body.Close()
+    return response.StatusCode
+  }
+
+  // Untrusted: X-Forwarded-For is ignored, so both count against 127.0.0.1.
+  restore := withRateLimits(map[string]string{"SNEAKYNOTE_STATUS_RATE_LIMIT": "1/1h"})
+  if status := statusFrom("203.0.113.1"); status != 404 {
+    t.Errorf("Expected status 404, got %d", status)
+  }
+  if status := statusFrom("203.0.113.2"); status != 429 {
+    t.Errorf("Expected status 429, got %d", status)
+  }
+  restore()
+
+  // Trusted: each forwarded client gets its own bucket. Spoofed entries left
+  // of what the proxy appended don't help.
+  defer withRateLimits(map[string]string{"SNEAKYNOTE_STATUS_RATE_LIMIT": "1/1h", "SNEAKYNOTE_TRUSTED_PROXIES": "10.0.0.0/8, 127.0.0.1"})()
+  if status := statusFrom("203.0.113.1"); status != 404 {
+    t.Errorf("Expected status 404, got %d", status)
+  }
+  if status := statusFrom("203.0.113.2, 10.1.2.3"); status != 404 {
+    t.Errorf("Expected status 404, got %d", status)
+  }
+  if status := statusFrom("198.51.100.7, 203.0.113.1"); status != 429 {
+    t.Errorf("Expected status 429, got %d", status)
+  }
+}
+
+func TestRateLimitBucketsIPv6By64(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+  defer withRateLimits(map[string]string{"SNEAKYNOTE_STATUS_RATE_LIMIT": "1/1h", "SNEAKYNOTE_TRUSTED_PROXIES": "127.0.0.1"})()
+
+  statusFrom := func(forwardedFor string) int {
+    request, _ := http.NewRequest("GET", testServer.URL + "/api/v1/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27/status", nil)
+    request.Header.Set("X-Forwarded-For", forwardedFor)
+    response, err := http.DefaultClient.Do(request)
+    if err != nil {
+      t.Fatal(err)
+    }
+    response.Body.Close()
+    return response.StatusCode
+  }
+
+  if status := statusFrom("2001:db8:0:1::1"); status != 404 {
+    t.Errorf("Expected status 404, got %d", status)
+  }
+  // Another address in the same /64.
+  if status := statusFrom("2001:db8:0:1:ffff::2"); status != 429 {
+    t.Errorf("Expected status 429, got %d", status)
+  }
+  if status := statusFrom("2001:db8:0:2::1"); status != 404 {
+    t.Errorf("Expected status 404 for another /64, got %d", status)
+  }
+}
+
+func TestRateLimitForgetsLongestIdleClients(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+  defer withRateLimits(map[string]string{"SNEAKYNOTE_STATUS_RATE_LIMIT": "1/1h", "SNEAKYNOTE_TRUSTED_PROXIES": "127.0.0.1", "SNEAKYNOTE_RATE_LIMIT_CLIENTS": "10"})()
+
+  statusFrom := func(forwardedFor string) int {
+    request, _ := http.NewRequest("GET", testServer.URL + "/api/v1/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27/status", nil)
+    request.Header.Set("X-Forwarded-For", forwardedFor)
+    response, err := http.DefaultClient.Do(request)
+    if err != nil {
+      t.Fatal(err)
+    }
+    response.Body.Close()
+    return response.StatusCode
+  }
+
+  statusFrom("203.0.113.1")
+  if status := statusFrom("203.0.113.1"); status != 429 {
+    t.Errorf("Expected status 429, got %d", status)
+  }
+
+  // Ten more clients fill the map, and the first is forgotten to make room.
+  for i := 2; i <= 11; i++ {
+    if status := statusFrom("203.0.113." + strconv.Itoa(i)); status != 404 {
+      t.Errorf("Expected status 404, got %d", status)
+    }
+  }
+  if status := statusFrom("203.0.113.1"); status != 404 {
+    t.Errorf("Expected the longest idle client forgotten, got %d", status)
+  }
+}
+
+func TestCreateRateLimitChargesBatchesPerNote(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+  defer withRateLimits(map[string]string{"SNEAKYNOTE_CREATE_RATE_LIMIT": "3/1h"})()
+
+  postBatch := func(body string) *http.Response {
+    response, err := http.Post(testServer.URL + "/api/v1/notes:batch", "application/json", strings.NewReader(body))
+    if err != nil {
+      t.Fatal(err)
+    }
+    return response
+  }
+
+  response := postBatch(batchOf("fc2a4122-e81e-4b10-a31b-d79fbdb33a27", "fc2a4122-e81e-4b10-a31b-d79fbdb33a28"))
+  response.Body.Close()
+  if response.StatusCode != 201 {
+    t.Errorf("Expected status 201, got %d", response.StatusCode)
+  }
+
+  // One token left, not enough for two notes.
+  response = postBatch(batchOf("fc2a4122-e81e-4b10-a31b-d79fbdb33a29", "fc2a4122-e81e-4b10-a31b-d79fbdb33a2a"))
+  if response.StatusCode != 429 {
+    t.Errorf("Expected status 429, got %d", response.StatusCode)
+  }
+  // 20 minutes a token.
+  if response.Header.Get("Retry-After") != "1200" {
+    t.Errorf("Expected \"Retry-After: 1200\", got %s", response.Header.Get("Retry-After"))
+  }
+  expectErrorType(t, response, "rate_limited")
+
+  response, err := http.Post(testServer.URL + "/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a29", "application/octet-stream", strings.NewReader("this is my secret"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  response.Body.Close()
+  if response.StatusCode != 201 {
+    t.Errorf("Expected the last token to buy one note, got %d", response.StatusCode)
+  }
+}
@@ -0,0 +1,6 @@
+./gzip_assets.sh
+
+# The running server hands its sockets to the new binary and drains, so no
+# connections are dropped. Only the newest process is still listening for
+# this; older ones draining ignore it.
+sudo pkill -USR2 -x sneakynote.com && echo "sneakynote.com restarting"
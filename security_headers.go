@@ -0,0 +1,263 @@
+package main
+
+import (
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "github.com/brianhempel/sneakynote.com/logs"
+  "io/ioutil"
+  "log/slog"
+  "net/http"
+  "os"
+  "path"
+  "regexp"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+// Security headers for every response, set per path prefix. The
+// Content-Security-Policy allows no inline code except what is on the page
+// right now: the placeholders below are replaced with the SHA-256 hashes of
+// the page's inline scripts and styles, recomputed when the file changes.
+//
+// SNEAKYNOTE_SECURITY_HEADERS may name a JSON file of overrides:
+//
+//   {"/send": {"Permissions-Policy": "accelerometer=(self)"}}
+//
+// Every prefix that matches a path applies in order from shortest to
+// longest, so an override only needs the headers it changes. An empty value
+// drops the header.
+
+const (
+  scriptHashesPlaceholder = "{script-hashes}"
+  styleHashesPlaceholder = "{style-hashes}"
+)
+
+type SecurityHeaders map[string]string
+
+var (
+  defaultSecurityHeaders = map[string]SecurityHeaders{
+    "/": {
+      "Content-Security-Policy": "default-src 'none'; script-src " + scriptHashesPlaceholder + "; style-src 'self' " + styleHashesPlaceholder + "; img-src 'self'; connect-src 'self'; base-uri 'none'; form-action 'none'; frame-ancestors 'none'",
+      "Referrer-Policy": "no-referrer",
+      "X-Frame-Options": "DENY",
+      "X-Content-Type-Options": "nosniff",
+      "Permissions-Policy": "accelerometer=(), camera=(), geolocation=(), gyroscope=(), magnetometer=(), microphone=(), payment=(), usb=()",
+      "Cross-Origin-Opener-Policy": "same-origin",
+    },
+    // SJCL gathers entropy from device motion.
+    "/send": {
+      "Permissions-Policy": "accelerometer=(self), camera=(), geolocation=(), gyroscope=(self), magnetometer=(), microphone=(), payment=(), usb=()",
+    },
+    "/notes/": {
+      "Content-Security-Policy": "default-src 'none'; frame-ancestors 'none'",
+    },
+    "/api/": {
+      "Content-Security-Policy": "default-src 'none'; frame-ancestors 'none'",
+    },
+  }
+
+  securityHeadersMutex sync.RWMutex
+  securityHeaders = defaultSecurityHeaders
+
+  inlineScriptRegexp = regexp.MustCompile("(?is)<script(\\s[^>]*)?>(.*?)</script>")
+  inlineStyleRegexp = regexp.MustCompile("(?is)<style(\\s[^>]*)?>(.*?)</style>")
+  styleAttributeRegexp = regexp.MustCompile("(?is)\\sstyle=\"([^\"]*)\"")
+  scriptSrcRegexp = regexp.MustCompile("(?i)\\ssrc\\s*=")
+
+  inlineHashesMutex sync.Mutex
+  inlineHashesCache = map[string]*inlineHashes{}
+)
+
+type inlineHashes struct {
+  modTime time.Time
+  size int64
+  scripts []string
+  styles []string
+  // Hashes of style="" attributes, which need 'unsafe-hashes'.
+  styleAttributes []string
+}
+
+// Reads SNEAKYNOTE_SECURITY_HEADERS, the path of a JSON file of overrides.
+// Without it, the defaults apply.
+func ConfigureSecurityHeaders() {
+  if err := ReloadSecurityHeaders(); err != nil {
+    logs.Fatal("Loading security headers", logs.Err(err))
+  }
+}
+
+// Rereads SNEAKYNOTE_SECURITY_HEADERS. On error the headers in use are kept.
+func ReloadSecurityHeaders() error {
+  headers := map[string]SecurityHeaders{}
+  for prefix, prefixHeaders := range defaultSecurityHeaders {
+    headers[prefix] = SecurityHeaders{}
+    for name, value := range prefixHeaders {
+      headers[prefix][name] = value
+    }
+  }
+
+  overridesPath := os.Getenv("SNEAKYNOTE_SECURITY_HEADERS")
+  if overridesPath != "" {
+    overridesJSON, err := ioutil.ReadFile(overridesPath)
+    if err != nil {
+      return fmt.Errorf("Reading SNEAKYNOTE_SECURITY_HEADERS: %v", err)
+    }
+
+    overrides := map[string]SecurityHeaders{}
+    err = json.Unmarshal(overridesJSON, &overrides)
+    if err != nil {
+      return fmt.Errorf("Parsing SNEAKYNOTE_SECURITY_HEADERS: %v", err)
+    }
+
+    for prefix, prefixHeaders := range overrides {
+      if !strings.HasPrefix(prefix, "/") {
+        return errors.New("Security header paths must start with /, got " + prefix)
+      }
+      if headers[prefix] == nil {
+        headers[prefix] = SecurityHeaders{}
+      }
+      for name, value := range prefixHeaders {
+        headers[prefix][http.CanonicalHeaderKey(name)] = value
+      }
+    }
+
+    slog.Info("Security header overrides", "path", overridesPath, "paths", len(overrides))
+  }
+
+  securityHeadersMutex.Lock()
+  securityHeaders = headers
+  securityHeadersMutex.Unlock()
+  return nil
+}
+
+func AddSecurityHeaders(original http.Handler) http.Handler {
+  return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+    header := response.Header()
+    for name, value := range securityHeadersFor(request.URL.Path) {
+      if value == "" {
+        continue
+      }
+      if name == "Content-Security-Policy" {
+        value = expandContentSecurityPolicy(value, request.URL.Path)
+      }
+      header.Set(name, value)
+    }
+    original.ServeHTTP(response, request)
+  })
+}
+
+func securityHeadersFor(requestPath string) SecurityHeaders {
+  securityHeadersMutex.RLock()
+  defer securityHeadersMutex.RUnlock()
+
+  var prefixes []string
+  for prefix := range securityHeaders {
+    if strings.HasPrefix(requestPath, prefix) {
+      prefixes = append(prefixes, prefix)
+    }
+  }
+  sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) < len(prefixes[j]) })
+
+  headers := SecurityHeaders{}
+  for _, prefix := range prefixes {
+    for name, value := range securityHeaders[prefix] {
+      headers[name] = value
+    }
+  }
+  return headers
+}
+
+// Fills in the hash placeholders for the public file at requestPath. A
+// directive left with no sources gets 'none'.
+func expandContentSecurityPolicy(policy string, requestPath string) string {
+  if !strings.Contains(policy, scriptHashesPlaceholder) && !strings.Contains(policy, styleHashesPlaceholder) {
+    return policy
+  }
+
+  hashes := inlineHashesFor(publicFilePath(requestPath))
+
+  scriptSources := strings.Join(hashes.scripts, " ")
+  styleSources := strings.Join(hashes.styles, " ")
+  if len(hashes.styleAttributes) > 0 {
+    styleSources = strings.TrimSpace(styleSources + " 'unsafe-hashes' " + strings.Join(hashes.styleAttributes, " "))
+  }
+
+  policy = strings.Replace(policy, scriptHashesPlaceholder, scriptSources, -1)
+  policy = strings.Replace(policy, styleHashesPlaceholder, styleSources, -1)
+
+  directives := strings.Split(policy, ";")
+  for i, directive := range directives {
+    fields := strings.Fields(directive)
+    if len(fields) == 1 {
+      fields = append(fields, "'none'")
+    }
+    directives[i] = strings.Join(fields, " ")
+  }
+  return strings.Join(directives, "; ")
+}
+
+// The file http.FileServer serves for requestPath.
+func publicFilePath(requestPath string) string {
+  filePath := path.Join(publicPath(), path.Clean("/" + requestPath))
+  if fileInfo, err := os.Stat(filePath); err == nil && fileInfo.IsDir() {
+    filePath = path.Join(filePath, "index.html")
+  }
+  return filePath
+}
+
+// Cached until the file's modification time or size changes. A missing
+// file has no hashes.
+func inlineHashesFor(filePath string) *inlineHashes {
+  fileInfo, err := os.Stat(filePath)
+  if err != nil || fileInfo.IsDir() {
+    return &inlineHashes{}
+  }
+
+  inlineHashesMutex.Lock()
+  cached := inlineHashesCache[filePath]
+  inlineHashesMutex.Unlock()
+
+  if cached != nil && cached.modTime.Equal(fileInfo.ModTime()) && cached.size == fileInfo.Size() {
+    return cached
+  }
+
+  contents, err := ioutil.ReadFile(filePath)
+  if err != nil {
+    slog.Error("Error reading asset to hash", logs.Err(err))
+    return &inlineHashes{}
+  }
+
+  hashes := &inlineHashes{modTime: fileInfo.ModTime(), size: fileInfo.Size()}
+  for _, match := range inlineScriptRegexp.FindAllSubmatch(contents, -1) {
+    if !scriptSrcRegexp.Match(match[1]) {
+      hashes.scripts = appendHashSource(hashes.scripts, match[2])
+    }
+  }
+  for _, match := range inlineStyleRegexp.FindAllSubmatch(contents, -1) {
+    hashes.styles = appendHashSource(hashes.styles, match[2])
+  }
+  for _, match := range styleAttributeRegexp.FindAllSubmatch(contents, -1) {
+    hashes.styleAttributes = appendHashSource(hashes.styleAttributes, match[1])
+  }
+
+  inlineHashesMutex.Lock()
+  inlineHashesCache[filePath] = hashes
+  inlineHashesMutex.Unlock()
+
+  return hashes
+}
+
+func appendHashSource(sources []string, content []byte) []string {
+  sum := sha256.Sum256(content)
+  source := "'sha256-" + base64.StdEncoding.EncodeToString(sum[:]) + "'"
+  for _, existing := range sources {
+    if existing == source {
+      return sources
+    }
+  }
+  return append(sources, source)
+}
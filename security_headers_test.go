@@ -0,0 +1,200 @@
+package main_test
+
+import (
+  "crypto/sha256"
+  "encoding/base64"
+  "github.com/brianhempel/sneakynote.com"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "strings"
+  "testing"
+  "time"
+)
+
+func withSecurityHeaderOverrides(t *testing.T, overridesJSON string) func() {
+  err := ioutil.WriteFile("/tmp/security_headers.json", []byte(overridesJSON), 0600)
+  if err != nil {
+    t.Fatal(err)
+  }
+  os.Setenv("SNEAKYNOTE_SECURITY_HEADERS", "/tmp/security_headers.json")
+  main.ConfigureSecurityHeaders()
+
+  return func() {
+    os.Unsetenv("SNEAKYNOTE_SECURITY_HEADERS")
+    os.Remove("/tmp/security_headers.json")
+    main.ConfigureSecurityHeaders()
+  }
+}
+
+func expectedHashSource(content string) string {
+  sum := sha256.Sum256([]byte(content))
+  return "'sha256-" + base64.StdEncoding.EncodeToString(sum[:]) + "'"
+}
+
+func inlineScripts(page string) []string {
+  var scripts []string
+  for _, part := range strings.Split(page, "<script>")[1:] {
+    scripts = append(scripts, strings.Split(part, "</script>")[0])
+  }
+  return scripts
+}
+
+func TestSecurityHeadersOnCryptoPages(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+
+  for _, page := range []string{"send", "get"} {
+    response, err := http.Get(testServer.URL + "/" + page)
+    if err != nil {
+      t.Fatal(err)
+    }
+    body, _ := ioutil.ReadAll(response.Body)
+    response.Body.Close()
+
+    policy := response.Header.Get("Content-Security-Policy")
+    if !strings.HasPrefix(policy, "default-src 'none'; script-src 'sha256-") || strings.Contains(policy, "unsafe-inline") {
+      t.Errorf("Expected a strict policy for /%s, got %q", page, policy)
+    }
+
+    scripts := inlineScripts(string(body))
+    if len(scripts) == 0 {
+      t.Fatalf("Expected inline scripts in /%s", page)
+    }
+    for _, script := range scripts {
+      if !strings.Contains(policy, expectedHashSource(script)) {
+        t.Errorf("Expected the policy for /%s to allow script %s", page, expectedHashSource(script))
+      }
+    }
+
+    expectations := map[string]string{
+      "Referrer-Policy": "no-referrer",
+      "X-Frame-Options": "DENY",
+      "Cross-Origin-Opener-Policy": "same-origin",
+    }
+    for name, expected := range expectations {
+      if response.Header.Get(name) != expected {
+        t.Errorf("Expected %s: %s on /%s, got %q", name, expected, page, response.Header.Get(name))
+      }
+    }
+  }
+
+  response, err := http.Get(testServer.URL + "/send")
+  if err != nil {
+    t.Fatal(err)
+  }
+  response.Body.Close()
+  if !strings.Contains(response.Header.Get("Permissions-Policy"), "accelerometer=(self)") {
+    t.Error("Expected /send to allow the accelerometer, got", response.Header.Get("Permissions-Policy"))
+  }
+
+  response, err = http.Get(testServer.URL + "/get")
+  if err != nil {
+    t.Fatal(err)
+  }
+  response.Body.Close()
+  if !strings.Contains(response.Header.Get("Permissions-Policy"), "accelerometer=()") {
+    t.Error("Expected /get to disallow the accelerometer, got", response.Header.Get("Permissions-Policy"))
+  }
+}
+
+func TestSecurityHeadersOnApi(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  response, err := http.Get(testServer.URL + "/api/v1/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27")
+  if err != nil {
+    t.Fatal(err)
+  }
+  response.Body.Close()
+
+  if response.Header.Get("Content-Security-Policy") != "default-src 'none'; frame-ancestors 'none'" {
+    t.Error("Expected the API policy, got", response.Header.Get("Content-Security-Policy"))
+  }
+  if response.Header.Get("Referrer-Policy") != "no-referrer" {
+    t.Error("Expected Referrer-Policy: no-referrer, got", response.Header.Get("Referrer-Policy"))
+  }
+}
+
+func TestSecurityHeadersRecomputedWhenAssetChanges(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+
+  pagePath := "public/security_headers_test_page"
+  defer os.Remove(pagePath)
+
+  policyFor := func(script string, modTime time.Time) string {
+    err := ioutil.WriteFile(pagePath, []byte("<style>p { color: red; }</style><script>" + script + "</script>"), 0600)
+    if err != nil {
+      t.Fatal(err)
+    }
+    os.Chtimes(pagePath, modTime, modTime)
+
+    response, err := http.Get(testServer.URL + "/security_headers_test_page")
+    if err != nil {
+      t.Fatal(err)
+    }
+    response.Body.Close()
+    return response.Header.Get("Content-Security-Policy")
+  }
+
+  policy := policyFor("alert(1)", time.Now().Add(-time.Minute))
+  if !strings.Contains(policy, "script-src " + expectedHashSource("alert(1)") + ";") || !strings.Contains(policy, expectedHashSource("p { color: red; }")) {
+    t.Error("Expected the policy to allow the page's script and style, got", policy)
+  }
+
+  policy = policyFor("alert(2)", time.Now())
+  if !strings.Contains(policy, "script-src " + expectedHashSource("alert(2)") + ";") {
+    t.Error("Expected the policy to follow the changed script, got", policy)
+  }
+}
+
+func TestSecurityHeadersNoInlineCode(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+
+  response, err := http.Get(testServer.URL + "/robots.txt")
+  if err != nil {
+    t.Fatal(err)
+  }
+  response.Body.Close()
+
+  if !strings.Contains(response.Header.Get("Content-Security-Policy"), "script-src 'none'; style-src 'self';") {
+    t.Error("Expected no inline scripts or styles allowed, got", response.Header.Get("Content-Security-Policy"))
+  }
+}
+
+func TestSecurityHeadersOverrides(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  defer withSecurityHeaderOverrides(t, `{"/get": {"x-frame-options": "SAMEORIGIN", "Cross-Origin-Opener-Policy": ""}}`)()
+
+  response, err := http.Get(testServer.URL + "/get")
+  if err != nil {
+    t.Fatal(err)
+  }
+  response.Body.Close()
+
+  if response.Header.Get("X-Frame-Options") != "SAMEORIGIN" {
+    t.Error("Expected the overridden X-Frame-Options, got", response.Header.Get("X-Frame-Options"))
+  }
+  if _, ok := response.Header["Cross-Origin-Opener-Policy"]; ok {
+    t.Error("Expected Cross-Origin-Opener-Policy dropped, got", response.Header.Get("Cross-Origin-Opener-Policy"))
+  }
+  if response.Header.Get("Referrer-Policy") != "no-referrer" {
+    t.Error("Expected the default Referrer-Policy to remain, got", response.Header.Get("Referrer-Policy"))
+  }
+
+  response, err = http.Get(testServer.URL + "/send")
+  if err != nil {
+    t.Fatal(err)
+  }
+  response.Body.Close()
+
+  if response.Header.Get("X-Frame-Options") != "DENY" {
+    t.Error("Expected other paths untouched, got", response.Header.Get("X-Frame-Options"))
+  }
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+  "context"
+  "github.com/brianhempel/sneakynote.com/logs"
+  "log/slog"
+  "net/http"
+  "os"
+  "os/signal"
+  "sync"
+  "sync/atomic"
+  "syscall"
+  "time"
+)
+
+// On SIGINT or SIGTERM the server stops accepting connections and drains
+// for up to SNEAKYNOTE_DRAIN_TIMEOUT (default 30s): notes already being read
+// and status long polls finish, while new notes are refused with a 503. Then
+// the sweeper stops between sweeps and the final stats are logged.
+//
+// net/http's Shutdown doesn't wait on hijacked connections, and secrets go
+// out over those (see respondSecret), so note requests are also counted
+// here until their handlers return.
+
+const (
+  defaultDrainTimeout = 30 * time.Second
+)
+
+var (
+  drainTimeout = defaultDrainTimeout
+
+  draining int32
+  inFlightNoteRequestCount int64
+
+  // Closed once Shutdown has finished.
+  shutdownComplete = make(chan struct{})
+)
+
+func ConfigureShutdown() {
+  drainTimeout = envDuration("SNEAKYNOTE_DRAIN_TIMEOUT", defaultDrainTimeout)
+}
+
+// Shuts the servers down gracefully on the first SIGINT or SIGTERM.
+func ShutdownOnSignal(servers ...*http.Server) {
+  signalChan := make(chan os.Signal, 1)
+  signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+  go func() {
+    received := <-signalChan
+    slog.Info("Shutting down", "signal", received.String())
+    Shutdown(servers...)
+  }()
+}
+
+// Drains the servers, stops the sweeper, and logs final stats.
+func Shutdown(servers ...*http.Server) {
+  slog.Info("Draining", "timeout", drainTimeout.String())
+  StartDraining()
+
+  ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+  defer cancel()
+
+  var wait sync.WaitGroup
+  for _, server := range servers {
+    wait.Add(1)
+    go func(server *http.Server) {
+      defer wait.Done()
+      err := server.Shutdown(ctx)
+      if err != nil {
+        slog.Warn("Drain deadline passed, closing remaining connections", logs.Err(err))
+        server.Close()
+      }
+    }(server)
+  }
+  wait.Wait()
+
+  for atomic.LoadInt64(&inFlightNoteRequestCount) > 0 && ctx.Err() == nil {
+    time.Sleep(10 * time.Millisecond)
+  }
+  if remaining := atomic.LoadInt64(&inFlightNoteRequestCount); remaining > 0 {
+    slog.Warn("Drain deadline passed with note requests in flight", "in_flight", remaining)
+  }
+
+  StopSweeper()
+  logStatus()
+  slog.Info("Shutdown complete")
+
+  select {
+  case <-shutdownComplete:
+  default:
+    close(shutdownComplete)
+  }
+}
+
+func StartDraining() {
+  atomic.StoreInt32(&draining, 1)
+}
+
+func StopDraining() {
+  atomic.StoreInt32(&draining, 0)
+}
+
+func Draining() bool {
+  return atomic.LoadInt32(&draining) == 1
+}
+
+// Counts a note request in flight.
+func drainable(original http.Handler) http.Handler {
+  return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+    atomic.AddInt64(&inFlightNoteRequestCount, 1)
+    defer atomic.AddInt64(&inFlightNoteRequestCount, -1)
+
+    original.ServeHTTP(response, request)
+  })
+}
+
+// Refuses to create notes while draining or in maintenance. Only wraps the
+// routes that create notes: revoking a group must keep working, since an
+// incident is when maintenance goes on and when groups need killing.
+func takingNewNotes(handler http.HandlerFunc) http.HandlerFunc {
+  return func(response http.ResponseWriter, request *http.Request) {
+    if Draining() {
+      respondShuttingDown(response)
+      return
+    } else if inMaintenance() {
+      respondMaintenance(response)
+      return
+    }
+
+    handler(response, request)
+  }
+}
+
+func respondShuttingDown(response http.ResponseWriter) {
+  setRetryAfter(response, shuttingDownRetryAfter)
+  respondError(response, http.StatusServiceUnavailable, "shutting_down", "The server is shutting down and not taking new notes. Try again shortly.") // 503
+}
@@ -0,0 +1,112 @@
+package main_test
+
+import (
+  "bytes"
+  "encoding/json"
+  "github.com/brianhempel/sneakynote.com"
+  "io/ioutil"
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestShutdownDrainsInFlightGet(t *testing.T) {
+  main.SetupStore()
+  defer main.TeardownStore()
+  defer main.StopDraining()
+
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  server := &http.Server{Handler: main.Handlers()}
+  go server.Serve(main.OwnConnections(server, listener))
+  noteURL := "http://" + listener.Addr().String() + "/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27"
+
+  secret := []byte("this is my secret")
+  postSecret(t, noteURL, secret)
+
+  // Holds the GET in flight long enough to shut down underneath it.
+  defer withEqualization()()
+
+  bodies := make(chan []byte, 1)
+  go func() {
+    response, err := http.Get(noteURL)
+    if err != nil {
+      bodies <- nil
+      return
+    }
+    body, _ := ioutil.ReadAll(response.Body)
+    response.Body.Close()
+    bodies <- body
+  }()
+
+  time.Sleep(equalizedMinLatency / 4)
+  main.Shutdown(server)
+
+  select {
+  case body := <-bodies:
+    if !bytes.Equal(body, secret) {
+      t.Errorf("Expected the in-flight GET to get the secret, got %q", body)
+    }
+  default:
+    t.Error("Expected Shutdown to wait for the in-flight GET")
+  }
+
+  if _, err := http.Get(noteURL); err == nil {
+    t.Error("Expected new connections refused after shutdown")
+  }
+}
+
+func TestDrainingRefusesNewNotes(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  noteURL := testServer.URL + "/notes/fc2a4122-e81e-4b10-a31b-d79fbdb33a27"
+  code := postSecret(t, noteURL, []byte("this is my secret"))
+
+  main.StartDraining()
+  defer main.StopDraining()
+
+  for _, url := range []string{testServer.URL + "/notes/3bd5ff31-2a37-4b6f-9a0c-5d39e9a4c0a1", testServer.URL + "/api/v1/notes/3bd5ff31-2a37-4b6f-9a0c-5d39e9a4c0a1"} {
+    response, err := http.Post(url, "application/octet-stream", strings.NewReader("another secret"))
+    if err != nil {
+      t.Fatal(err)
+    }
+    errorBody := map[string]string{}
+    json.NewDecoder(response.Body).Decode(&errorBody)
+    response.Body.Close()
+
+    if response.StatusCode != http.StatusServiceUnavailable || errorBody["error_type"] != "shutting_down" {
+      t.Errorf("Expected 503 shutting_down for %s, got %d %v", url, response.StatusCode, errorBody)
+    }
+    if response.Header.Get("Retry-After") != "5" {
+      t.Errorf("Expected Retry-After of 5 seconds, got %q", response.Header.Get("Retry-After"))
+    }
+  }
+
+  request, _ := http.NewRequest("GET", noteURL + "/status", nil)
+  request.Header.Set("X-Note-Code", code)
+  response, err := http.DefaultClient.Do(request)
+  if err != nil {
+    t.Fatal(err)
+  }
+  response.Body.Close()
+  if response.StatusCode != http.StatusOK {
+    t.Errorf("Expected status still answered while draining, got %d", response.StatusCode)
+  }
+
+  response, err = http.Get(noteURL)
+  if err != nil {
+    t.Fatal(err)
+  }
+  response.Body.Close()
+  if response.StatusCode != http.StatusOK {
+    t.Errorf("Expected notes still readable while draining, got %d", response.StatusCode)
+  }
+}
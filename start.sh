@@ -3,12 +3,10 @@
 ./gzip_assets.sh
 
 sudo sh -c "SNEAKYNOTE_PORT=443 \
-SNEAKYNOTE_CERTS=/home/sneakynote/src/github.com/brianhempel/sneakynote.com/letsencrypt/config/live/sneakynote.com/fullchain.pem \
-SNEAKYNOTE_PRIVATE_KEY=/home/sneakynote/src/github.com/brianhempel/sneakynote.com/letsencrypt/config/live/sneakynote.com/privkey.pem \
-/home/sneakynote/src/github.com/brianhempel/sneakynote.com/sneakynote.com >> /home/sneakynote/src/github.com/brianhempel/sneakynote.com/log.txt 2>&1 &" && echo "sneakynote.com started"
+SNEAKYNOTE_ACME_DIRECTORY=https://acme-v02.api.letsencrypt.org/directory \
+SNEAKYNOTE_ACME_DIR=/home/sneakynote/src/github.com/brianhempel/sneakynote.com/acme \
+SNEAKYNOTE_LOG_FILE=/home/sneakynote/src/github.com/brianhempel/sneakynote.com/log.txt \
+/home/sneakynote/src/github.com/brianhempel/sneakynote.com/sneakynote.com >> /home/sneakynote/src/github.com/brianhempel/sneakynote.com/stderr.txt 2>&1 &" && echo "sneakynote.com started"
 
-sudo ./periodically_renew_certs.sh >> /home/sneakynote/src/github.com/brianhempel/sneakynote.com/log.txt 2>&1 &
-echo $! > periodically_renew_certs.sh.pid
-
-sudo ./free_memory_maximizer.sh >> /home/sneakynote/src/github.com/brianhempel/sneakynote.com/log.txt 2>&1 &
+sudo ./free_memory_maximizer.sh > /dev/null 2>&1 &
 echo $! > free_memory_maximizer.sh.pid
@@ -0,0 +1,91 @@
+package store
+
+import (
+  "errors"
+  "github.com/brianhempel/sneakynote.com/logs"
+  "log/slog"
+  "os"
+  "sync"
+  "syscall"
+)
+
+// Memory for secrets that lives outside the Go heap. The garbage collector
+// is free to copy heap objects, so zeroing a slice from make() can leave
+// older copies behind, and heap pages can be swapped to disk. A SecureBuffer
+// is mapped with mmap, locked into RAM with mlock, and fenced by guard pages
+// that fault on any access. Free zeroes it before unmapping it.
+//
+// The data ends right at the trailing guard page, so an overrun faults on
+// the first byte past the end, and a use after Free faults too.
+
+type SecureBuffer struct {
+  // Guard page, data pages, guard page.
+  mapping []byte
+  data []byte
+}
+
+var mlockWarning sync.Once
+
+func NewSecureBuffer(size int) (*SecureBuffer, error) {
+  if size < 0 {
+    return nil, errors.New("Secure buffer size must not be negative")
+  }
+
+  pageSize := os.Getpagesize()
+  dataPageCount := (size + pageSize - 1) / pageSize
+  if dataPageCount == 0 {
+    dataPageCount = 1
+  }
+
+  mapping, err := syscall.Mmap(-1, 0, (dataPageCount + 2) * pageSize, syscall.PROT_NONE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+  if err != nil {
+    slog.Error("Error mapping secure buffer", logs.Err(err))
+    return nil, err
+  }
+
+  dataPages := mapping[pageSize:len(mapping)-pageSize]
+  err = syscall.Mprotect(dataPages, syscall.PROT_READ|syscall.PROT_WRITE)
+  if err != nil {
+    syscall.Munmap(mapping)
+    slog.Error("Error unprotecting secure buffer", logs.Err(err))
+    return nil, err
+  }
+
+  // Over RLIMIT_MEMLOCK the buffer still stays off the heap and is still
+  // zeroed, it just may be swapped. Better than refusing notes.
+  err = syscall.Mlock(dataPages)
+  if err != nil {
+    mlockWarning.Do(func() {
+      slog.Warn("Could not lock secure buffers into memory, they may be swapped", logs.Err(err))
+    })
+  }
+
+  return &SecureBuffer{mapping: mapping, data: dataPages[len(dataPages)-size:]}, nil
+}
+
+// Invalid after Free.
+func (b *SecureBuffer) Bytes() []byte {
+  return b.data
+}
+
+// Zeroes and unmaps the buffer. Safe to call more than once.
+func (b *SecureBuffer) Free() {
+  if b == nil || b.mapping == nil {
+    return
+  }
+
+  pageSize := os.Getpagesize()
+  dataPages := b.mapping[pageSize:len(b.mapping)-pageSize]
+  for i := 0; i < len(dataPages); i++ {
+    dataPages[i] = 0
+  }
+
+  syscall.Munlock(dataPages)
+  err := syscall.Munmap(b.mapping)
+  if err != nil {
+    slog.Error("Error unmapping secure buffer", logs.Err(err))
+  }
+
+  b.mapping = nil
+  b.data = nil
+}
@@ -0,0 +1,234 @@
+package store_test
+
+import (
+  "bufio"
+  "bytes"
+  "crypto/rand"
+  "github.com/brianhempel/sneakynote.com/store"
+  "io"
+  "os"
+  "runtime"
+  "runtime/debug"
+  "strconv"
+  "strings"
+  "testing"
+  "unsafe"
+)
+
+// The tests keep only the inverse of each canary, so the canary itself
+// turns up in process memory only where the code under test put it.
+func newInvertedCanary(t *testing.T) []byte {
+  inverted := make([]byte, 64)
+  _, err := rand.Read(inverted)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return inverted
+}
+
+// Reads the canary out of an inverted one without building it anywhere
+// but the reader's p.
+type invertingReader struct {
+  inverted []byte
+}
+
+func (r *invertingReader) Read(p []byte) (int, error) {
+  if len(r.inverted) == 0 {
+    return 0, io.EOF
+  }
+  n := copy(p, r.inverted)
+  for i := 0; i < n; i++ {
+    p[i] = ^p[i]
+  }
+  r.inverted = r.inverted[n:]
+  return n, nil
+}
+
+func matchesInverted(data []byte, inverted []byte) bool {
+  if len(data) < len(inverted) {
+    return false
+  }
+  for i := range inverted {
+    if data[i] != ^inverted[i] {
+      return false
+    }
+  }
+  return true
+}
+
+// Scans every readable mapping of this process through /proc/self/mem.
+func processMemoryContains(t *testing.T, inverted []byte) bool {
+  runtime.GC()
+
+  maps, err := os.Open("/proc/self/maps")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer maps.Close()
+
+  mem, err := os.Open("/proc/self/mem")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer mem.Close()
+
+  chunk := make([]byte, 1024*1024)
+  overlap := len(inverted) - 1
+  first := ^inverted[0]
+  found := false
+
+  scanner := bufio.NewScanner(maps)
+  for scanner.Scan() && !found {
+    fields := strings.Fields(scanner.Text())
+    if len(fields) < 2 || fields[1][0] != 'r' {
+      continue
+    }
+    if len(fields) >= 6 && (fields[5] == "[vvar]" || fields[5] == "[vsyscall]" || fields[5] == "[vvar_vclock]") {
+      continue
+    }
+
+    bounds := strings.Split(fields[0], "-")
+    start, _ := strconv.ParseUint(bounds[0], 16, 64)
+    end, _ := strconv.ParseUint(bounds[1], 16, 64)
+
+    for offset := start; offset < end && !found; offset += uint64(len(chunk) - overlap) {
+      size := uint64(len(chunk))
+      if end - offset < size {
+        size = end - offset
+      }
+      n, _ := mem.ReadAt(chunk[:size], int64(offset))
+
+      data := chunk[:n]
+      for i := bytes.IndexByte(data, first); i >= 0 && !found; {
+        found = matchesInverted(data[i:], inverted)
+        next := bytes.IndexByte(data[i+1:], first)
+        if next < 0 {
+          break
+        }
+        i += 1 + next
+      }
+
+      // Our own copy of this chunk mustn't be found when its mapping is read.
+      for i := range chunk {
+        chunk[i] = 0
+      }
+      if uint64(n) < size {
+        break
+      }
+    }
+  }
+
+  return found
+}
+
+func TestSecureBufferFreeZeroes(t *testing.T) {
+  inverted := newInvertedCanary(t)
+
+  buffer, err := store.NewSecureBuffer(len(inverted))
+  if err != nil {
+    t.Fatal("Error on store.NewSecureBuffer:", err)
+  }
+  (&invertingReader{inverted}).Read(buffer.Bytes())
+
+  if !processMemoryContains(t, inverted) {
+    t.Fatal("Expected to find the canary before Free; the scan is broken")
+  }
+
+  buffer.Free()
+  buffer.Free()
+
+  if processMemoryContains(t, inverted) {
+    t.Error("Canary still in memory after Free")
+  }
+}
+
+func TestSecureBufferGuardPages(t *testing.T) {
+  buffer, err := store.NewSecureBuffer(100)
+  if err != nil {
+    t.Fatal("Error on store.NewSecureBuffer:", err)
+  }
+  defer buffer.Free()
+
+  data := buffer.Bytes()
+  if len(data) != 100 {
+    t.Fatalf("Expected 100 bytes, got %d", len(data))
+  }
+
+  expectFault := func(description string, access func()) {
+    defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+    defer func() {
+      if recover() == nil {
+        t.Error("Expected a fault", description)
+      }
+    }()
+    access()
+  }
+
+  expectFault("one byte past the end", func() { data[:101][100] = 1 })
+
+  // The data starts a page in when it fills its pages.
+  wholePage, err := store.NewSecureBuffer(os.Getpagesize())
+  if err != nil {
+    t.Fatal("Error on store.NewSecureBuffer:", err)
+  }
+  defer wholePage.Free()
+
+  first := unsafe.Pointer(&wholePage.Bytes()[0])
+  expectFault("one byte before the start", func() { *(*byte)(unsafe.Add(first, -1)) = 1 })
+}
+
+func TestSaveAndRetrieveLeaveNoCanary(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  inverted := newInvertedCanary(t)
+  id := store.GenerateUuid()
+
+  _, err := s.Save(&invertingReader{inverted}, id)
+  if err != nil {
+    t.Fatal("Error on store.Save:", err)
+  }
+
+  if processMemoryContains(t, inverted) {
+    t.Error("Canary still in memory after Save")
+  }
+
+  buffer, err := store.NewSecureBuffer(s.MaxSecretSize + 1)
+  if err != nil {
+    t.Fatal("Error on store.NewSecureBuffer:", err)
+  }
+  nRead, _, err := s.Retrieve(id, buffer.Bytes())
+  if err != nil {
+    t.Fatal("Error on store.Retrieve:", err)
+  }
+
+  if nRead != len(inverted) || !matchesInverted(buffer.Bytes(), inverted) {
+    t.Error("Expected the canary back from store.Retrieve")
+  }
+  buffer.Free()
+
+  if processMemoryContains(t, inverted) {
+    t.Error("Canary still in memory after Retrieve")
+  }
+}
+
+func TestSaveDuplicateIdLeavesNoCanary(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  id := store.GenerateUuid()
+  _, err := s.Save(strings.NewReader("the original"), id)
+  if err != nil {
+    t.Fatal("Error on store.Save:", err)
+  }
+
+  inverted := newInvertedCanary(t)
+  _, err = s.Save(&invertingReader{inverted}, id)
+  if err != store.DuplicateId {
+    t.Fatal("Expected DuplicateId, got", err)
+  }
+
+  if processMemoryContains(t, inverted) {
+    t.Error("Canary still in memory after a duplicate Save")
+  }
+}
@@ -1,14 +1,17 @@
 package store
 
 import (
+  "bytes"
   "crypto/rand"
   "crypto/sha256"
   "encoding/hex"
+  "encoding/json"
   "errors"
   "fmt"
-  "log"
+  "github.com/brianhempel/sneakynote.com/logs"
   "io"
   "io/ioutil"
+  "log/slog"
   "math/big"
   "os"
   "path"
@@ -22,9 +25,32 @@ type Store struct {
   AccessedPath string
   ExpiringPath string
   ExpiredPath string
+  MetadataPath string
+  GroupsPath string
+  AttemptsPath string
+  // Proof of work challenges already solved. See store_challenges.go.
+  ChallengesPath string
+  // Flags that apply to every process using the store. See
+  // store_maintenance.go.
+  ControlPath string
   MaxSecretSize int
   Headroom int
   SecretLifetime time.Duration
+  // After this many wrong codes, status checks are locked out for
+  // CodeLockout, doubling with each further round of wrong codes.
+  MaxFailedCodeAttempts int
+  CodeLockout time.Duration
+  // Store secrets padded to fixed size buckets. See store_padding.go.
+  PadSecrets bool
+  // For metrics, if set: called with each secret's unpadded size once it
+  // is saved, and with its age once it is opened.
+  OnSave func(size int)
+  OnOpen func(age time.Duration)
+  // Called with the phases of each sweep. See store_sweeper.go.
+  OnSweep func(phases []SweepPhase)
+  // Unix nanoseconds of the last sweep by SweepContinuously that finished
+  // without error. See store_health.go.
+  lastSweepTime int64
 }
 
 const (
@@ -32,6 +58,24 @@ const (
   DefaultStorePath = "/tmp/sneakynote_store"
   DefaultMaxSecretSize int = 1024*16
   DefaultSecretLifetime time.Duration = 10*time.Minute
+  DefaultMaxFailedCodeAttempts int = 5
+  DefaultCodeLockout time.Duration = time.Minute
+
+  StateUnopened = "unopened"
+  StateOpened = "opened"
+  StateExpired = "expired"
+  StateDestroyed = "destroyed"
+
+  ReasonOpened = "opened"
+  ReasonExpired = "expired"
+  ReasonDuplicateId = "duplicate_id"
+  ReasonRevoked = "revoked"
+  ReasonShredded = "shredded"
+
+  // A secret moving between folders can briefly be in none of them, so
+  // looking for it is retried.
+  locateTries = 3
+  locateRetryDelay = 50 * time.Millisecond
 )
 
 var (
@@ -46,15 +90,47 @@ var (
   SecretNotFound = errors.New("Secret not found")
 )
 
+// What the sender may learn about their note. Times the store no longer
+// knows (e.g. records written before metadata was kept) are left nil.
+type NoteStatus struct {
+  State string `json:"state"`
+  CreatedAt *time.Time `json:"created_at"`
+  ExpiresAt *time.Time `json:"expires_at"`
+  OpenedAt *time.Time `json:"opened_at"`
+  DestroyedAt *time.Time `json:"destroyed_at"`
+  ViewsRemaining int `json:"views_remaining"`
+  DestroyedReason string `json:"destroyed_reason,omitempty"`
+  // Wrong codes tried for this note. Flagged once that's enough for a
+  // lockout: someone other than the sender may be guessing.
+  FailedCodeAttempts int `json:"failed_code_attempts"`
+  Flagged bool `json:"flagged"`
+}
+
+// Written to the metadata folder when a secret is destroyed, so we still know
+// when it was created after the secret file itself is gone.
+type noteMetadata struct {
+  CreatedAt time.Time `json:"created_at"`
+  DestroyedAt time.Time `json:"destroyed_at"`
+  Reason string `json:"reason"`
+}
+
 func Get() *Store {
-  storePath := DefaultStorePath
+  return storeAt(DefaultStorePath)
+}
+
+func storeAt(storePath string) *Store {
   beingAccessedPath := path.Join(storePath, "being_accessed")
   accessedPath := path.Join(storePath, "accessed")
   expiringPath := path.Join(storePath, "expiring")
   expiredPath := path.Join(storePath, "expired")
+  metadataPath := path.Join(storePath, "metadata")
+  groupsPath := path.Join(storePath, "groups")
+  attemptsPath := path.Join(storePath, "attempts")
+  challengesPath := path.Join(storePath, "challenges")
+  controlPath := path.Join(storePath, "control")
   maxSecretSize := DefaultMaxSecretSize
 
-  return &Store{Root: storePath, BeingAccessedPath: beingAccessedPath, AccessedPath: accessedPath, ExpiringPath: expiringPath, ExpiredPath: expiredPath, MaxSecretSize: maxSecretSize, Headroom: DefaultHeadroom, SecretLifetime: DefaultSecretLifetime}
+  return &Store{Root: storePath, BeingAccessedPath: beingAccessedPath, AccessedPath: accessedPath, ExpiringPath: expiringPath, ExpiredPath: expiredPath, MetadataPath: metadataPath, GroupsPath: groupsPath, AttemptsPath: attemptsPath, ChallengesPath: challengesPath, ControlPath: controlPath, MaxSecretSize: maxSecretSize, Headroom: DefaultHeadroom, SecretLifetime: DefaultSecretLifetime, MaxFailedCodeAttempts: DefaultMaxFailedCodeAttempts, CodeLockout: DefaultCodeLockout}
 }
 
 func Setup() *Store {
@@ -66,38 +142,37 @@ func Setup() *Store {
 
   err := setupRamDisk(s.Root)
   if err != nil {
-    log.Fatal("Creating ramdisk: ", err)
+    logs.Fatal("Creating ramdisk", logs.Err(err))
   }
 
-  if _, err := os.Stat(s.BeingAccessedPath); os.IsNotExist(err) {
-    err = os.Mkdir(s.BeingAccessedPath, 0700)
-    if err != nil {
-      log.Fatal("Making being_accessed dir for store: ", err)
-    }
+  err = s.EnsureFolders()
+  if err != nil {
+    logs.Fatal("Making store folders", logs.Err(err))
   }
 
-  if _, err := os.Stat(s.AccessedPath); os.IsNotExist(err) {
-    err = os.Mkdir(s.AccessedPath, 0700)
-    if err != nil {
-      log.Fatal("Making accessed dir for store: ", err)
-    }
-  }
+  return s
+}
 
-  if _, err := os.Stat(s.ExpiredPath); os.IsNotExist(err) {
-    err = os.Mkdir(s.ExpiringPath, 0700)
-    if err != nil {
-      log.Fatal("Making expiring dir for store: ", err)
-    }
+// The store as set up by an earlier run, with any folders added since then
+// made.
+func Open() (*Store, error) {
+  s := Get()
+  err := s.EnsureFolders()
+  if err != nil {
+    return nil, err
   }
+  return s, nil
+}
 
-  if _, err := os.Stat(s.ExpiredPath); os.IsNotExist(err) {
-    err = os.Mkdir(s.ExpiredPath, 0700)
+// Makes whichever store folders are missing.
+func (s *Store) EnsureFolders() error {
+  for _, folderPath := range []string{s.BeingAccessedPath, s.AccessedPath, s.ExpiringPath, s.ExpiredPath, s.MetadataPath, s.GroupsPath, s.AttemptsPath, s.ChallengesPath, s.ControlPath} {
+    err := os.MkdirAll(folderPath, 0700)
     if err != nil {
-      log.Fatal("Making expired dir for store: ", err)
+      return err
     }
   }
-
-  return s
+  return nil
 }
 
 func (s *Store) Teardown() error {
@@ -107,10 +182,23 @@ func (s *Store) Teardown() error {
   return teardownRamDisk(s.Root)
 }
 
+// Records kept of opened and expired notes, so their IDs can't be reused.
+func (s *Store) Tombstones() (int, int, error) {
+  opened, err := ioutil.ReadDir(s.AccessedPath)
+  if err != nil {
+    return 0, 0, err
+  }
+  expired, err := ioutil.ReadDir(s.ExpiredPath)
+  if err != nil {
+    return 0, 0, err
+  }
+  return len(opened), len(expired), nil
+}
+
 func (s *Store) AvailableMemory() int {
   freeBytes, err := s.freeSpace()
   if err != nil {
-    log.Print("Error determining free space", err)
+    slog.Error("Error determining free space", logs.Err(err))
     return -1
   }
 
@@ -118,90 +206,81 @@ func (s *Store) AvailableMemory() int {
 }
 
 func (s *Store) Save(data io.Reader, uuid string) (string, error) {
+  code, size, err := s.save(data, uuid)
+  if err == nil && s.OnSave != nil {
+    s.OnSave(size)
+  }
+  return code, err
+}
+
+// Save without calling OnSave, also returning the secret's size.
+func (s *Store) save(data io.Reader, uuid string) (string, int, error) {
   fileName := s.UuidToFileName(uuid)
   filePath := s.uuidToFilePath(uuid)
 
   err := s.accessedOrExpired(fileName)
   if err != nil {
-    return "", DuplicateId
+    return "", 0, DuplicateId
   }
 
-  buf := make([]byte, s.maxSecretStorageSize() + 1)
+  secureBuf, err := NewSecureBuffer(s.maxSecretStorageSize() + 1)
+  if err != nil {
+    return "", 0, err
+  }
+  // Zero out our buffer when done
+  defer secureBuf.Free()
+  buf := secureBuf.Bytes()
+
   code, err := generateCode()
   if err != nil {
-    log.Print("Error generating code:", err)
-    return "", err
+    slog.Error("Error generating code", logs.Err(err))
+    return "", 0, err
   }
   codePart := []byte(code + "\n")
   copy(buf[:len(codePart)], codePart)
 
   nRead, err := io.ReadFull(data, buf[len(codePart):])
-  // Zero out our buffer when done
-  defer func() {
-    for i := 0; i < len(buf); i++ {
-      buf[i] = 0
-    }
-  }()
 
   if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
-    log.Print("Error reading request body:", err)
-    return "", err
+    slog.Error("Error reading request body", logs.Err(err))
+    return "", 0, err
   } else {
     err = nil
   }
 
   if nRead > s.MaxSecretSize {
-    return "", SecretTooLarge
+    return "", 0, SecretTooLarge
   }
 
+  storedSize := s.storedSecretSize(nRead)
+
   available := s.AvailableMemory()
-  if nRead > available {
-    return "", StorageFull
+  if storedSize > available {
+    return "", 0, StorageFull
   } else if available < 0 {
-    return "", errors.New("Could not determine storage free space")
+    return "", 0, errors.New("Could not determine storage free space")
   }
 
   // Same secret sent twice? Kill the secret to penalize the client or thwart
   // the attacker trying to replace the secret.
   if _, err := os.Stat(filePath); !os.IsNotExist(err) {
-    beingAccessedFilePath := path.Join(s.BeingAccessedPath, fileName)
-
-    err = os.Rename(filePath, beingAccessedFilePath)
-    defer zeroFileAndRemove(beingAccessedFilePath)
-
-    accessedFilePath := path.Join(s.AccessedPath, fileName)
-    ioutil.WriteFile(accessedFilePath, nil, 0600)
-
-    // Extract the code
-
-    beingAccessedFile, err := os.Open(beingAccessedFilePath)
-    if err != nil {
-      log.Print("Error opening file:", err)
-      return "", DuplicateId
-    }
-
-    codePart := make([]byte, CodeByteSize + 1) // Grab newline.
-    _, err = io.ReadFull(beingAccessedFile, codePart)
-    if err != nil {
-      log.Print("Error reading code from file:", err)
-    } else {
-      // Remove newline.
-      code := strings.TrimSpace(string(codePart))
-
-      // Update the accessed file with the code
-
-      ioutil.WriteFile(accessedFilePath, []byte(code), 0400)
-    }
+    // Don't hold the replacement while destroying the original.
+    secureBuf.Free()
+    s.destroySecret(fileName, ReasonDuplicateId)
+    return "", 0, DuplicateId
+  }
 
-    return "", DuplicateId
+  if s.PadSecrets {
+    buf[len(codePart)-1] = paddedCodeSeparator
+    PadSecret(buf[len(codePart):], nRead, storedSize)
   }
 
-  err = ioutil.WriteFile(filePath, buf[:(len(codePart)+nRead)], 0600)
+  err = ioutil.WriteFile(filePath, buf[:(len(codePart)+storedSize)], 0600)
   if err != nil && strings.Contains(err.Error(), "no space left on device") {
-    return "", StorageFull
+    return "", 0, StorageFull
   } else if err != nil {
-    log.Print("Error writing secret file:", err)
-    return "", err
+    slog.Error("Error writing secret file", logs.Err(err))
+    return "", 0, err
   }
 
   // Attempt to clear the secret out of memory.
@@ -237,10 +316,105 @@ func (s *Store) Save(data io.Reader, uuid string) (string, error) {
   // nothing to do there. Well, maybe there is, but
   // I'm not smart enough right now to know.
 
-  return code, err
+  return code, nRead, err
+}
+
+// Saves every secret or none of them. Sizes and total capacity are checked
+// before anything is written; if a save fails partway, the secrets already
+// written are zeroed and removed. Returns the codes in order, or the index of
+// the secret that failed (-1 if the batch as a whole was rejected) and why.
+func (s *Store) SaveBatch(ids []string, secrets [][]byte) ([]string, int, error) {
+  seen := map[string]bool{}
+  for i, id := range ids {
+    fileName := s.UuidToFileName(id)
+    if seen[fileName] {
+      return nil, i, DuplicateId
+    }
+    seen[fileName] = true
+  }
+
+  totalSize := 0
+  for i, secret := range secrets {
+    if len(secret) > s.MaxSecretSize {
+      return nil, i, SecretTooLarge
+    }
+    totalSize += s.storedSecretSize(len(secret)) + CodeByteSize + 1
+  }
+
+  available := s.AvailableMemory()
+  if available < 0 {
+    return nil, -1, errors.New("Could not determine storage free space")
+  } else if totalSize > available {
+    return nil, -1, StorageFull
+  }
+
+  codes := make([]string, 0, len(ids))
+  sizes := make([]int, 0, len(ids))
+
+  for i, id := range ids {
+    code, size, err := s.save(bytes.NewReader(secrets[i]), id)
+    if err != nil {
+      for _, savedId := range ids[:i] {
+        zeroFileAndRemove(s.uuidToFilePath(savedId))
+      }
+      return nil, i, err
+    }
+    codes = append(codes, code)
+    sizes = append(sizes, size)
+  }
+
+  // Only once none can be rolled back.
+  if s.OnSave != nil {
+    for _, size := range sizes {
+      s.OnSave(size)
+    }
+  }
+
+  return codes, -1, nil
+}
+
+// Destroys an unopened secret without returning it, leaving an accessed record
+// (with the code) so the sender's status checks see it is gone, and metadata
+// saying why.
+func (s *Store) destroySecret(fileName string, reason string) error {
+  filePath := path.Join(s.Root, fileName)
+  beingAccessedFilePath := path.Join(s.BeingAccessedPath, fileName)
+
+  fileInfo, err := os.Stat(filePath)
+  if err != nil {
+    return err
+  }
+
+  err = os.Rename(filePath, beingAccessedFilePath)
+  if err != nil {
+    slog.Error("Error moving file", logs.Err(err))
+    return err
+  }
+  defer zeroFileAndRemove(beingAccessedFilePath)
+
+  accessedFilePath := path.Join(s.AccessedPath, fileName)
+  ioutil.WriteFile(accessedFilePath, nil, 0600)
+  s.writeMetadata(fileName, fileInfo.ModTime(), reason)
+
+  // Update the accessed record with the code
+
+  code, err := readCode(beingAccessedFilePath)
+  if err != nil {
+    slog.Error("Error reading code from file", logs.Err(err))
+    return err
+  }
+
+  ioutil.WriteFile(accessedFilePath, []byte(code), 0400)
+
+  return nil
 }
 
 // returns nRead, code, err
+//
+// Padded secrets are read whole before the padding is stripped, so buf
+// needs room for MaxSecretSize + 1 bytes if the store has ever padded. The
+// secret is read straight into buf, so pass a SecureBuffer's Bytes() to keep
+// it off the heap.
 func (s *Store) Retrieve(id string, buf []byte) (int, string, error) {
   fileName := s.UuidToFileName(id)
   filePath := s.uuidToFilePath(id)
@@ -248,16 +422,18 @@ func (s *Store) Retrieve(id string, buf []byte) (int, string, error) {
   tempRand := make([]byte, 32)
   _, err := rand.Read(tempRand)
   if err != nil {
-    log.Print("Error getting random bytes:", err)
+    slog.Error("Error getting random bytes", logs.Err(err))
     return -1, "", err
   }
   tempFileName := hex.EncodeToString(tempRand)
   tempFilePath := path.Join(s.BeingAccessedPath, tempFileName)
 
+  var createdAt time.Time
   fileInfo, err := os.Stat(filePath)
   if err == nil {
+    createdAt = fileInfo.ModTime()
     cutoff := time.Now().Add(-s.SecretLifetime)
-    if fileInfo.ModTime().Before(cutoff) {
+    if createdAt.Before(cutoff) {
       return -1, "", SecretExpired
     }
   }
@@ -269,7 +445,7 @@ func (s *Store) Retrieve(id string, buf []byte) (int, string, error) {
     if _, err := os.Stat(filePath); os.IsNotExist(err) {
       return -1, "", s.retrieveNotFoundError(fileName)
     }
-    log.Print("Error moving file:", err)
+    slog.Error("Error moving file", logs.Err(err))
     return -1, "", err
   }
 
@@ -277,11 +453,12 @@ func (s *Store) Retrieve(id string, buf []byte) (int, string, error) {
 
   accessedFilePath := path.Join(s.AccessedPath, fileName)
   ioutil.WriteFile(accessedFilePath, nil, 0600)
+  s.writeMetadata(fileName, createdAt, ReasonOpened)
 
   tempFile, err := os.Open(tempFilePath)
   defer tempFile.Close()
   if err != nil {
-    log.Print("Error opening file:", err)
+    slog.Error("Error opening file", logs.Err(err))
     return -1, "", err
   }
 
@@ -290,9 +467,10 @@ func (s *Store) Retrieve(id string, buf []byte) (int, string, error) {
   codePart := make([]byte, CodeByteSize + 1) // Grab newline.
   _, err = io.ReadFull(tempFile, codePart)
   if err != nil {
-    log.Print("Error reading code from file:", err)
+    slog.Error("Error reading code from file", logs.Err(err))
     return -1, "", err
   }
+  padded := codePart[CodeByteSize] == paddedCodeSeparator
   // Remove newline.
   code := strings.TrimSpace(string(codePart))
 
@@ -304,26 +482,117 @@ func (s *Store) Retrieve(id string, buf []byte) (int, string, error) {
 
   nRead, err := io.ReadFull(tempFile, buf)
   if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
-    log.Print("Error reading file:", err)
+    slog.Error("Error reading file", logs.Err(err))
     return -1, "", err
   }
 
+  if padded {
+    nRead, err = UnpaddedSize(buf[:nRead])
+    if err != nil {
+      slog.Error("Error unpadding secret", logs.Err(err))
+      return -1, "", err
+    }
+  }
+
+  if s.OnOpen != nil && !createdAt.IsZero() {
+    s.OnOpen(time.Since(createdAt))
+  }
+
   return nRead, code, nil
 }
 
 func (s *Store) Status(id string, givenCode string) (error) {
+  _, err := s.StatusDetails(id, givenCode)
+
+  return err
+}
+
+// Like Status, but also describes the note's lifecycle. The returned error is
+// the same one Status would return; the NoteStatus is nil only when the
+// error is SecretNotFound, CodeLockedOut, AttemptsNotRecorded or unexpected.
+func (s *Store) StatusDetails(id string, givenCode string) (*NoteStatus, error) {
   fileName := s.UuidToFileName(id)
 
-  err, secretCode := s.locateSecretAndCode(fileName)
+  status, secretCode, err := s.noteStatus(fileName, locateTries)
 
-  if givenCode != "" && givenCode == secretCode {
-    return err
+  if secretCode == "" {
+    return nil, SecretNotFound
+  }
+
+  attempts, codeErr := s.checkCode(fileName, givenCode, secretCode)
+  if codeErr != nil {
+    return nil, codeErr
+  }
+
+  if status != nil {
+    status.FailedCodeAttempts = attempts.Failures
+    status.Flagged = attempts.Failures >= s.MaxFailedCodeAttempts
+  }
+
+  return status, err
+}
+
+// Status of the secret stored under fileName, without checking any code.
+// Callers must authorize the request themselves. Looks for it up to tries
+// times.
+func (s *Store) noteStatus(fileName string, tries int) (*NoteStatus, string, error) {
+  err, secretCode, foundPath := s.locateSecretAndCode(fileName, tries)
+
+  status := &NoteStatus{}
+
+  switch err {
+  case nil:
+    status.State = StateUnopened
+    status.ViewsRemaining = 1
+  case SecretExpired:
+    status.State = StateExpired
+    status.DestroyedReason = ReasonExpired
+  case SecretAlreadyAccessed:
+    status.State = StateOpened
+    status.DestroyedReason = ReasonOpened
+  default:
+    return nil, secretCode, err
+  }
+
+  recordTime := modTime(foundPath)
+
+  if foundPath == path.Join(s.Root, fileName) {
+    // Secret file still here (maybe expired but not yet swept). Its
+    // modification time is its creation time.
+    status.CreatedAt = &recordTime
   } else {
-    return SecretNotFound
+    status.DestroyedAt = &recordTime
+
+    if metadata, metadataErr := s.readMetadata(fileName); metadataErr == nil {
+      if !metadata.CreatedAt.IsZero() {
+        status.CreatedAt = &metadata.CreatedAt
+      }
+      status.DestroyedAt = &metadata.DestroyedAt
+      status.DestroyedReason = metadata.Reason
+    }
+  }
+
+  if status.CreatedAt != nil {
+    expiresAt := status.CreatedAt.Add(s.SecretLifetime)
+    status.ExpiresAt = &expiresAt
+  }
+
+  if status.State == StateExpired && status.DestroyedAt == nil {
+    status.DestroyedAt = status.ExpiresAt
   }
+
+  if status.DestroyedReason == ReasonDuplicateId || status.DestroyedReason == ReasonRevoked || status.DestroyedReason == ReasonShredded {
+    status.State = StateDestroyed
+  } else if status.DestroyedReason == ReasonOpened {
+    status.OpenedAt = status.DestroyedAt
+  }
+
+  return status, secretCode, err
 }
 
-func (s *Store) locateSecretAndCode(fileName string) (error, string) {
+// Returns the state error, the code, and the path of whichever file the code
+// was found in.
+func (s *Store) locateSecretAndCode(fileName string, tries int) (error, string, string) {
   accessedFilePath := path.Join(s.AccessedPath, fileName)
   expiredFilePath := path.Join(s.ExpiredPath, fileName)
   secretFilePath := path.Join(s.Root, fileName)
@@ -333,15 +602,15 @@ func (s *Store) locateSecretAndCode(fileName string) (error, string) {
   //
   // Therfore, watch for errors and retry.
 
-  for retries := 0; retries < 3; retries++ {
+  for try := 1; try <= tries; try++ {
 
     if code, err := readCode(accessedFilePath); err == nil {
 
-      return SecretAlreadyAccessed, code
+      return SecretAlreadyAccessed, code, accessedFilePath
 
     } else if code, err := readCode(expiredFilePath); err == nil {
 
-      return SecretExpired, code
+      return SecretExpired, code, expiredFilePath
 
     } else if code, err := readCode(secretFilePath); err == nil {
 
@@ -349,18 +618,56 @@ func (s *Store) locateSecretAndCode(fileName string) (error, string) {
       if err == nil {
         cutoff := time.Now().Add(-s.SecretLifetime)
         if fileInfo.ModTime().Before(cutoff) {
-          return SecretExpired, code
+          return SecretExpired, code, secretFilePath
         } else {
-          return nil, code
+          return nil, code, secretFilePath
         }
       }
 
     }
 
-    time.Sleep(time.Millisecond * 50)
+    if try < tries {
+      time.Sleep(locateRetryDelay)
+    }
   }
 
-  return SecretNotFound, ""
+  return SecretNotFound, "", ""
+}
+
+func modTime(path string) time.Time {
+  fileInfo, err := os.Stat(path)
+  if err != nil {
+    return time.Time{}
+  }
+  return fileInfo.ModTime()
+}
+
+// Best effort. A missing metadata record only means a less detailed status.
+func (s *Store) writeMetadata(fileName string, createdAt time.Time, reason string) {
+  metadata := noteMetadata{CreatedAt: createdAt, DestroyedAt: time.Now(), Reason: reason}
+
+  data, err := json.Marshal(metadata)
+  if err != nil {
+    slog.Error("Error encoding metadata", logs.Err(err))
+    return
+  }
+
+  ioutil.WriteFile(path.Join(s.MetadataPath, fileName), data, 0600)
+}
+
+func (s *Store) readMetadata(fileName string) (*noteMetadata, error) {
+  data, err := ioutil.ReadFile(path.Join(s.MetadataPath, fileName))
+  if err != nil {
+    return nil, err
+  }
+
+  metadata := &noteMetadata{}
+  err = json.Unmarshal(data, metadata)
+  if err != nil {
+    return nil, err
+  }
+
+  return metadata, nil
 }
 
 // Read only the code from a secret file, accessed record, or expired record
@@ -405,7 +712,7 @@ func GenerateUuid() (string) {
   bytes := make([]byte, 16)
   _, err := rand.Read(bytes)
   if err != nil {
-    log.Print("Error getting random bytes:", err)
+    slog.Error("Error getting random bytes", logs.Err(err))
     return ""
   }
   bytes[6] = bytes[6] & 0x0f | 0x40
@@ -423,7 +730,7 @@ func GenerateUuid() (string) {
 func (s *Store) UuidToFileName(uuid string) (string) {
   idBytes, err := hex.DecodeString(strings.Replace(uuid, "-", "", -1))
   if err != nil {
-    log.Print("Error converting uuid to bytes:", err, " ", uuid)
+    slog.Error("Error converting uuid to bytes", logs.Note(uuid), logs.Err(err))
     return ""
   }
   hashed := sha256.Sum256(idBytes)
@@ -499,12 +806,27 @@ func zeroFileAndRemove(filePath string) error {
     return err
   }
 
-  zeros := make([]byte, fileInfo.Size())
-  _, err = file.Write(zeros)
+  // Zeros written a page at a time from a buffer off the heap, rather than
+  // a heap allocation the size of every secret deleted.
+  zeros, err := NewSecureBuffer(os.Getpagesize())
   if err != nil {
     file.Close()
     return err
   }
+  defer zeros.Free()
+
+  for remaining := fileInfo.Size(); remaining > 0; {
+    chunk := zeros.Bytes()
+    if remaining < int64(len(chunk)) {
+      chunk = chunk[:remaining]
+    }
+    n, err := file.Write(chunk)
+    if err != nil {
+      file.Close()
+      return err
+    }
+    remaining -= int64(n)
+  }
 
   err = file.Sync()
   if err != nil {
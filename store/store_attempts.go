@@ -0,0 +1,178 @@
+// Wrong codes are counted per hashed ID so status checks can't be used to
+// guess a note's code. The counts live in the attempts folder, so they
+// survive restarts like everything else in the store.
+
+package store
+
+import (
+  "crypto/subtle"
+  "encoding/json"
+  "errors"
+  "github.com/brianhempel/sneakynote.com/logs"
+  "io/ioutil"
+  "log/slog"
+  "os"
+  "path"
+  "sync"
+  "sync/atomic"
+  "syscall"
+  "time"
+)
+
+const (
+  // Beyond 2^10 lockouts the wait is long enough.
+  maxLockoutDoublings = 10
+  // In the control folder, locked while attempts are read and written.
+  attemptsLockFileName = "attempts.lock"
+)
+
+var (
+  CodeLockedOut = errors.New("Too many wrong codes; status checks locked out")
+  // Without a record of attempts there'd be no lockout, so codes aren't
+  // checked.
+  AttemptsNotRecorded = errors.New("Code attempts can't be recorded; status checks refused")
+
+  // Wrong codes given for secrets and groups that exist. Only ever goes up,
+  // so /metrics can report it as a counter.
+  FailedCodeAttemptCount uint64 = 0
+
+  // Serializes read-count-write within this process, so parallel guesses are
+  // all counted. The lock file does the same across processes.
+  attemptsMutex sync.Mutex
+)
+
+type codeAttempts struct {
+  Failures int `json:"failures"`
+  LockedUntil time.Time `json:"locked_until"`
+}
+
+// Constant time, so response timing says nothing about how much of the code
+// was right.
+func codesMatch(givenCode string, actualCode string) bool {
+  if givenCode == "" || actualCode == "" {
+    return false
+  }
+  return subtle.ConstantTimeCompare([]byte(givenCode), []byte(actualCode)) == 1
+}
+
+// Checks givenCode against the code of the secret or group whose attempts
+// are kept under attemptsName. A wrong code is counted and returns
+// SecretNotFound, like a missing secret. While locked out, every code
+// returns CodeLockedOut, right or wrong. If the attempts can't be read or
+// written, returns AttemptsNotRecorded, right or wrong.
+func (s *Store) checkCode(attemptsName string, givenCode string, actualCode string) (*codeAttempts, error) {
+  unlock, err := s.lockAttempts()
+  if err != nil {
+    slog.Error("Locking code attempts", logs.Err(err))
+    return &codeAttempts{}, AttemptsNotRecorded
+  }
+  defer unlock()
+
+  attempts, err := s.readAttempts(attemptsName)
+  if err != nil {
+    slog.Error("Reading code attempts", logs.Err(err))
+    return attempts, AttemptsNotRecorded
+  }
+
+  if time.Now().Before(attempts.LockedUntil) {
+    return attempts, CodeLockedOut
+  }
+
+  if codesMatch(givenCode, actualCode) {
+    return attempts, nil
+  }
+
+  atomic.AddUint64(&FailedCodeAttemptCount, 1)
+
+  attempts.Failures++
+  if s.MaxFailedCodeAttempts > 0 && attempts.Failures % s.MaxFailedCodeAttempts == 0 {
+    doublings := attempts.Failures / s.MaxFailedCodeAttempts - 1
+    if doublings > maxLockoutDoublings {
+      doublings = maxLockoutDoublings
+    }
+    attempts.LockedUntil = time.Now().Add(s.CodeLockout << uint(doublings))
+  }
+
+  err = s.writeAttempts(attemptsName, attempts)
+  if err != nil {
+    slog.Error("Recording code attempts", logs.Err(err))
+    return attempts, AttemptsNotRecorded
+  }
+
+  return attempts, SecretNotFound
+}
+
+// When status checks for the secret will be allowed again. Zero if they are
+// allowed now.
+func (s *Store) CodeLockedUntil(id string) time.Time {
+  return s.attemptsLockedUntil(s.UuidToFileName(id))
+}
+
+func (s *Store) GroupCodeLockedUntil(groupId string) time.Time {
+  return s.attemptsLockedUntil(groupAttemptsName(s.UuidToFileName(groupId)))
+}
+
+func (s *Store) attemptsLockedUntil(attemptsName string) time.Time {
+  if unlock, err := s.lockAttempts(); err == nil {
+    defer unlock()
+  }
+
+  attempts, _ := s.readAttempts(attemptsName)
+  lockedUntil := attempts.LockedUntil
+  if time.Now().After(lockedUntil) {
+    return time.Time{}
+  }
+  return lockedUntil
+}
+
+// Locks out other goroutines, and other processes using the store, as both
+// sides of a handoff do, until the returned func is called.
+func (s *Store) lockAttempts() (func(), error) {
+  attemptsMutex.Lock()
+
+  lockFile, err := os.OpenFile(path.Join(s.ControlPath, attemptsLockFileName), os.O_WRONLY|os.O_CREATE, 0600)
+  if err != nil {
+    attemptsMutex.Unlock()
+    return nil, err
+  }
+  if err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+    lockFile.Close()
+    attemptsMutex.Unlock()
+    return nil, err
+  }
+
+  return func() {
+    syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+    lockFile.Close()
+    attemptsMutex.Unlock()
+  }, nil
+}
+
+// Group and secret IDs are hashed the same way, so keep their attempts
+// apart.
+func groupAttemptsName(groupFileName string) string {
+  return "group_" + groupFileName
+}
+
+// No record means no failures.
+func (s *Store) readAttempts(attemptsName string) (*codeAttempts, error) {
+  attempts := &codeAttempts{}
+
+  data, err := ioutil.ReadFile(path.Join(s.AttemptsPath, attemptsName))
+  if os.IsNotExist(err) {
+    return attempts, nil
+  } else if err != nil {
+    return attempts, err
+  }
+
+  return attempts, json.Unmarshal(data, attempts)
+}
+
+func (s *Store) writeAttempts(attemptsName string, attempts *codeAttempts) error {
+  data, err := json.Marshal(attempts)
+  if err != nil {
+    return err
+  }
+
+  return ioutil.WriteFile(path.Join(s.AttemptsPath, attemptsName), data, 0600)
+}
@@ -0,0 +1,190 @@
+package store_test
+
+import (
+  "github.com/brianhempel/sneakynote.com/store"
+  "io/ioutil"
+  "os"
+  "path"
+  "strings"
+  "sync/atomic"
+  "syscall"
+  "testing"
+  "time"
+)
+
+func TestStatusDetailsLocksOutAfterWrongCodes(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+  s.CodeLockout = 200 * time.Millisecond
+
+  id := store.GenerateUuid()
+  code, err := s.Save(strings.NewReader("my super secret"), id)
+  if err != nil {
+    t.Error("Error on store.Save:", err)
+    return
+  }
+
+  countBefore := atomic.LoadUint64(&store.FailedCodeAttemptCount)
+
+  for i := 0; i < s.MaxFailedCodeAttempts; i++ {
+    _, err = s.StatusDetails(id, "bad code")
+    if err != store.SecretNotFound {
+      t.Errorf("Expected SecretNotFound for wrong code %d, got %v", i + 1, err)
+    }
+  }
+
+  if count := atomic.LoadUint64(&store.FailedCodeAttemptCount) - countBefore; count != uint64(s.MaxFailedCodeAttempts) {
+    t.Errorf("Expected %d failed attempts counted, got %d", s.MaxFailedCodeAttempts, count)
+  }
+
+  // Even the right code is refused while locked out.
+  status, err := s.StatusDetails(id, code)
+  if err != store.CodeLockedOut || status != nil {
+    t.Error("Expected CodeLockedOut and no status, got", err, status)
+  }
+
+  if s.CodeLockedUntil(id).IsZero() {
+    t.Error("Expected a lockout time")
+  }
+
+  time.Sleep(250 * time.Millisecond)
+
+  status, err = s.StatusDetails(id, code)
+  if err != nil {
+    t.Error("Expected no error after the lockout, got", err)
+    return
+  }
+
+  if !status.Flagged || status.FailedCodeAttempts != s.MaxFailedCodeAttempts {
+    t.Errorf("Expected a flagged status with %d failed attempts, got %#v", s.MaxFailedCodeAttempts, status)
+  }
+
+  if !s.CodeLockedUntil(id).IsZero() {
+    t.Error("Expected no lockout time, got", s.CodeLockedUntil(id))
+  }
+
+  // The next round of wrong codes locks out for twice as long.
+  for i := 0; i < s.MaxFailedCodeAttempts; i++ {
+    s.StatusDetails(id, "bad code")
+  }
+
+  lockedFor := s.CodeLockedUntil(id).Sub(time.Now())
+  if lockedFor < 300 * time.Millisecond || lockedFor > 400 * time.Millisecond {
+    t.Error("Expected a lockout of about 400ms, got", lockedFor)
+  }
+}
+
+func TestStatusDetailsNotFoundDoesNotCountAttempts(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  countBefore := atomic.LoadUint64(&store.FailedCodeAttemptCount)
+
+  id := store.GenerateUuid()
+  for i := 0; i < s.MaxFailedCodeAttempts + 1; i++ {
+    _, err := s.StatusDetails(id, "bad code")
+    if err != store.SecretNotFound {
+      t.Error("Expected SecretNotFound, got", err)
+    }
+  }
+
+  if count := atomic.LoadUint64(&store.FailedCodeAttemptCount) - countBefore; count != 0 {
+    t.Errorf("Expected no failed attempts counted, got %d", count)
+  }
+}
+
+// Failing open would let codes be guessed without limit.
+func TestStatusDetailsRefusedWithoutAttemptsRecord(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  id := store.GenerateUuid()
+  code, err := s.Save(strings.NewReader("my super secret"), id)
+  if err != nil {
+    t.Fatal("Error on store.Save:", err)
+  }
+
+  os.Remove(s.AttemptsPath)
+  ioutil.WriteFile(s.AttemptsPath, []byte("not a folder"), 0600)
+  defer func() {
+    os.Remove(s.AttemptsPath)
+    os.Mkdir(s.AttemptsPath, 0700)
+  }()
+
+  for _, givenCode := range []string{"bad code", code} {
+    status, err := s.StatusDetails(id, givenCode)
+    if err != store.AttemptsNotRecorded || status != nil {
+      t.Errorf("Expected AttemptsNotRecorded and no status for code %q, got %v %v", givenCode, err, status)
+    }
+  }
+}
+
+func TestGroupStatusLocksOutAfterWrongCodes(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  groupId := store.GenerateUuid()
+  groupCode, _, _, err := s.SaveGroupBatch(groupId, 1, []string{store.GenerateUuid()}, [][]byte{[]byte("share")})
+  if err != nil {
+    t.Error("Error on store.SaveGroupBatch:", err)
+    return
+  }
+
+  for i := 0; i < s.MaxFailedCodeAttempts; i++ {
+    _, err = s.GroupStatus(groupId, "bad code")
+    if err != store.GroupNotFound {
+      t.Errorf("Expected GroupNotFound for wrong code %d, got %v", i + 1, err)
+    }
+  }
+
+  _, err = s.RevokeGroup(groupId, groupCode)
+  if err != store.CodeLockedOut {
+    t.Error("Expected CodeLockedOut, got", err)
+  }
+
+  if s.GroupCodeLockedUntil(groupId).IsZero() {
+    t.Error("Expected a lockout time")
+  }
+}
+
+// Both sides of a handoff check codes against the same store, so a lock
+// held elsewhere holds up the count here.
+func TestCheckCodeWaitsForAttemptsLock(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  id := store.GenerateUuid()
+  if _, err := s.Save(strings.NewReader("my super secret"), id); err != nil {
+    t.Fatal("Error on store.Save:", err)
+  }
+
+  // A separate open file, so locked like another process's.
+  lockFile, err := os.OpenFile(path.Join(s.ControlPath, "attempts.lock"), os.O_WRONLY|os.O_CREATE, 0600)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer lockFile.Close()
+  syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX)
+
+  checked := make(chan error, 1)
+  go func() {
+    _, err := s.StatusDetails(id, "bad code")
+    checked <- err
+  }()
+
+  select {
+  case err = <-checked:
+    t.Fatal("Expected the check to wait for the lock, got", err)
+  case <-time.After(100 * time.Millisecond):
+  }
+
+  syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+  select {
+  case err = <-checked:
+    if err != store.SecretNotFound {
+      t.Error("Expected SecretNotFound, got", err)
+    }
+  case <-time.After(5 * time.Second):
+    t.Fatal("Expected the check done once the lock was released")
+  }
+}
@@ -0,0 +1,47 @@
+// A proof of work challenge is good for one note. Solved challenges are
+// recorded in the challenges folder until they expire, so every process
+// using the store sees them, and one spent on the old process during a
+// handoff can't be spent again on the new one.
+
+package store
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "os"
+  "path"
+  "time"
+)
+
+// Records challenge as spent until expiresAt. False if it already was, by
+// this process or another.
+func (s *Store) SpendChallenge(challenge string, expiresAt time.Time) (bool, error) {
+  hash := sha256.Sum256([]byte(challenge))
+  filePath := path.Join(s.ChallengesPath, hex.EncodeToString(hash[:]))
+
+  file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+  if os.IsExist(err) {
+    return false, nil
+  } else if err != nil {
+    return false, err
+  }
+  file.Close()
+
+  // The sweeper goes by modification time. If it can't be set, the record
+  // would be swept before the challenge expires, so don't take the solution.
+  if err = os.Chtimes(filePath, expiresAt, expiresAt); err != nil {
+    return false, err
+  }
+  return true, nil
+}
+
+func (s *Store) SweepChallenges() error {
+  _, err := s.sweepChallenges()
+  return err
+}
+
+// Records are dated when their challenge expires, so they go once that has
+// passed.
+func (s *Store) sweepChallenges() (int, error) {
+  return sweepFolder(s.ChallengesPath, 0)
+}
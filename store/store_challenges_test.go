@@ -0,0 +1,35 @@
+package store_test
+
+import (
+  "github.com/brianhempel/sneakynote.com/store"
+  "testing"
+  "time"
+)
+
+func TestSpendChallenge(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  spent, err := s.SpendChallenge("1760745600.14.abcd.ef01", time.Now().Add(time.Minute))
+  if err != nil || !spent {
+    t.Fatalf("Expected a new challenge spent, got %v %v", spent, err)
+  }
+
+  // Another process sees it spent too.
+  spent, err = store.Get().SpendChallenge("1760745600.14.abcd.ef01", time.Now().Add(time.Minute))
+  if err != nil || spent {
+    t.Errorf("Expected a spent challenge refused, got %v %v", spent, err)
+  }
+
+  s.SpendChallenge("1760745600.14.dcba.ef01", time.Now().Add(-time.Second))
+  if err = s.SweepChallenges(); err != nil {
+    t.Fatal("Error sweeping challenges:", err)
+  }
+
+  if spent, _ = s.SpendChallenge("1760745600.14.abcd.ef01", time.Now().Add(time.Minute)); spent {
+    t.Error("Expected an unexpired challenge kept through the sweep")
+  }
+  if spent, _ = s.SpendChallenge("1760745600.14.dcba.ef01", time.Now().Add(time.Minute)); !spent {
+    t.Error("Expected an expired challenge swept")
+  }
+}
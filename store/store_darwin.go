@@ -3,7 +3,8 @@
 package store
 
 import (
-  "log"
+  "github.com/brianhempel/sneakynote.com/logs"
+  "log/slog"
   "os"
   "os/exec"
   "regexp"
@@ -25,29 +26,29 @@ func setupRamDisk(path string) (error) {
   // 1 MB
   diskPath, err := exec.Command("hdiutil", "attach", "-nomount", "ram://2048").Output()
   if err != nil {
-    log.Fatal("Creating ramdisk: ", err)
+    logs.Fatal("Creating ramdisk", logs.Err(err))
   }
   diskPathStr := strings.TrimSpace(string(diskPath))
-  log.Printf("Created ramdisk at %s", diskPathStr)
+  slog.Info("Created ramdisk", "disk", diskPathStr)
 
   err = exec.Command("newfs_hfs", diskPathStr).Run()
   if err != nil {
-    log.Fatal("Formatting ramdisk: ", err)
+    logs.Fatal("Formatting ramdisk", logs.Err(err))
   }
-  log.Printf("Formatted ramdisk as HFS.")
+  slog.Info("Formatted ramdisk as HFS")
 
   if _, err := os.Stat(path); os.IsNotExist(err) {
     err = os.Mkdir(path, 0700)
     if err != nil {
-      log.Fatal("Making dir for ramdisk: ", err)
+      logs.Fatal("Making dir for ramdisk", logs.Err(err))
     }
   }
 
   err = exec.Command("mount", "-t", "hfs", diskPathStr, path).Run()
   if err != nil {
-    log.Fatal("Mounting ramdisk: ", err)
+    logs.Fatal("Mounting ramdisk", logs.Err(err))
   }
-  log.Printf("Ramdisk mounted at %s", path)
+  slog.Info("Ramdisk mounted", "path", path)
 
   return nil
 }
@@ -60,10 +61,10 @@ func teardownRamDisk(path string) error {
     out, err = exec.Command("hdiutil", "detach", "-force", path).CombinedOutput()
   }
   if err != nil {
-    log.Print("Umounting/ejecting ramdisk: ", err, " ", string(out))
+    slog.Error("Umounting/ejecting ramdisk", logs.Err(err), "output", string(out))
     return err
   }
-  log.Printf("Ramdisk %s unmounted and ejected.", path)
+  slog.Info("Ramdisk unmounted and ejected", "path", path)
 
   // rm -r is dangerous...
   if isMatch, _ := regexp.MatchString("\\A/tmp/[^/]+", path); isMatch {
@@ -73,11 +74,11 @@ func teardownRamDisk(path string) error {
     //   time.Sleep(time.Second)
     //   err = exec.Command("rm", "-r", path).Run()
       if err != nil {
-        log.Print("rm -r: ", err, " ", string(out))
+        slog.Error("rm -r", logs.Err(err), "output", string(out))
         return err
       }
     // }
-    log.Printf("Mountpoint folder %s removed.", path)
+    slog.Info("Mountpoint folder removed", "path", path)
   }
 
   return nil
@@ -88,7 +89,7 @@ func (s *Store) freeSpace() (int, error) {
   // On Mac OS X we can read straigh out of the store
   df, err := exec.Command("df", s.Root).CombinedOutput()
   if err != nil {
-    log.Print("Error getting store free space: ", err, string(df))
+    slog.Error("Error getting store free space", logs.Err(err), "output", string(df))
     return -1, err
   }
   // log.Print(string(df))
@@ -97,19 +98,19 @@ func (s *Store) freeSpace() (int, error) {
 
   regexp, err := regexp.Compile("\\s\\d+\\s")
   if err != nil {
-    log.Print("Error compiling regexp: ", err)
+    slog.Error("Error compiling regexp", logs.Err(err))
     return -1, err
   }
   matches := regexp.FindAll(df, -1)
   if matches == nil {
-    log.Print("Error matching df output")
+    slog.Error("Error matching df output")
     return -1, err
   }
 
   freeBlocksStr := strings.TrimSpace(string(matches[2]))
   freeBlocks, err := strconv.ParseInt(freeBlocksStr, 10, 64)
   if err != nil {
-    log.Print("Error parsing freeBlocks string: ", err)
+    slog.Error("Error parsing freeBlocks string", logs.Err(err))
     return -1, err
   }
   // log.Print(free * 512)
@@ -0,0 +1,199 @@
+// Groups tie several secrets together, e.g. the Shamir shares of a key where
+// any k of the n shares recover it. The server never sees the shares'
+// plaintext; it only tracks how many have been opened.
+
+package store
+
+import (
+  "encoding/json"
+  "errors"
+  "io/ioutil"
+  "os"
+  "path"
+  "time"
+)
+
+var (
+  DuplicateGroupId = errors.New("Group ID has been used before")
+  InvalidThreshold = errors.New("Group threshold must be between 1 and the number of secrets")
+  GroupNotFound = errors.New("Group not found")
+)
+
+type GroupStatus struct {
+  Threshold int `json:"threshold"`
+  Shares int `json:"shares"`
+  Unopened int `json:"unopened"`
+  Opened int `json:"opened"`
+  Expired int `json:"expired"`
+  Destroyed int `json:"destroyed"`
+  QuorumReached bool `json:"quorum_reached"`
+  // False once too many shares are gone for a quorum to ever be reached.
+  QuorumPossible bool `json:"quorum_possible"`
+  CreatedAt time.Time `json:"created_at"`
+  RevokedAt *time.Time `json:"revoked_at"`
+  // In the order the secrets were saved.
+  ShareStates []string `json:"share_states"`
+}
+
+// Stored in the groups folder under the hashed group ID.
+type groupRecord struct {
+  Code string `json:"code"`
+  Threshold int `json:"threshold"`
+  FileNames []string `json:"file_names"`
+  CreatedAt time.Time `json:"created_at"`
+  RevokedAt *time.Time `json:"revoked_at"`
+}
+
+// Like SaveBatch, but also records the secrets as a group needing threshold
+// of them opened for a quorum. Returns the group's code, which the sender
+// needs for GroupStatus and RevokeGroup.
+func (s *Store) SaveGroupBatch(groupId string, threshold int, ids []string, secrets [][]byte) (string, []string, int, error) {
+  if threshold < 1 || threshold > len(ids) {
+    return "", nil, -1, InvalidThreshold
+  }
+
+  groupFilePath := path.Join(s.GroupsPath, s.UuidToFileName(groupId))
+
+  if _, err := os.Stat(groupFilePath); !os.IsNotExist(err) {
+    return "", nil, -1, DuplicateGroupId
+  }
+
+  groupCode, err := generateCode()
+  if err != nil {
+    return "", nil, -1, err
+  }
+
+  fileNames := make([]string, len(ids))
+  for i, id := range ids {
+    fileNames[i] = s.UuidToFileName(id)
+  }
+
+  group := &groupRecord{Code: groupCode, Threshold: threshold, FileNames: fileNames, CreatedAt: time.Now()}
+
+  err = s.writeGroup(groupFilePath, group)
+  if err != nil {
+    return "", nil, -1, err
+  }
+
+  codes, failedIndex, err := s.SaveBatch(ids, secrets)
+  if err != nil {
+    os.Remove(groupFilePath)
+    return "", nil, failedIndex, err
+  }
+
+  return groupCode, codes, -1, nil
+}
+
+func (s *Store) GroupStatus(groupId string, givenCode string) (*GroupStatus, error) {
+  group, err := s.readGroup(groupId, givenCode)
+  if err != nil {
+    return nil, err
+  }
+
+  return s.groupStatus(group), nil
+}
+
+// Destroys every share that hasn't been opened yet. Opened shares are already
+// out of our hands.
+func (s *Store) RevokeGroup(groupId string, givenCode string) (*GroupStatus, error) {
+  group, err := s.readGroup(groupId, givenCode)
+  if err != nil {
+    return nil, err
+  }
+
+  if group.RevokedAt == nil {
+    now := time.Now()
+    group.RevokedAt = &now
+    s.writeGroup(path.Join(s.GroupsPath, s.UuidToFileName(groupId)), group)
+  }
+
+  for _, fileName := range group.FileNames {
+    if _, err := os.Stat(path.Join(s.Root, fileName)); err == nil {
+      s.destroySecret(fileName, ReasonRevoked)
+    }
+  }
+
+  return s.groupStatus(group), nil
+}
+
+func (s *Store) groupStatus(group *groupRecord) *GroupStatus {
+  status := &GroupStatus{
+    Threshold: group.Threshold,
+    Shares: len(group.FileNames),
+    CreatedAt: group.CreatedAt,
+    RevokedAt: group.RevokedAt,
+    ShareStates: make([]string, len(group.FileNames)),
+  }
+
+  // Each share is looked for once, and any not found once more after a
+  // single wait, rather than waiting on each in turn, since this holds a
+  // request slot and long polls call it again and again.
+  notFound := []int{}
+  for i, fileName := range group.FileNames {
+    if noteStatus, _, _ := s.noteStatus(fileName, 1); noteStatus != nil {
+      status.ShareStates[i] = noteStatus.State
+    } else {
+      notFound = append(notFound, i)
+    }
+  }
+  if len(notFound) > 0 {
+    time.Sleep(locateRetryDelay)
+  }
+  for _, i := range notFound {
+    if noteStatus, _, _ := s.noteStatus(group.FileNames[i], 1); noteStatus != nil {
+      status.ShareStates[i] = noteStatus.State
+    } else {
+      // Rolled back or unreadable. Treat as gone.
+      status.ShareStates[i] = StateDestroyed
+    }
+  }
+
+  for i := range group.FileNames {
+    switch status.ShareStates[i] {
+    case StateUnopened: status.Unopened++
+    case StateOpened: status.Opened++
+    case StateExpired: status.Expired++
+    case StateDestroyed: status.Destroyed++
+    }
+  }
+
+  status.QuorumReached = status.Opened >= status.Threshold
+  status.QuorumPossible = status.Opened + status.Unopened >= status.Threshold
+
+  return status
+}
+
+func (s *Store) readGroup(groupId string, givenCode string) (*groupRecord, error) {
+  groupFileName := s.UuidToFileName(groupId)
+
+  data, err := ioutil.ReadFile(path.Join(s.GroupsPath, groupFileName))
+  if os.IsNotExist(err) {
+    return nil, GroupNotFound
+  } else if err != nil {
+    return nil, err
+  }
+
+  group := &groupRecord{}
+  err = json.Unmarshal(data, group)
+  if err != nil {
+    return nil, err
+  }
+
+  _, err = s.checkCode(groupAttemptsName(groupFileName), givenCode, group.Code)
+  if err == SecretNotFound {
+    return nil, GroupNotFound
+  } else if err != nil {
+    return nil, err
+  }
+
+  return group, nil
+}
+
+func (s *Store) writeGroup(groupFilePath string, group *groupRecord) error {
+  data, err := json.Marshal(group)
+  if err != nil {
+    return err
+  }
+
+  return ioutil.WriteFile(groupFilePath, data, 0600)
+}
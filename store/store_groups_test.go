@@ -0,0 +1,143 @@
+package store_test
+
+import (
+  "github.com/brianhempel/sneakynote.com/store"
+  "os"
+  "path"
+  "testing"
+  "time"
+)
+
+func saveTestGroup(t *testing.T, s *store.Store, threshold int) (string, string, []string) {
+  groupId := store.GenerateUuid()
+  ids := []string{store.GenerateUuid(), store.GenerateUuid(), store.GenerateUuid()}
+  secrets := [][]byte{[]byte("share 1"), []byte("share 2"), []byte("share 3")}
+
+  groupCode, codes, _, err := s.SaveGroupBatch(groupId, threshold, ids, secrets)
+  if err != nil {
+    t.Error("Error on store.SaveGroupBatch:", err)
+  }
+  if len(codes) != 3 {
+    t.Errorf("Expected 3 codes, got %d", len(codes))
+  }
+
+  return groupId, groupCode, ids
+}
+
+func TestGroupStatusQuorum(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  groupId, groupCode, ids := saveTestGroup(t, s, 2)
+
+  status, err := s.GroupStatus(groupId, groupCode)
+  if err != nil {
+    t.Error("Error on store.GroupStatus:", err)
+    return
+  }
+  if status.Shares != 3 || status.Unopened != 3 || status.Opened != 0 || status.QuorumReached || !status.QuorumPossible {
+    t.Errorf("Expected 3 unopened shares and no quorum yet, got %#v", status)
+  }
+
+  buf := make([]byte, s.MaxSecretSize)
+  s.Retrieve(ids[0], buf)
+  s.Retrieve(ids[2], buf)
+
+  status, err = s.GroupStatus(groupId, groupCode)
+  if err != nil {
+    t.Error("Error on store.GroupStatus:", err)
+    return
+  }
+  if status.Opened != 2 || status.Unopened != 1 || !status.QuorumReached {
+    t.Errorf("Expected 2 opened shares and a quorum, got %#v", status)
+  }
+  if status.ShareStates[0] != store.StateOpened || status.ShareStates[1] != store.StateUnopened || status.ShareStates[2] != store.StateOpened {
+    t.Error("Expected share states in order, got", status.ShareStates)
+  }
+
+  // Codes must match
+  _, err = s.GroupStatus(groupId, "bad code")
+  if err != store.GroupNotFound {
+    t.Error("Expected a GroupNotFound error for a bad code, got", err)
+  }
+}
+
+func TestRevokeGroup(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  groupId, groupCode, ids := saveTestGroup(t, s, 2)
+
+  buf := make([]byte, s.MaxSecretSize)
+  s.Retrieve(ids[0], buf)
+
+  status, err := s.RevokeGroup(groupId, groupCode)
+  if err != nil {
+    t.Error("Error on store.RevokeGroup:", err)
+    return
+  }
+  if status.RevokedAt == nil {
+    t.Error("Expected revoked_at to be set")
+  }
+  if status.Opened != 1 || status.Destroyed != 2 || status.QuorumReached || status.QuorumPossible {
+    t.Errorf("Expected 1 opened and 2 destroyed shares with no quorum possible, got %#v", status)
+  }
+
+  for _, id := range ids[1:] {
+    filePath := path.Join(s.Root, s.UuidToFileName(id))
+    if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+      t.Errorf("Expected secret file %s to be destroyed, but was found.", filePath)
+    }
+
+    _, _, err := s.Retrieve(id, buf)
+    if err != store.SecretAlreadyAccessed {
+      t.Error("Expected a SecretAlreadyAccessed error for a revoked share, got", err)
+    }
+  }
+}
+
+func TestSaveGroupBatchInvalidThreshold(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  _, _, _, err := s.SaveGroupBatch(store.GenerateUuid(), 3, []string{store.GenerateUuid(), store.GenerateUuid()}, [][]byte{[]byte("share 1"), []byte("share 2")})
+  if err != store.InvalidThreshold {
+    t.Error("Expected an InvalidThreshold error, got", err)
+  }
+}
+
+func TestSaveGroupBatchDuplicateGroupId(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  groupId, _, _ := saveTestGroup(t, s, 2)
+
+  _, _, _, err := s.SaveGroupBatch(groupId, 1, []string{store.GenerateUuid()}, [][]byte{[]byte("share 1")})
+  if err != store.DuplicateGroupId {
+    t.Error("Expected a DuplicateGroupId error, got", err)
+  }
+}
+
+// Shares that can't be found are looked for again once for the whole group,
+// not with a wait for each.
+func TestGroupStatusMissingSharesWaitOnce(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  groupId, groupCode, ids := saveTestGroup(t, s, 2)
+  for _, id := range ids {
+    os.Remove(path.Join(s.Root, s.UuidToFileName(id)))
+  }
+
+  start := time.Now()
+  status, err := s.GroupStatus(groupId, groupCode)
+  if err != nil {
+    t.Fatal("Error on store.GroupStatus:", err)
+  }
+  if status.Destroyed != 3 {
+    t.Errorf("Expected 3 missing shares counted destroyed, got %#v", status)
+  }
+  if elapsed := time.Since(start); elapsed > 120 * time.Millisecond {
+    t.Errorf("Expected a single wait of 50ms, took %v", elapsed)
+  }
+}
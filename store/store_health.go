@@ -0,0 +1,110 @@
+package store
+
+import (
+  "bytes"
+  "crypto/rand"
+  "errors"
+  "fmt"
+  "os"
+  "path"
+  "sync/atomic"
+  "time"
+)
+
+// Checks that the store works, for deciding whether to take traffic.
+
+// Zero if SweepContinuously hasn't finished a sweep.
+func (s *Store) LastSweep() time.Time {
+  nanos := atomic.LoadInt64(&s.lastSweepTime)
+  if nanos == 0 {
+    return time.Time{}
+  }
+  return time.Unix(0, nanos)
+}
+
+// An error naming the first store folder that's missing or can't be written.
+func (s *Store) CheckFolders() error {
+  for _, folderPath := range []string{s.Root, s.BeingAccessedPath, s.AccessedPath, s.ExpiringPath, s.ExpiredPath, s.MetadataPath, s.GroupsPath, s.AttemptsPath, s.ChallengesPath, s.ControlPath} {
+    file, err := os.CreateTemp(folderPath, ".writable")
+    if err != nil {
+      return err
+    }
+    file.Close()
+    os.Remove(file.Name())
+  }
+  return nil
+}
+
+// Takes two throwaway notes of random bytes through the whole lifecycle: one
+// is saved and opened, the other saved, aged past SecretLifetime and swept.
+// They go in a scratch store of their own in the control folder, on the same
+// disk but apart from real notes, their records and the hooks, and the
+// scratch store is removed after.
+func (s *Store) SelfCheck() error {
+  scratch := storeAt(path.Join(s.ControlPath, "self_check"))
+  scratch.MaxSecretSize = s.MaxSecretSize
+  scratch.Headroom = s.Headroom
+  scratch.SecretLifetime = s.SecretLifetime
+  scratch.MaxFailedCodeAttempts = s.MaxFailedCodeAttempts
+  scratch.CodeLockout = s.CodeLockout
+  scratch.PadSecrets = s.PadSecrets
+
+  // Left by a check cut short, or another process's.
+  os.RemoveAll(scratch.Root)
+  defer os.RemoveAll(scratch.Root)
+
+  if err := scratch.EnsureFolders(); err != nil {
+    return fmt.Errorf("Self check failed making its store: %v", err)
+  }
+  return scratch.selfCheck()
+}
+
+func (s *Store) selfCheck() error {
+  secret := make([]byte, 64)
+  if _, err := rand.Read(secret); err != nil {
+    return err
+  }
+
+  openedId := GenerateUuid()
+  code, err := s.Save(bytes.NewReader(secret), openedId)
+  if err != nil {
+    return fmt.Errorf("Self check failed saving: %v", err)
+  }
+
+  buf := make([]byte, s.MaxSecretSize + 1)
+  nRead, retrievedCode, err := s.Retrieve(openedId, buf)
+  if err != nil {
+    return fmt.Errorf("Self check failed opening: %v", err)
+  }
+  if retrievedCode != code || !bytes.Equal(buf[:nRead], secret) {
+    return errors.New("Self check: opened note doesn't match what was saved")
+  }
+  if status, _ := s.StatusDetails(openedId, code); status == nil || status.State != StateOpened {
+    return errors.New("Self check: opened note not recorded as opened")
+  }
+
+  expiredId := GenerateUuid()
+  code, err = s.Save(bytes.NewReader(secret), expiredId)
+  if err != nil {
+    return fmt.Errorf("Self check failed saving: %v", err)
+  }
+  aged := time.Now().Add(-s.SecretLifetime - time.Minute)
+  if err = os.Chtimes(s.uuidToFilePath(expiredId), aged, aged); err != nil {
+    return fmt.Errorf("Self check failed aging: %v", err)
+  }
+
+  if err = s.Sweep(); err != nil {
+    return fmt.Errorf("Self check failed sweeping: %v", err)
+  }
+  fileName := s.UuidToFileName(expiredId)
+  for _, leftover := range []string{s.uuidToFilePath(expiredId), path.Join(s.ExpiringPath, fileName)} {
+    if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+      return errors.New("Self check: expired note not swept away")
+    }
+  }
+  if status, _ := s.StatusDetails(expiredId, code); status == nil || status.State != StateExpired {
+    return errors.New("Self check: swept note not recorded as expired")
+  }
+
+  return nil
+}
@@ -0,0 +1,78 @@
+package store_test
+
+import (
+  "github.com/brianhempel/sneakynote.com/store"
+  "io/ioutil"
+  "os"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestSelfCheck(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  saves := 0
+  s.OnSave = func(size int) { saves++ }
+
+  err := s.SelfCheck()
+  if err != nil {
+    t.Fatal("Expected the self check to pass, got", err)
+  }
+
+  opened, expired, _ := s.Tombstones()
+  liveNotes, _, _ := s.LiveNotes()
+  if opened != 0 || expired != 0 || liveNotes != 0 || saves != 0 {
+    t.Errorf("Expected the self check's notes kept apart from real ones, got %d opened, %d expired, %d live and %d saves", opened, expired, liveNotes, saves)
+  }
+
+  entries, _ := ioutil.ReadDir(s.ControlPath)
+  if len(entries) != 0 {
+    t.Errorf("Expected the scratch store removed, got %d entries in the control folder", len(entries))
+  }
+}
+
+func TestSelfCheckUnwritableStore(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  os.RemoveAll(s.ControlPath)
+  ioutil.WriteFile(s.ControlPath, []byte("not a folder"), 0600)
+  defer os.Remove(s.ControlPath)
+
+  if err := s.SelfCheck(); err == nil {
+    t.Error("Expected the self check to fail without a control folder to work in")
+  }
+}
+
+func TestCheckFolders(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  if err := s.CheckFolders(); err != nil {
+    t.Error("Expected a new store's folders fine, got", err)
+  }
+
+  os.RemoveAll(s.GroupsPath)
+  if err := s.CheckFolders(); err == nil || !strings.Contains(err.Error(), "groups") {
+    t.Error("Expected the missing groups folder named, got", err)
+  }
+}
+
+func TestLastSweep(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  if !s.LastSweep().IsZero() {
+    t.Error("Expected no last sweep before sweeping")
+  }
+
+  stop := make(chan struct{})
+  close(stop)
+  s.SweepContinuously(stop)
+
+  if time.Since(s.LastSweep()) > time.Second {
+    t.Errorf("Expected a sweep just now, got %v", s.LastSweep())
+  }
+}
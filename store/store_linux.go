@@ -3,7 +3,8 @@
 package store
 
 import (
-  "log"
+  "github.com/brianhempel/sneakynote.com/logs"
+  "log/slog"
   "os"
   "os/exec"
   "regexp"
@@ -28,14 +29,14 @@ func setupRamDisk(path string) (error) {
 
   err := os.MkdirAll(path, 0700)
   if err != nil {
-    log.Fatal("Creating ramdisk folder: ", err)
+    logs.Fatal("Creating ramdisk folder", logs.Err(err))
   }
 
   err = exec.Command("sudo", "mount", "-t", "ramfs", "-o", "size=1m", "ramfs", path).Run()
   if err != nil {
-    log.Fatal("Mounting ramdisk: ", err)
+    logs.Fatal("Mounting ramdisk", logs.Err(err))
   }
-  log.Printf("Ramdisk mounted at %s", path)
+  slog.Info("Ramdisk mounted", "path", path)
 
   return nil
 }
@@ -48,10 +49,10 @@ func teardownRamDisk(path string) error {
     out, err = exec.Command("sudo", "umount", path).CombinedOutput()
   }
   if err != nil {
-    log.Print("Umounting/ejecting ramdisk: ", err, " ", string(out))
+    slog.Error("Umounting/ejecting ramdisk", logs.Err(err), "output", string(out))
     return err
   }
-  log.Printf("Ramdisk %s unmounted and ejected.", path)
+  slog.Info("Ramdisk unmounted and ejected", "path", path)
 
   // rm -r is dangerous...
   if isMatch, _ := regexp.MatchString("\\A/tmp/[^/]+", path); isMatch {
@@ -61,11 +62,11 @@ func teardownRamDisk(path string) error {
     //   time.Sleep(time.Second)
     //   err = exec.Command("rm", "-r", path).Run()
       if err != nil {
-        log.Print("rm -r: ", err, " ", string(out))
+        slog.Error("rm -r", logs.Err(err), "output", string(out))
         return err
       }
     // }
-    log.Printf("Mountpoint folder %s removed.", path)
+    slog.Info("Mountpoint folder removed", "path", path)
   }
 
   return nil
@@ -76,7 +77,7 @@ func (s *Store) freeSpace() (int, error) {
   // On Mac OS X we can read straigh out of the store
   out, err := exec.Command("free", "-b").CombinedOutput()
   if err != nil {
-    log.Print("Error getting computer free space: ", err, string(out))
+    slog.Error("Error getting computer free space", logs.Err(err), "output", string(out))
     return -1, err
   }
   // log.Print(string(df))
@@ -87,14 +88,14 @@ func (s *Store) freeSpace() (int, error) {
 
   matches := freeSpaceRegexp.FindAll(out, -1)
   if matches == nil {
-    log.Print("Error matching free output")
+    slog.Error("Error matching free output")
     return -1, err
   }
 
   freeBytesStr := strings.TrimSpace(string(matches[2]))
   freeBytes, err := strconv.ParseInt(freeBytesStr, 10, 64)
   if err != nil {
-    log.Print("Error parsing freeBytes string: ", err)
+    slog.Error("Error parsing freeBytes string", logs.Err(err))
     return -1, err
   }
 
@@ -0,0 +1,80 @@
+package store
+
+import (
+  "io/ioutil"
+  "os"
+  "path"
+  "time"
+)
+
+// In maintenance mode no new notes are taken, while those already stored can
+// still be read or expire. The flag is a file in the control folder, so it
+// holds for every process using the store: the CLI, and both sides of a
+// handoff.
+
+const (
+  maintenanceFileName = "maintenance"
+)
+
+func (s *Store) maintenanceFilePath() string {
+  return path.Join(s.ControlPath, maintenanceFileName)
+}
+
+// Records when maintenance started, unless it already had.
+func (s *Store) StartMaintenance() error {
+  file, err := os.OpenFile(s.maintenanceFilePath(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+  if os.IsExist(err) {
+    return nil
+  } else if err != nil {
+    return err
+  }
+  defer file.Close()
+
+  _, err = file.WriteString(time.Now().UTC().Format(time.RFC3339))
+  return err
+}
+
+func (s *Store) StopMaintenance() error {
+  err := os.Remove(s.maintenanceFilePath())
+  if os.IsNotExist(err) {
+    return nil
+  }
+  return err
+}
+
+// Whether the store is in maintenance, and since when.
+func (s *Store) Maintenance() (bool, time.Time) {
+  contents, err := ioutil.ReadFile(s.maintenanceFilePath())
+  if err != nil {
+    return false, time.Time{}
+  }
+
+  since, _ := time.Parse(time.RFC3339, string(contents))
+  return true, since
+}
+
+// Unopened notes still stored, and when the last of them expires. With no
+// notes, that's now.
+func (s *Store) LiveNotes() (int, time.Time, error) {
+  files, err := ioutil.ReadDir(s.Root)
+  if err != nil {
+    return 0, time.Time{}, err
+  }
+
+  count := 0
+  emptyAt := time.Now()
+
+  // Secrets are the only plain files at the top of the store.
+  for _, fileInfo := range files {
+    if fileInfo.IsDir() {
+      continue
+    }
+    count++
+    expiresAt := fileInfo.ModTime().Add(s.SecretLifetime)
+    if expiresAt.After(emptyAt) {
+      emptyAt = expiresAt
+    }
+  }
+
+  return count, emptyAt, nil
+}
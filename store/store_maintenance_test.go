@@ -0,0 +1,70 @@
+package store_test
+
+import (
+  "github.com/brianhempel/sneakynote.com/store"
+  "testing"
+  "time"
+)
+
+func TestMaintenance(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  if on, _ := s.Maintenance(); on {
+    t.Error("Expected a new store not in maintenance")
+  }
+
+  err := s.StartMaintenance()
+  if err != nil {
+    t.Fatal("Error on StartMaintenance:", err)
+  }
+  on, since := s.Maintenance()
+  if !on || time.Since(since) > time.Minute {
+    t.Errorf("Expected maintenance on since now, got %v %v", on, since)
+  }
+
+  // Starting again keeps the original time; another process sees it too.
+  time.Sleep(1100 * time.Millisecond)
+  s.StartMaintenance()
+  if _, sinceAgain := store.Get().Maintenance(); !sinceAgain.Equal(since) {
+    t.Errorf("Expected maintenance still since %v, got %v", since, sinceAgain)
+  }
+
+  err = s.StopMaintenance()
+  if err != nil {
+    t.Fatal("Error on StopMaintenance:", err)
+  }
+  if on, _ := s.Maintenance(); on {
+    t.Error("Expected maintenance off")
+  }
+  if err = s.StopMaintenance(); err != nil {
+    t.Error("Expected stopping twice to be fine, got", err)
+  }
+}
+
+func TestLiveNotes(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  count, emptyAt, err := s.LiveNotes()
+  if err != nil || count != 0 || time.Since(emptyAt) > time.Second {
+    t.Errorf("Expected an empty store empty now, got %d %v %v", count, emptyAt, err)
+  }
+
+  makeFile(s.Root, "secret_older", "234 567 abcd\n", 8, 0600)
+  makeFile(s.Root, "secret_newer", "234 567 abcd\n", 3, 0600)
+  // Opened and expiring notes aren't live.
+  makeFile(s.AccessedPath, "accessed_record", "234 567 abcd", 1, 0400)
+  makeFile(s.ExpiringPath, "secret_expiring", "234 567 abcd\n", 0, 0600)
+  s.StartMaintenance()
+
+  count, emptyAt, err = s.LiveNotes()
+  if err != nil || count != 2 {
+    t.Errorf("Expected 2 live notes, got %d %v", count, err)
+  }
+  // The newer note expires last.
+  expected := time.Now().Add(s.SecretLifetime - 3 * time.Minute)
+  if emptyAt.Before(expected.Add(-time.Second)) || emptyAt.After(expected.Add(time.Second)) {
+    t.Errorf("Expected the store empty at %v, got %v", expected, emptyAt)
+  }
+}
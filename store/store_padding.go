@@ -0,0 +1,66 @@
+package store
+
+import (
+  "errors"
+)
+
+// With PadSecrets, secrets are stored padded to a few fixed sizes so a note's
+// file size says little about the size of the secret inside.
+//
+// A padded file is the code, a tab where the newline would be, the secret,
+// 0x80, then zeros up to the bucket size. Files without the tab are read as
+// before, so the store can switch modes with notes in flight.
+
+const (
+  minPaddedSize = 256
+  paddedCodeSeparator = '\t'
+  paddingMarker = 0x80
+)
+
+var MalformedPadding = errors.New("Secret padding is malformed")
+
+// The smallest bucket with room for the secret and the padding marker:
+// 256, 512, 1024... and finally MaxSecretSize + 1.
+func (s *Store) PaddedSize(secretSize int) int {
+  size := minPaddedSize
+  for size < secretSize + 1 {
+    size *= 2
+  }
+  if size > s.MaxSecretSize + 1 {
+    size = s.MaxSecretSize + 1
+  }
+  return size
+}
+
+// Marks the end of the secret in buf[:secretSize] and zeros the rest of the
+// bucket. buf must have room for paddedSize bytes.
+func PadSecret(buf []byte, secretSize int, paddedSize int) []byte {
+  buf[secretSize] = paddingMarker
+  for i := secretSize + 1; i < paddedSize; i++ {
+    buf[i] = 0
+  }
+  return buf[:paddedSize]
+}
+
+// The length of the secret in a padded buffer.
+func UnpaddedSize(padded []byte) (int, error) {
+  for i := len(padded) - 1; i >= 0; i-- {
+    switch padded[i] {
+    case 0:
+      continue
+    case paddingMarker:
+      return i, nil
+    default:
+      return -1, MalformedPadding
+    }
+  }
+  return -1, MalformedPadding
+}
+
+// Bytes the secret takes on disk after the code line.
+func (s *Store) storedSecretSize(secretSize int) int {
+  if s.PadSecrets {
+    return s.PaddedSize(secretSize)
+  }
+  return secretSize
+}
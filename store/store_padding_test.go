@@ -0,0 +1,142 @@
+package store_test
+
+import (
+  "bytes"
+  "github.com/brianhempel/sneakynote.com/store"
+  "io/ioutil"
+  "os"
+  "path"
+  "strings"
+  "testing"
+)
+
+func TestPaddedSize(t *testing.T) {
+  s := store.Get()
+
+  expectations := map[int]int{
+    0: 256,
+    255: 256,
+    256: 512,
+    1000: 1024,
+    s.MaxSecretSize - 1: s.MaxSecretSize,
+    s.MaxSecretSize: s.MaxSecretSize + 1,
+  }
+
+  for secretSize, expected := range expectations {
+    if paddedSize := s.PaddedSize(secretSize); paddedSize != expected {
+      t.Errorf("Expected %d bytes padded to %d, got %d", secretSize, expected, paddedSize)
+    }
+  }
+}
+
+func TestSavePaddedHidesSize(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+  s.PadSecrets = true
+
+  shortSecret := []byte("short")
+  longSecret := bytes.Repeat([]byte{0x80, 0}, 100)
+
+  shortId := store.GenerateUuid()
+  longId := store.GenerateUuid()
+
+  _, err := s.Save(bytes.NewReader(shortSecret), shortId)
+  if err != nil {
+    t.Fatal("Error on store.Save:", err)
+  }
+  longCode, err := s.Save(bytes.NewReader(longSecret), longId)
+  if err != nil {
+    t.Fatal("Error on store.Save:", err)
+  }
+
+  shortInfo, _ := os.Stat(path.Join(s.Root, s.UuidToFileName(shortId)))
+  longInfo, _ := os.Stat(path.Join(s.Root, s.UuidToFileName(longId)))
+
+  if shortInfo.Size() != longInfo.Size() || shortInfo.Size() != int64(store.CodeByteSize + 1 + 256) {
+    t.Errorf("Expected both secret files to be %d bytes, got %d and %d", store.CodeByteSize + 1 + 256, shortInfo.Size(), longInfo.Size())
+  }
+
+  // Status checks read the code from padded files too.
+  if err = s.Status(longId, longCode); err != nil {
+    t.Error("Expected status with the code, got", err)
+  }
+
+  buf := make([]byte, s.MaxSecretSize + 1)
+  nRead, code, err := s.Retrieve(longId, buf)
+  if err != nil {
+    t.Fatal("Error on store.Retrieve:", err)
+  }
+
+  if code != longCode {
+    t.Errorf("Expected code %s, got %s", longCode, code)
+  }
+
+  if !bytes.Equal(buf[:nRead], longSecret) {
+    t.Errorf("Expected %x, got %x", longSecret, buf[:nRead])
+  }
+}
+
+func TestSavePaddedMaxSize(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+  s.PadSecrets = true
+
+  secret := bytes.Repeat([]byte("a"), s.MaxSecretSize)
+  id := store.GenerateUuid()
+
+  _, err := s.Save(bytes.NewReader(secret), id)
+  if err != nil {
+    t.Fatal("Error on store.Save:", err)
+  }
+
+  buf := make([]byte, s.MaxSecretSize + 1)
+  nRead, _, err := s.Retrieve(id, buf)
+  if err != nil {
+    t.Fatal("Error on store.Retrieve:", err)
+  }
+
+  if !bytes.Equal(buf[:nRead], secret) {
+    t.Errorf("Expected %d bytes back, got %d", len(secret), nRead)
+  }
+}
+
+// Switching padding on mustn't break notes saved before.
+func TestRetrieveUnpaddedWhilePadding(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  id := store.GenerateUuid()
+  _, err := s.Save(strings.NewReader("saved before padding"), id)
+  if err != nil {
+    t.Fatal("Error on store.Save:", err)
+  }
+
+  s.PadSecrets = true
+
+  buf := make([]byte, s.MaxSecretSize + 1)
+  nRead, _, err := s.Retrieve(id, buf)
+  if err != nil {
+    t.Fatal("Error on store.Retrieve:", err)
+  }
+
+  if string(buf[:nRead]) != "saved before padding" {
+    t.Errorf("Expected \"saved before padding\", got %q", buf[:nRead])
+  }
+}
+
+func TestRetrieveMalformedPadding(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  id := store.GenerateUuid()
+  err := ioutil.WriteFile(path.Join(s.Root, s.UuidToFileName(id)), []byte("234 567 abcd\tno marker here"), 0600)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  buf := make([]byte, s.MaxSecretSize + 1)
+  _, _, err = s.Retrieve(id, buf)
+  if err != store.MalformedPadding {
+    t.Error("Expected MalformedPadding, got", err)
+  }
+}
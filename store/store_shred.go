@@ -0,0 +1,41 @@
+package store
+
+import (
+  "io/ioutil"
+  "path"
+)
+
+// Destroys every unopened secret at once, for emergencies. Each leaves a
+// record, so senders' status checks say it was shredded and the ID can't be
+// reused. Secrets mid-read and awaiting zeroing are zeroed too.
+//
+// Returns how many unopened secrets were destroyed. Notes saved while this
+// runs may survive it; stop new notes first to be sure.
+func (s *Store) Shred() (int, error) {
+  files, err := ioutil.ReadDir(s.Root)
+  if err != nil {
+    return 0, err
+  }
+
+  shredded := 0
+  for _, fileInfo := range files {
+    if fileInfo.IsDir() {
+      continue
+    }
+    if s.destroySecret(fileInfo.Name(), ReasonShredded) == nil {
+      shredded++
+    }
+  }
+
+  for _, folderPath := range []string{s.BeingAccessedPath, s.ExpiringPath} {
+    files, err := ioutil.ReadDir(folderPath)
+    if err != nil {
+      return shredded, err
+    }
+    for _, fileInfo := range files {
+      zeroFileAndRemove(path.Join(folderPath, fileInfo.Name()))
+    }
+  }
+
+  return shredded, nil
+}
@@ -0,0 +1,37 @@
+package store_test
+
+import (
+  "github.com/brianhempel/sneakynote.com/store"
+  "bytes"
+  "io/ioutil"
+  "testing"
+)
+
+func TestShred(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  code, _ := s.Save(bytes.NewBufferString("this is my secret"), "fc2a4122-e81e-4b10-a31b-d79fbdb33a27")
+  s.Save(bytes.NewBufferString("another secret"), "3bd5ff31-2a37-4b6f-9a0c-5d39e9a4c0a1")
+  makeFile(s.ExpiringPath, "secret_expiring", "234 567 abcd\n", 0, 0600)
+
+  shredded, err := s.Shred()
+  if err != nil || shredded != 2 {
+    t.Errorf("Expected 2 notes shredded, got %d %v", shredded, err)
+  }
+
+  liveNotes, _, _ := s.LiveNotes()
+  expiring, _ := ioutil.ReadDir(s.ExpiringPath)
+  if liveNotes != 0 || len(expiring) != 0 {
+    t.Errorf("Expected nothing left, got %d live and %d expiring", liveNotes, len(expiring))
+  }
+
+  status, err := s.StatusDetails("fc2a4122-e81e-4b10-a31b-d79fbdb33a27", code)
+  if status == nil || status.State != store.StateDestroyed || status.DestroyedReason != store.ReasonShredded {
+    t.Errorf("Expected the note destroyed by shredding, got %+v %v", status, err)
+  }
+
+  if _, err = s.Save(bytes.NewBufferString("again"), "fc2a4122-e81e-4b10-a31b-d79fbdb33a27"); err != store.DuplicateId {
+    t.Error("Expected a shredded note's ID not reusable, got", err)
+  }
+}
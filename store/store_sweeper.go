@@ -1,64 +1,106 @@
 package store
 
 import (
+  "github.com/brianhempel/sneakynote.com/logs"
   "io/ioutil"
-  "log"
+  "log/slog"
   "os"
   "path"
+  "sync/atomic"
   "time"
 )
 
-func (s *Store) SweepContinuously() {
+// What one phase of a sweep did: how long it took and how many files it
+// swept away.
+type SweepPhase struct {
+  Name string
+  Duration time.Duration
+  Items int
+}
+
+// Sweeps every minute until stop is closed. A sweep underway finishes first.
+//
+// Panics aren't recovered here; the caller should, and call this again.
+func (s *Store) SweepContinuously(stop <-chan struct{}) {
   for {
-    s.Sweep()
-    time.Sleep(time.Minute)
+    if err := s.Sweep(); err == nil {
+      atomic.StoreInt64(&s.lastSweepTime, time.Now().UnixNano())
+    } else {
+      slog.Error("Sweep failed, will retry", logs.Err(err))
+    }
+
+    select {
+    case <-stop:
+      return
+    case <-time.After(time.Minute):
+    }
   }
 }
 
 func (s *Store) Sweep() error {
-  err := s.SweepSecrets(s.SecretLifetime)
-  if err != nil {
-    return err
-  }
-
-  err = s.SweepBeingAccessed(s.SecretLifetime + time.Minute)
-  if err != nil {
-    return err
-  }
+  _, err := s.SweepAndReport()
+  return err
+}
 
-  err = s.SweepAccessed()
-  if err != nil {
-    return err
+// Stops at the first phase that fails. The phases that ran are returned, and
+// passed to OnSweep if set, either way.
+func (s *Store) SweepAndReport() ([]SweepPhase, error) {
+  phases := []struct {
+    name string
+    sweep func() (int, error)
+  }{
+    {"secrets", func() (int, error) { return s.sweepSecrets(s.SecretLifetime) }},
+    {"being_accessed", func() (int, error) { return sweepFolder(s.BeingAccessedPath, s.SecretLifetime + time.Minute) }},
+    {"accessed", s.sweepAccessed},
+    {"expiring", s.sweepExpiring},
+    {"expired", s.sweepExpired},
+    {"metadata", s.sweepMetadata},
+    {"groups", s.sweepGroups},
+    {"attempts", s.sweepAttempts},
+    {"challenges", s.sweepChallenges},
   }
 
-  err = s.SweepExpiring()
-  if err != nil {
-    return err
+  report := make([]SweepPhase, 0, len(phases))
+  var err error
+  for _, phase := range phases {
+    start := time.Now()
+    var items int
+    items, err = phase.sweep()
+    report = append(report, SweepPhase{Name: phase.name, Duration: time.Since(start), Items: items})
+    if err != nil {
+      break
+    }
   }
 
-  err = s.SweepExpired()
-  if err != nil {
-    return err
+  if s.OnSweep != nil {
+    s.OnSweep(report)
   }
-
-  return nil
+  return report, err
 }
 
 func (s *Store) SweepSecrets(maxAge time.Duration) error {
+  _, err := s.sweepSecrets(maxAge)
+  return err
+}
+
+// Returns how many secrets were moved to expiring.
+func (s *Store) sweepSecrets(maxAge time.Duration) (int, error) {
   files, err := ioutil.ReadDir(s.Root)
 
   if err != nil {
-    log.Print("Error reading store to sweep secrets:", err)
-    return err
+    slog.Error("Error reading store to sweep secrets", logs.Err(err))
+    return 0, err
   }
 
   cutoff := time.Now().Add(-maxAge)
+  swept := 0
 
   for _, fileInfo := range files {
     if !fileInfo.IsDir() && fileInfo.ModTime().Before(cutoff) {
       // Make a record of this secret's expiration
       expiredFilePath := path.Join(s.ExpiredPath, fileInfo.Name())
       ioutil.WriteFile(expiredFilePath, nil, 0600)
+      s.writeMetadata(fileInfo.Name(), fileInfo.ModTime(), ReasonExpired)
 
       // Move secret to expiring folder. Sweep there will zero and remove it.
       expiringFilePath := path.Join(s.ExpiringPath, fileInfo.Name())
@@ -68,17 +110,18 @@ func (s *Store) SweepSecrets(maxAge time.Duration) error {
 
       if err != nil {
         // Just log the error, don't abort sweep.
-        log.Print("Error moving", filePath, "to", expiringFilePath, err)
+        slog.Error("Error moving expired secret", logs.Note(fileInfo.Name()), logs.Err(err))
       } else {
+        swept++
         // Rewrite the expired record with the code from the secret file
         code := make([]byte, CodeByteSize)
         file, err := os.Open(expiringFilePath)
         if err != nil {
-          log.Print("Error opening", filePath, err)
+          slog.Error("Error opening expired secret", logs.Note(fileInfo.Name()), logs.Err(err))
         } else {
           _, err := file.Read(code)
           if err != nil {
-            log.Print("Error reading", filePath, err)
+            slog.Error("Error reading expired secret", logs.Note(fileInfo.Name()), logs.Err(err))
           }
           file.Close()
           ioutil.WriteFile(expiredFilePath, code, 0400)
@@ -87,42 +130,94 @@ func (s *Store) SweepSecrets(maxAge time.Duration) error {
     }
   }
 
-  return nil
+  return swept, nil
 }
 
 // This folder shouldn't have leftovers, but just in case...
 func (s *Store) SweepBeingAccessed(maxAge time.Duration) error {
   // One minute to read the secret should be more than plenty
-  return sweepFolder(s.BeingAccessedPath, maxAge)
+  _, err := sweepFolder(s.BeingAccessedPath, maxAge)
+  return err
 }
 
 func (s *Store) SweepAccessed() error {
+  _, err := s.sweepAccessed()
+  return err
+}
+
+func (s *Store) sweepAccessed() (int, error) {
   return sweepFolder(s.AccessedPath, 24 * time.Hour)
 }
 
 func (s *Store) SweepExpiring() error {
+  _, err := s.sweepExpiring()
+  return err
+}
+
+func (s *Store) sweepExpiring() (int, error) {
   return sweepFolder(s.ExpiringPath, 0)
 }
 
 func (s *Store) SweepExpired() error {
+  _, err := s.sweepExpired()
+  return err
+}
+
+func (s *Store) sweepExpired() (int, error) {
   return sweepFolder(s.ExpiredPath, 24 * time.Hour)
 }
 
-func sweepFolder(folderPath string, maxAge time.Duration) error {
+func (s *Store) SweepMetadata() error {
+  _, err := s.sweepMetadata()
+  return err
+}
+
+// Metadata outlives the accessed/expired records slightly so a record is
+// never left without its metadata.
+func (s *Store) sweepMetadata() (int, error) {
+  return sweepFolder(s.MetadataPath, 24 * time.Hour + s.SecretLifetime)
+}
+
+func (s *Store) SweepGroups() error {
+  _, err := s.sweepGroups()
+  return err
+}
+
+// Groups are created before their secrets are opened, so sweeping them at 24
+// hours means they never outlive their secrets' records.
+func (s *Store) sweepGroups() (int, error) {
+  return sweepFolder(s.GroupsPath, 24 * time.Hour)
+}
+
+func (s *Store) SweepAttempts() error {
+  _, err := s.sweepAttempts()
+  return err
+}
+
+// Lockouts must outlast the records a status check could still find.
+func (s *Store) sweepAttempts() (int, error) {
+  return sweepFolder(s.AttemptsPath, 24 * time.Hour + s.SecretLifetime)
+}
+
+// Returns how many files were removed.
+func sweepFolder(folderPath string, maxAge time.Duration) (int, error) {
   files, err := ioutil.ReadDir(folderPath)
   if err != nil {
-    log.Print("Error reading", folderPath, "folder to sweep secrets:", err)
-    return err
+    slog.Error("Error reading folder to sweep secrets", "path", folderPath, logs.Err(err))
+    return 0, err
   }
 
   cutoff := time.Now().Add(-maxAge)
+  swept := 0
 
   for _, fileInfo := range files {
     if !fileInfo.IsDir() && fileInfo.ModTime().Before(cutoff) {
       filePath := path.Join(folderPath, fileInfo.Name())
-      zeroFileAndRemove(filePath)
+      if zeroFileAndRemove(filePath) == nil {
+        swept++
+      }
     }
   }
 
-  return nil
+  return swept, nil
 }
\ No newline at end of file
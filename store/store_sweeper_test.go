@@ -434,3 +434,34 @@ func TestSweepExpired(t *testing.T) {
     t.Error("Expected not to find secret old2 but did!")
   }
 }
+
+func TestSweepReportsPhases(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  makeFile(s.Root, "secret_old", "234 567 abcd\n", 10, 0600)
+  makeFile(s.AccessedPath, "accessed_record_old", "234 567 abcd", 24*60, 0400)
+
+  var phases []store.SweepPhase
+  s.OnSweep = func(swept []store.SweepPhase) {
+    phases = swept
+  }
+
+  if err := s.Sweep(); err != nil {
+    t.Fatal("Sweep errored:", err)
+  }
+
+  items := map[string]int{}
+  for _, phase := range phases {
+    items[phase.Name] = phase.Items
+  }
+  expected := map[string]int{"secrets": 1, "being_accessed": 0, "accessed": 1, "expiring": 1, "expired": 0, "metadata": 0, "groups": 0, "attempts": 0, "challenges": 0}
+  if len(phases) != len(expected) {
+    t.Fatalf("Expected %d phases, got %v", len(expected), phases)
+  }
+  for name, count := range expected {
+    if items[name] != count {
+      t.Errorf("Expected %d items swept in %s, got %d", count, name, items[name])
+    }
+  }
+}
@@ -94,6 +94,33 @@ func TestTeardown(t *testing.T) {
   }
 }
 
+// Stores set up by older versions lack the folders added since.
+func TestOpenMakesMissingFolders(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  missing := []string{s.MetadataPath, s.GroupsPath, s.AttemptsPath, s.ChallengesPath, s.ControlPath}
+  for _, folderPath := range missing {
+    os.Remove(folderPath)
+  }
+
+  s, err := store.Open()
+  if err != nil {
+    t.Fatal("Error opening store:", err)
+  }
+  for _, folderPath := range missing {
+    if info, err := os.Stat(folderPath); err != nil || !info.IsDir() {
+      t.Errorf("Expected %s made on opening, got %v", folderPath, err)
+    }
+  }
+  if err = s.Sweep(); err != nil {
+    t.Error("Expected sweeping the opened store to work, got", err)
+  }
+  if err = s.StartMaintenance(); err != nil {
+    t.Error("Expected maintenance to work on the opened store, got", err)
+  }
+}
+
 func TestSave(t *testing.T) {
   s := store.Setup()
   defer s.Teardown()
@@ -705,4 +732,284 @@ func TestStatusNotFound(t *testing.T) {
   if err != store.SecretNotFound {
     t.Error("Expected a SecretNotFound error, got", err)
   }
-}
\ No newline at end of file
+}
+func TestStatusDetailsUnopened(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  id := store.GenerateUuid()
+  code, err := s.Save(strings.NewReader("my super secret"), id)
+  if err != nil {
+    t.Error("Error on store.Save:", err)
+    return
+  }
+
+  status, err := s.StatusDetails(id, code)
+  if err != nil {
+    t.Error("Expected no error for secret status, got", err)
+    return
+  }
+
+  if status.State != store.StateUnopened {
+    t.Errorf("Expected state %s, got %s", store.StateUnopened, status.State)
+  }
+  if status.ViewsRemaining != 1 {
+    t.Errorf("Expected 1 view remaining, got %d", status.ViewsRemaining)
+  }
+  if status.CreatedAt == nil || time.Since(*status.CreatedAt) > time.Minute {
+    t.Error("Expected created_at to be about now, got", status.CreatedAt)
+  }
+  if status.ExpiresAt == nil || !status.ExpiresAt.Equal(status.CreatedAt.Add(s.SecretLifetime)) {
+    t.Error("Expected expires_at to be created_at plus the secret lifetime, got", status.ExpiresAt)
+  }
+  if status.OpenedAt != nil || status.DestroyedAt != nil || status.DestroyedReason != "" {
+    t.Errorf("Expected no opened/destroyed details, got %#v", status)
+  }
+
+  // Codes must match
+  status, err = s.StatusDetails(id, "bad code")
+  if err != store.SecretNotFound || status != nil {
+    t.Error("Expected a SecretNotFound error and no status for a bad code, got", err, status)
+  }
+}
+
+func TestStatusDetailsOpened(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  id := store.GenerateUuid()
+  code, err := s.Save(strings.NewReader("my super secret"), id)
+  if err != nil {
+    t.Error("Error on store.Save:", err)
+    return
+  }
+
+  // Pretend the secret was created three minutes ago
+  createdAt := time.Now().Add(-3*time.Minute).Truncate(time.Second)
+  os.Chtimes(path.Join(s.Root, s.UuidToFileName(id)), time.Now(), createdAt)
+
+  _, _, err = s.Retrieve(id, make([]byte, s.MaxSecretSize))
+  if err != nil {
+    t.Error("Error on store.Retrieve:", err)
+    return
+  }
+
+  status, err := s.StatusDetails(id, code)
+  if err != store.SecretAlreadyAccessed {
+    t.Error("Expected a SecretAlreadyAccessed error, got", err)
+    return
+  }
+
+  if status.State != store.StateOpened {
+    t.Errorf("Expected state %s, got %s", store.StateOpened, status.State)
+  }
+  if status.DestroyedReason != store.ReasonOpened {
+    t.Errorf("Expected destroyed reason %s, got %s", store.ReasonOpened, status.DestroyedReason)
+  }
+  if status.ViewsRemaining != 0 {
+    t.Errorf("Expected 0 views remaining, got %d", status.ViewsRemaining)
+  }
+  if status.CreatedAt == nil || !status.CreatedAt.Equal(createdAt) {
+    t.Error("Expected created_at to be", createdAt, "got", status.CreatedAt)
+  }
+  if status.OpenedAt == nil || status.OpenedAt.Sub(createdAt) < 3*time.Minute {
+    t.Error("Expected opened_at to be about three minutes after created_at, got", status.OpenedAt)
+  }
+}
+
+func TestStatusDetailsExpired(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  id := store.GenerateUuid()
+  code, err := s.Save(strings.NewReader("my super secret"), id)
+  if err != nil {
+    t.Error("Error on store.Save:", err)
+    return
+  }
+
+  createdAt := time.Now().Add(-11*time.Minute).Truncate(time.Second)
+  os.Chtimes(path.Join(s.Root, s.UuidToFileName(id)), time.Now(), createdAt)
+
+  // Expired but not yet swept
+
+  status, err := s.StatusDetails(id, code)
+  if err != store.SecretExpired {
+    t.Error("Expected a SecretExpired error, got", err)
+    return
+  }
+  if status.State != store.StateExpired || status.DestroyedReason != store.ReasonExpired {
+    t.Errorf("Expected expired state and reason, got %s %s", status.State, status.DestroyedReason)
+  }
+  if status.DestroyedAt == nil || !status.DestroyedAt.Equal(createdAt.Add(s.SecretLifetime)) {
+    t.Error("Expected destroyed_at to be the expiration time, got", status.DestroyedAt)
+  }
+
+  // Swept
+
+  s.Sweep()
+
+  status, err = s.StatusDetails(id, code)
+  if err != store.SecretExpired {
+    t.Error("Expected a SecretExpired error, got", err)
+    return
+  }
+  if status.State != store.StateExpired || status.DestroyedReason != store.ReasonExpired {
+    t.Errorf("Expected expired state and reason, got %s %s", status.State, status.DestroyedReason)
+  }
+  if status.CreatedAt == nil || !status.CreatedAt.Equal(createdAt) {
+    t.Error("Expected created_at to be", createdAt, "got", status.CreatedAt)
+  }
+  if status.OpenedAt != nil {
+    t.Error("Expected no opened_at, got", status.OpenedAt)
+  }
+}
+
+func TestStatusDetailsDuplicateId(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  id := store.GenerateUuid()
+  code, err := s.Save(strings.NewReader("my super secret"), id)
+  if err != nil {
+    t.Error("Error on store.Save:", err)
+    return
+  }
+
+  _, err = s.Save(strings.NewReader("my super secret"), id)
+  if err != store.DuplicateId {
+    t.Error("Expected a DuplicateId error, got", err)
+  }
+
+  status, err := s.StatusDetails(id, code)
+  if err != store.SecretAlreadyAccessed {
+    t.Error("Expected a SecretAlreadyAccessed error, got", err)
+    return
+  }
+  if status.State != store.StateDestroyed || status.DestroyedReason != store.ReasonDuplicateId {
+    t.Errorf("Expected destroyed state and duplicate_id reason, got %s %s", status.State, status.DestroyedReason)
+  }
+  if status.OpenedAt != nil {
+    t.Error("Expected no opened_at, got", status.OpenedAt)
+  }
+}
+
+func TestSaveBatch(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  ids := []string{store.GenerateUuid(), store.GenerateUuid(), store.GenerateUuid()}
+  secrets := [][]byte{[]byte("secret 1"), []byte("secret 2"), []byte("secret 3")}
+
+  var savedSizes []int
+  s.OnSave = func(size int) { savedSizes = append(savedSizes, size) }
+
+  codes, failedIndex, err := s.SaveBatch(ids, secrets)
+  if err != nil {
+    t.Error("Error on store.SaveBatch:", err, failedIndex)
+    return
+  }
+
+  if len(savedSizes) != 3 || savedSizes[0] != 8 {
+    t.Error("Expected OnSave called for each secret, got sizes", savedSizes)
+  }
+
+  if len(codes) != 3 {
+    t.Errorf("Expected 3 codes, got %d", len(codes))
+    return
+  }
+
+  for i, id := range ids {
+    err = s.Status(id, codes[i])
+    if err != nil {
+      t.Errorf("Expected secret %d to be saved with its code, got %s", i, err)
+    }
+  }
+}
+
+func TestSaveBatchRollsBackOnDuplicateId(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  existingId := store.GenerateUuid()
+  _, err := s.Save(bytes.NewReader([]byte("already here")), existingId)
+  if err != nil {
+    t.Error("Error on store.Save:", err)
+    return
+  }
+
+  ids := []string{store.GenerateUuid(), store.GenerateUuid(), existingId}
+  secrets := [][]byte{[]byte("secret 1"), []byte("secret 2"), []byte("secret 3")}
+
+  saves := 0
+  s.OnSave = func(size int) { saves++ }
+
+  codes, failedIndex, err := s.SaveBatch(ids, secrets)
+  if err != store.DuplicateId {
+    t.Error("Expected a DuplicateId error, got", err)
+  }
+  if saves != 0 {
+    t.Errorf("Expected no saves reported for a rolled back batch, got %d", saves)
+  }
+  if failedIndex != 2 {
+    t.Errorf("Expected secret 2 to fail, got %d", failedIndex)
+  }
+  if codes != nil {
+    t.Error("Expected no codes, got", codes)
+  }
+
+  // Secrets written before the failure are gone, without a trace
+
+  for _, id := range ids[:2] {
+    filePath := path.Join(s.Root, s.UuidToFileName(id))
+    if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+      t.Errorf("Expected secret file %s to be removed, but was found.", filePath)
+    }
+
+    accessedFilePath := path.Join(s.AccessedPath, s.UuidToFileName(id))
+    if _, err := os.Stat(accessedFilePath); !os.IsNotExist(err) {
+      t.Errorf("Expected no accessed record %s, but was found.", accessedFilePath)
+    }
+  }
+}
+
+func TestSaveBatchDuplicateIdWithinBatch(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  id := store.GenerateUuid()
+
+  _, failedIndex, err := s.SaveBatch([]string{id, id}, [][]byte{[]byte("secret 1"), []byte("secret 2")})
+  if err != store.DuplicateId {
+    t.Error("Expected a DuplicateId error, got", err)
+  }
+  if failedIndex != 1 {
+    t.Errorf("Expected secret 1 to fail, got %d", failedIndex)
+  }
+
+  files, _ := ioutil.ReadDir(s.Root)
+  for _, fileInfo := range files {
+    if !fileInfo.IsDir() {
+      t.Error("Expected nothing to be written, found", fileInfo.Name())
+    }
+  }
+}
+
+func TestSaveBatchOutOfMemory(t *testing.T) {
+  s := store.Setup()
+  defer s.Teardown()
+
+  available := s.AvailableMemory()
+  s.MaxSecretSize = available
+
+  // Each fits on its own; together they don't.
+  secrets := [][]byte{make([]byte, available / 2), make([]byte, available / 2)}
+
+  _, failedIndex, err := s.SaveBatch([]string{store.GenerateUuid(), store.GenerateUuid()}, secrets)
+  if err != store.StorageFull {
+    t.Error("Expected a StorageFull error, got", err)
+  }
+  if failedIndex != -1 {
+    t.Errorf("Expected the whole batch to be rejected, got %d", failedIndex)
+  }
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+  "fmt"
+  "github.com/brianhempel/sneakynote.com/store"
+  "log/slog"
+  "runtime/debug"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// The sweeper is what expires notes, so it's supervised. A panic is logged
+// and the sweeper restarted, after sweeperMinBackoff at first, doubling up to
+// sweeperMaxBackoff while it keeps panicking.
+//
+// A watchdog raises an alert, in the log, in metrics and in /readyz, while
+// the last successful sweep is older than SecretLifetime: unopened notes may
+// then be outliving it.
+
+const (
+  sweeperMinBackoff = time.Second
+  sweeperMaxBackoff = time.Minute
+  sweeperMaxWatchInterval = 15 * time.Second
+)
+
+var (
+  sweeperRestartCount uint64 = 0
+  sweeperBehind int32 = 0
+
+  sweepPhaseSeconds = newHistogramVec(0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 30)
+
+  sweptItemsMutex sync.Mutex
+  // By phase name.
+  sweptItemCounts = map[string]uint64{}
+)
+
+// Sweeps until stop is closed. Runs its own watchdog.
+func SuperviseSweeper(s *store.Store, stop <-chan struct{}) {
+  watchdogStopped := make(chan struct{})
+  go func() {
+    watchSweeper(s, time.Now(), stop)
+    close(watchdogStopped)
+  }()
+  defer func() { <-watchdogStopped }()
+
+  backoff := sweeperMinBackoff
+  for {
+    started := time.Now()
+    if !sweepUntilPanic(s, stop) {
+      return
+    }
+    atomic.AddUint64(&sweeperRestartCount, 1)
+
+    // A sweeper that ran a good while before panicking starts over.
+    if time.Since(started) > sweeperMaxBackoff {
+      backoff = sweeperMinBackoff
+    }
+    slog.Error("Restarting sweeper", "backoff", backoff.String())
+
+    select {
+    case <-stop:
+      return
+    case <-time.After(backoff):
+    }
+    backoff *= 2
+    if backoff > sweeperMaxBackoff {
+      backoff = sweeperMaxBackoff
+    }
+  }
+}
+
+// False once stop is closed.
+func sweepUntilPanic(s *store.Store, stop <-chan struct{}) (panicked bool) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      slog.Error("Sweeper panicked", "panic", fmt.Sprint(recovered), "stack", string(debug.Stack()))
+      panicked = true
+    }
+  }()
+
+  s.SweepContinuously(stop)
+  return false
+}
+
+// Checks at least four times per SecretLifetime. started stands in for the
+// last sweep until there's been one.
+func watchSweeper(s *store.Store, started time.Time, stop <-chan struct{}) {
+  interval := s.SecretLifetime / 4
+  if interval > sweeperMaxWatchInterval {
+    interval = sweeperMaxWatchInterval
+  }
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
+  defer atomic.StoreInt32(&sweeperBehind, 0)
+
+  for {
+    select {
+    case <-stop:
+      return
+    case <-ticker.C:
+    }
+
+    lastSweep := s.LastSweep()
+    if lastSweep.IsZero() {
+      lastSweep = started
+    }
+    behind := time.Since(lastSweep) > s.SecretLifetime
+
+    if behind && atomic.CompareAndSwapInt32(&sweeperBehind, 0, 1) {
+      slog.Error("Sweeper behind, notes may be outliving their lifetime", "since_last_sweep", time.Since(lastSweep).Round(time.Second).String())
+    } else if !behind && atomic.CompareAndSwapInt32(&sweeperBehind, 1, 0) {
+      slog.Info("Sweeper caught up")
+    }
+  }
+}
+
+func SweeperBehind() bool {
+  return atomic.LoadInt32(&sweeperBehind) == 1
+}
+
+func observeSweep(phases []store.SweepPhase) {
+  sweptItemsMutex.Lock()
+  for _, phase := range phases {
+    sweptItemCounts[phase.Name] += uint64(phase.Items)
+  }
+  sweptItemsMutex.Unlock()
+
+  for _, phase := range phases {
+    sweepPhaseSeconds.With(`phase="` + phase.Name + `"`).Observe(phase.Duration.Seconds())
+  }
+
+  args := []any{}
+  for _, phase := range phases {
+    args = append(args, slog.Group(phase.Name, "items", phase.Items, "seconds", phase.Duration.Seconds()))
+  }
+  slog.Debug("Swept", args...)
+}
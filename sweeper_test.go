@@ -0,0 +1,110 @@
+package main_test
+
+import (
+  "github.com/brianhempel/sneakynote.com"
+  "github.com/brianhempel/sneakynote.com/store"
+  "net/http/httptest"
+  "testing"
+  "time"
+)
+
+func TestSuperviseSweeperRestartsAfterPanic(t *testing.T) {
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  s := store.Get()
+  sweeps := 0
+  s.OnSweep = func(phases []store.SweepPhase) {
+    sweeps++
+    if sweeps == 1 {
+      panic("sweeper test panic")
+    }
+  }
+
+  stop := make(chan struct{})
+  stopped := make(chan struct{})
+  go func() {
+    main.SuperviseSweeper(s, stop)
+    close(stopped)
+  }()
+
+  deadline := time.Now().Add(5 * time.Second)
+  for s.LastSweep().IsZero() && time.Now().Before(deadline) {
+    time.Sleep(10 * time.Millisecond)
+  }
+  close(stop)
+  <-stopped
+
+  if s.LastSweep().IsZero() || sweeps != 2 {
+    t.Errorf("Expected the sweeper restarted and sweeping after a panic, got %d sweeps", sweeps)
+  }
+}
+
+func TestSweeperBehind(t *testing.T) {
+  main.SetupStore()
+  defer main.TeardownStore()
+
+  s := store.Get()
+  s.SecretLifetime = 200 * time.Millisecond
+  release := make(chan struct{})
+  s.OnSweep = func(phases []store.SweepPhase) {
+    <-release
+  }
+
+  stop := make(chan struct{})
+  stopped := make(chan struct{})
+  go func() {
+    main.SuperviseSweeper(s, stop)
+    close(stopped)
+  }()
+  defer func() {
+    close(stop)
+    <-stopped
+  }()
+
+  // Stuck in its first sweep.
+  deadline := time.Now().Add(5 * time.Second)
+  for !main.SweeperBehind() && time.Now().Before(deadline) {
+    time.Sleep(5 * time.Millisecond)
+  }
+  if !main.SweeperBehind() {
+    t.Fatal("Expected the sweeper behind once stuck past the secret lifetime")
+  }
+
+  close(release)
+  deadline = time.Now().Add(5 * time.Second)
+  for main.SweeperBehind() && time.Now().Before(deadline) {
+    time.Sleep(5 * time.Millisecond)
+  }
+  if main.SweeperBehind() {
+    t.Error("Expected the sweeper caught up after sweeping")
+  }
+}
+
+func TestSweeperMetrics(t *testing.T) {
+  testServer := httptest.NewServer(main.Handlers())
+  defer testServer.Close()
+  main.SetupStore()
+  defer main.TeardownStore()
+  defer withMetrics(map[string]string{"SNEAKYNOTE_METRICS_TOKEN": "s3cret"})()
+
+  // Stopping waits for the first sweep.
+  main.StartSweeper()
+  main.StopSweeper()
+
+  metrics := scrapeMetrics(t, testServer.URL + "/metrics", "s3cret")
+
+  for _, phase := range []string{"secrets", "being_accessed", "accessed", "expiring", "expired"} {
+    if count := metricValue(t, metrics, `sneakynote_sweep_phase_seconds_count{phase="` + phase + `"}`); count < 1 {
+      t.Errorf("Expected the %s phase timed, got %v", phase, count)
+    }
+    metricValue(t, metrics, `sneakynote_swept_items_total{phase="` + phase + `"}`)
+  }
+  if lastSweep := metricValue(t, metrics, "sneakynote_last_sweep_timestamp_seconds"); time.Since(time.Unix(int64(lastSweep), 0)) > time.Minute {
+    t.Errorf("Expected a sweep just now, got %v", lastSweep)
+  }
+  if behind := metricValue(t, metrics, "sneakynote_sweeper_behind"); behind != 0 {
+    t.Errorf("Expected the sweeper not behind, got %v", behind)
+  }
+  metricValue(t, metrics, "sneakynote_sweeper_restarts_total")
+}
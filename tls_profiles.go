@@ -0,0 +1,335 @@
+package main
+
+import (
+  "bytes"
+  "crypto/rand"
+  "crypto/tls"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/asn1"
+  "errors"
+  "github.com/brianhempel/sneakynote.com/logs"
+  "io/ioutil"
+  "log/slog"
+  "math/big"
+  "os"
+  "sync"
+  "time"
+)
+
+// TLS settings come in named profiles, after Mozilla's server side TLS
+// recommendations:
+//
+//   modern:       TLS 1.3 only.
+//   intermediate: TLS 1.2 and 1.3, forward secret AEAD suites only.
+//   legacy:       TLS 1.0 and up, adding CBC and static RSA suites for old
+//                 clients. What SneakyNote used to serve.
+//
+// Choose one with SNEAKYNOTE_TLS_PROFILE; the default is intermediate. TLS
+// 1.3 suites aren't configurable in Go and are always on when 1.3 is.
+//
+// SNEAKYNOTE_OCSP_RESPONSE names a DER OCSP response file for the
+// certificate, kept fresh by something like `openssl ocsp -respout`. It is
+// reread every SNEAKYNOTE_OCSP_REFRESH (default 1h) and stapled while it is
+// good.
+//
+// Session ticket keys are rotated every SNEAKYNOTE_TICKET_KEY_ROTATION
+// (default 8h). The last few keys still decrypt, so tickets live for at
+// most sessionTicketKeyCount rotations.
+
+const (
+  defaultTLSProfile = "intermediate"
+  defaultOCSPRefresh = time.Hour
+  defaultTicketKeyRotation = 8 * time.Hour
+  sessionTicketKeyCount = 3
+)
+
+var (
+  tlsProfile = defaultTLSProfile
+  ocspResponsePath = ""
+  ocspRefresh = defaultOCSPRefresh
+  ticketKeyRotation = defaultTicketKeyRotation
+
+  intermediateCipherSuites = []uint16{
+    tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+    tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+    tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+    tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+    tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+  }
+
+  legacyCipherSuites = append(append([]uint16{}, intermediateCipherSuites...),
+    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+    tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+    tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+    tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+    tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+  )
+
+  tlsProfiles = map[string]func() *tls.Config{
+    "modern": func() *tls.Config {
+      return &tls.Config{MinVersion: tls.VersionTLS13}
+    },
+    "intermediate": func() *tls.Config {
+      return &tls.Config{MinVersion: tls.VersionTLS12, CipherSuites: intermediateCipherSuites}
+    },
+    "legacy": func() *tls.Config {
+      return &tls.Config{MinVersion: tls.VersionTLS10, CipherSuites: legacyCipherSuites}
+    },
+  }
+
+  OCSPResponseExpired = errors.New("OCSP response has expired")
+  OCSPResponseNotGood = errors.New("OCSP response does not say the certificate is good")
+)
+
+// Reads SNEAKYNOTE_TLS_PROFILE, SNEAKYNOTE_OCSP_RESPONSE,
+// SNEAKYNOTE_OCSP_REFRESH, SNEAKYNOTE_TICKET_KEY_ROTATION and
+// SNEAKYNOTE_CERT_RELOAD_INTERVAL.
+func ConfigureTLS() {
+  tlsProfile = os.Getenv("SNEAKYNOTE_TLS_PROFILE")
+  if tlsProfile == "" {
+    tlsProfile = defaultTLSProfile
+  }
+  if tlsProfiles[tlsProfile] == nil {
+    logs.Fatal("Unknown SNEAKYNOTE_TLS_PROFILE, use modern, intermediate or legacy", "profile", tlsProfile)
+  }
+
+  ocspResponsePath = os.Getenv("SNEAKYNOTE_OCSP_RESPONSE")
+  ocspRefresh = envDuration("SNEAKYNOTE_OCSP_REFRESH", defaultOCSPRefresh)
+  ticketKeyRotation = envDuration("SNEAKYNOTE_TICKET_KEY_ROTATION", defaultTicketKeyRotation)
+  certReloadInterval = envDuration("SNEAKYNOTE_CERT_RELOAD_INTERVAL", defaultCertReloadInterval)
+
+  if ocspRefresh <= 0 || ticketKeyRotation <= 0 || certReloadInterval <= 0 {
+    logs.Fatal("OCSP refresh, ticket key rotation and certificate reload intervals must be positive")
+  }
+}
+
+// A fresh config for the configured profile.
+func TLSConfig() *tls.Config {
+  return TLSProfileConfig(tlsProfile)
+}
+
+// Nil for an unknown profile.
+func TLSProfileConfig(profile string) *tls.Config {
+  newConfig := tlsProfiles[profile]
+  if newConfig == nil {
+    return nil
+  }
+  return newConfig()
+}
+
+// Sets fresh random session ticket keys on config every interval, keeping
+// the previous ones for decryption. Set the first key before serving.
+func StartSessionTicketKeyRotation(config *tls.Config, interval time.Duration) {
+  keys, err := RotateSessionTicketKeys(config, nil)
+  if err != nil {
+    logs.Fatal("Generating session ticket key", logs.Err(err))
+  }
+
+  go func() {
+    for range time.Tick(interval) {
+      rotated, err := RotateSessionTicketKeys(config, keys)
+      if err != nil {
+        slog.Error("Error rotating session ticket keys", logs.Err(err))
+        continue
+      }
+      keys = rotated
+    }
+  }()
+}
+
+// Puts a new key first and drops the oldest beyond sessionTicketKeyCount.
+// Returns the keys now in use.
+func RotateSessionTicketKeys(config *tls.Config, keys [][32]byte) ([][32]byte, error) {
+  var key [32]byte
+  _, err := rand.Read(key[:])
+  if err != nil {
+    return keys, err
+  }
+
+  rotated := append([][32]byte{key}, keys...)
+  if len(rotated) > sessionTicketKeyCount {
+    rotated = rotated[:sessionTicketKeyCount]
+  }
+  config.SetSessionTicketKeys(rotated)
+  return rotated, nil
+}
+
+// Staples a periodically reread OCSP response to the certificates a
+// GetCertificate returns, when the response is for that certificate, says
+// it is good, and hasn't expired.
+type OCSPStapler struct {
+  responsePath string
+
+  mutex sync.RWMutex
+  response []byte
+  serialNumber *big.Int
+  nextUpdate time.Time
+}
+
+func NewOCSPStapler(responsePath string) *OCSPStapler {
+  return &OCSPStapler{responsePath: responsePath}
+}
+
+// Rereads the response file. A bad response is rejected and the last good
+// one kept.
+func (s *OCSPStapler) Refresh() error {
+  response, err := ioutil.ReadFile(s.responsePath)
+  if err != nil {
+    return err
+  }
+
+  serialNumber, nextUpdate, err := parseOCSPResponse(response, time.Now())
+  if err != nil {
+    return err
+  }
+
+  s.mutex.Lock()
+  s.response = response
+  s.serialNumber = serialNumber
+  s.nextUpdate = nextUpdate
+  s.mutex.Unlock()
+
+  return nil
+}
+
+func (s *OCSPStapler) StartRefreshing(interval time.Duration) {
+  err := s.Refresh()
+  if err != nil {
+    slog.Warn("Error loading OCSP response, not stapling", logs.Err(err))
+  }
+
+  go func() {
+    for range time.Tick(interval) {
+      err := s.Refresh()
+      if err != nil {
+        slog.Warn("Error refreshing OCSP response, keeping the last one", logs.Err(err))
+      }
+    }
+  }()
+}
+
+// Wraps getCertificate to staple the current response.
+func (s *OCSPStapler) GetCertificate(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+  return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+    certificate, err := getCertificate(hello)
+    if err != nil || certificate == nil {
+      return certificate, err
+    }
+    return s.staple(certificate), nil
+  }
+}
+
+func (s *OCSPStapler) staple(certificate *tls.Certificate) *tls.Certificate {
+  s.mutex.RLock()
+  response, serialNumber, nextUpdate := s.response, s.serialNumber, s.nextUpdate
+  s.mutex.RUnlock()
+
+  if response == nil || !nextUpdate.IsZero() && time.Now().After(nextUpdate) {
+    return certificate
+  }
+
+  leaf := certificate.Leaf
+  if leaf == nil && len(certificate.Certificate) > 0 {
+    leaf, _ = x509.ParseCertificate(certificate.Certificate[0])
+  }
+  if leaf == nil || leaf.SerialNumber.Cmp(serialNumber) != 0 {
+    return certificate
+  }
+
+  if bytes.Equal(certificate.OCSPStaple, response) {
+    return certificate
+  }
+  stapled := *certificate
+  stapled.OCSPStaple = response
+  return &stapled
+}
+
+// RFC 6960 OCSP responses, as much as is needed to decide whether to staple
+// one. Clients check the signature.
+
+var ocspBasicResponseOID = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+
+type ocspResponse struct {
+  Status asn1.Enumerated
+  ResponseBytes ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseBytes struct {
+  ResponseType asn1.ObjectIdentifier
+  Response []byte
+}
+
+type ocspBasicResponse struct {
+  TBSResponseData ocspResponseData
+  SignatureAlgorithm pkix.AlgorithmIdentifier
+  Signature asn1.BitString
+  Certificates []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+  Version int `asn1:"optional,default:0,explicit,tag:0"`
+  RawResponderID asn1.RawValue
+  ProducedAt time.Time `asn1:"generalized"`
+  Responses []ocspSingleResponse
+  Extensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspSingleResponse struct {
+  CertID ocspCertID
+  Good asn1.Flag `asn1:"tag:0,optional"`
+  Revoked ocspRevokedInfo `asn1:"tag:1,optional"`
+  Unknown asn1.Flag `asn1:"tag:2,optional"`
+  ThisUpdate time.Time `asn1:"generalized"`
+  NextUpdate time.Time `asn1:"generalized,explicit,tag:0,optional"`
+  Extensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspRevokedInfo struct {
+  RevocationTime time.Time `asn1:"generalized"`
+  Reason asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspCertID struct {
+  HashAlgorithm pkix.AlgorithmIdentifier
+  NameHash []byte
+  IssuerKeyHash []byte
+  SerialNumber *big.Int
+}
+
+// Returns the serial number the response is about and when it expires
+// (zero if it doesn't say).
+func parseOCSPResponse(der []byte, now time.Time) (*big.Int, time.Time, error) {
+  response := ocspResponse{}
+  rest, err := asn1.Unmarshal(der, &response)
+  if err != nil {
+    return nil, time.Time{}, err
+  }
+  if len(rest) > 0 {
+    return nil, time.Time{}, errors.New("Trailing data after OCSP response")
+  }
+  if response.Status != 0 || !response.ResponseBytes.ResponseType.Equal(ocspBasicResponseOID) {
+    return nil, time.Time{}, errors.New("OCSP response is not a successful basic response")
+  }
+
+  basic := ocspBasicResponse{}
+  _, err = asn1.Unmarshal(response.ResponseBytes.Response, &basic)
+  if err != nil {
+    return nil, time.Time{}, err
+  }
+  if len(basic.TBSResponseData.Responses) != 1 {
+    return nil, time.Time{}, errors.New("OCSP response must be about exactly one certificate")
+  }
+
+  single := basic.TBSResponseData.Responses[0]
+  if !single.Good {
+    return nil, time.Time{}, OCSPResponseNotGood
+  }
+  if now.Before(single.ThisUpdate) || !single.NextUpdate.IsZero() && now.After(single.NextUpdate) {
+    return nil, time.Time{}, OCSPResponseExpired
+  }
+
+  return single.CertID.SerialNumber, single.NextUpdate, nil
+}
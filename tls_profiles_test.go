@@ -0,0 +1,307 @@
+package main_test
+
+import (
+  "bytes"
+  "crypto/tls"
+  "crypto/x509/pkix"
+  "encoding/asn1"
+  "fmt"
+  "github.com/brianhempel/sneakynote.com"
+  "io/ioutil"
+  "math/big"
+  "net"
+  "net/http"
+  "os"
+  "testing"
+  "time"
+)
+
+// Serves config over TLS the way StartServer does. Returns the address and
+// a func to stop it.
+func newTLSConfigTestServer(t *testing.T, config *tls.Config) (string, func()) {
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if config.Certificates == nil && config.GetCertificate == nil {
+    config.Certificates = []tls.Certificate{selfSignedCertificate(t, "127.0.0.1")}
+  }
+
+  server := &http.Server{Handler: main.Handlers()}
+  go server.Serve(main.OwnTLSConnections(server, listener, config))
+
+  return listener.Addr().String(), func() { server.Close() }
+}
+
+// Makes a request so TLS 1.3 session tickets are read too.
+func tlsHandshake(address string, clientConfig *tls.Config) (tls.ConnectionState, error) {
+  clientConfig.InsecureSkipVerify = true
+
+  conn, err := tls.Dial("tcp", address, clientConfig)
+  if err != nil {
+    return tls.ConnectionState{}, err
+  }
+  defer conn.Close()
+
+  fmt.Fprint(conn, "GET /robots.txt HTTP/1.1\r\nHost: 127.0.0.1\r\nConnection: close\r\n\r\n")
+  ioutil.ReadAll(conn)
+
+  return conn.ConnectionState(), nil
+}
+
+func TestTLSProfileModern(t *testing.T) {
+  address, stop := newTLSConfigTestServer(t, main.TLSProfileConfig("modern"))
+  defer stop()
+
+  state, err := tlsHandshake(address, &tls.Config{})
+  if err != nil || state.Version != tls.VersionTLS13 {
+    t.Errorf("Expected TLS 1.3, got %x %v", state.Version, err)
+  }
+
+  _, err = tlsHandshake(address, &tls.Config{MaxVersion: tls.VersionTLS12})
+  if err == nil {
+    t.Error("Expected TLS 1.2 refused")
+  }
+}
+
+func TestTLSProfileIntermediate(t *testing.T) {
+  address, stop := newTLSConfigTestServer(t, main.TLSProfileConfig("intermediate"))
+  defer stop()
+
+  state, err := tlsHandshake(address, &tls.Config{})
+  if err != nil || state.Version != tls.VersionTLS13 {
+    t.Errorf("Expected TLS 1.3, got %x %v", state.Version, err)
+  }
+
+  state, err = tlsHandshake(address, &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}})
+  if err != nil || state.Version != tls.VersionTLS12 || state.CipherSuite != tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256 {
+    t.Errorf("Expected TLS 1.2 with ChaCha20-Poly1305, got %x %s %v", state.Version, tls.CipherSuiteName(state.CipherSuite), err)
+  }
+
+  _, err = tlsHandshake(address, &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA}})
+  if err == nil {
+    t.Error("Expected CBC suites refused")
+  }
+
+  _, err = tlsHandshake(address, &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11})
+  if err == nil {
+    t.Error("Expected TLS 1.1 refused")
+  }
+}
+
+func TestTLSProfileLegacy(t *testing.T) {
+  address, stop := newTLSConfigTestServer(t, main.TLSProfileConfig("legacy"))
+  defer stop()
+
+  state, err := tlsHandshake(address, &tls.Config{})
+  if err != nil || state.Version != tls.VersionTLS13 {
+    t.Errorf("Expected TLS 1.3 for modern clients, got %x %v", state.Version, err)
+  }
+
+  state, err = tlsHandshake(address, &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS10, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA}})
+  if err != nil || state.Version != tls.VersionTLS10 || state.CipherSuite != tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA {
+    t.Errorf("Expected TLS 1.0 with AES-128-CBC, got %x %s %v", state.Version, tls.CipherSuiteName(state.CipherSuite), err)
+  }
+}
+
+func TestTLSProfileUnknown(t *testing.T) {
+  if main.TLSProfileConfig("ancient") != nil {
+    t.Error("Expected no config for an unknown profile")
+  }
+}
+
+func TestSessionTicketKeyRotation(t *testing.T) {
+  config := main.TLSProfileConfig("intermediate")
+  keys, err := main.RotateSessionTicketKeys(config, nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  address, stop := newTLSConfigTestServer(t, config)
+  defer stop()
+
+  sessions := tls.NewLRUClientSessionCache(1)
+  resumes := func() bool {
+    state, err := tlsHandshake(address, &tls.Config{ClientSessionCache: sessions})
+    if err != nil {
+      t.Fatal(err)
+    }
+    return state.DidResume
+  }
+
+  if resumes() {
+    t.Error("Expected a full handshake the first time")
+  }
+  if !resumes() {
+    t.Error("Expected the session resumed")
+  }
+
+  for i := 0; i < 2; i++ {
+    keys, _ = main.RotateSessionTicketKeys(config, keys)
+  }
+  if len(keys) != 3 {
+    t.Errorf("Expected 3 keys kept, got %d", len(keys))
+  }
+  if !resumes() {
+    t.Error("Expected tickets from a recent key to still resume")
+  }
+
+  for i := 0; i < 3; i++ {
+    keys, _ = main.RotateSessionTicketKeys(config, keys)
+  }
+  if resumes() {
+    t.Error("Expected tickets from a rotated out key not to resume")
+  }
+}
+
+// Enough of RFC 6960 to build responses. Unsigned; the server doesn't check
+// signatures, clients do.
+
+type testOCSPResponse struct {
+  Status asn1.Enumerated
+  ResponseBytes testOCSPResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type testOCSPResponseBytes struct {
+  ResponseType asn1.ObjectIdentifier
+  Response []byte
+}
+
+type testOCSPBasicResponse struct {
+  TBSResponseData testOCSPResponseData
+  SignatureAlgorithm pkix.AlgorithmIdentifier
+  Signature asn1.BitString
+}
+
+type testOCSPResponseData struct {
+  RawResponderID asn1.RawValue
+  ProducedAt time.Time `asn1:"generalized"`
+  Responses []testOCSPSingleResponse
+}
+
+type testOCSPSingleResponse struct {
+  CertID testOCSPCertID
+  Good asn1.Flag `asn1:"tag:0,optional"`
+  Revoked testOCSPRevokedInfo `asn1:"tag:1,optional"`
+  ThisUpdate time.Time `asn1:"generalized"`
+  NextUpdate time.Time `asn1:"generalized,explicit,tag:0,optional"`
+}
+
+type testOCSPRevokedInfo struct {
+  RevocationTime time.Time `asn1:"generalized"`
+}
+
+type testOCSPCertID struct {
+  HashAlgorithm pkix.AlgorithmIdentifier
+  NameHash []byte
+  IssuerKeyHash []byte
+  SerialNumber *big.Int
+}
+
+func ocspResponseDER(t *testing.T, serialNumber int64, good bool, nextUpdate time.Time) []byte {
+  now := time.Now().UTC().Truncate(time.Second)
+
+  single := testOCSPSingleResponse{
+    CertID: testOCSPCertID{
+      HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}, Parameters: asn1.NullRawValue},
+      NameHash: make([]byte, 20),
+      IssuerKeyHash: make([]byte, 20),
+      SerialNumber: big.NewInt(serialNumber),
+    },
+    Good: asn1.Flag(good),
+    ThisUpdate: now.Add(-2 * time.Hour),
+    NextUpdate: nextUpdate.UTC().Truncate(time.Second),
+  }
+  if !good {
+    single.Revoked = testOCSPRevokedInfo{RevocationTime: now.Add(-time.Hour)}
+  }
+
+  basic, err := asn1.Marshal(testOCSPBasicResponse{
+    TBSResponseData: testOCSPResponseData{
+      RawResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: []byte{0x04, 0x00}},
+      ProducedAt: now,
+      Responses: []testOCSPSingleResponse{single},
+    },
+    SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}},
+    Signature: asn1.BitString{Bytes: []byte{0}, BitLength: 8},
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  der, err := asn1.Marshal(testOCSPResponse{
+    ResponseBytes: testOCSPResponseBytes{
+      ResponseType: asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1},
+      Response: basic,
+    },
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  return der
+}
+
+func TestOCSPStapling(t *testing.T) {
+  responsePath := "/tmp/sneakynote_ocsp_response.der"
+  defer os.Remove(responsePath)
+
+  certificate := selfSignedCertificate(t, "127.0.0.1")
+  stapler := main.NewOCSPStapler(responsePath)
+
+  config := main.TLSProfileConfig("intermediate")
+  config.GetCertificate = stapler.GetCertificate(func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+    return &certificate, nil
+  })
+  address, stop := newTLSConfigTestServer(t, config)
+  defer stop()
+
+  stapled := func() []byte {
+    state, err := tlsHandshake(address, &tls.Config{})
+    if err != nil {
+      t.Fatal(err)
+    }
+    return state.OCSPResponse
+  }
+
+  if err := stapler.Refresh(); err == nil {
+    t.Error("Expected an error with no response file")
+  }
+  if stapled() != nil {
+    t.Error("Expected no staple before there is a response")
+  }
+
+  good := ocspResponseDER(t, 1, true, time.Now().Add(time.Hour))
+  ioutil.WriteFile(responsePath, good, 0600)
+  if err := stapler.Refresh(); err != nil {
+    t.Fatal("Error on Refresh:", err)
+  }
+  if !bytes.Equal(stapled(), good) {
+    t.Error("Expected the response stapled")
+  }
+
+  // Bad responses are rejected and the last good one kept.
+  ioutil.WriteFile(responsePath, ocspResponseDER(t, 1, true, time.Now().Add(-time.Minute)), 0600)
+  if err := stapler.Refresh(); err != main.OCSPResponseExpired {
+    t.Error("Expected OCSPResponseExpired, got", err)
+  }
+  ioutil.WriteFile(responsePath, ocspResponseDER(t, 1, false, time.Now().Add(time.Hour)), 0600)
+  if err := stapler.Refresh(); err != main.OCSPResponseNotGood {
+    t.Error("Expected OCSPResponseNotGood, got", err)
+  }
+  ioutil.WriteFile(responsePath, []byte("not DER"), 0600)
+  if err := stapler.Refresh(); err == nil {
+    t.Error("Expected an error for garbage")
+  }
+  if !bytes.Equal(stapled(), good) {
+    t.Error("Expected the last good response still stapled")
+  }
+
+  // A response for another certificate isn't stapled.
+  ioutil.WriteFile(responsePath, ocspResponseDER(t, 2, true, time.Now().Add(time.Hour)), 0600)
+  if err := stapler.Refresh(); err != nil {
+    t.Fatal("Error on Refresh:", err)
+  }
+  if stapled() != nil {
+    t.Error("Expected no staple for another certificate's response")
+  }
+}